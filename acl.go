@@ -0,0 +1,622 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	pathpkg "path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-yaml/yaml"
+)
+
+// aclEntry is the access configuration of a directory with a .ghs.yml,
+// merged with the ones of the directories above it
+type aclEntry struct {
+	dir    string // storage name of the directory of the .ghs.yml
+	conf   AccessConf
+	files  []string // the .ghs.yml conf is made of, from the root down
+	parent *aclEntry
+	mtime  time.Time
+	size   int64
+	err    error
+}
+
+// aclCache keeps the parsed .ghs.yml files by directory. An entry is used
+// as long as its file has the same mtime and size and its parent entry is
+// still current; the index watcher drops entries whose file changed.
+type aclCache struct {
+	st       Storage
+	defaults func() AccessConf
+
+	mu      sync.Mutex
+	base    *aclEntry            // the defaults of the server
+	entries map[string]*aclEntry // directory -> entry
+
+	// writing serializes the changes of /-/acl/set and /-/acl/patch, so a
+	// patch never works on a .ghs.yml another one is replacing
+	writing sync.Mutex
+}
+
+func newACLCache(st Storage, defaults func() AccessConf) *aclCache {
+	return &aclCache{st: st, defaults: defaults, entries: make(map[string]*aclEntry)}
+}
+
+// get returns the entry of the storage name, which is treated as a
+// directory: files get the entry of their directory, as .ghs.yml can not be
+// read below them.
+func (c *aclCache) get(name string) *aclEntry {
+	var parent *aclEntry
+	if name == "" {
+		parent = c.baseEntry()
+	} else {
+		dir := pathpkg.Dir(name)
+		if dir == "." {
+			dir = ""
+		}
+		parent = c.get(dir)
+	}
+
+	info, err := c.st.Stat(pathpkg.Join(name, ghsFileName))
+	if err != nil || info.IsDir() {
+		c.mu.Lock()
+		delete(c.entries, name)
+		c.mu.Unlock()
+		return parent
+	}
+	c.mu.Lock()
+	e := c.entries[name]
+	c.mu.Unlock()
+	if e != nil && e.parent == parent && e.mtime.Equal(info.ModTime()) && e.size == info.Size() {
+		return e
+	}
+
+	e = c.load(name, parent, info)
+	c.mu.Lock()
+	c.entries[name] = e
+	c.mu.Unlock()
+	return e
+}
+
+func (c *aclCache) baseEntry() *aclEntry {
+	d := c.defaults()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.base == nil || c.base.conf.Upload != d.Upload || c.base.conf.Delete != d.Delete || c.base.conf.NoAccess != d.NoAccess {
+		c.base = &aclEntry{conf: d, files: []string{}}
+	}
+	return c.base
+}
+
+// load reads the .ghs.yml of dir. A file which can not be parsed denies
+// everything below dir to everybody but the admins of the parent directory,
+// until they fix it.
+func (c *aclCache) load(dir string, parent *aclEntry, info os.FileInfo) *aclEntry {
+	name := pathpkg.Join(dir, ghsFileName)
+	e := &aclEntry{
+		dir:    dir,
+		parent: parent,
+		files:  append(parent.files[:len(parent.files):len(parent.files)], "/"+name),
+		mtime:  info.ModTime(),
+		size:   info.Size(),
+	}
+	data, err := readStorageFile(c.st, name)
+	if err == nil {
+		e.conf, err = parseAccessConf(parent.conf, data)
+	}
+	if err != nil {
+		log.Printf("Err format %s: %v, only admins can access /%s until it is fixed", name, err, dir)
+		e.conf = adminsOnly(parent.conf)
+		e.err = err
+	}
+	return e
+}
+
+// changed drops the entries of the storage name, a .ghs.yml or a directory
+// which was removed or moved
+func (c *aclCache) changed(name string) {
+	dir := name
+	if pathpkg.Base(name) == ghsFileName {
+		dir = pathpkg.Dir(name)
+	}
+	if dir == "." {
+		dir = ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for d := range c.entries {
+		if d == dir || strings.HasPrefix(d, dir+"/") || dir == "" {
+			delete(c.entries, d)
+		}
+	}
+}
+
+// errors returns the errors of the .ghs.yml files which could not be used
+func (c *aclCache) errors() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	errs := make(map[string]string)
+	for _, e := range c.entries {
+		if e.err != nil {
+			errs[e.files[len(e.files)-1]] = e.err.Error()
+		}
+	}
+	return errs
+}
+
+// adminsOnly keeps the rules of c which grant admin, and denies everything
+// to everybody else
+func adminsOnly(c AccessConf) AccessConf {
+	ac := AccessConf{Perms: []string{}}
+	for _, u := range c.Users {
+		if rulePerms(u.Perms, u.Upload, u.Delete, u.NoAccess)&permAdmin != 0 {
+			ac.Users = append(ac.Users, u)
+		}
+	}
+	for _, g := range c.Groups {
+		if rulePerms(g.Perms, g.Upload, g.Delete, g.NoAccess)&permAdmin != 0 {
+			ac.Groups = append(ac.Groups, g)
+		}
+	}
+	return ac
+}
+
+// parseAccessConf applies the .ghs.yml data to the configuration of the
+// parent directory and checks the permission names and regexps.
+func parseAccessConf(parent AccessConf, data []byte) (AccessConf, error) {
+	ac := parent
+	// the flags of a .ghs.yml replace perms inherited from above
+	keys := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return ac, err
+	}
+	_, upload := keys["upload"]
+	_, del := keys["delete"]
+	_, noAccess := keys["noaccess"]
+	if upload || del || noAccess {
+		ac.Perms = nil
+	}
+	// a quota is of the directory it is set for, not of those below
+	ac.Quota = nil
+	if err := yaml.Unmarshal(data, &ac); err != nil {
+		return ac, err
+	}
+	if ac.Quota != nil {
+		if err := ac.Quota.validate(); err != nil {
+			return ac, fmt.Errorf("quota: %v", err)
+		}
+	}
+
+	if _, err := parsePerms(ac.Perms); err != nil {
+		return ac, err
+	}
+	for _, u := range ac.Users {
+		if _, err := parsePerms(u.Perms); err != nil {
+			return ac, fmt.Errorf("user %s: %v", u.Username, err)
+		}
+	}
+	for _, g := range ac.Groups {
+		if _, err := parsePerms(g.Perms); err != nil {
+			return ac, fmt.Errorf("group %s: %v", g.Group, err)
+		}
+	}
+	for _, table := range ac.AccessTables {
+		if _, err := regexp.Compile(table.Regex); err != nil {
+			return ac, fmt.Errorf("accessTables: %v", err)
+		}
+	}
+	return ac, nil
+}
+
+// checkAccessConfs loads the .ghs.yml files found by the search index, so
+// broken ones show up in /-/status before anybody runs into them
+func (s *HTTPStaticServer) checkAccessConfs() {
+	query, err := parseQuery(ghsFileName)
+	if err != nil {
+		return
+	}
+	for _, item := range s.Index.search(query, "") {
+		if pathpkg.Base(item.Path) == ghsFileName {
+			s.acl.get(cleanName(pathpkg.Dir(item.Path)))
+		}
+	}
+}
+
+// aclCheck explains the permissions of a user on a path
+type aclCheck struct {
+	Path   string   `json:"path"`
+	User   string   `json:"user"`
+	Groups []string `json:"groups"`
+	Hidden bool     `json:"hidden"`
+	Rule   string   `json:"rule"`
+	Perms  []string `json:"perms"`
+	Files  []string `json:"files"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// explain resolves the permissions of the user of r on the storage name
+func (s *HTTPStaticServer) explain(r *http.Request, name string) aclCheck {
+	auth := s.readAccessConf(name, r)
+	p, rule := auth.effective(r)
+	check := aclCheck{
+		Path:   "/" + name,
+		User:   getUser(r),
+		Groups: userGroups.groups(identityOf(r).source(), getUser(r)),
+		Hidden: s.hidden(r, name),
+		Rule:   rule,
+		Perms:  p.names(),
+		Files:  s.acl.get(name).files,
+	}
+	if check.Groups == nil {
+		check.Groups = []string{}
+	}
+	if check.Hidden {
+		check.Perms = []string{}
+	}
+	errs := s.acl.errors()
+	for _, file := range check.Files {
+		if msg, ok := errs[file]; ok {
+			check.Errors = append(check.Errors, file+": "+msg)
+		}
+	}
+	return check
+}
+
+// hACLCheck explains the permissions of ?user= on ?path=. Users may check
+// themselves, admins and auditors anybody.
+func (s *HTTPStaticServer) hACLCheck(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("user")
+	if username == "" {
+		username = getUser(r)
+	}
+	if username != getUser(r) && !canAudit(r) {
+		http.Error(w, "only admins and auditors can check other users", http.StatusForbidden)
+		return
+	}
+	req := withIdentity(r, &Identity{Username: username, Provider: "acl"})
+	name := cleanName(r.FormValue("path"))
+	if isInternalPath(name) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(s.explain(req, name))
+}
+
+// aclRule is an entry of users or groups in an aclDoc
+type aclRule struct {
+	Username string    `yaml:"username,omitempty" json:"username,omitempty"`
+	Email    string    `yaml:"email,omitempty" json:"email,omitempty"`
+	Group    string    `yaml:"group,omitempty" json:"group,omitempty"`
+	Upload   bool      `yaml:"upload,omitempty" json:"upload,omitempty"`
+	Delete   bool      `yaml:"delete,omitempty" json:"delete,omitempty"`
+	NoAccess bool      `yaml:"noaccess,omitempty" json:"noaccess,omitempty"`
+	Perms    *[]string `yaml:"perms,omitempty" json:"perms,omitempty"`
+}
+
+func (u aclRule) perms() permSet {
+	var perms []string
+	if u.Perms != nil {
+		perms = *u.Perms
+	}
+	return rulePerms(perms, u.Upload, u.Delete, u.NoAccess)
+}
+
+// setPerms replaces the flags of the rule with p
+func (u *aclRule) setPerms(p permSet) {
+	names := p.names()
+	u.Perms = &names
+	u.Upload, u.Delete, u.NoAccess = false, false, false
+}
+
+// aclDoc is a .ghs.yml as the /-/acl endpoints read and write it. Keys which
+// are left out are inherited from the directory above.
+type aclDoc struct {
+	Upload       *bool          `yaml:"upload,omitempty" json:"upload,omitempty"`
+	Delete       *bool          `yaml:"delete,omitempty" json:"delete,omitempty"`
+	NoAccess     *bool          `yaml:"noaccess,omitempty" json:"noaccess,omitempty"`
+	Perms        *[]string      `yaml:"perms,omitempty" json:"perms,omitempty"`
+	Username     string         `yaml:"username,omitempty" json:"username,omitempty"`
+	Users        *[]aclRule     `yaml:"users,omitempty" json:"users,omitempty"`
+	Groups       *[]aclRule     `yaml:"groups,omitempty" json:"groups,omitempty"`
+	AccessTables *[]AccessTable `yaml:"accessTables,omitempty" json:"accessTables,omitempty"`
+	Quota        *DirQuota      `yaml:"quota,omitempty" json:"quota,omitempty"`
+}
+
+// validate checks the permission names, the entries of users and groups
+// and the regexps of accessTables
+func (d *aclDoc) validate() error {
+	if d.Perms != nil {
+		if _, err := parsePerms(*d.Perms); err != nil {
+			return err
+		}
+	}
+	check := func(key string, rules *[]aclRule, name func(aclRule) (string, string)) error {
+		if rules == nil {
+			return nil
+		}
+		seen := make(map[string]bool)
+		for _, rule := range *rules {
+			n, other := name(rule)
+			if n == "" {
+				return fmt.Errorf("%s: an entry has no name", key)
+			}
+			if other != "" {
+				return fmt.Errorf("%s: %s: user and group in one entry", key, n)
+			}
+			if seen[n] {
+				return fmt.Errorf("%s: %s is listed twice", key, n)
+			}
+			seen[n] = true
+			if rule.Perms != nil {
+				if _, err := parsePerms(*rule.Perms); err != nil {
+					return fmt.Errorf("%s: %s: %v", key, n, err)
+				}
+			}
+		}
+		return nil
+	}
+	if err := check("users", d.Users, func(u aclRule) (string, string) { return u.Username, u.Group }); err != nil {
+		return err
+	}
+	if err := check("groups", d.Groups, func(u aclRule) (string, string) { return u.Group, u.Username }); err != nil {
+		return err
+	}
+	if d.AccessTables != nil {
+		for _, table := range *d.AccessTables {
+			if table.Regex == "" {
+				return errors.New("accessTables: empty regex")
+			}
+			if _, err := regexp.Compile(table.Regex); err != nil {
+				return fmt.Errorf("accessTables: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// aclPatch changes the rule of a user, of a group, or the defaults if both
+// are empty
+type aclPatch struct {
+	User   string   `json:"user"`
+	Group  string   `json:"group"`
+	Grant  []string `json:"grant"`
+	Revoke []string `json:"revoke"`
+	Remove bool     `json:"remove"` // drop the entry of the user or group
+}
+
+// apply changes doc, the .ghs.yml of a directory with the configuration
+// conf. Lists the file does not have yet start as a copy of the inherited
+// ones, and new entries with the permissions the user or group had.
+func (p aclPatch) apply(doc *aclDoc, conf AccessConf) error {
+	grant, err := parsePerms(p.Grant)
+	if err != nil {
+		return err
+	}
+	revoke, err := parsePerms(p.Revoke)
+	if err != nil {
+		return err
+	}
+	defaults := rulePerms(conf.Perms, conf.Upload, conf.Delete, conf.NoAccess)
+
+	if p.User == "" && p.Group == "" {
+		if p.Remove {
+			return errors.New("remove needs a user or a group")
+		}
+		perms := ((defaults | grant) &^ revoke).names()
+		doc.Perms = &perms
+		doc.Upload, doc.Delete, doc.NoAccess = nil, nil, nil
+		return nil
+	}
+	if p.User != "" && p.Group != "" {
+		return errors.New("either a user or a group")
+	}
+
+	rules, name := doc.Users, p.User
+	var seed permSet
+	if p.User != "" {
+		if rules == nil {
+			rules = &[]aclRule{}
+			for _, u := range conf.Users {
+				*rules = append(*rules, aclRule{Username: u.Username, Email: u.Email, Upload: u.Upload, Delete: u.Delete, NoAccess: u.NoAccess, Perms: copyPerms(u.Perms)})
+			}
+		}
+		r := withIdentity(&http.Request{}, &Identity{Username: p.User, Provider: "acl"})
+		seed, _ = conf.granted(r)
+	} else {
+		rules, name = doc.Groups, p.Group
+		if rules == nil {
+			rules = &[]aclRule{}
+			for _, g := range conf.Groups {
+				*rules = append(*rules, aclRule{Group: g.Group, Upload: g.Upload, Delete: g.Delete, NoAccess: g.NoAccess, Perms: copyPerms(g.Perms)})
+			}
+		}
+		seed = defaults
+	}
+
+	i := 0
+	for ; i < len(*rules); i++ {
+		if (*rules)[i].Username == name && p.User != "" || (*rules)[i].Group == name && p.Group != "" {
+			break
+		}
+	}
+	switch {
+	case p.Remove && i < len(*rules):
+		*rules = append((*rules)[:i], (*rules)[i+1:]...)
+	case p.Remove:
+		return fmt.Errorf("no entry for %s", name)
+	case i < len(*rules):
+		(*rules)[i].setPerms(((*rules)[i].perms() | grant) &^ revoke)
+	default:
+		rule := aclRule{Username: p.User, Group: p.Group}
+		rule.setPerms((seed | grant) &^ revoke)
+		*rules = append(*rules, rule)
+	}
+	if p.User != "" {
+		doc.Users = rules
+	} else {
+		doc.Groups = rules
+	}
+	return nil
+}
+
+func copyPerms(perms []string) *[]string {
+	if perms == nil {
+		return nil
+	}
+	c := append([]string{}, perms...)
+	return &c
+}
+
+// readACL reads the .ghs.yml of the directory dir, if there is one
+func (s *HTTPStaticServer) readACL(dir string) (doc aclDoc, exists bool, err error) {
+	data, err := readStorageFile(s.storage, pathpkg.Join(dir, ghsFileName))
+	if os.IsNotExist(err) {
+		return doc, false, nil
+	}
+	if err != nil {
+		return doc, true, err
+	}
+	return doc, true, yaml.Unmarshal(data, &doc)
+}
+
+// writeACL validates doc and replaces the .ghs.yml of dir with it. The file
+// is staged first and renamed, so the rules are never seen half written.
+func (s *HTTPStaticServer) writeACL(dir string, doc aclDoc) error {
+	if err := doc.validate(); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if _, err := parseAccessConf(AccessConf{}, data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.stageDir, 0755); err != nil {
+		return err
+	}
+	staged := s.stagePath(newUploadID())
+	if err := ioutil.WriteFile(staged, data, 0644); err != nil {
+		return err
+	}
+	name := pathpkg.Join(dir, ghsFileName)
+	if err := s.commitUpload(staged, name); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	s.acl.changed(name)
+	return nil
+}
+
+// aclTarget is the directory of the /-/acl/ endpoints, in ?path=
+func aclTarget(r *http.Request) string {
+	return r.URL.Query().Get("path")
+}
+
+// aclDir returns the storage name of the directory of the request
+func (s *HTTPStaticServer) aclDir(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := cleanName(aclTarget(r))
+	info, err := s.storage.Stat(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return "", false
+	}
+	if !info.IsDir() {
+		http.Error(w, "/"+name+" is not a directory", http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
+
+// aclResponse is the answer of the /-/acl/ endpoints
+type aclResponse struct {
+	Path   string `json:"path"`
+	Exists bool   `json:"exists"`
+	ACL    aclDoc `json:"acl"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (s *HTTPStaticServer) writeACLResponse(w http.ResponseWriter, dir string) {
+	resp := aclResponse{Path: "/" + dir}
+	var err error
+	resp.ACL, resp.Exists, err = s.readACL(dir)
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// hACLGet returns the .ghs.yml of the directory ?path=
+func (s *HTTPStaticServer) hACLGet(w http.ResponseWriter, r *http.Request) {
+	dir, ok := s.aclDir(w, r)
+	if !ok {
+		return
+	}
+	s.writeACLResponse(w, dir)
+}
+
+// hACLSet replaces the .ghs.yml of the directory ?path= with the aclDoc in
+// the body
+func (s *HTTPStaticServer) hACLSet(w http.ResponseWriter, r *http.Request) {
+	dir, ok := s.aclDir(w, r)
+	if !ok {
+		return
+	}
+	doc := aclDoc{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.acl.writing.Lock()
+	defer s.acl.writing.Unlock()
+	if err := s.writeACL(dir, doc); err != nil {
+		http.Error(w, s.relError(err), http.StatusBadRequest)
+		return
+	}
+	s.writeACLResponse(w, dir)
+}
+
+// hACLPatch applies the aclPatch in the body to the .ghs.yml of the
+// directory ?path=
+func (s *HTTPStaticServer) hACLPatch(w http.ResponseWriter, r *http.Request) {
+	dir, ok := s.aclDir(w, r)
+	if !ok {
+		return
+	}
+	patch := aclPatch{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&patch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	auditOf(r).Target = patch.User + patch.Group
+	auditOf(r).Detail = map[string]interface{}{"grant": patch.Grant, "revoke": patch.Revoke, "remove": patch.Remove}
+	s.acl.writing.Lock()
+	defer s.acl.writing.Unlock()
+	doc, _, err := s.readACL(dir)
+	if err != nil {
+		http.Error(w, "/"+pathpkg.Join(dir, ghsFileName)+" is broken, replace it with set: "+err.Error(), http.StatusConflict)
+		return
+	}
+	if err := patch.apply(&doc, s.readAccessConf(dir, r)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.writeACL(dir, doc); err != nil {
+		http.Error(w, s.relError(err), http.StatusBadRequest)
+		return
+	}
+	s.writeACLResponse(w, dir)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"grapehttp/config"
+)
+
+func TestACLCache(t *testing.T) {
+	s := permServer(t, map[string]string{
+		"a/.ghs.yml":   "perms: [read]\n",
+		"a/b/.ghs.yml": "users:\n- username: alice\n  perms: [admin]\n",
+		"a/b/c.txt":    "c",
+	})
+	bob := withIdentity(httptest.NewRequest("GET", "/", nil), &Identity{Username: "bob", Provider: "static"})
+	alice := withIdentity(httptest.NewRequest("GET", "/", nil), &Identity{Username: "alice", Provider: "static"})
+
+	auth := s.readAccessConf("a/b/c.txt", bob)
+	if got := auth.perms(bob); got != permRead {
+		t.Fatalf("got %v, want read", got.names())
+	}
+	if s.acl.get("a/b") != s.acl.get("a/b/c.txt") || s.acl.get("a/b") != s.acl.get("a/b") {
+		t.Error("entry not cached")
+	}
+
+	// changes of a parent are picked up by the children
+	file := filepath.Join(s.Root, "a", ".ghs.yml")
+	if err := ioutil.WriteFile(file, []byte("perms: [read, list]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Minute))
+	auth = s.readAccessConf("a/b/c.txt", bob)
+	if got := auth.perms(bob); got != permRead|permList {
+		t.Errorf("after change: got %v, want read,list", got.names())
+	}
+
+	// a broken file leaves only the admins of the parent
+	file = filepath.Join(s.Root, "a", "b", ".ghs.yml")
+	ioutil.WriteFile(file, []byte("perms: [read, lst]\nusers:\n- username: alice\n  perms: [admin]\n"), 0644)
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Minute))
+	auth = s.readAccessConf("a/b/c.txt", bob)
+	if got := auth.perms(bob); got != 0 {
+		t.Errorf("broken file: got %v, want nothing", got.names())
+	}
+	ioutil.WriteFile(filepath.Join(s.Root, "a", ".ghs.yml"), []byte("users:\n- username: alice\n  perms: [admin]\n"), 0644)
+	s.acl.changed("a/.ghs.yml")
+	auth = s.readAccessConf("a/b/c.txt", alice)
+	if got := auth.perms(alice); got != permAll {
+		t.Errorf("broken file: got %v for the admin of the parent", got.names())
+	}
+	if errs := s.acl.errors(); errs["/a/b/.ghs.yml"] == "" {
+		t.Errorf("error not reported: %v", errs)
+	}
+
+	os.Remove(file)
+	auth = s.readAccessConf("a/b/c.txt", bob)
+	if errs := s.acl.errors(); len(errs) != 0 || auth.perms(bob) != permRead|permList {
+		t.Errorf("after removal: %v %v", errs, auth.perms(bob).names())
+	}
+}
+
+func TestACLConcurrent(t *testing.T) {
+	s := permServer(t, map[string]string{
+		".ghs.yml":   "accessTables:\n- regex: \\.key$\n  allow: false\n",
+		"a/.ghs.yml": "accessTables:\n- regex: ^tmp\n  allow: false\n",
+	})
+	r := httptest.NewRequest("GET", "/", nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				auth := s.readAccessConf("a/x.txt", r)
+				if auth.canAccess("tmp.txt") || !auth.canAccess("x.txt") {
+					t.Error("wrong access tables")
+					return
+				}
+				s.acl.changed("a/.ghs.yml")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestACLCheck(t *testing.T) {
+	saved := userGroups
+	defer func() { userGroups = saved }()
+	userGroups = newGroupCache(staticGroups(map[string][]string{"devs": {"bob"}}))
+	savedRoles := userRoles
+	defer func() { userRoles = savedRoles }()
+	gcfg := config.Configure{}
+	gcfg.Auth.Auditors = []string{"dave"}
+	userRoles = newRoleCache(newRoleLookup(gcfg, nil))
+
+	s := permServer(t, map[string]string{
+		".ghs.yml":   "perms: [read]\n",
+		"a/.ghs.yml": "groups:\n- group: devs\n  perms: [read, list, write]\n",
+		"a/f.txt":    "f",
+	})
+	check := func(user, target string) (int, aclCheck) {
+		r := httptest.NewRequest("GET", target, nil)
+		r = withIdentity(r, &Identity{Username: user, Provider: "static"})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		var c aclCheck
+		json.Unmarshal(w.Body.Bytes(), &c)
+		return w.Code, c
+	}
+
+	code, c := check("admin", "/-/acl/check?path=/a/f.txt&user=bob")
+	want := aclCheck{
+		Path:   "/a/f.txt",
+		User:   "bob",
+		Groups: []string{"devs"},
+		Rule:   "groups devs",
+		Perms:  []string{"read", "list", "write"},
+		Files:  []string{"/.ghs.yml", "/a/.ghs.yml"},
+	}
+	if code != 200 || !reflect.DeepEqual(c, want) {
+		t.Errorf("got %d %+v", code, c)
+	}
+	if code, c = check("carol", "/-/acl/check?path=/a"); code != 200 || c.Rule != "defaults" || c.User != "carol" {
+		t.Errorf("check of oneself: got %d %+v", code, c)
+	}
+	if code, _ = check("carol", "/-/acl/check?path=/a&user=bob"); code != 403 {
+		t.Errorf("check of others: got %d, want 403", code)
+	}
+	if code, c = check("dave", "/-/acl/check?path=/a&user=bob"); code != 200 || c.User != "bob" {
+		t.Errorf("check of others by an auditor: got %d %+v", code, c)
+	}
+}
+
+func TestACLEndpoints(t *testing.T) {
+	s := permServer(t, map[string]string{
+		"team/.ghs.yml":  "perms: [read, list]\nusers:\n- username: alice\n  perms: [admin]\n",
+		"team/sub/f.txt": "f",
+	})
+	call := func(user, method, target, body string) (int, aclResponse) {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r = withIdentity(r, &Identity{Username: user, Provider: "static"})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		var resp aclResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	ghs := filepath.Join(s.Root, "team", "sub", ".ghs.yml")
+
+	if code, _ := call("bob", "GET", "/-/acl/get?path=/team/sub", ""); code != 403 {
+		t.Errorf("get by bob: got %d, want 403", code)
+	}
+	if code, _ := call("alice", "POST", "/-/acl/set?path=/", "{}"); code != 403 {
+		t.Errorf("set above the subtree: got %d, want 403", code)
+	}
+	if code, resp := call("alice", "GET", "/-/acl/get?path=/team/sub", ""); code != 200 || resp.Exists {
+		t.Errorf("get: got %d %+v", code, resp)
+	}
+
+	// grant copies the inherited users, so alice stays admin
+	code, resp := call("alice", "POST", "/-/acl/patch?path=/team/sub", `{"user":"bob","grant":["write"]}`)
+	if code != 200 || resp.ACL.Users == nil || len(*resp.ACL.Users) != 2 {
+		t.Fatalf("grant: got %d %+v", code, resp)
+	}
+	if bob := (*resp.ACL.Users)[1]; bob.Username != "bob" || !reflect.DeepEqual(*bob.Perms, []string{"read", "list", "write"}) {
+		t.Errorf("grant: got %+v", bob)
+	}
+	if got := upload(s, "bob", "/team/sub", "new.txt"); got != 200 {
+		t.Errorf("upload after grant: got %d", got)
+	}
+	call("alice", "POST", "/-/acl/patch?path=/team/sub", `{"user":"bob","revoke":["write","list"]}`)
+	if got := permRequest(s, "bob", "GET", "/-/json/team/sub", nil, ""); got != 403 {
+		t.Errorf("list after revoke: got %d", got)
+	}
+	call("alice", "POST", "/-/acl/patch?path=/team/sub", `{"user":"bob","remove":true}`)
+	if got := permRequest(s, "bob", "GET", "/-/json/team/sub", nil, ""); got != 200 {
+		t.Errorf("list after remove: got %d", got)
+	}
+
+	// an empty perms list denies everything, unlike a missing one
+	code, _ = call("alice", "POST", "/-/acl/set?path=/team/sub", `{"perms":[],"users":[{"username":"alice","perms":["admin"]}]}`)
+	if code != 200 {
+		t.Fatalf("set: got %d", code)
+	}
+	if got := permRequest(s, "bob", "GET", "/team/sub/f.txt", nil, ""); got != 403 {
+		t.Errorf("download after set: got %d", got)
+	}
+
+	// concurrent patches all end up in the file
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			if code, _ := call("alice", "POST", "/-/acl/patch?path=/team/sub", `{"user":"`+user+`","grant":["read"]}`); code != 200 {
+				t.Errorf("patch %s: got %d", user, code)
+			}
+		}(string(rune('a' + i)))
+	}
+	wg.Wait()
+	if _, resp := call("alice", "GET", "/-/acl/get?path=/team/sub", ""); resp.ACL.Users == nil || len(*resp.ACL.Users) != 9 {
+		t.Errorf("concurrent patches: got %+v", resp.ACL.Users)
+	}
+
+	data, _ := ioutil.ReadFile(ghs)
+	for _, body := range []string{
+		`{"perms":["read","execute"]}`,
+		`{"users":[{"username":"bob"},{"username":"bob"}]}`,
+		`{"groups":[{"perms":["read"]}]}`,
+		`{"accessTables":[{"regex":"(","allow":false}]}`,
+		`{"upload":true,"owner":"bob"}`,
+	} {
+		if code, _ := call("alice", "POST", "/-/acl/set?path=/team/sub", body); code != 400 {
+			t.Errorf("set %s: got %d, want 400", body, code)
+		}
+	}
+	if after, _ := ioutil.ReadFile(ghs); string(after) != string(data) {
+		t.Errorf("rejected set changed the file:\n%s", after)
+	}
+	if code, _ := call("alice", "POST", "/-/acl/set?path=/team/sub/f.txt", "{}"); code != 400 {
+		t.Errorf("set on a file: got %d, want 400", code)
+	}
+}
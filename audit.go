@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"grapehttp/models/admin"
+)
+
+const (
+	auditDir          = ".ghs-audit"
+	auditFileName     = "audit.log"
+	auditMaxSize      = 10 << 20
+	auditMaxFiles     = 5
+	auditDefaultLimit = 100
+)
+
+// auditRecord is one line of the audit log. Paths are the storage paths the
+// request is about, Target the user, group or token it changes.
+type auditRecord struct {
+	Time     time.Time              `json:"time"`
+	User     string                 `json:"user"`
+	Provider string                 `json:"provider,omitempty"`
+	IP       string                 `json:"ip"`
+	Action   string                 `json:"action"`
+	Paths    []string               `json:"paths,omitempty"`
+	Target   string                 `json:"target,omitempty"`
+	Detail   map[string]interface{} `json:"detail,omitempty"`
+	Status   int                    `json:"status"`
+	Result   string                 `json:"result"`
+	Bytes    int64                  `json:"bytes"`
+
+	skip bool
+}
+
+// auditLog writes the records as JSON lines to file. The file is renamed to
+// file.1 when it grows over maxSize, keeping maxFiles old files.
+type auditLog struct {
+	file     string
+	maxSize  int64
+	maxFiles int
+	db       func(rec *auditRecord) error // optional copy in the database
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newAuditLog(file string) *auditLog {
+	return &auditLog{file: file, maxSize: auditMaxSize, maxFiles: auditMaxFiles}
+}
+
+func (a *auditLog) write(rec *auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if err := a.append(data); err != nil {
+		return err
+	}
+	if a.db != nil {
+		return a.db(rec)
+	}
+	return nil
+}
+
+// append writes one line to the log file, rotating it when it is full
+func (a *auditLog) append(data []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f != nil && a.size+int64(len(data)) > a.maxSize {
+		a.f.Close()
+		a.f = nil
+		a.rotateLocked()
+	}
+	if a.f == nil {
+		if err := os.MkdirAll(filepath.Dir(a.file), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(a.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		a.f, a.size = f, info.Size()
+	}
+	n, err := a.f.Write(data)
+	a.size += int64(n)
+	return err
+}
+
+// rotateLocked shifts file.N to file.N+1 and file to file.1, the oldest is
+// dropped
+func (a *auditLog) rotateLocked() {
+	os.Remove(a.rotated(a.maxFiles))
+	for i := a.maxFiles - 1; i > 0; i-- {
+		os.Rename(a.rotated(i), a.rotated(i+1))
+	}
+	if a.maxFiles > 0 {
+		os.Rename(a.file, a.rotated(1))
+	} else {
+		os.Remove(a.file)
+	}
+}
+
+func (a *auditLog) rotated(i int) string {
+	return a.file + "." + strconv.Itoa(i)
+}
+
+// auditFilter selects records, empty fields match all of them. Path matches
+// the path itself and everything below it.
+type auditFilter struct {
+	User   string
+	Path   string
+	Action string
+	Since  time.Time
+	Limit  int
+}
+
+func (q auditFilter) match(rec *auditRecord) bool {
+	if q.User != "" && rec.User != q.User && !q.targets(rec) {
+		return false
+	}
+	if q.Action != "" && rec.Action != q.Action && !strings.HasPrefix(rec.Action, q.Action+".") {
+		return false
+	}
+	if !q.Since.IsZero() && rec.Time.Before(q.Since) {
+		return false
+	}
+	if q.Path != "" {
+		dir := "/" + cleanName(q.Path)
+		for _, p := range rec.Paths {
+			if p == dir || dir == "/" || strings.HasPrefix(p, dir+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// targets reports whether q.User is one of the targets of rec
+func (q auditFilter) targets(rec *auditRecord) bool {
+	for _, t := range strings.Split(rec.Target, ",") {
+		if t == q.User {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot opens the log files, oldest first, under the lock; a rotation
+// renames them afterwards but the open files keep their content
+func (a *auditLog) snapshot() ([]*os.File, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	names := []string{}
+	for i := a.maxFiles; i > 0; i-- {
+		names = append(names, a.rotated(i))
+	}
+	files := []*os.File{}
+	for _, name := range append(names, a.file) {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// query returns the last q.Limit matching records, oldest first; the files
+// are scanned without holding the lock
+func (a *auditLog) query(q auditFilter) ([]*auditRecord, error) {
+	if q.Limit <= 0 {
+		q.Limit = auditDefaultLimit
+	}
+	files, err := a.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	records := []*auditRecord{}
+	for _, f := range files {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		// lines written after the snapshot are left for the next query
+		scanner := bufio.NewScanner(io.LimitReader(f, info.Size()))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			rec := &auditRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+				continue
+			}
+			if !q.match(rec) {
+				continue
+			}
+			records = append(records, rec)
+			if len(records) > q.Limit {
+				records = records[1:]
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name(), err)
+		}
+	}
+	return records, nil
+}
+
+// secretKeys are the fields which never go into the audit log
+var secretKeys = []string{"password", "passwd", "secret", "token", "key"}
+
+// redact returns a copy of the JSON object data with the values of its
+// secrets replaced, nil if data is not an object
+func redact(data []byte) map[string]interface{} {
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	for k, v := range m {
+		lower := strings.ToLower(k)
+		for _, secret := range secretKeys {
+			if strings.Contains(lower, secret) {
+				if v != "" && v != nil {
+					m[k] = "***"
+				}
+				break
+			}
+		}
+	}
+	return m
+}
+
+// insertAuditRecord copies rec into the database
+func insertAuditRecord(rec *auditRecord) error {
+	paths, _ := json.Marshal(rec.Paths)
+	a := &admin.Audit{
+		Time:     rec.Time,
+		Username: rec.User,
+		Provider: rec.Provider,
+		Ip:       rec.IP,
+		Action:   rec.Action,
+		Paths:    string(paths),
+		Target:   rec.Target,
+		Status:   rec.Status,
+		Result:   rec.Result,
+		Bytes:    rec.Bytes,
+	}
+	if rec.Detail != nil {
+		detail, _ := json.Marshal(rec.Detail)
+		a.Detail = string(detail)
+	}
+	return a.Insert()
+}
+
+type auditKey struct{}
+
+// auditOf returns the record of the request, handlers add the paths and the
+// target the route can not know. Requests which are not audited get a record
+// which goes nowhere.
+func auditOf(r *http.Request) *auditRecord {
+	if rec, ok := r.Context().Value(auditKey{}).(*auditRecord); ok {
+		return rec
+	}
+	return &auditRecord{}
+}
+
+// auditWriter counts the bytes of the response and keeps its status
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *auditWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *auditWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// auditReader counts the bytes of the request body
+type auditReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (r *auditReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// audited serves r with h and writes the record of action once h is done.
+// Bytes are those of the response for downloads and those of the request
+// body for uploads, unless the handler knows better.
+func (s *HTTPStaticServer) audited(action string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.audit == nil || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			h(w, r)
+			return
+		}
+		rec := &auditRecord{
+			Time:   time.Now(),
+			User:   getUser(r),
+			IP:     getRealIP(r),
+			Action: action,
+		}
+		if id := identityOf(r); id != nil {
+			rec.Provider = id.Provider
+		}
+		aw := &auditWriter{ResponseWriter: w}
+		var body *auditReader
+		if r.Body != nil {
+			body = &auditReader{ReadCloser: r.Body}
+			r.Body = body
+		}
+		h(aw, r.WithContext(context.WithValue(r.Context(), auditKey{}, rec)))
+		if rec.skip || rec.Action == "" {
+			return
+		}
+
+		rec.Status = aw.status
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		switch {
+		case rec.Status == http.StatusUnauthorized || rec.Status == http.StatusForbidden:
+			rec.Result = "denied"
+		case rec.Status >= 400:
+			rec.Result = "error"
+		case rec.Result == "":
+			rec.Result = "ok"
+		}
+		if rec.Bytes == 0 && rec.Result == "ok" {
+			switch {
+			case rec.Action == "download":
+				rec.Bytes = aw.bytes
+			case rec.Action == "upload" && body != nil:
+				rec.Bytes = body.bytes
+			}
+		}
+		if err := s.audit.write(rec); err != nil {
+			log.Println("audit:", err)
+		}
+	}
+}
+
+// parseSince reads ?since= as a time or as a duration back from now, like
+// 2024-12-31, 2024-12-31T08:00:00Z, 12h or 7d
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if strings.HasSuffix(s, "d") {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("bad since %q, use e.g. 12h, 7d or 2024-12-31", s)
+}
+
+// hAudit answers the records of ?user=, ?path=, ?action= and ?since=, the
+// last ?limit= of them
+func (s *HTTPStaticServer) hAudit(w http.ResponseWriter, r *http.Request) {
+	if s.audit == nil {
+		http.Error(w, "audit log is disabled", http.StatusNotFound)
+		return
+	}
+	since, err := parseSince(r.FormValue("since"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := auditFilter{
+		User:   r.FormValue("user"),
+		Path:   r.FormValue("path"),
+		Action: r.FormValue("action"),
+		Since:  since,
+	}
+	if l := r.FormValue("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil || q.Limit < 0 {
+			http.Error(w, fmt.Sprintf("bad limit %q", l), http.StatusBadRequest)
+			return
+		}
+	}
+	records, err := s.audit.query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(records)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	s := permServer(t, map[string]string{
+		"pub/.ghs.yml": "perms: [read, list]\n",
+		"pub/a.txt":    "hello",
+		"pub/b.txt":    "b",
+	})
+	permRequest(s, "bob", "GET", "/pub/a.txt", nil, "")
+	permRequest(s, "bob", "GET", "/pub", nil, "") // listings are not audited
+	permRequest(s, "bob", "HEAD", "/pub/a.txt", nil, "")
+	upload(s, "bob", "/pub", "new.txt")
+	upload(s, "admin", "/pub", "new.txt")
+	permRequest(s, "admin", "DELETE", "/pub/b.txt", nil, "")
+	permRequest(s, "admin", "POST", "/-/cmd", []byte(`{"name":"mkdir","paths":["/pub/x","/pub/a.txt"]}`), "")
+	permRequest(s, "bob", "POST", "/-/token/create", []byte(`{"name":"ci","scopes":["read"]}`), "")
+
+	records, err := s.audit.query(auditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type summary struct {
+		User, Action, Result string
+		Paths                []string
+		Bytes                int64
+	}
+	got := []summary{}
+	for _, rec := range records {
+		if rec.IP == "" || rec.Time.IsZero() {
+			t.Errorf("incomplete record %+v", rec)
+		}
+		got = append(got, summary{rec.User, rec.Action, rec.Result, rec.Paths, rec.Bytes})
+	}
+	want := []summary{
+		{"bob", "download", "ok", []string{"/pub/a.txt"}, 5},
+		{"bob", "upload", "denied", []string{"/pub"}, 0},
+		{"admin", "upload", "ok", []string{"/pub/new.txt"}, got[2].Bytes},
+		{"admin", "delete", "ok", []string{"/pub/b.txt"}, 0},
+		{"admin", "cmd.mkdir", "partial", []string{"/pub/x", "/pub/a.txt"}, 0},
+		{"bob", "token.create", "ok", nil, 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+	if got[2].Bytes == 0 {
+		t.Error("upload without bytes")
+	}
+	if rec := records[5]; rec.Target != "bob" || rec.Detail["name"] != "ci" {
+		t.Errorf("token record %+v", rec)
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(s.Root, auditDir, auditFileName))
+	if strings.Contains(string(data), "ghs_") {
+		t.Error("token secret in the audit log")
+	}
+
+	// only admin may read it
+	if code := permRequest(s, "bob", "GET", "/-/audit", nil, ""); code != 403 {
+		t.Errorf("audit by bob: got %d, want 403", code)
+	}
+	query := func(target string) []*auditRecord {
+		r := withIdentity(httptest.NewRequest("GET", target, nil), &Identity{Username: "admin", Provider: "static"})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Fatalf("%s: got %d %s", target, w.Code, w.Body.String())
+		}
+		records := []*auditRecord{}
+		json.Unmarshal(w.Body.Bytes(), &records)
+		return records
+	}
+	if rs := query("/-/audit?user=bob&action=upload"); len(rs) != 1 || rs[0].Result != "denied" {
+		t.Errorf("user and action: got %+v", rs)
+	}
+	if rs := query("/-/audit?path=/pub/x"); len(rs) != 1 || rs[0].Action != "cmd.mkdir" {
+		t.Errorf("path: got %+v", rs)
+	}
+	if rs := query("/-/audit?action=cmd&limit=1&since=1h"); len(rs) != 1 {
+		t.Errorf("action prefix: got %+v", rs)
+	}
+	if rs := query("/-/audit?since=" + time.Now().Add(time.Hour).Format(time.RFC3339)); len(rs) != 0 {
+		t.Errorf("since: got %+v", rs)
+	}
+	if code := permRequest(s, "admin", "GET", "/-/audit?since=yesterday", nil, ""); code != 400 {
+		t.Errorf("bad since: got %d, want 400", code)
+	}
+	if code := permRequest(s, "admin", "GET", "/"+auditDir+"/"+auditFileName, nil, ""); code != 404 {
+		t.Errorf("download of the log: got %d, want 404", code)
+	}
+}
+
+func TestAuditRotate(t *testing.T) {
+	a := newAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	a.maxSize = 200
+	a.maxFiles = 2
+	for i := 0; i < 20; i++ {
+		if err := a.write(&auditRecord{Time: time.Now(), User: "bob", Action: "download", Bytes: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(a.rotated(3)); !os.IsNotExist(err) {
+		t.Errorf("more than 2 old files: %v", err)
+	}
+	records, err := a.query(auditFilter{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[2].Bytes != 19 || records[0].Bytes != 17 {
+		t.Errorf("got %+v", records)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	got := redact([]byte(`{"username":"bob","password":"secret1","repassword":"secret1","email":"","apiToken":"x"}`))
+	want := map[string]interface{}{"username": "bob", "password": "***", "repassword": "***", "email": "", "apiToken": "***"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestAuditQueryUnlocked(t *testing.T) {
+	a := newAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	entered, block := make(chan struct{}), make(chan struct{})
+	a.db = func(rec *auditRecord) error {
+		close(entered)
+		<-block
+		return nil
+	}
+	go a.write(&auditRecord{Time: time.Now(), User: "bob", Action: "download"})
+	defer close(block)
+	<-entered
+
+	// a slow database does not hold back the queries
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.query(auditFilter{})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query waits for the database")
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/gob"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"grapehttp/config"
+	"grapehttp/models/admin"
+)
+
+// Identity is the authenticated user of a request
+type Identity struct {
+	Username string `json:"username"`
+	Email    string `json:"email,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Provider string `json:"provider"`
+
+	// set for API tokens, see allows and source
+	TokenID string   `json:"tokenId,omitempty"`
+	Scopes  []string `json:"scopes,omitempty"`
+	Paths   []string `json:"paths,omitempty"`
+	Source  string   `json:"source,omitempty"`
+}
+
+// userKey names username of source in the configuration and the caches:
+// the username itself for the users of the user store and of simpleauth,
+// source:username for the others, e.g. ldap:alice.
+func userKey(source, username string) string {
+	if source == "" {
+		return username
+	}
+	return source + ":" + username
+}
+
+// source returns where the user of id comes from, for its roles and groups:
+// "" for the users of the user store and of simpleauth, else the provider.
+// Users of ldap, oidc and openid choose or type their names, which must not
+// give them the roles and groups of a local user of the same name. Tokens
+// are of the source of the user who created them.
+func (id *Identity) source() string {
+	if id == nil {
+		return ""
+	}
+	switch id.Provider {
+	case "token":
+		return id.Source
+	case "", "static", "db", "acl":
+		return ""
+	}
+	return id.Provider
+}
+
+// Authenticator resolves the identity of a request. It returns nil without
+// an error when the request carries no credentials it understands, so the
+// next authenticator can be tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// loginProvider is an Authenticator with its own login pages, the user is
+// sent there instead of getting a Basic auth prompt.
+type loginProvider interface {
+	Authenticator
+	handleLogin(mux *http.ServeMux)
+}
+
+// PasswordChecker verifies a username and password, it is used for the
+// credentials of HTTP Basic auth.
+type PasswordChecker interface {
+	CheckPassword(user, pass string) (*Identity, error)
+}
+
+// loginRecorder is a PasswordChecker which keeps the logins of its users. A
+// login is a password check, the requests of the next minute with the same
+// credentials do not count.
+type loginRecorder interface {
+	recordLogin(user, ip string)
+}
+
+var errBadCredentials = errors.New("bad username or password")
+
+type identityKey struct{}
+
+func init() {
+	gob.Register(&Identity{})
+}
+
+// withIdentity returns a shallow copy of r which carries id
+func withIdentity(r *http.Request, id *Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+}
+
+// identityOf returns the identity of r, nil for anonymous requests
+func identityOf(r *http.Request) *Identity {
+	id, _ := r.Context().Value(identityKey{}).(*Identity)
+	return id
+}
+
+// basicAuth authenticates the HTTP Basic credentials of a request. Checked
+// credentials are remembered for a minute, so a remote directory or user
+// store is not asked again for every request of a page.
+type basicAuth struct {
+	checker PasswordChecker
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]basicCacheEntry
+}
+
+type basicCacheEntry struct {
+	id      *Identity
+	expires time.Time
+}
+
+const basicCacheTTL = time.Minute
+
+// basicAuths are all basicAuth authenticators, so forgetCredentials can
+// reach their caches
+var basicAuths struct {
+	sync.Mutex
+	all []*basicAuth
+}
+
+func newBasicAuth(checker PasswordChecker) *basicAuth {
+	a := &basicAuth{checker: checker, cache: make(map[[sha256.Size]byte]basicCacheEntry)}
+	basicAuths.Lock()
+	basicAuths.all = append(basicAuths.all, a)
+	basicAuths.Unlock()
+	return a
+}
+
+// forgetCredentials drops the cached credentials of usernames, after their
+// password changed or they were disabled or deleted
+func forgetCredentials(usernames ...string) {
+	basicAuths.Lock()
+	defer basicAuths.Unlock()
+	for _, a := range basicAuths.all {
+		a.forget(usernames)
+	}
+}
+
+func (a *basicAuth) forget(usernames []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, e := range a.cache {
+		for _, username := range usernames {
+			if e.id.Username == username {
+				delete(a.cache, key)
+			}
+		}
+	}
+}
+
+func (a *basicAuth) Authenticate(r *http.Request) (*Identity, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + pass))
+	now := time.Now()
+	a.mu.Lock()
+	e, ok := a.cache[key]
+	if ok && now.After(e.expires) {
+		delete(a.cache, key)
+		ok = false
+	}
+	a.mu.Unlock()
+	if ok {
+		return e.id, nil
+	}
+
+	id, err := a.checker.CheckPassword(user, pass)
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := a.checker.(loginRecorder); ok {
+		l.recordLogin(id.Username, getRealIP(r))
+	}
+	a.mu.Lock()
+	if len(a.cache) > 1000 {
+		a.cache = make(map[[sha256.Size]byte]basicCacheEntry)
+	}
+	a.cache[key] = basicCacheEntry{id, now.Add(basicCacheTTL)}
+	a.mu.Unlock()
+	return id, nil
+}
+
+// staticUsers checks passwords against a fixed list from the configuration
+type staticUsers map[string]string
+
+func (s staticUsers) CheckPassword(user, pass string) (*Identity, error) {
+	want, ok := s[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(want), []byte(pass)) != 1 {
+		return nil, errBadCredentials
+	}
+	return &Identity{Username: user, Provider: "static"}, nil
+}
+
+// dbUsers checks passwords against the enabled users of the user store
+type dbUsers struct {
+	users UserStore
+}
+
+func (d dbUsers) CheckPassword(user, pass string) (*Identity, error) {
+	userInfo, err := d.users.ActiveUser(user)
+	if err != nil {
+		return nil, errBadCredentials
+	}
+	ok, rehashed := userInfo.CheckPassword(pass)
+	if !ok {
+		log.Printf("user: %s login failed", user)
+		return nil, errBadCredentials
+	}
+	if rehashed {
+		if err := d.users.UpdateUser(&userInfo); err != nil {
+			log.Printf("user: %s upgrade password hash: %v", user, err)
+		} else {
+			log.Printf("user: %s password hash upgraded", user)
+		}
+	}
+
+	return &Identity{
+		Username: userInfo.Username,
+		Email:    userInfo.Email,
+		Name:     userInfo.Nickname,
+		Provider: "db",
+	}, nil
+}
+
+// recordLogin keeps the time and address of the login of user, and counts
+// it
+func (d dbUsers) recordLogin(user, ip string) {
+	userInfo, err := d.users.User(user)
+	if err != nil {
+		log.Printf("user: %s login: %v", user, err)
+		return
+	}
+	now := time.Now()
+	userInfo.Lastlogintime = now
+	userInfo.Lastip = ip
+	userInfo.Logincount++
+	if err := d.users.UpdateUser(&userInfo); err != nil {
+		log.Printf("user: %s login: %v", user, err)
+	}
+	if err := d.users.AddLogin(&admin.Login{Username: user, Time: now, Ip: ip}); err != nil {
+		log.Printf("user: %s login: %v", user, err)
+	}
+}
+
+// authHandler resolves the identity of every request with the first
+// authenticator that recognizes its credentials. A username or password
+// one authenticator does not know is tried with the next; credentials none
+// accepts, and broken ones like an invalid token, are always refused.
+// Requests without any are refused only if required.
+type authHandler struct {
+	auths    []Authenticator
+	required bool
+	login    bool // a loginProvider is configured
+	next     http.Handler
+}
+
+func newAuthHandler(auths []Authenticator, required bool, next http.Handler) http.Handler {
+	h := &authHandler{auths: auths, required: required, next: next}
+	for _, a := range auths {
+		if _, ok := a.(loginProvider); ok {
+			h.login = true
+		}
+	}
+	return h
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var bad error
+	for _, a := range h.auths {
+		id, err := a.Authenticate(r)
+		if err == errBadCredentials {
+			bad = err
+			continue
+		}
+		if err != nil {
+			h.unauthorized(w, r, err)
+			return
+		}
+		if id != nil {
+			h.next.ServeHTTP(w, withIdentity(r, id))
+			return
+		}
+	}
+	if bad != nil {
+		h.unauthorized(w, r, bad)
+		return
+	}
+	if h.required {
+		h.unauthorized(w, r, nil)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func (h *authHandler) unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	if err == nil && h.login && r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/-/login?next="+r.URL.RequestURI(), http.StatusFound)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+	msg := http.StatusText(http.StatusUnauthorized)
+	if err != nil {
+		msg = err.Error()
+	}
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+// newAuthenticators creates the authenticators of the comma separated auth
+// types of the configuration, in the given order, after the API tokens of
+// tokens. It also reports whether anonymous requests are refused, which is
+// the case with any password based type.
+func newAuthenticators(gcfg config.Configure, tokens *tokenStore, users UserStore) (auths []Authenticator, required bool, err error) {
+	// tokens of users which are gone are refused, if that can be told
+	var userActive func(string) bool
+	external := false
+	for _, typ := range strings.Split(gcfg.Auth.Type, ",") {
+		switch strings.TrimSpace(typ) {
+		case "":
+		case "http":
+			required = true
+			if gcfg.SimpleAuth {
+				users := staticUsers{}
+				if userpass := strings.SplitN(gcfg.Auth.HTTP, ":", 2); len(userpass) == 2 {
+					users[userpass[0]] = userpass[1]
+				}
+				for user, pass := range gcfg.Auth.Users {
+					users[user] = pass
+				}
+				if len(users) == 0 {
+					return nil, false, errors.New("auth http: no users, set auth.http or auth.users")
+				}
+				auths = append(auths, newBasicAuth(users))
+				userActive = func(name string) bool { _, ok := users[name]; return ok }
+			} else {
+				auths = append(auths, newBasicAuth(dbUsers{users}))
+				userActive = func(name string) bool { _, err := users.ActiveUser(name); return err == nil }
+			}
+		case "ldap":
+			required = true
+			external = true
+			l := gcfg.Auth.LDAP
+			if l.URL == "" || l.BindDN == "" {
+				return nil, false, errors.New("auth ldap: url and bind_dn are required")
+			}
+			auths = append(auths, newBasicAuth(&ldapAuth{
+				URL:                l.URL,
+				BindDN:             l.BindDN,
+				InsecureSkipVerify: l.InsecureSkipVerify,
+				Timeout:            10 * time.Second,
+			}))
+		case "oidc":
+			external = true
+			o := gcfg.Auth.OIDC
+			if o.Issuer == "" || o.ClientID == "" {
+				return nil, false, errors.New("auth oidc: issuer and client_id are required")
+			}
+			auths = append(auths, &oidcAuth{
+				Issuer:        strings.TrimRight(o.Issuer, "/"),
+				ClientID:      o.ClientID,
+				ClientSecret:  o.ClientSecret,
+				RedirectURL:   o.RedirectURL,
+				Scopes:        o.Scopes,
+				UsernameClaim: o.UsernameClaim,
+			})
+		case "openid":
+			external = true
+			auths = append(auths, &openIDAuth{URL: gcfg.Auth.OpenID})
+		default:
+			return nil, false, errors.New("unknown auth type: " + typ)
+		}
+	}
+	if len(auths) > 0 && tokens != nil {
+		if external {
+			userActive = nil
+		}
+		auths = append([]Authenticator{&tokenAuth{store: tokens, userActive: userActive}}, auths...)
+	}
+	return auths, required, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ldapAuth checks passwords with a simple bind to an LDAP server. The DN to
+// bind as is BindDN with %s replaced by the escaped username, e.g.
+// uid=%s,ou=people,dc=example,dc=org. The server matches the username
+// ignoring case, so the user is named by the value of that attribute read
+// back from its entry: BOB and bob are the same user, of the rules for bob.
+// Only the bind and that search are implemented, that is all the client
+// needs.
+type ldapAuth struct {
+	URL                string // ldap://host[:389] or ldaps://host[:636]
+	BindDN             string
+	InsecureSkipVerify bool
+	Timeout            time.Duration
+}
+
+// LDAP result codes, RFC 4511 section 4.1.9
+const (
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+func (a *ldapAuth) CheckPassword(user, pass string) (*Identity, error) {
+	// a bind without password is an anonymous bind and succeeds
+	if user == "" || pass == "" {
+		return nil, errBadCredentials
+	}
+	conn, err := a.dial()
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %v", err)
+	}
+	defer conn.Close()
+	if a.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(a.Timeout))
+	}
+
+	dn := strings.Replace(a.BindDN, "%s", ldapEscapeDN(user), -1)
+	code, msg, err := ldapBind(conn, dn, pass)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %v", err)
+	}
+	switch code {
+	case ldapSuccess:
+	case ldapInvalidCredentials:
+		return nil, errBadCredentials
+	default:
+		return nil, fmt.Errorf("ldap: bind failed with result %d: %s", code, msg)
+	}
+	if attr := a.nameAttr(); attr != "" {
+		name, err := ldapSearchAttr(conn, dn, attr)
+		if err != nil {
+			return nil, fmt.Errorf("ldap: %s of %s: %v", attr, dn, err)
+		}
+		user = name
+	}
+	// unbind, the server closes the connection
+	conn.Write(berTLV(0x30, append(berInt(0x02, 3), berTLV(0x42, nil)...)))
+	return &Identity{Username: user, Provider: "ldap"}, nil
+}
+
+// nameAttr returns the attribute BindDN puts the username in, uid of
+// uid=%s,ou=people, or "" if it is not a whole attribute value like in
+// %s@example.org
+func (a *ldapAuth) nameAttr() string {
+	i := strings.Index(a.BindDN, "=%s")
+	if i < 0 {
+		return ""
+	}
+	if rest := a.BindDN[i+3:]; rest != "" && rest[0] != ',' && rest[0] != '+' {
+		return ""
+	}
+	attr := a.BindDN[:i]
+	if j := strings.LastIndexAny(attr, ",+"); j >= 0 {
+		attr = attr[j+1:]
+	}
+	return strings.TrimSpace(attr)
+}
+
+func (a *ldapAuth) dial() (net.Conn, error) {
+	u, err := url.Parse(a.URL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: a.Timeout}
+	switch u.Scheme {
+	case "ldap":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		return dialer.Dial("tcp", host)
+	case "ldaps":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		return tls.DialWithDialer(dialer, "tcp", host, &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: a.InsecureSkipVerify,
+		})
+	}
+	return nil, fmt.Errorf("unsupported url %q", a.URL)
+}
+
+// ldapBind sends a simple BindRequest with message id 1 and returns the
+// result code and diagnostic message of the BindResponse
+func ldapBind(conn io.ReadWriter, dn, pass string) (int, string, error) {
+	bind := append(berInt(0x02, 3), berTLV(0x04, []byte(dn))...)
+	bind = append(bind, berTLV(0x80, []byte(pass))...)
+	msg := append(berInt(0x02, 1), berTLV(0x60, bind)...)
+	if _, err := conn.Write(berTLV(0x30, msg)); err != nil {
+		return 0, "", err
+	}
+
+	tag, body, err := berRead(conn)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != 0x30 {
+		return 0, "", errors.New("malformed response")
+	}
+	fields, err := berSplit(body)
+	if err != nil || len(fields) < 2 || fields[1].tag != 0x61 {
+		return 0, "", errors.New("malformed bind response")
+	}
+	result, err := berSplit(fields[1].value)
+	if err != nil || len(result) < 3 || result[0].tag != 0x0a {
+		return 0, "", errors.New("malformed bind response")
+	}
+	return berInteger(result[0].value), string(result[2].value), nil
+}
+
+// ldapSearchAttr reads the first value of attr of the entry dn, with a
+// base object SearchRequest with message id 2
+func ldapSearchAttr(conn io.ReadWriter, dn, attr string) (string, error) {
+	search := berTLV(0x04, []byte(dn))
+	search = append(search, berInt(0x0a, 0)...) // scope baseObject
+	search = append(search, berInt(0x0a, 0)...) // neverDerefAliases
+	search = append(search, berInt(0x02, 1)...) // sizeLimit
+	search = append(search, berInt(0x02, 0)...) // timeLimit
+	search = append(search, berTLV(0x01, []byte{0})...)
+	search = append(search, berTLV(0x87, []byte("objectClass"))...) // present
+	search = append(search, berTLV(0x30, berTLV(0x04, []byte(attr)))...)
+	msg := append(berInt(0x02, 2), berTLV(0x63, search)...)
+	if _, err := conn.Write(berTLV(0x30, msg)); err != nil {
+		return "", err
+	}
+
+	value := ""
+	for {
+		tag, body, err := berRead(conn)
+		if err != nil {
+			return "", err
+		}
+		if tag != 0x30 {
+			return "", errors.New("malformed response")
+		}
+		fields, err := berSplit(body)
+		if err != nil || len(fields) < 2 {
+			return "", errors.New("malformed search response")
+		}
+		switch fields[1].tag {
+		case 0x64: // SearchResultEntry
+			entry, err := berSplit(fields[1].value)
+			if err != nil || len(entry) < 2 {
+				return "", errors.New("malformed search result")
+			}
+			attrs, _ := berSplit(entry[1].value)
+			for _, a := range attrs {
+				parts, err := berSplit(a.value)
+				if err != nil || len(parts) < 2 || !strings.EqualFold(string(parts[0].value), attr) {
+					continue
+				}
+				if vals, err := berSplit(parts[1].value); err == nil && len(vals) > 0 && value == "" {
+					value = string(vals[0].value)
+				}
+			}
+		case 0x65: // SearchResultDone
+			result, err := berSplit(fields[1].value)
+			if err != nil || len(result) < 3 || result[0].tag != 0x0a {
+				return "", errors.New("malformed search result")
+			}
+			if code := berInteger(result[0].value); code != ldapSuccess {
+				return "", fmt.Errorf("search failed with result %d: %s", code, result[2].value)
+			}
+			if value == "" {
+				return "", errors.New("not found")
+			}
+			return value, nil
+		}
+	}
+}
+
+// ldapEscapeDN escapes the special characters of an attribute value in a
+// distinguished name, RFC 4514 section 2.4
+func ldapEscapeDN(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case strings.IndexByte(`"+,;<>\=`, c) >= 0,
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(s)-1):
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// berTLV encodes a BER element with a definite length
+func berTLV(tag byte, value []byte) []byte {
+	out := []byte{tag}
+	n := len(value)
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xff:
+		out = append(out, 0x81, byte(n))
+	case n <= 0xffff:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, value...)
+}
+
+// berInt encodes a small non-negative INTEGER or ENUMERATED
+func berInt(tag byte, v int) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berInteger(b []byte) int {
+	v := 0
+	for _, c := range b {
+		v = v<<8 | int(c)
+	}
+	return v
+}
+
+// berRead reads one BER element of at most 1M
+func berRead(r io.Reader) (byte, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, nil, err
+	}
+	n := int(head[1])
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 3 {
+			return 0, nil, errors.New("unsupported BER length")
+		}
+		l := make([]byte, size)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return 0, nil, err
+		}
+		n = berInteger(l)
+	}
+	if n > 1<<20 {
+		return 0, nil, errors.New("BER element too large")
+	}
+	value := make([]byte, n)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return 0, nil, err
+	}
+	return head[0], value, nil
+}
+
+type berElement struct {
+	tag   byte
+	value []byte
+}
+
+// berSplit decodes the elements of a constructed value
+func berSplit(b []byte) ([]berElement, error) {
+	var out []berElement
+	for len(b) > 0 {
+		r := bytes.NewReader(b)
+		tag, value, err := berRead(r)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, berElement{tag, value})
+		b = b[len(b)-r.Len():]
+	}
+	return out, nil
+}
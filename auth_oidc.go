@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcAuth logs users in with the authorization code flow of an OpenID
+// Connect provider. The endpoints and signing keys of the provider are
+// found with discovery, so the issuer url is all it needs besides the
+// client credentials. The identity is kept in the session cookie.
+type oidcAuth struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string // default: <scheme>://<host>/-/oidc/callback
+	Scopes        []string
+	UsernameClaim string // default: preferred_username, then email, then sub
+	Client        *http.Client
+
+	mu       sync.Mutex
+	provider *oidcProvider
+	keys     map[string]*rsa.PublicKey
+	keysAt   time.Time
+}
+
+// oidcProvider is the discovery document of the issuer
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcState is what the login page remembers until the callback
+type oidcState struct {
+	State string
+	Nonce string
+	Next  string
+}
+
+const oidcStateCookie = "ghs-oidc"
+
+func init() {
+	gob.Register(&oidcState{})
+}
+
+func (a *oidcAuth) Authenticate(r *http.Request) (*Identity, error) {
+	return sessionIdentity(r), nil
+}
+
+func (a *oidcAuth) client() *http.Client {
+	if a.Client != nil {
+		return a.Client
+	}
+	return &http.Client{Timeout: 30 * time.Second}
+}
+
+func (a *oidcAuth) getJSON(u string, v interface{}) error {
+	resp, err := a.client().Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover fetches the discovery document of the issuer once
+func (a *oidcAuth) discover() (*oidcProvider, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.provider != nil {
+		return a.provider, nil
+	}
+	p := &oidcProvider{}
+	if err := a.getJSON(a.Issuer+"/.well-known/openid-configuration", p); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %v", err)
+	}
+	if strings.TrimRight(p.Issuer, "/") != a.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer is %q, want %q", p.Issuer, a.Issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: endpoints missing")
+	}
+	a.provider = p
+	return p, nil
+}
+
+// key returns the signing key kid of the provider, the key set is fetched
+// again when an unknown key shows up, at most once a minute.
+func (a *oidcAuth) key(p *oidcProvider, kid string) (*rsa.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if k, ok := a.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(a.keysAt) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	a.keysAt = time.Now()
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := a.getJSON(p.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc keys: %v", err)
+	}
+	a.keys = make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			continue
+		}
+		a.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if k, ok := a.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (a *oidcAuth) redirectURL(r *http.Request) string {
+	if a.RedirectURL != "" {
+		return a.RedirectURL
+	}
+	return requestScheme(r) + "://" + r.Host + "/-/oidc/callback"
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (a *oidcAuth) handleLogin(mux *http.ServeMux) {
+	mux.HandleFunc("/-/login", func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.discover()
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "OpenID Connect provider not available", http.StatusBadGateway)
+			return
+		}
+		st := &oidcState{State: randomString(), Nonce: randomString(), Next: loginNext(r)}
+		session, _ := store.Get(r, oidcStateCookie)
+		session.Values["state"] = st
+		session.Options.MaxAge = 600
+		if err := session.Save(r, w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		scopes := a.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"openid", "profile", "email"}
+		}
+		q := url.Values{
+			"response_type": {"code"},
+			"client_id":     {a.ClientID},
+			"redirect_uri":  {a.redirectURL(r)},
+			"scope":         {strings.Join(scopes, " ")},
+			"state":         {st.State},
+			"nonce":         {st.Nonce},
+		}
+		sep := "?"
+		if strings.Contains(p.AuthorizationEndpoint, "?") {
+			sep = "&"
+		}
+		http.Redirect(w, r, p.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+	})
+
+	mux.HandleFunc("/-/oidc/callback", func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, oidcStateCookie)
+		st, _ := session.Values["state"].(*oidcState)
+		if st == nil || r.FormValue("state") != st.State {
+			http.Error(w, "Authentication check failed: bad state", http.StatusBadRequest)
+			return
+		}
+		delete(session.Values, "state")
+		session.Options.MaxAge = -1
+		session.Save(r, w)
+		if msg := r.FormValue("error"); msg != "" {
+			http.Error(w, "Authentication failed: "+msg, http.StatusForbidden)
+			return
+		}
+		id, err := a.exchange(r, r.FormValue("code"), st.Nonce)
+		if err != nil {
+			log.Println("oidc login:", err)
+			http.Error(w, "Authentication check failed.", http.StatusForbidden)
+			return
+		}
+		saveSessionIdentity(w, r, id, st.Next)
+	})
+}
+
+// exchange redeems the authorization code and verifies the id token
+func (a *oidcAuth) exchange(r *http.Request, code, nonce string) (*Identity, error) {
+	p, err := a.discover()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {a.redirectURL(r)},
+		"client_id":    {a.ClientID},
+	}
+	req, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+	resp, err := a.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %s: %s", resp.Status, body)
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("token endpoint: %v", err)
+	}
+	claims, err := a.verify(p, token.IDToken, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("id token: nonce does not match")
+	}
+	return a.identity(claims)
+}
+
+// verify checks the signature, issuer, audience and expiry of an RS256
+// signed id token and returns its claims
+func (a *oidcAuth) verify(p *oidcProvider, token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token: malformed")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("id token: unsupported algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("id token: malformed signature")
+	}
+	key, err := a.key(p, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, errors.New("id token: bad signature")
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimRight(iss, "/") != a.Issuer {
+		return nil, fmt.Errorf("id token: issuer is %q", iss)
+	}
+	if !audienceContains(claims["aud"], a.ClientID) {
+		return nil, errors.New("id token: not issued for this client")
+	}
+	if exp, ok := claims["exp"].(float64); !ok || now.After(time.Unix(int64(exp), 0).Add(time.Minute)) {
+		return nil, errors.New("id token: expired")
+	}
+	return claims, nil
+}
+
+func (a *oidcAuth) identity(claims map[string]interface{}) (*Identity, error) {
+	str := func(name string) string {
+		s, _ := claims[name].(string)
+		return s
+	}
+	username := ""
+	if a.UsernameClaim != "" {
+		username = str(a.UsernameClaim)
+	} else {
+		for _, c := range []string{"preferred_username", "email", "sub"} {
+			if username = str(c); username != "" {
+				break
+			}
+		}
+	}
+	if username == "" {
+		return nil, errors.New("id token: no username claim")
+	}
+	return &Identity{
+		Username: username,
+		Email:    str("email"),
+		Name:     str("name"),
+		Provider: "oidc",
+	}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("id token: malformed")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("id token: malformed")
+	}
+	return nil
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, s := range v {
+			if s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthHandler(t *testing.T) {
+	var seen string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = getUser(r)
+	})
+	// alice is only known to the second password backend
+	auths := []Authenticator{
+		newBasicAuth(staticUsers{"bob": "secret"}),
+		newBasicAuth(staticUsers{"alice": "pw", "bob": "other"}),
+	}
+
+	tests := []struct {
+		user, pass string
+		required   bool
+		code       int
+		seen       string
+	}{
+		{"bob", "secret", true, 200, "bob"},
+		{"alice", "pw", true, 200, "alice"},
+		{"bob", "other", true, 200, "bob"},
+		{"bob", "wrong", true, 401, ""},
+		{"alice", "secret", true, 401, ""},
+		{"eve", "secret", false, 401, ""},
+		{"", "", true, 401, ""},
+		{"", "", false, 200, ""},
+	}
+	for _, v := range tests {
+		seen = ""
+		r := httptest.NewRequest("GET", "/", nil)
+		if v.user != "" {
+			r.SetBasicAuth(v.user, v.pass)
+		}
+		w := httptest.NewRecorder()
+		newAuthHandler(auths, v.required, next).ServeHTTP(w, r)
+		if w.Code != v.code || seen != v.seen {
+			t.Fatalf("%s:%s required=%v: got %d %q, want %d %q", v.user, v.pass, v.required, w.Code, seen, v.code, v.seen)
+		}
+	}
+}
+
+// fakeLDAP answers simple binds, the password of every DN is "pw-" + DN in
+// lower case, and searches for the attribute of the first RDN of a DN,
+// which is in lower case like the names of a directory ignoring case
+func fakeLDAP(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					tag, body, err := berRead(conn)
+					if err != nil || tag != 0x30 {
+						return
+					}
+					msg, _ := berSplit(body)
+					id := berInteger(msg[0].value)
+					switch msg[1].tag {
+					case 0x60: // bind
+						bind, _ := berSplit(msg[1].value)
+						dn, pass := string(bind[1].value), string(bind[2].value)
+						code := ldapInvalidCredentials
+						if pass == "pw-"+strings.ToLower(dn) {
+							code = ldapSuccess
+						}
+						resp := append(berInt(0x0a, code), berTLV(0x04, nil)...)
+						resp = append(resp, berTLV(0x04, []byte("diag"))...)
+						conn.Write(berTLV(0x30, append(berInt(0x02, id), berTLV(0x61, resp)...)))
+					case 0x63: // search
+						search, _ := berSplit(msg[1].value)
+						dn := strings.ToLower(string(search[0].value))
+						attrs, _ := berSplit(search[7].value)
+						attr := string(attrs[0].value)
+						value := ""
+						for i := strings.Index(dn, "=") + 1; i < len(dn) && dn[i] != ','; i++ {
+							if dn[i] == '\\' {
+								i++
+							}
+							value += dn[i : i+1]
+						}
+						vals := berTLV(0x31, berTLV(0x04, []byte(value)))
+						partial := berTLV(0x30, append(berTLV(0x04, []byte(attr)), vals...))
+						entry := append(berTLV(0x04, []byte(dn)), berTLV(0x30, partial)...)
+						conn.Write(berTLV(0x30, append(berInt(0x02, id), berTLV(0x64, entry)...)))
+						done := append(berInt(0x0a, ldapSuccess), berTLV(0x04, nil)...)
+						done = append(done, berTLV(0x04, nil)...)
+						conn.Write(berTLV(0x30, append(berInt(0x02, id), berTLV(0x65, done)...)))
+					default: // unbind
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln
+}
+
+func TestLDAPAuth(t *testing.T) {
+	ln := fakeLDAP(t)
+	defer ln.Close()
+	a := &ldapAuth{URL: "ldap://" + ln.Addr().String(), BindDN: "uid=%s,ou=people,dc=example", Timeout: 5 * time.Second}
+	id, err := a.CheckPassword("alice", "pw-uid=alice,ou=people,dc=example")
+	if err != nil || id.Username != "alice" || id.Provider != "ldap" {
+		t.Fatalf("good bind: %v %v", id, err)
+	}
+	if _, err := a.CheckPassword("alice", "wrong"); err != errBadCredentials {
+		t.Fatalf("bad password: %v", err)
+	}
+	if _, err := a.CheckPassword("alice", ""); err != errBadCredentials {
+		t.Fatalf("empty password: %v", err)
+	}
+	// a user name can not change the DN
+	if _, err := a.CheckPassword("x,ou=admins", "pw-uid=x,ou=admins,ou=people,dc=example"); err != errBadCredentials {
+		t.Fatalf("DN injection: %v", err)
+	}
+	if id, err := a.CheckPassword(`x,ou=admins`, `pw-uid=x\,ou\=admins,ou=people,dc=example`); err != nil || id.Username != "x,ou=admins" {
+		t.Fatalf("escaped DN: %v %v", id, err)
+	}
+	// the name of the directory, not the one typed
+	if id, err := a.CheckPassword("ALICE", "pw-uid=alice,ou=people,dc=example"); err != nil || id.Username != "alice" {
+		t.Fatalf("name in upper case: %v %v", id, err)
+	}
+	// without an attribute of its own the name is taken as typed
+	a.BindDN = "%s@example"
+	if id, err := a.CheckPassword("Bob", "pw-bob@example"); err != nil || id.Username != "Bob" {
+		t.Fatalf("name without attribute: %v %v", id, err)
+	}
+}
+
+// fakeIdP is an OpenID Connect provider which signs id tokens with key and
+// issues them to every code
+type fakeIdP struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	nonce string
+	aud   string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{key: key, aud: "ghs"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "ghs" || pass != "s3cret" || r.FormValue("code") != "the-code" {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.token(t, map[string]interface{}{
+			"iss":                idp.URL,
+			"aud":                idp.aud,
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"nonce":              idp.nonce,
+			"sub":                "1234",
+			"preferred_username": "carol",
+			"email":              "carol@example.org",
+		})})
+	})
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *fakeIdP) token(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCAuth(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Close()
+	a := &oidcAuth{Issuer: idp.URL, ClientID: "ghs", ClientSecret: "s3cret"}
+	mux := http.NewServeMux()
+	a.handleLogin(mux)
+
+	// the login page sends the user to the provider
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://files.example/-/login?next=/docs/", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	q := loc.Query()
+	if !strings.HasPrefix(loc.String(), idp.URL+"/authorize?") || q.Get("client_id") != "ghs" ||
+		q.Get("redirect_uri") != "http://files.example/-/oidc/callback" || q.Get("scope") != "openid profile email" {
+		t.Fatalf("login redirect: %s", loc)
+	}
+	cookies := w.Result().Cookies()
+	callback := func(state string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://files.example/-/oidc/callback?code=the-code&state="+state, nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := callback("forged"); w.Code != http.StatusBadRequest {
+		t.Fatalf("callback with bad state: %d", w.Code)
+	}
+	idp.nonce = "other"
+	if w := callback(q.Get("state")); w.Code != http.StatusForbidden {
+		t.Fatalf("callback with bad nonce: %d", w.Code)
+	}
+	idp.nonce = q.Get("nonce")
+	w = callback(q.Get("state"))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/docs/" {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+
+	// the session cookie carries the identity
+	r := httptest.NewRequest("GET", "http://files.example/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	id, err := a.Authenticate(r)
+	if err != nil || id == nil || id.Username != "carol" || id.Email != "carol@example.org" || id.Provider != "oidc" {
+		t.Fatalf("session identity: %+v %v", id, err)
+	}
+
+	// tokens which must be refused
+	p, _ := a.discover()
+	good := map[string]interface{}{"iss": idp.URL, "aud": "ghs", "exp": time.Now().Add(time.Hour).Unix(), "sub": "1"}
+	bad := []func(map[string]interface{}){
+		func(c map[string]interface{}) { c["iss"] = "https://evil.example" },
+		func(c map[string]interface{}) { c["aud"] = []string{"other"} },
+		func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+	}
+	if _, err := a.verify(p, idp.token(t, good), time.Now()); err != nil {
+		t.Fatalf("good token: %v", err)
+	}
+	for i, change := range bad {
+		claims := map[string]interface{}{}
+		for k, v := range good {
+			claims[k] = v
+		}
+		change(claims)
+		if _, err := a.verify(p, idp.token(t, claims), time.Now()); err == nil {
+			t.Fatalf("bad token %d accepted", i)
+		}
+	}
+	token := idp.token(t, good)
+	tampered := token[:strings.LastIndex(token, ".")-2] + "xx" + token[strings.LastIndex(token, "."):]
+	if _, err := a.verify(p, tampered, time.Now()); err == nil {
+		t.Fatal("tampered token accepted")
+	}
+}
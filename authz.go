@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	pathpkg "path"
+	"path/filepath"
+
+	"github.com/gorilla/mux"
+)
+
+// accessCheck reports whether the user of r may do what a route does to the
+// storage name, auth is the access configuration of name
+type accessCheck func(r *http.Request, auth *AccessConf, name string) bool
+
+// access is what a route requires, authorize checks it before the handler
+// runs. Routes without their path in the URL (/-/cmd, the upload sessions
+// and WebDAV) check the paths of the request in their handlers.
+type access struct {
+	target func(r *http.Request) string // path the route works on, nil if none
+	check  accessCheck                  // what the user needs on target
+	login  bool                         // only signed in users
+	admin  bool                         // only admins
+	read   bool                         // with admin, auditors too
+	action string                       // name in the audit log, empty if not audited
+}
+
+var (
+	anyone    = access{}
+	signedIn  = access{login: true}
+	adminOnly = access{login: true, admin: true}
+	auditors  = access{login: true, admin: true, read: true} // admins and auditors
+)
+
+// onPath requires check on the path in the mux variable name
+func onPath(name string, check accessCheck) access {
+	return access{
+		target: func(r *http.Request) string { return mux.Vars(r)[name] },
+		check:  check,
+	}
+}
+
+// audit returns a which also writes the requests to the audit log as action
+func (a access) audit(action string) access {
+	a.action = action
+	return a
+}
+
+// needPerm requires all permissions of p
+func needPerm(p permSet) accessCheck {
+	return func(r *http.Request, auth *AccessConf, name string) bool {
+		return auth.can(r, p)
+	}
+}
+
+// needAnyPerm requires one of the permissions of p at least
+func needAnyPerm(p permSet) accessCheck {
+	return func(r *http.Request, auth *AccessConf, name string) bool {
+		return auth.perms(r)&p != 0
+	}
+}
+
+// canGet reports whether the user of r may download the file name, or list
+// it if it is a directory or the index page is asked for with ?raw=false
+func (s *HTTPStaticServer) canGet(r *http.Request, auth *AccessConf, name string) bool {
+	if r.FormValue("raw") == "false" {
+		return auth.can(r, permList)
+	}
+	if info, err := s.storage.Stat(name); err == nil && info.IsDir() {
+		return auth.can(r, permList)
+	}
+	return auth.can(r, permRead)
+}
+
+// plistTarget is the ipa file of a /-/ipa/plist/ request
+func plistTarget(r *http.Request) string {
+	path := mux.Vars(r)["path"]
+	if filepath.Ext(path) == ".plist" {
+		path = path[0:len(path)-6] + ".ipa"
+	}
+	return path
+}
+
+// authorize is the middleware of all routes. It resolves the access
+// configuration of the path the request is about and serves it with h if
+// the user has what a requires. Internal paths and paths hidden by
+// accessTables answer 404, as if they did not exist. Refused requests of
+// audited routes are logged too.
+func (s *HTTPStaticServer) authorize(a access, h http.HandlerFunc) http.HandlerFunc {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		if (a.login || a.admin) && identityOf(r) == nil {
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		if a.admin && !isAdmin(r) && !(a.read && canAudit(r)) {
+			http.Error(w, "only admins have operation authority", http.StatusForbidden)
+			return
+		}
+		if a.target != nil {
+			path := a.target(r)
+			name := cleanName(path)
+			rec := auditOf(r)
+			rec.Paths = append(rec.Paths, "/"+name)
+			if s.hidden(r, name) {
+				http.NotFound(w, r)
+				return
+			}
+			auth := s.readAccessConf(path, r)
+			if !a.check(r, &auth, name) {
+				http.Error(w, "Access forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		h(w, r)
+	}
+	if a.action != "" {
+		return s.audited(a.action, f)
+	}
+	return f
+}
+
+// hidden reports whether the storage name is internal, or hidden from the
+// user of r
+func (s *HTTPStaticServer) hidden(r *http.Request, name string) bool {
+	return isInternalPath(name) || !s.visible(r, name)
+}
+
+// visible reports whether the accessTables of the directories above the
+// storage name let the user see every part of it
+func (s *HTTPStaticServer) visible(r *http.Request, name string) bool {
+	for ; name != "" && name != "."; name = pathpkg.Dir(name) {
+		auth := s.readAccessConf(pathpkg.Dir(name), r)
+		if !auth.canAccess(pathpkg.Base(name)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizeEndpoints(t *testing.T) {
+	s := permServer(t, map[string]string{
+		".ghs.yml":          "accessTables:\n- regex: ^secret$\n  allow: false\n- regex: \\.key$\n  allow: false\n",
+		"secret/a.txt":      "a",
+		"secret/app.ipa":    "ipa",
+		"secret/a.zip":      "zip",
+		"pub/id.key":        "key",
+		"closed/.ghs.yml":   "noaccess: true\n",
+		"closed/a.txt":      "a",
+		"closed/app.ipa":    "ipa",
+		"closed/a.zip":      "zip",
+		".ghs-owners/x.txt": "x",
+		"hide/secret/a.txt": "a",
+		"wrap/sub/x/a.txt":  "a",
+	})
+
+	// every route which has a path in its URL, with %s for the path
+	routes := []struct {
+		method, url string
+	}{
+		{"GET", "/%s"},
+		{"HEAD", "/%s"},
+		{"DELETE", "/%s"},
+		{"GET", "/-/json/%s"},
+		{"GET", "/-/zip/%s"},
+		{"GET", "/-/unzip/%s/-/a.txt"},
+		{"GET", "/-/checksum/%s"},
+		{"GET", "/-/info/%s"},
+		{"GET", "/-/ipa/link/%s"},
+	}
+	paths := []struct {
+		path string
+		want int
+	}{
+		{"secret/a.txt", 404}, // hidden by the table of its parent
+		{"secret/a.zip", 404},
+		{"pub/id.key", 404},
+		{".ghs-owners/x.txt", 404},
+		{"closed/a.txt", 403},
+		{"closed/a.zip", 403},
+	}
+	for _, route := range routes {
+		for _, p := range paths {
+			target := strings.Replace(route.url, "%s", p.path, 1)
+			if got := permRequest(s, "bob", route.method, target, nil, ""); got != p.want {
+				t.Errorf("%s %s: got %d, want %d", route.method, target, got, p.want)
+			}
+		}
+	}
+
+	tests := []struct {
+		user, method, target string
+		want                 int
+	}{
+		{"bob", "GET", "/secret", 404},
+		{"bob", "GET", "/-/ipa/plist/secret/app.plist", 404},
+		{"bob", "GET", "/-/ipa/plist/closed/app.plist", 403},
+		{"bob", "GET", "/-/webdav/secret/a.txt", 404},
+		{"bob", "PROPFIND", "/-/webdav/secret", 404},
+		{"bob", "GET", "/-/webdav/closed/a.txt", 403},
+		{"", "GET", "/-/webdav/closed/a.txt", 401},
+		{"admin", "GET", "/closed/a.txt", 200},
+		{"admin", "GET", "/pub/id.key", 404}, // hidden from admin too
+		{"bob", "GET", "/-/user/list", 403},
+		{"", "GET", "/-/group/list", 401},
+		{"", "GET", "/-/token/list", 401},
+	}
+	for _, v := range tests {
+		if got := permRequest(s, v.user, v.method, v.target, nil, ""); got != v.want {
+			t.Errorf("%q %s %s: got %d, want %d", v.user, v.method, v.target, got, v.want)
+		}
+	}
+
+	// single child directories are collapsed in listings, hidden ones not
+	r := httptest.NewRequest("GET", "/-/json/", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, withIdentity(r, &Identity{Username: "bob", Provider: "static"}))
+	if body := w.Body.String(); w.Code != 200 || strings.Contains(body, "hide/secret") || !strings.Contains(body, `"wrap/sub/x"`) {
+		t.Errorf("list /: got %d %s", w.Code, body)
+	}
+
+	for dir, want := range map[string]int{"/secret": 404, "/secret/sub": 404, "/closed": 403} {
+		if got := upload(s, "bob", dir, "new.txt"); got != want {
+			t.Errorf("upload to %s: got %d, want %d", dir, got, want)
+		}
+	}
+}
+
+func TestAuthorizeCmd(t *testing.T) {
+	s := permServer(t, map[string]string{
+		".ghs.yml":        "delete: true\naccessTables:\n- regex: ^secret$\n  allow: false\n",
+		"secret/a.txt":    "a",
+		"closed/.ghs.yml": "noaccess: true\n",
+		"closed/a.txt":    "a",
+		"pub/b.txt":       "b",
+	})
+	tests := []struct {
+		body, want string
+	}{
+		{`{"name":"ls","paths":["/secret"]}`, "no such file"},
+		{`{"name":"rm","paths":["/secret/a.txt"]}`, "no such file"},
+		{`{"name":"cp","paths":["/secret/a.txt","/pub"]}`, "no such file"},
+		{`{"name":"ls","paths":["/closed"]}`, "forbidden"},
+		{`{"name":"cp","paths":["/closed/a.txt","/pub"]}`, "forbidden"},
+		{`{"name":"mv","paths":["/pub/b.txt","/secret"]}`, "forbidden"},
+	}
+	for _, v := range tests {
+		r := httptest.NewRequest("POST", "/-/cmd", strings.NewReader(v.body))
+		r = withIdentity(r, &Identity{Username: "bob", Provider: "static"})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if !strings.Contains(w.Body.String(), v.want) {
+			t.Errorf("%s: got %s, want %q", v.body, w.Body.String(), v.want)
+		}
+	}
+}
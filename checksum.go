@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// hashAlgorithms are the algorithms /-/checksum can compute
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// digestAlgorithms maps RFC 3230 digest names to hashAlgorithms
+var digestAlgorithms = map[string]string{
+	"sha-256": "sha256",
+	"sha":     "sha1",
+	"md5":     "md5",
+}
+
+const maxChecksumCacheSize = 10000
+
+type checksumEntry struct {
+	size  int64
+	mtime time.Time
+	sum   []byte
+}
+
+// checksumCache remembers file digests by path and algorithm. An entry is
+// only valid as long as size and mtime of the file did not change.
+type checksumCache struct {
+	mu      sync.Mutex
+	entries map[string]checksumEntry
+}
+
+func (c *checksumCache) get(path, algo string, info os.FileInfo) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[algo+":"+path]
+	if !ok || e.size != info.Size() || !e.mtime.Equal(info.ModTime()) {
+		return nil, false
+	}
+	return e.sum, true
+}
+
+func (c *checksumCache) put(path, algo string, info os.FileInfo, sum []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]checksumEntry)
+	}
+	if len(c.entries) >= maxChecksumCacheSize {
+		// drop an arbitrary entry, map iteration order is random
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[algo+":"+path] = checksumEntry{info.Size(), info.ModTime(), sum}
+}
+
+// fileChecksums returns the digests of a file for all algos, reading the file
+// at most once for those not cached yet.
+func (s *HTTPStaticServer) fileChecksums(name string, algos []string) (map[string][]byte, os.FileInfo, error) {
+	f, err := s.storage.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil, fmt.Errorf("%s is not a file", filepath.Base(name))
+	}
+
+	sums := make(map[string][]byte)
+	hashes := make(map[string]hash.Hash)
+	writers := []io.Writer{}
+	for _, algo := range algos {
+		if sum, ok := s.checksums.get(name, algo, info); ok {
+			sums[algo] = sum
+			continue
+		}
+		h := hashAlgorithms[algo]()
+		hashes[algo] = h
+		writers = append(writers, h)
+	}
+	if len(writers) == 0 {
+		return sums, info, nil
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return nil, nil, err
+	}
+	for algo, h := range hashes {
+		sums[algo] = h.Sum(nil)
+		s.checksums.put(name, algo, info, sums[algo])
+	}
+	return sums, info, nil
+}
+
+func (s *HTTPStaticServer) hChecksum(w http.ResponseWriter, r *http.Request) {
+	path := mux.Vars(r)["path"]
+	algos := []string{}
+	for _, algo := range strings.Split(r.FormValue("algo"), ",") {
+		algo = strings.ToLower(strings.TrimSpace(algo))
+		if algo == "" {
+			continue
+		}
+		if _, ok := hashAlgorithms[algo]; !ok {
+			http.Error(w, fmt.Sprintf("unsupported algorithm: %s", algo), http.StatusBadRequest)
+			return
+		}
+		algos = append(algos, algo)
+	}
+	if len(algos) == 0 {
+		algos = []string{"sha256"}
+	}
+
+	sums, info, err := s.fileChecksums(cleanName(path), algos)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, s.relError(err), http.StatusBadRequest)
+		return
+	}
+
+	checksums := make(map[string]string)
+	for algo, sum := range sums {
+		checksums[algo] = hex.EncodeToString(sum)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":      filepath.ToSlash(filepath.Clean("/" + path)),
+		"size":      info.Size(),
+		"mtime":     info.ModTime().UnixNano() / 1e6,
+		"checksums": checksums,
+	})
+}
+
+// wantDigest picks the first supported algorithm of a Want-Digest header,
+// e.g. "sha-256;q=1, md5;q=0.5".
+func wantDigest(header string) string {
+	for _, field := range strings.Split(header, ",") {
+		name := strings.ToLower(strings.TrimSpace(strings.SplitN(field, ";", 2)[0]))
+		if _, ok := digestAlgorithms[name]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// setDigestHeader answers a Want-Digest request header with the Digest of
+// the whole file, so clients can verify ranged or resumed downloads.
+func (s *HTTPStaticServer) setDigestHeader(w http.ResponseWriter, r *http.Request, name string) {
+	digest := wantDigest(r.Header.Get("Want-Digest"))
+	if digest == "" {
+		return
+	}
+	algo := digestAlgorithms[digest]
+	sums, _, err := s.fileChecksums(name, []string{algo})
+	if err != nil {
+		return
+	}
+	w.Header().Set("Digest", digest+"="+base64.StdEncoding.EncodeToString(sums[algo]))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChecksum(t *testing.T) {
+	s := permServer(t, map[string]string{
+		"d/f.txt": "hello",
+	})
+	checksums := func(target string) (int, map[string]string) {
+		r := httptest.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		resp := struct {
+			Checksums map[string]string `json:"checksums"`
+		}{}
+		if w.Code == 200 {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, resp.Checksums
+	}
+
+	code, sums := checksums("/-/checksum/d/f.txt?algo=md5,SHA1,sha256")
+	want := map[string]string{
+		"md5":    "5d41402abc4b2a76b9719d911017c592",
+		"sha1":   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		"sha256": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}
+	if code != 200 || len(sums) != len(want) {
+		t.Fatalf("all algorithms: got %d %v", code, sums)
+	}
+	for algo, sum := range want {
+		if sums[algo] != sum {
+			t.Errorf("%s: got %s, want %s", algo, sums[algo], sum)
+		}
+	}
+	if _, sums := checksums("/-/checksum/d/f.txt"); len(sums) != 1 || sums["sha256"] != want["sha256"] {
+		t.Errorf("default algorithm: got %v", sums)
+	}
+	if code, _ := checksums("/-/checksum/d/f.txt?algo=crc32"); code != 400 {
+		t.Errorf("bad algorithm: got %d, want 400", code)
+	}
+	if code, _ := checksums("/-/checksum/d/missing.txt"); code != 404 {
+		t.Errorf("missing file: got %d, want 404", code)
+	}
+	if code, _ := checksums("/-/checksum/d"); code != 400 {
+		t.Errorf("directory: got %d, want 400", code)
+	}
+
+	for header, digest := range map[string]string{
+		"sha-256":                 "sha-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=",
+		"unixsum, md5;q=0.5, sha": "md5=XUFAKrxLKna5cZ2REBfFkg==",
+		"unixsum":                 "",
+	} {
+		r := httptest.NewRequest("GET", "/d/f.txt", nil)
+		r.Header.Set("Want-Digest", header)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if got := w.Header().Get("Digest"); w.Code != 200 || got != digest {
+			t.Errorf("Want-Digest %s: got %d %q, want %q", header, w.Code, got, digest)
+		}
+	}
+
+	// the cache is only used while size and mtime stay the same
+	name := filepath.Join(s.Root, "d", "f.txt")
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte("HELLO"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(name, info.ModTime(), info.ModTime())
+	if _, sums := checksums("/-/checksum/d/f.txt?algo=sha256"); sums["sha256"] != want["sha256"] {
+		t.Errorf("cached sum: got %v", sums)
+	}
+	if err := ioutil.WriteFile(name, []byte("hello!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := info.ModTime().Add(time.Minute)
+	os.Chtimes(name, mtime, mtime)
+	changed := "ce06092fb948d9ffac7d1a376e404b26b7575bcc11ee05a4615fef4fec3a308b"
+	if _, sums := checksums("/-/checksum/d/f.txt?algo=sha256"); sums["sha256"] != changed {
+		t.Errorf("changed file: got %s, want %s", sums["sha256"], changed)
+	}
+}
@@ -0,0 +1,261 @@
+/*
+Author: lkong
+Description: test cmd tool
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"grapehttp/client/cmd/templates"
+	cmdutil "grapehttp/client/cmd/util"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/cobra"
+)
+
+// aclCheck is the answer of /-/acl/check
+type aclCheck struct {
+	Path   string   `json:"path"`
+	User   string   `json:"user"`
+	Groups []string `json:"groups"`
+	Hidden bool     `json:"hidden"`
+	Rule   string   `json:"rule"`
+	Perms  []string `json:"perms"`
+	Files  []string `json:"files"`
+	Errors []string `json:"errors"`
+}
+
+// aclResponse is the answer of /-/acl/get, set and patch
+type aclResponse struct {
+	Path   string          `json:"path"`
+	Exists bool            `json:"exists"`
+	ACL    json.RawMessage `json:"acl"`
+	Error  string          `json:"error"`
+}
+
+// aclPatch is the body of /-/acl/patch
+type aclPatch struct {
+	User   string   `json:"user,omitempty"`
+	Group  string   `json:"group,omitempty"`
+	Grant  []string `json:"grant,omitempty"`
+	Revoke []string `json:"revoke,omitempty"`
+	Remove bool     `json:"remove,omitempty"`
+}
+
+var (
+	aclExample = templates.Examples(`
+		# Explain what bob may do in /lkong
+		fctl acl check /lkong bob
+
+		# Explain your own permissions
+		fctl acl check /lkong/api.log
+
+		# Show the .ghs.yml of a directory, edit and replace it
+		fctl acl get /lkong > ghs.yml
+		fctl acl set /lkong ghs.yml
+
+		# Let bob upload, and take delete from the group devs
+		fctl acl grant /lkong write --user bob
+		fctl acl revoke /lkong delete --group devs
+
+		# Drop the entry of bob
+		fctl acl revoke /lkong --user bob`)
+)
+
+func NewCmdACL(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "acl",
+		Short: "Inspect and change the access rules of .ghs.yml",
+		Long: `Inspect and change the access rules of the .ghs.yml files. Changing the
+rules of a directory needs the admin permission on it.`,
+		Example: aclExample,
+		Run:     runHelp,
+	}
+	cmd.AddCommand(NewCmdACLCheck(f, out, cmdErr))
+	cmd.AddCommand(NewCmdACLGet(f, out, cmdErr))
+	cmd.AddCommand(NewCmdACLSet(f, out, cmdErr))
+	cmd.AddCommand(NewCmdACLPatch(f, out, cmdErr, "grant", "Grant permissions to a user, a group or everybody"))
+	cmd.AddCommand(NewCmdACLPatch(f, out, cmdErr, "revoke", "Revoke permissions, or drop the entry of a user or group"))
+	return cmd
+}
+
+// aclRequest sends body to the acl endpoint name for the directory dir
+func aclRequest(f cmdutil.Factory, name, dir string, body interface{}) (*aclResponse, error) {
+	request := f.Gorequest()
+	query := url.Values{}
+	query.Set("path", dir)
+	target := "http://" + f.Server + "/-/acl/" + name + "?" + query.Encode()
+	if body == nil {
+		request = request.Get(target)
+	} else {
+		request = request.Post(target).Type("json").Send(body)
+	}
+	resp, data, errs := request.Set("Authorization", f.Authorization()).End()
+	if err := cmdutil.CombineRequestErr(resp, data, errs); err != nil {
+		return nil, err
+	}
+	ar := &aclResponse{}
+	if err := json.Unmarshal([]byte(data), ar); err != nil {
+		return nil, err
+	}
+	return ar, nil
+}
+
+// printACL writes the .ghs.yml of the answer as YAML
+func printACL(out io.Writer, ar *aclResponse) error {
+	if !ar.Exists {
+		fmt.Fprintf(out, "# %s has no .ghs.yml, its rules are inherited\n", ar.Path)
+		return nil
+	}
+	if ar.Error != "" {
+		return fmt.Errorf("%s/.ghs.yml: %s", strings.TrimSuffix(ar.Path, "/"), ar.Error)
+	}
+	data, err := yaml.JSONToYAML(ar.ACL)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "# %s/.ghs.yml\n%s", strings.TrimSuffix(ar.Path, "/"), data)
+	return nil
+}
+
+func NewCmdACLGet(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "get REMOTE_DIR",
+		Short: "Print the .ghs.yml of a directory",
+		Long:  "Print the .ghs.yml of a directory as YAML",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			ar, err := aclRequest(f, "get", args[0], nil)
+			cmdutil.CheckErr(err)
+			cmdutil.CheckErr(printACL(out, ar))
+		},
+	}
+	return cmd
+}
+
+func NewCmdACLSet(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "set REMOTE_DIR FILE",
+		Short: "Replace the .ghs.yml of a directory",
+		Long: `Replace the .ghs.yml of a directory with a local YAML or JSON file, - reads
+standard input. The server checks the rules before it writes them.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 2 {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			var data []byte
+			var err error
+			if args[1] == "-" {
+				data, err = ioutil.ReadAll(os.Stdin)
+			} else {
+				data, err = ioutil.ReadFile(args[1])
+			}
+			cmdutil.CheckErr(err)
+			body, err := yaml.YAMLToJSON(data)
+			cmdutil.CheckErr(err)
+			if strings.TrimSpace(string(body)) == "null" {
+				body = []byte("{}")
+			}
+			ar, err := aclRequest(f, "set", args[0], string(body))
+			cmdutil.CheckErr(err)
+			cmdutil.CheckErr(printACL(out, ar))
+		},
+	}
+	return cmd
+}
+
+func NewCmdACLPatch(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, name, short string) *cobra.Command {
+	use := name + " REMOTE_DIR PERM [PERM...]"
+	if name == "revoke" {
+		use = name + " REMOTE_DIR [PERM...]"
+	}
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: short,
+		Long: short + `. Without --user or --group the defaults of the directory are
+changed. Permissions are read, list, write, overwrite, rename, delete,
+delete-own, share and admin.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) < 1 || (name == "grant" && len(args) < 2) {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			patch := aclPatch{
+				User:  cmdutil.GetFlagString(cmd, "user"),
+				Group: cmdutil.GetFlagString(cmd, "group"),
+			}
+			if name == "grant" {
+				patch.Grant = args[1:]
+			} else if len(args) > 1 {
+				patch.Revoke = args[1:]
+			} else {
+				patch.Remove = true
+			}
+			ar, err := aclRequest(f, "patch", args[0], patch)
+			cmdutil.CheckErr(err)
+			cmdutil.CheckErr(printACL(out, ar))
+		},
+	}
+	cmd.Flags().String("user", "", "change the entry of this user")
+	cmd.Flags().String("group", "", "change the entry of this group")
+	return cmd
+}
+
+func NewCmdACLCheck(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "check REMOTE_PATH [USERNAME]",
+		Short: "Explain the permissions of a user on a path",
+		Long: `Explain the permissions of a user on a path: the rule which applies and
+the .ghs.yml files it comes from. Only admins and auditors can check other
+users.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) < 1 || len(args) > 2 {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			query := url.Values{}
+			query.Set("path", args[0])
+			if len(args) == 2 {
+				query.Set("user", args[1])
+			}
+			request := f.Gorequest()
+			resp, body, errs := request.Get("http://"+f.Server+"/-/acl/check").
+				Set("Authorization", f.Authorization()).
+				Query(query.Encode()).
+				End()
+			cmdutil.CheckErr(cmdutil.CombineRequestErr(resp, body, errs))
+
+			c := aclCheck{}
+			cmdutil.CheckErr(json.Unmarshal([]byte(body), &c))
+			printACLCheck(out, c)
+		},
+	}
+	return cmd
+}
+
+func printACLCheck(out io.Writer, c aclCheck) {
+	fmt.Fprintf(out, "Path:   %s\n", c.Path)
+	fmt.Fprintf(out, "User:   %s\n", c.User)
+	fmt.Fprintf(out, "Groups: %s\n", strings.Join(c.Groups, ","))
+	if c.Hidden {
+		fmt.Fprintf(out, "Hidden: yes, by accessTables\n")
+	}
+	fmt.Fprintf(out, "Rule:   %s\n", c.Rule)
+	fmt.Fprintf(out, "Perms:  %s\n", strings.Join(c.Perms, ","))
+	if len(c.Files) == 0 {
+		fmt.Fprintf(out, "Files:  none, the defaults of the server\n")
+	} else {
+		fmt.Fprintf(out, "Files:  %s\n", strings.Join(c.Files, " "))
+	}
+	for _, e := range c.Errors {
+		fmt.Fprintf(out, "Error:  %s\n", e)
+	}
+}
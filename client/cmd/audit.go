@@ -0,0 +1,124 @@
+/*
+Author: lkong
+Description: test cmd tool
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"grapehttp/client/cmd/templates"
+	cmdutil "grapehttp/client/cmd/util"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// auditRecord is a record of the audit log as the server answers it
+type auditRecord struct {
+	Time   time.Time              `json:"time"`
+	User   string                 `json:"user"`
+	IP     string                 `json:"ip"`
+	Action string                 `json:"action"`
+	Paths  []string               `json:"paths,omitempty"`
+	Target string                 `json:"target,omitempty"`
+	Detail map[string]interface{} `json:"detail,omitempty"`
+	Status int                    `json:"status"`
+	Result string                 `json:"result"`
+	Bytes  int64                  `json:"bytes"`
+}
+
+var (
+	auditExample = templates.Examples(`
+		# What happened in the last 24 hours
+		fctl audit --since 24h
+
+		# Everything bob did, or which was done to bob, this week
+		fctl audit --user bob --since 7d
+
+		# The deletes below /lkong, as JSON lines
+		fctl audit --path /lkong --action delete -o json`)
+)
+
+func NewCmdAudit(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Show the audit log (admins and auditors)",
+		Long: `Show the audit log of the file, user and access rule changes, the last
+--limit records which match all of the filters.`,
+		Example: auditExample,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 0 {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			cmdutil.CheckErr(runAudit(f, out, cmd))
+		},
+	}
+	cmd.Flags().String("user", "", "records of this user, or about this user")
+	cmd.Flags().String("path", "", "records of this path and the paths below it")
+	cmd.Flags().String("action", "", "records of this action, e.g. upload, delete, cmd or user.add")
+	cmd.Flags().String("since", "", "records since a time or a duration ago, e.g. 12h, 7d or 2024-12-31")
+	cmd.Flags().Int("limit", 100, "number of records")
+	cmd.Flags().StringP("output", "o", "", "output format, one of <table|json>")
+	return cmd
+}
+
+func runAudit(f cmdutil.Factory, out io.Writer, cmd *cobra.Command) error {
+	query := url.Values{}
+	for _, name := range []string{"user", "path", "action", "since"} {
+		if v := cmdutil.GetFlagString(cmd, name); v != "" {
+			query.Set(name, v)
+		}
+	}
+	query.Set("limit", strconv.Itoa(cmdutil.GetFlagInt(cmd, "limit")))
+	request := f.Gorequest()
+	resp, body, errs := request.Get("http://"+f.Server+"/-/audit").
+		Set("Authorization", f.Authorization()).
+		Query(query.Encode()).
+		End()
+	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+		return fmt.Errorf("%s", strings.TrimRight(err.Error(), "\n"))
+	}
+	records := []auditRecord{}
+	if err := json.Unmarshal([]byte(body), &records); err != nil {
+		return err
+	}
+
+	switch output := cmdutil.GetFlagString(cmd, "output"); output {
+	case "json":
+		enc := json.NewEncoder(out)
+		for _, rec := range records {
+			enc.Encode(rec)
+		}
+		return nil
+	case "", "table":
+	default:
+		return cmdutil.UsageErrorf(cmd, "unknown output format %q", output)
+	}
+
+	table := tablewriter.NewWriter(out)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetColWidth(TABLE_WIDTH)
+	table.SetHeader([]string{"Time", "User", "IP", "Action", "Paths", "Target", "Result", "Bytes"})
+	for _, rec := range records {
+		result := rec.Result
+		if rec.Status != 200 {
+			result += " " + strconv.Itoa(rec.Status)
+		}
+		bytes := "-"
+		if rec.Bytes > 0 {
+			bytes = humanSize(rec.Bytes)
+		}
+		table.Append([]string{rec.Time.Local().Format("2006-01-02 15:04:05"), rec.User, rec.IP, rec.Action,
+			strings.Join(rec.Paths, " "), rec.Target, result, bytes})
+	}
+	table.Render()
+	return nil
+}
@@ -0,0 +1,162 @@
+/*
+Author: lkong
+Description: test cmd tool
+*/
+
+package cmd
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"grapehttp/client/cmd/templates"
+	cmdutil "grapehttp/client/cmd/util"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+type ChecksumOptions struct {
+	algo string
+}
+
+// remoteChecksum is the answer of /-/checksum
+type remoteChecksum struct {
+	Path      string            `json:"path"`
+	Size      int64             `json:"size"`
+	Mtime     int64             `json:"mtime"`
+	Checksums map[string]string `json:"checksums"`
+}
+
+var (
+	checksumExample = templates.Examples(`
+		# Print the sha256 checksum of a remote file
+		fctl checksum /lkong/api.log
+
+		# Print md5 checksums of multiple files
+		fctl checksum -a md5 /test.txt /lkong/api.log`)
+)
+
+func NewCmdChecksum(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "checksum REMOTE_FILE [REMOTE_FILE]",
+		Short:   "Print checksums of remote files",
+		Long:    "Print checksums of remote files, computed by the server",
+		Example: checksumExample,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) < 1 {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			options := new(ChecksumOptions)
+			cmdutil.CheckErr(options.Complete(cmd))
+			cmdutil.CheckErr(options.Run(f, out, cmdErr, args))
+			return
+		},
+		Aliases: []string{"sum"},
+	}
+
+	cmd.Flags().StringP("algorithm", "a", "sha256", "checksum `algorithm`, one of md5, sha1, sha256")
+	return cmd
+}
+
+func (o *ChecksumOptions) Complete(cmd *cobra.Command) error {
+	o.algo = strings.ToLower(cmdutil.GetFlagString(cmd, "algorithm"))
+	if newHash(o.algo) == nil {
+		return fmt.Errorf("unsupported algorithm: %s", o.algo)
+	}
+	return nil
+}
+
+func (o *ChecksumOptions) Run(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, args []string) error {
+	failed := 0
+	for _, name := range args {
+		sum, err := getRemoteChecksum(f, name, o.algo)
+		if err != nil {
+			color.Yellow("%s: %v", name, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(out, "%s  %s\n", sum, name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checksums failed", failed, len(args))
+	}
+	return nil
+}
+
+// getRemoteChecksum asks the server for the hex digest of remotePath.
+func getRemoteChecksum(f cmdutil.Factory, remotePath, algo string) (string, error) {
+	request := f.Gorequest()
+	resp, body, errs := request.Get("http://"+f.Server+"/-/checksum"+escapePath(remotePath)).
+		Set("Authorization", f.Authorization()).
+		Query("algo=" + algo).
+		End()
+
+	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+		return "", fmt.Errorf("%s", strings.TrimRight(err.Error(), "\n"))
+	}
+
+	rc := &remoteChecksum{}
+	if err := json.Unmarshal([]byte(body), rc); err != nil {
+		return "", err
+	}
+	sum, ok := rc.Checksums[algo]
+	if !ok {
+		return "", fmt.Errorf("server did not return a %s checksum", algo)
+	}
+	return sum, nil
+}
+
+// newHash accepts both plain names and the RFC 3230 names of the Digest header.
+func newHash(algo string) hash.Hash {
+	switch algo {
+	case "sha256", "sha-256":
+		return sha256.New()
+	case "sha1", "sha":
+		return sha1.New()
+	case "md5":
+		return md5.New()
+	}
+	return nil
+}
+
+// fileChecksum returns the digest of a local file.
+func fileChecksum(filename, algo string) ([]byte, error) {
+	h := newHash(algo)
+	if h == nil {
+		return nil, fmt.Errorf("unsupported algorithm: %s", algo)
+	}
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	if _, err := io.Copy(h, fh); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyRemoteChecksum compares a local file with the remote copy.
+func verifyRemoteChecksum(f cmdutil.Factory, filename, remotePath string) error {
+	remote, err := getRemoteChecksum(f, remotePath, "sha256")
+	if err != nil {
+		return fmt.Errorf("verify: %v", err)
+	}
+	local, err := fileChecksum(filename, "sha256")
+	if err != nil {
+		return fmt.Errorf("verify: %v", err)
+	}
+	if hex.EncodeToString(local) != remote {
+		return fmt.Errorf("sha256 checksum mismatch, local %s remote %s", hex.EncodeToString(local), remote)
+	}
+	return nil
+}
@@ -202,6 +202,9 @@ func NewFctlCommand(f cmdutil.Factory, in io.Reader, out, err io.Writer) *cobra.
 				NewCmdRm(f, out, err),
 				NewCmdUpload(f, out, err),
 				NewCmdDownload(f, out, err),
+				NewCmdChecksum(f, out, err),
+				NewCmdSync(f, out, err),
+				NewCmdFind(f, out, err),
 			},
 		},
 		{
@@ -215,6 +218,14 @@ func NewFctlCommand(f cmdutil.Factory, in io.Reader, out, err io.Writer) *cobra.
 				NewCmdUserList(f, out, err),
 				NewCmdUserEnable(f, out, err),
 				NewCmdUserDisable(f, out, err),
+				NewCmdLogin(f, out, err),
+				NewCmdWhoami(f, out, err),
+				NewCmdPasswd(f, out, err),
+				NewCmdQuota(f, out, err),
+				NewCmdToken(f, out, err),
+				NewCmdGroup(f, out, err),
+				NewCmdACL(f, out, err),
+				NewCmdAudit(f, out, err),
 			},
 		},
 	}
@@ -1,10 +1,16 @@
 package cmd
 
 import (
+	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	cmdutil "grapehttp/client/cmd/util"
+
 	"github.com/asaskevich/govalidator"
+	"github.com/spf13/cobra"
 )
 
 type user struct {
@@ -19,6 +25,9 @@ type user struct {
 	Lastlogintime time.Time `json:"lastLoginTime"`
 	Createtime    time.Time `json:"createTime"`
 	Lastip        string    `json:"lastip"`
+	Role          string    `json:"role,omitempty"`
+	QuotaBytes    *int64    `json:"quotaBytes,omitempty"`
+	QuotaFiles    *int64    `json:"quotaFiles,omitempty"`
 }
 
 const (
@@ -33,3 +42,50 @@ func isUsername(username string) bool {
 func isEmail(email string) bool {
 	return govalidator.IsEmail(email)
 }
+
+func isRole(role string) bool {
+	return role == "admin" || role == "auditor" || role == "user"
+}
+
+// parseSize parses sizes like 100, 1.5K or 10G as the server does, units
+// are powers of 1024
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	num := strings.TrimSuffix(strings.ToUpper(s), "B")
+	if n := len(num); n > 0 {
+		if i := strings.IndexByte("KMGTP", num[n-1]); i >= 0 {
+			mult = int64(1) << (10 * uint(i+1))
+			num = num[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return int64(f * float64(mult)), nil
+}
+
+func addQuotaFlags(cmd *cobra.Command) {
+	cmd.Flags().String("quota-bytes", "", "Specify the most bytes the user may own, like 10G, 0 for no limit.")
+	cmd.Flags().Int64("quota-files", 0, "Specify the most files the user may own, 0 for no limit.")
+}
+
+// quotaFlags returns the quotas given with --quota-bytes and --quota-files,
+// nil for those which are not given
+func quotaFlags(cmd *cobra.Command) (bytes, files *int64, err error) {
+	if cmd.Flags().Changed("quota-bytes") {
+		n, err := parseSize(cmdutil.GetFlagString(cmd, "quota-bytes"))
+		if err != nil {
+			return nil, nil, err
+		}
+		bytes = &n
+	}
+	if cmd.Flags().Changed("quota-files") {
+		n, _ := cmd.Flags().GetInt64("quota-files")
+		if n < 0 {
+			return nil, nil, fmt.Errorf("--quota-files can not be negative")
+		}
+		files = &n
+	}
+	return bytes, files, nil
+}
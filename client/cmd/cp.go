@@ -19,13 +19,13 @@ import (
 var (
 	cpExample = templates.Examples(i18n.T(`
 		# Copy files and directories
-		gctl cp /A /
+		fctl cp /A /
 
 		# Do not prompt before overwriting.
-		gctl cp -f /A /
+		fctl cp -f /A /
 
 		# Copy directories recursively
-		gctl cp -r /dir1 /dir2`))
+		fctl cp -r /dir1 /dir2`))
 )
 
 func NewCmdCp(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
@@ -45,39 +45,30 @@ func NewCmdCp(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command
 	}
 
 	cmd.Flags().BoolP("force", "f", false, "do not prompt before overwriting.")
-	cmd.Flags().BoolP("archive", "a", false, "same as -dR --preserve=all.")
+	cmd.Flags().BoolP("archive", "a", false, "same as -r.")
 	cmd.Flags().BoolP("recursive", "r", false, "copy directories recursively.")
 	return cmd
 }
 
 func RunCp(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, cmd *cobra.Command, args []string) error {
-	cmdArgs := []string{}
-	if cmdutil.GetFlagBool(cmd, "force") {
-		cmdArgs = append(cmdArgs, "-f")
-	}
-	if cmdutil.GetFlagBool(cmd, "archive") {
-		cmdArgs = append(cmdArgs, "-a")
-	}
-	if cmdutil.GetFlagBool(cmd, "recursive") {
-		cmdArgs = append(cmdArgs, "-r")
+	req := cmdRequest{
+		Name:  "cp",
+		Paths: args,
+		Options: cmdOptions{
+			Force:     cmdutil.GetFlagBool(cmd, "force"),
+			Recursive: cmdutil.GetFlagBool(cmd, "recursive") || cmdutil.GetFlagBool(cmd, "archive"),
+		},
 	}
 
-	req := struct {
-		Name  string   `json:"name"`
-		Args  []string `json:"args"`
-		Paths []string `json:"paths"`
-	}{"cp", cmdArgs, args}
-
-	request := f.Gorequest()
-	resp, body, errs := request.Get("http://"+f.Server+"/-/cmd").
-		Set("Authorization", "Basic "+f.Auth()).
-		Send(req).
-		End()
-
-	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+	res, err := runServerCmd(f, req)
+	if err != nil {
 		return err
 	}
 
-	fmt.Printf("%s", body)
-	return nil
+	for _, result := range res.Results {
+		if result.Error == "" {
+			fmt.Fprintf(out, "%s -> %s\n", result.Path, result.Dest)
+		}
+	}
+	return res.reportErrors(cmdErr)
 }
@@ -6,13 +6,19 @@ Description: test cmd tool
 package cmd
 
 import (
+	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"grapehttp/client/cmd/templates"
 	cmdutil "grapehttp/client/cmd/util"
@@ -24,7 +30,28 @@ import (
 )
 
 type DownloadOptions struct {
-	output string
+	output    string
+	parallel  int
+	minSplit  int64
+	verify    bool
+	recursive bool
+	jobs      int
+}
+
+// remoteFile is what a HEAD request tells about a file before downloading it
+type remoteFile struct {
+	size         int64
+	modTime      time.Time
+	acceptRanges bool
+	digestAlgo   string
+	digest       []byte
+	validator    string // ETag, or else Last-Modified, for If-Range
+}
+
+// segment is a byte range of the remote file, downloaded into its own part file
+type segment struct {
+	start, end int64 // inclusive
+	partName   string
 }
 
 var (
@@ -36,14 +63,23 @@ var (
 		fctl download /api.log -o /data
 
 		# Download multiple files from different directory
-		fctl download /test.txt /lkong/api.log`)
+		fctl download /test.txt /lkong/api.log
+
+		# Mirror a remote directory into /data/lkong
+		fctl download -r /lkong -o /data
+
+		# Download a large file in 4 parallel segments
+		fctl download -n 4 /lkong/image.iso
+
+		# Compare the downloaded file with the server checksum
+		fctl download --verify /lkong/api.log`)
 )
 
 func NewCmdDownload(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:     "download REMOTE_FILE LOCAL_FILE",
 		Short:   "Download files from remote http server",
-		Long:    "Download files from remote http server",
+		Long:    "Download files from remote http server, interrupted downloads are resumed from their .part files",
 		Example: downloadExample,
 		Run: func(cmd *cobra.Command, args []string) {
 			if len(args) < 1 {
@@ -58,65 +94,119 @@ func NewCmdDownload(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.C
 	}
 
 	cmd.Flags().StringP("output", "o", ".", "download file to `output` directory, default .")
+	cmd.Flags().IntP("parallel", "n", 1, "split each file into `N` concurrently downloaded segments")
+	cmd.Flags().Int64("min-split", 64, "only split files larger than this size in MiB")
+	cmd.Flags().Bool("verify", false, "compare the sha256 checksum of each file with the server, fail on mismatch")
+	cmd.Flags().BoolP("recursive", "r", false, "download directories and their contents recursively")
+	cmd.Flags().IntP("jobs", "j", 4, "download at most `N` files at the same time")
 	return cmd
 }
 
 func (o *DownloadOptions) Complete(cmd *cobra.Command) error {
 	o.output = cmdutil.GetFlagString(cmd, "output")
+	o.parallel = cmdutil.GetFlagInt(cmd, "parallel")
+	o.minSplit = cmdutil.GetFlagInt64(cmd, "min-split") << 20
+	o.verify = cmdutil.GetFlagBool(cmd, "verify")
+	o.recursive = cmdutil.GetFlagBool(cmd, "recursive")
+	o.jobs = cmdutil.GetFlagInt(cmd, "jobs")
+	if o.parallel < 1 {
+		return fmt.Errorf("--parallel must be at least 1")
+	}
+	if o.jobs < 1 {
+		return fmt.Errorf("--jobs must be at least 1")
+	}
 	return nil
 }
 
 func (o *DownloadOptions) Run(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, args []string) error {
-	var wg sync.WaitGroup
-	p := mpb.New(mpb.WithWaitGroup(&wg))
+	p := mpb.New()
 
+	report := &transferReport{}
+	jobs := []downloadJob{}
 	for _, name := range args {
-		url := "http://" + f.Server + name
-		wg.Add(1)
-		go o.download(f, &wg, p, path.Base(name), url)
+		if o.recursive {
+			jobs = append(jobs, collectDownloads(f, report, o.output, name)...)
+		} else {
+			jobs = append(jobs, downloadJob{path.Base(name), name})
+		}
 	}
 
-	wg.Wait()
+	runParallel(o.jobs, len(jobs), func(i int) {
+		if err := o.download(f, p, jobs[i].name, jobs[i].remotePath); err != nil {
+			report.fail(jobs[i].remotePath, err)
+		} else {
+			report.ok()
+		}
+	})
 	p.Stop()
-	return nil
+	return report.finish(out, "downloaded", o.recursive)
 }
 
-func (o DownloadOptions) download(f cmdutil.Factory, wg *sync.WaitGroup, p *mpb.Progress, name, url string) error {
-	defer wg.Done()
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+func headRemoteFile(f cmdutil.Factory, remotePath string) (*remoteFile, error) {
+	req, err := f.NewRequest("HEAD", escapePath(remotePath), nil)
 	if err != nil {
-		color.Yellow("%s: %v", name, err)
-		return err
+		return nil, err
 	}
-
-	req.Header.Set("Authorization", "Basic "+f.Auth())
-	req.Header.Set("Username", f.Username)
-	resp, err := client.Do(req)
+	req.Header.Set("Want-Digest", "sha-256, md5;q=0.5")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		color.Yellow("%s: %v", name, err)
-		return fmt.Errorf("%s: %v", name, err)
+		return nil, err
 	}
-	defer resp.Body.Close()
-
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		color.Yellow("%s: %v", name, resp.Status)
-		return fmt.Errorf("%s: %v", name, err)
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("%s is not a file", remotePath)
 	}
 
-	size := resp.ContentLength
+	rf := &remoteFile{
+		size:         resp.ContentLength,
+		acceptRanges: resp.Header.Get("Accept-Ranges") == "bytes",
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		rf.modTime = t
+	}
+	rf.validator = resp.Header.Get("ETag")
+	if rf.validator == "" {
+		rf.validator = resp.Header.Get("Last-Modified")
+	}
+	if digest := strings.SplitN(resp.Header.Get("Digest"), "=", 2); len(digest) == 2 {
+		if sum, err := base64.StdEncoding.DecodeString(digest[1]); err == nil {
+			rf.digestAlgo, rf.digest = strings.ToLower(digest[0]), sum
+		}
+	}
+	return rf, nil
+}
 
-	// create dest
-	destName := filepath.Base(url)
-	dest, err := os.Create(filepath.Join(o.output, destName))
+// download fetches remotePath into the output directory. Data is written to
+// .part files which are kept on failure, so the next run continues where this
+// one stopped. The result is checked against the server digest before it is
+// renamed to its final name, which gets the modification time of the server.
+func (o DownloadOptions) download(f cmdutil.Factory, p *mpb.Progress, name, remotePath string) error {
+	rf, err := headRemoteFile(f, remotePath)
 	if err != nil {
-		err = fmt.Errorf("Can't create %s: %v", destName, err)
-		color.Yellow("%s: %v", name, resp.Status)
+		color.Yellow("%s: %v", name, err)
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	destName := filepath.Join(o.output, name)
+	partName := destName + ".part"
+	segments := []segment{{0, rf.size - 1, partName}}
+	if o.parallel > 1 && rf.acceptRanges && rf.size >= o.minSplit && rf.size > int64(o.parallel) {
+		segments = splitSegments(partName, rf.size, o.parallel)
+	}
+	if err := checkPartValidator(partName, rf.validator); err != nil {
+		color.Yellow("%s: %v", name, err)
 		return fmt.Errorf("%s: %v", name, err)
 	}
 
 	// create bar with appropriate decorators
-	bar := p.AddBar(size,
+	bar := p.AddBar(rf.size,
 		mpb.PrependDecorators(
 			decor.StaticName(color.CyanString(name), 0, 0),
 			decor.Counters("%3s / %3s", decor.Unit_KiB, 18, decor.DSyncSpace),
@@ -127,19 +217,218 @@ func (o DownloadOptions) download(f cmdutil.Factory, wg *sync.WaitGroup, p *mpb.
 		p.RemoveBar(bar)
 	}
 
+	var wg sync.WaitGroup
+	errs := make([]error, len(segments))
+	for i := range segments {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fetchSegment(f, bar, remotePath, segments[i], rf)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			p.RemoveBar(bar)
+			color.Yellow("%s: %v", name, err)
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if len(segments) > 1 {
+		if err := joinSegments(partName, segments); err != nil {
+			p.RemoveBar(bar)
+			color.Yellow("%s: %v", name, err)
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	verify := func() error {
+		if o.verify {
+			return verifyRemoteChecksum(f, partName, remotePath)
+		}
+		return verifyDigest(partName, rf.digestAlgo, rf.digest)
+	}
+	if err := verify(); err != nil {
+		// a corrupt part can not be resumed, start over next time
+		os.Remove(partName)
+		os.Remove(partName + validatorSuffix)
+		p.RemoveBar(bar)
+		color.Yellow("%s: %v", name, err)
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	if err := os.Rename(partName, destName); err != nil {
+		p.RemoveBar(bar)
+		color.Yellow("%s: %v", name, err)
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	os.Remove(partName + validatorSuffix)
+	if !rf.modTime.IsZero() {
+		os.Chtimes(destName, time.Now(), rf.modTime)
+	}
+	return nil
+}
+
+func splitSegments(partName string, size int64, n int) []segment {
+	segments := make([]segment, 0, n)
+	step := size / int64(n)
+	for i := 0; i < n; i++ {
+		start, end := int64(i)*step, int64(i+1)*step-1
+		if i == n-1 {
+			end = size - 1
+		}
+		segments = append(segments, segment{start, end, fmt.Sprintf("%s.%d-of-%d", partName, i+1, n)})
+	}
+	return segments
+}
+
+// validatorSuffix names the file next to a .part which keeps the validator of
+// the remote file the part is of
+const validatorSuffix = ".validator"
+
+// checkPartValidator drops the part files of partName if they are of another
+// version of the remote file than validator, and remembers validator for
+// the next run
+func checkPartValidator(partName, validator string) error {
+	file := partName + validatorSuffix
+	old, err := ioutil.ReadFile(file)
+	if err == nil && string(old) != validator {
+		parts, _ := filepath.Glob(partName + "*")
+		for _, part := range parts {
+			if part != file {
+				os.Remove(part)
+			}
+		}
+	}
+	if validator == "" {
+		os.Remove(file)
+		return nil
+	}
+	return ioutil.WriteFile(file, []byte(validator), 0644)
+}
+
+// fetchSegment downloads the missing tail of a segment into its part file.
+// The range is only used while the remote file still matches rf.validator,
+// a changed file is downloaded from the start.
+func fetchSegment(f cmdutil.Factory, bar *mpb.Bar, remotePath string, seg segment, rf *remoteFile) error {
+	acceptRanges := rf.acceptRanges
+	dest, err := os.OpenFile(seg.partName, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("Can't create %s: %v", seg.partName, err)
+	}
+	defer dest.Close()
+
+	done, err := dest.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	want := seg.end - seg.start + 1
+	if done > want || !acceptRanges {
+		// stale part file, or no way to resume it
+		done = 0
+		if err := dest.Truncate(0); err != nil {
+			return err
+		}
+		dest.Seek(0, io.SeekStart)
+	}
+	if done > 0 {
+		bar.IncrBy(int(done))
+	}
+	if done == want {
+		return nil
+	}
+
+	req, err := f.NewRequest("GET", escapePath(remotePath), nil)
+	if err != nil {
+		return err
+	}
+	if acceptRanges {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", seg.start+done, seg.end))
+		if rf.validator != "" {
+			req.Header.Set("If-Range", rf.validator)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range, or the file changed since the part
+		// was started
+		if seg.start != 0 {
+			dest.Truncate(0)
+			return fmt.Errorf("%s changed on the server, download it again", remotePath)
+		}
+		if done != 0 {
+			bar.IncrBy(-int(done))
+			done = 0
+			if err := dest.Truncate(0); err != nil {
+				return err
+			}
+			dest.Seek(0, io.SeekStart)
+		}
+	default:
+		return fmt.Errorf("%s", resp.Status)
+	}
+
 	// create proxy reader
-	reader := bar.ProxyReader(resp.Body)
+	reader := bar.ProxyReader(io.LimitReader(resp.Body, want-done))
 	// and copy from reader
-	_, err = io.Copy(dest, reader)
-
+	n, err := io.Copy(dest, reader)
+	if err == nil && n != want-done {
+		err = io.ErrUnexpectedEOF
+	}
 	if closeErr := dest.Close(); err == nil {
 		err = closeErr
 	}
+	return err
+}
+
+// joinSegments appends all segment part files into partName and removes them.
+func joinSegments(partName string, segments []segment) error {
+	dest, err := os.Create(partName)
 	if err != nil {
-		p.RemoveBar(bar)
-		color.Yellow("%s: %v", name, err)
-		return fmt.Errorf("%s: %v", name, err)
+		return err
+	}
+	for _, seg := range segments {
+		src, err := os.Open(seg.partName)
+		if err != nil {
+			dest.Close()
+			return err
+		}
+		_, err = io.Copy(dest, src)
+		src.Close()
+		if err != nil {
+			dest.Close()
+			return err
+		}
+	}
+	if err := dest.Close(); err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		os.Remove(seg.partName)
+	}
+	return nil
+}
+
+// verifyDigest compares the file with the digest sent by the server. Servers
+// which do not send a digest are trusted.
+func verifyDigest(filename, algo string, digest []byte) error {
+	if newHash(algo) == nil || len(digest) == 0 {
+		return nil
+	}
+	sum, err := fileChecksum(filename, algo)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, digest) {
+		return fmt.Errorf("%s checksum mismatch, file is corrupted", algo)
 	}
-	//p.RemoveBar(bar)
 	return nil
 }
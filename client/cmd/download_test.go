@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cmdutil "grapehttp/client/cmd/util"
+
+	"github.com/vbauerster/mpb"
+)
+
+func TestDownloadOptions(t *testing.T) {
+	tests := []struct {
+		args []string
+		want DownloadOptions
+		err  bool
+	}{
+		{nil, DownloadOptions{output: ".", parallel: 1, minSplit: 64 << 20, jobs: 4}, false},
+		{[]string{"-o", "/data", "-n", "4", "--min-split", "1", "--verify"},
+			DownloadOptions{output: "/data", parallel: 4, minSplit: 1 << 20, verify: true, jobs: 4}, false},
+		{[]string{"-r", "-j", "8"}, DownloadOptions{output: ".", parallel: 1, minSplit: 64 << 20, recursive: true, jobs: 8}, false},
+		{[]string{"-n", "0"}, DownloadOptions{}, true},
+		{[]string{"-j", "0"}, DownloadOptions{}, true},
+	}
+	for _, v := range tests {
+		cmd := NewCmdDownload(cmdutil.Factory{}, ioutil.Discard, ioutil.Discard)
+		if err := cmd.ParseFlags(v.args); err != nil {
+			t.Fatal(err)
+		}
+		o := DownloadOptions{}
+		err := o.Complete(cmd)
+		if (err != nil) != v.err {
+			t.Errorf("%v: got error %v", v.args, err)
+			continue
+		}
+		if err == nil && o != v.want {
+			t.Errorf("%v: got %+v, want %+v", v.args, o, v.want)
+		}
+	}
+}
+
+func TestSplitSegments(t *testing.T) {
+	tests := []struct {
+		size int64
+		n    int
+		want []segment
+	}{
+		{10, 1, []segment{{0, 9, "f.part.1-of-1"}}},
+		{10, 3, []segment{{0, 2, "f.part.1-of-3"}, {3, 5, "f.part.2-of-3"}, {6, 9, "f.part.3-of-3"}}},
+		{8, 2, []segment{{0, 3, "f.part.1-of-2"}, {4, 7, "f.part.2-of-2"}}},
+	}
+	for _, v := range tests {
+		if got := splitSegments("f.part", v.size, v.n); !reflect.DeepEqual(got, v.want) {
+			t.Errorf("%d in %d: got %v, want %v", v.size, v.n, got, v.want)
+		}
+	}
+}
+
+// rangeServer serves content at /dir/a file.txt with an ETag and a sha-256
+// digest, and records the Range and If-Range headers of the GET requests.
+type rangeServer struct {
+	content []byte
+	digest  string
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/dir/a file.txt" || r.Header.Get("Authorization") == "" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method == "GET" {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range")+" "+r.Header.Get("If-Range"))
+		s.mu.Unlock()
+	}
+	w.Header().Set("ETag", `"v1"`)
+	w.Header().Set("Digest", "sha-256="+s.digest)
+	http.ServeContent(w, r, "a file.txt", time.Unix(1500000000, 0), bytes.NewReader(s.content))
+}
+
+func TestDownloadResume(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	sum := sha256.Sum256(content)
+	tests := []struct {
+		name      string
+		part      string // content of the .part file left by an earlier run
+		validator string
+		parallel  int
+		digest    string
+		ranges    []string
+		err       bool
+	}{
+		{"fresh", "", "", 1, "", []string{`bytes=0-19 "v1"`}, false},
+		{"resumed", "0123", `"v1"`, 1, "", []string{`bytes=4-19 "v1"`}, false},
+		{"changed on the server", "xxxx", `"v0"`, 1, "", []string{`bytes=0-19 "v1"`}, false},
+		{"split", "", "", 2, "", []string{`bytes=0-9 "v1"`, `bytes=10-19 "v1"`}, false},
+		{"corrupt", "", "", 1, base64.StdEncoding.EncodeToString(make([]byte, 32)), []string{`bytes=0-19 "v1"`}, true},
+	}
+	for _, v := range tests {
+		srv := &rangeServer{content: content, digest: base64.StdEncoding.EncodeToString(sum[:])}
+		if v.digest != "" {
+			srv.digest = v.digest
+		}
+		ts := httptest.NewServer(srv)
+		f := cmdutil.Factory{Server: strings.TrimPrefix(ts.URL, "http://"), Username: "bob", Password: "secret"}
+
+		dir := t.TempDir()
+		dest := filepath.Join(dir, "a file.txt")
+		if v.part != "" {
+			ioutil.WriteFile(dest+".part", []byte(v.part), 0644)
+			ioutil.WriteFile(dest+".part"+validatorSuffix, []byte(v.validator), 0644)
+		}
+		o := DownloadOptions{output: dir, parallel: v.parallel, jobs: 1}
+		p := mpb.New()
+		err := o.download(f, p, "a file.txt", "/dir/a file.txt")
+		p.Stop()
+		ts.Close()
+
+		if (err != nil) != v.err {
+			t.Errorf("%s: got error %v", v.name, err)
+		}
+		if ranges := srv.ranges; len(ranges) > 1 && ranges[0] > ranges[1] {
+			ranges[0], ranges[1] = ranges[1], ranges[0]
+		}
+		if !reflect.DeepEqual(srv.ranges, v.ranges) {
+			t.Errorf("%s: got ranges %q, want %q", v.name, srv.ranges, v.ranges)
+		}
+		parts, _ := filepath.Glob(dest + ".part*")
+		if v.err {
+			if _, err := os.Stat(dest); err == nil || len(parts) != 0 {
+				t.Errorf("%s: corrupt download kept: %v", v.name, parts)
+			}
+			continue
+		}
+		if data, err := ioutil.ReadFile(dest); err != nil || !bytes.Equal(data, content) {
+			t.Errorf("%s: got %q %v", v.name, data, err)
+		}
+		if len(parts) != 0 {
+			t.Errorf("%s: part files left: %v", v.name, parts)
+		}
+		if info, err := os.Stat(dest); err != nil || info.ModTime().Unix() != 1500000000 {
+			t.Errorf("%s: modification time not kept", v.name)
+		}
+	}
+}
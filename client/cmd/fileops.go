@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	cmdutil "grapehttp/client/cmd/util"
+
+	"github.com/fatih/color"
+)
+
+// request and response of the /-/cmd endpoint
+type cmdOptions struct {
+	All       bool `json:"all"`
+	Recursive bool `json:"recursive"`
+	Parents   bool `json:"parents"`
+	Force     bool `json:"force"`
+}
+
+type cmdRequest struct {
+	Name    string     `json:"name"`
+	Paths   []string   `json:"paths"`
+	Options cmdOptions `json:"options"`
+}
+
+type cmdEntry struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Type    string `json:"type"`
+	Size    int64  `json:"size"`
+	Mode    string `json:"mode"`
+	ModTime int64  `json:"mtime"`
+}
+
+type cmdResult struct {
+	Path    string     `json:"path"`
+	Dest    string     `json:"dest"`
+	Entries []cmdEntry `json:"entries"`
+	Error   string     `json:"error"`
+}
+
+type cmdResponse struct {
+	Name    string      `json:"name"`
+	Results []cmdResult `json:"results"`
+}
+
+func runServerCmd(f cmdutil.Factory, req cmdRequest) (*cmdResponse, error) {
+	request := f.Gorequest()
+	resp, body, errs := request.Get("http://"+f.Server+"/-/cmd").
+		Set("Authorization", f.Authorization()).
+		Send(req).
+		End()
+
+	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+		return nil, err
+	}
+
+	res := &cmdResponse{}
+	if err := json.Unmarshal([]byte(body), res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// reportErrors prints every failed path and returns an error if there was any.
+func (r *cmdResponse) reportErrors(cmdErr io.Writer) error {
+	failed := 0
+	for _, res := range r.Results {
+		if res.Error != "" {
+			fmt.Fprintln(cmdErr, color.YellowString("%s: %s: %s", r.Name, res.Path, res.Error))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%s: %d of %d paths failed", r.Name, failed, len(r.Results))
+	}
+	return nil
+}
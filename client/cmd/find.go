@@ -0,0 +1,215 @@
+/*
+Author: lkong
+Description: test cmd tool
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"grapehttp/client/cmd/templates"
+	cmdutil "grapehttp/client/cmd/util"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// findPageSize is the most results the server returns per request
+const findPageSize = 1000
+
+type FindOptions struct {
+	dir     string
+	query   string
+	sort    string
+	desc    bool
+	offset  int
+	limit   int
+	long    bool
+	human   bool
+	content bool
+}
+
+// findEntry is a search result, with the matching lines of a content search
+type findEntry struct {
+	remoteEntry
+	Snippets []struct {
+		Line    int      `json:"line"`
+		Text    string   `json:"text"`
+		Matches [][2]int `json:"matches"`
+	} `json:"snippets"`
+}
+
+// findResult is the answer of /-/json?search=
+type findResult struct {
+	Files []findEntry `json:"files"`
+	Total int         `json:"total"`
+}
+
+var (
+	findExample = templates.Examples(`
+		# Find files whose path contains "report", ignoring case
+		fctl find report
+
+		# Find big archives below /release modified in the last week
+		fctl find -d /release 'ext:zip,tar.gz size:>100M mtime:<7d'
+
+		# Find directories named like a date, newest first
+		fctl find --sort mtime -r 'type:dir /^20[0-9]{2}-[0-9]{2}$/'
+
+		# Quoted phrases, OR and negation
+		fctl find '"annual report" pdf OR docx -draft'
+
+		# Find logs containing a line with "connection refused"
+		fctl find -c '"connection refused" ext:log'`)
+)
+
+func NewCmdFind(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "find QUERY",
+		Short: "Search files with the server index",
+		Long: `Search files with the search index of the server.
+
+Space separated terms must all match, "quoted phrases" are matched as a whole
+and a OR b matches either term. A leading - negates a term. Terms with * ? [
+are globs on the file name (on the path if they contain a /), /.../ is a
+regular expression on the path, everything else a substring of the path.
+Field filters: ext:go,md  type:file|dir  size:>100M  mtime:<7d  mtime:>=2024-01-31
+
+With --content, words, phrases and regular expressions are looked up in the
+lines of text files instead of the path, if the server indexes content.`,
+		Example: findExample,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) < 1 {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			options := new(FindOptions)
+			cmdutil.CheckErr(options.Complete(cmd, args))
+			cmdutil.CheckErr(options.Run(f, out, cmdErr))
+			return
+		},
+	}
+
+	cmd.Flags().StringP("dir", "d", "/", "search below this remote `directory`")
+	cmd.Flags().StringP("sort", "s", "path", "sort by path, name, size or mtime")
+	cmd.Flags().BoolP("reverse", "r", false, "reverse the sort order")
+	cmd.Flags().Int("offset", 0, "skip the first N results")
+	cmd.Flags().IntP("limit", "n", 0, "print at most N results, 0 for all")
+	cmd.Flags().BoolP("long", "l", false, "print type, size and modification time")
+	cmd.Flags().BoolP("human-readable", "H", false, "with -l, print sizes in human readable format (e.g., 1K 234M 2G)")
+	cmd.Flags().BoolP("content", "c", false, "search the content of text files and print the matching lines")
+	cmd.Flags().BoolP("color", "", true, "highlight the matches")
+	return cmd
+}
+
+func (o *FindOptions) Complete(cmd *cobra.Command, args []string) error {
+	o.dir = path.Clean("/" + cmdutil.GetFlagString(cmd, "dir"))
+	o.query = strings.Join(args, " ")
+	o.sort = cmdutil.GetFlagString(cmd, "sort")
+	o.desc = cmdutil.GetFlagBool(cmd, "reverse")
+	o.offset = cmdutil.GetFlagInt(cmd, "offset")
+	o.limit = cmdutil.GetFlagInt(cmd, "limit")
+	o.long = cmdutil.GetFlagBool(cmd, "long")
+	o.human = cmdutil.GetFlagBool(cmd, "human-readable")
+	o.content = cmdutil.GetFlagBool(cmd, "content")
+	color.NoColor = color.NoColor || !cmdutil.GetFlagBool(cmd, "color")
+	if o.offset < 0 || o.limit < 0 {
+		return fmt.Errorf("--offset and --limit must not be negative")
+	}
+	return nil
+}
+
+func (o *FindOptions) Run(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) error {
+	printed, total := 0, 0
+	for offset := o.offset; ; {
+		size := findPageSize
+		if o.limit > 0 && o.limit-printed < size {
+			size = o.limit - printed
+		}
+		page, err := o.find(f, offset, size)
+		if err != nil {
+			return err
+		}
+		total = page.Total
+		for _, e := range page.Files {
+			o.print(out, e)
+		}
+		printed += len(page.Files)
+		offset += len(page.Files)
+		if len(page.Files) == 0 || offset >= total || (o.limit > 0 && printed >= o.limit) {
+			break
+		}
+	}
+	if printed < total {
+		fmt.Fprintf(cmdErr, "%d of %d results\n", printed, total)
+	}
+	return nil
+}
+
+func (o *FindOptions) find(f cmdutil.Factory, offset, limit int) (*findResult, error) {
+	order := "asc"
+	if o.desc {
+		order = "desc"
+	}
+	query := url.Values{
+		"search": {o.query},
+		"sort":   {o.sort},
+		"order":  {order},
+		"offset": {strconv.Itoa(offset)},
+		"limit":  {strconv.Itoa(limit)},
+	}
+	if o.content {
+		query.Set("content", "true")
+	}
+	request := f.Gorequest()
+	resp, body, errs := request.Get("http://"+f.Server+"/-/json"+escapePath(o.dir)).
+		Set("Authorization", f.Authorization()).
+		Query(query.Encode()).
+		End()
+
+	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+		return nil, fmt.Errorf("%s", strings.TrimRight(err.Error(), "\n"))
+	}
+
+	result := &findResult{}
+	if err := json.Unmarshal([]byte(body), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (o *FindOptions) print(out io.Writer, e findEntry) {
+	name := path.Clean("/" + e.Path)
+	if o.content && !o.long {
+		for _, s := range e.Snippets {
+			line, last := "", 0
+			for _, m := range s.Matches {
+				if m[0] < last || m[1] > len(s.Text) {
+					continue
+				}
+				line += s.Text[last:m[0]] + color.RedString("%s", s.Text[m[0]:m[1]])
+				last = m[1]
+			}
+			line += s.Text[last:]
+			fmt.Fprintf(out, "%s:%d: %s\n", color.BlueString(name), s.Line, line)
+		}
+		return
+	}
+	if !o.long {
+		fmt.Fprintln(out, name)
+		return
+	}
+	size := strconv.FormatInt(e.Size, 10)
+	if o.human {
+		size = humanSize(e.Size)
+	}
+	mtime := time.Unix(0, e.ModTime*int64(time.Millisecond)).Format("Jan _2 15:04")
+	fmt.Fprintf(out, "%-4s %10s %s %s\n", e.Type, size, mtime, name)
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	cmdutil "grapehttp/client/cmd/util"
+)
+
+func TestFindOptions(t *testing.T) {
+	tests := []struct {
+		args []string
+		want FindOptions
+		err  bool
+	}{
+		{[]string{"report"}, FindOptions{dir: "/", query: "report", sort: "path"}, false},
+		{[]string{"-d", "release/", "-s", "mtime", "-r", "--offset", "10", "-n", "5", "-l", "-H", "-c", "ext:zip", "size:>100M"},
+			FindOptions{dir: "/release", query: "ext:zip size:>100M", sort: "mtime", desc: true, offset: 10, limit: 5, long: true, human: true, content: true}, false},
+		{[]string{"--offset", "-1", "x"}, FindOptions{}, true},
+		{[]string{"-n", "-1", "x"}, FindOptions{}, true},
+	}
+	for _, v := range tests {
+		cmd := NewCmdFind(cmdutil.Factory{}, ioutil.Discard, ioutil.Discard)
+		if err := cmd.ParseFlags(v.args); err != nil {
+			t.Fatal(err)
+		}
+		o := FindOptions{}
+		err := o.Complete(cmd, cmd.Flags().Args())
+		if (err != nil) != v.err {
+			t.Errorf("%v: got error %v", v.args, err)
+			continue
+		}
+		if err == nil && o != v.want {
+			t.Errorf("%v: got %+v, want %+v", v.args, o, v.want)
+		}
+	}
+}
+
+func TestFindPages(t *testing.T) {
+	const total = 2500
+	requests := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		requests = append(requests, r.URL.EscapedPath()+"?"+r.URL.RawQuery)
+		offset, _ := strconv.Atoi(q.Get("offset"))
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		result := findResult{Total: total}
+		for i := offset; i < offset+limit && i < total; i++ {
+			e := findEntry{}
+			e.Path = fmt.Sprintf("release/%04d", i)
+			if q.Get("content") == "true" {
+				json.Unmarshal([]byte(`{"snippets":[{"line":3,"text":"a x b","matches":[[2,3]]}]}`), &e)
+			}
+			result.Files = append(result.Files, e)
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+	defer ts.Close()
+	f := cmdutil.Factory{Server: strings.TrimPrefix(ts.URL, "http://"), Timeout: 5}
+
+	page := func(offset, limit int, rest string) string {
+		return fmt.Sprintf("/-/json/release/a%%20b?limit=%d&offset=%d&%s", limit, offset, rest)
+	}
+	tests := []struct {
+		o        FindOptions
+		requests []string
+		printed  int
+		summary  string
+	}{
+		{FindOptions{query: "ext:zip", sort: "path"},
+			[]string{page(0, 1000, "order=asc&search=ext%3Azip&sort=path"), page(1000, 1000, "order=asc&search=ext%3Azip&sort=path"), page(2000, 1000, "order=asc&search=ext%3Azip&sort=path")},
+			2500, ""},
+		{FindOptions{query: "x", sort: "size", desc: true, limit: 1500},
+			[]string{page(0, 1000, "order=desc&search=x&sort=size"), page(1000, 500, "order=desc&search=x&sort=size")},
+			1500, "1500 of 2500 results\n"},
+		{FindOptions{query: "x", sort: "path", offset: 2400, content: true},
+			[]string{"/-/json/release/a%20b?content=true&limit=1000&offset=2400&order=asc&search=x&sort=path"},
+			100, "100 of 2500 results\n"},
+	}
+	for _, v := range tests {
+		requests = nil
+		v.o.dir = "/release/a b"
+		out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+		if err := v.o.Run(f, out, errOut); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(requests, v.requests) {
+			t.Errorf("%+v: got requests\n%q\nwant\n%q", v.o, requests, v.requests)
+		}
+		if lines := strings.Count(out.String(), "\n"); lines != v.printed {
+			t.Errorf("%+v: printed %d, want %d", v.o, lines, v.printed)
+		}
+		if errOut.String() != v.summary {
+			t.Errorf("%+v: got summary %q, want %q", v.o, errOut, v.summary)
+		}
+	}
+}
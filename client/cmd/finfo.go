@@ -40,7 +40,7 @@ func NewCmdFinfo(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Comm
 func RunFinfo(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, cmd *cobra.Command, args []string) error {
 	request := f.Gorequest()
 	resp, body, errs := request.Get("http://"+f.Server+"/-/status").
-		Set("Authorization", "Basic "+f.Auth()).
+		Set("Authorization", f.Authorization()).
 		Send(``).
 		End()
 
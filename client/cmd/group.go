@@ -0,0 +1,178 @@
+/*
+Author: lkong
+Description: test cmd tool
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"grapehttp/client/cmd/templates"
+	cmdutil "grapehttp/client/cmd/util"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+type group struct {
+	Name       string    `json:"name"`
+	Remark     string    `json:"remark"`
+	Createtime time.Time `json:"createTime"`
+	Members    []string  `json:"members"`
+}
+
+var (
+	groupExample = templates.Examples(`
+		# Create the group devs with two members
+		fctl group add devs alice bob
+
+		# Add and remove members
+		fctl group adduser devs carol
+		fctl group deluser devs bob
+
+		# List the groups
+		fctl group list`)
+)
+
+func NewCmdGroup(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "group",
+		Short: "Manage groups of users",
+		Long: `Manage groups of users. The groups: section of .ghs.yml gives the members
+of a group upload, delete or noaccess rules in a directory.`,
+		Example: groupExample,
+		Run:     runHelp,
+	}
+	cmd.AddCommand(NewCmdGroupAdd(f, out, cmdErr))
+	cmd.AddCommand(NewCmdGroupDel(f, out, cmdErr))
+	cmd.AddCommand(NewCmdGroupGet(f, out, cmdErr))
+	cmd.AddCommand(NewCmdGroupList(f, out, cmdErr))
+	cmd.AddCommand(NewCmdGroupMembers(f, out, cmdErr, "adduser", "Add users to a group"))
+	cmd.AddCommand(NewCmdGroupMembers(f, out, cmdErr, "deluser", "Remove users from a group"))
+	return cmd
+}
+
+// groupRequest sends req to the group endpoint path and returns the body
+func groupRequest(f cmdutil.Factory, path string, req interface{}) (string, error) {
+	request := f.Gorequest()
+	resp, body, errs := request.Get("http://"+f.Server+"/-/group/"+path).
+		Set("Authorization", f.Authorization()).
+		Send(req).
+		End()
+
+	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+		return "", err
+	}
+	return body, nil
+}
+
+func NewCmdGroupAdd(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add GROUP [USERNAME...]",
+		Short: "Create a group",
+		Long:  "Create a group, with the given users as members",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) < 1 {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			req := group{Name: args[0], Remark: cmdutil.GetFlagString(cmd, "remark"), Members: args[1:]}
+			body, err := groupRequest(f, "add", req)
+			cmdutil.CheckErr(err)
+			fmt.Fprintf(out, "%s", body)
+		},
+	}
+	cmd.Flags().String("remark", "", "remark of the group")
+	return cmd
+}
+
+func NewCmdGroupDel(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "del GROUP [GROUP...]",
+		Short: "Delete groups",
+		Long:  "Delete groups, their members are not deleted",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) < 1 {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			req := struct {
+				Names []string `json:"names"`
+			}{args}
+			body, err := groupRequest(f, "del", req)
+			cmdutil.CheckErr(err)
+			fmt.Fprintf(out, "%s", body)
+		},
+	}
+	return cmd
+}
+
+func NewCmdGroupMembers(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, name, short string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   name + " GROUP USERNAME [USERNAME...]",
+		Short: short,
+		Long:  short,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) < 2 {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			req := struct {
+				Name      string   `json:"name"`
+				Usernames []string `json:"usernames"`
+			}{args[0], args[1:]}
+			body, err := groupRequest(f, name, req)
+			cmdutil.CheckErr(err)
+			fmt.Fprintf(out, "%s", body)
+		},
+	}
+	return cmd
+}
+
+func NewCmdGroupGet(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "get GROUP",
+		Short: "Get a group and its members",
+		Long:  "Get a group and its members",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			req := struct {
+				Name string `json:"name"`
+			}{args[0]}
+			body, err := groupRequest(f, "get", req)
+			cmdutil.CheckErr(err)
+			fmt.Fprintf(out, "%s\n", body)
+		},
+	}
+	return cmd
+}
+
+func NewCmdGroupList(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "list",
+		Short:   "List groups and their members",
+		Long:    "List groups and their members",
+		Aliases: []string{"ls"},
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := groupRequest(f, "list", struct{}{})
+			cmdutil.CheckErr(err)
+
+			groups := []group{}
+			cmdutil.CheckErr(json.Unmarshal([]byte(body), &groups))
+
+			table := tablewriter.NewWriter(out)
+			table.SetAlignment(tablewriter.ALIGN_LEFT)
+			table.SetColWidth(TABLE_WIDTH)
+			table.SetHeader([]string{"Name", "Members", "Remark"})
+			for _, g := range groups {
+				table.Append([]string{g.Name, strings.Join(g.Members, ","), g.Remark})
+			}
+			table.Render()
+		},
+	}
+	return cmd
+}
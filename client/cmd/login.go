@@ -0,0 +1,123 @@
+/*
+Author: lkong
+Description: test cmd tool
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"grapehttp/client/cmd/templates"
+	cmdutil "grapehttp/client/cmd/util"
+
+	"github.com/go-yaml/yaml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	loginExample = templates.Examples(`
+		# Log in as the user of the config file, asking for the password
+		fctl login
+
+		# Log in as another user with a token which expires after 30 days
+		fctl login -u ci --expires 30d`)
+)
+
+func NewCmdLogin(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "login",
+		Short: "Log in and store an API token instead of the password",
+		Long: `Log in with the username and password, create an API token and store it in
+~/.grape/config.yaml. The password is removed from the config file, later
+calls send the token.`,
+		Example: loginExample,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(runLogin(f, out, cmd))
+		},
+	}
+	cmd.Flags().StringP("username", "u", "", "the username, default the one of the config file")
+	cmd.Flags().StringP("password", "p", "", "the password, asked for if not given")
+	cmd.Flags().StringSlice("scope", []string{"read", "write", "delete"}, "scopes of the token: read, write, delete, admin")
+	cmd.Flags().String("expires", "", "expiry as a duration (12h, 30d, 4w, 1y) or date (2024-12-31), default never")
+	return cmd
+}
+
+func runLogin(f cmdutil.Factory, out io.Writer, cmd *cobra.Command) error {
+	username := cmdutil.GetFlagString(cmd, "username")
+	if username == "" {
+		username = f.Username
+	}
+	if username == "" {
+		fmt.Fprint(out, "Username: ")
+		line, err := stdin.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		username = strings.TrimSpace(line)
+	}
+	password := cmdutil.GetFlagString(cmd, "password")
+	if password == "" {
+		var err error
+		if password, err = readPassword(out, "Password: "); err != nil {
+			return err
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	t, err := createToken(f, "Basic "+auth, tokenRequest{
+		Name:    "fctl login " + hostname,
+		Scopes:  cmdutil.GetFlagStringSlice(cmd, "scope"),
+		Expires: cmdutil.GetFlagString(cmd, "expires"),
+	})
+	if err != nil {
+		return err
+	}
+
+	viper.Set("username", username)
+	viper.Set("password", "")
+	viper.Set("token", t.Token)
+	if err := writeConfig(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Logged in as %s, token %s stored in %s\n", username, t.ID, viper.ConfigFileUsed())
+	return nil
+}
+
+// stdin is shared by the prompts, a reader of its own would keep the
+// buffered lines of the next prompt
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassword asks for a password without echoing it
+func readPassword(out io.Writer, prompt string) (string, error) {
+	fmt.Fprint(out, prompt)
+	restore := echoOff()
+	line, err := stdin.ReadString('\n')
+	restore()
+	fmt.Fprintln(out)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// writeConfig saves the settings to the config file. It holds the password
+// or the token, so the file is kept private.
+func writeConfig() error {
+	data, err := yaml.Marshal(viper.AllSettings())
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(viper.ConfigFileUsed(), data, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(viper.ConfigFileUsed(), 0600)
+}
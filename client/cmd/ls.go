@@ -9,11 +9,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"grapehttp/client/cmd/templates"
 	cmdutil "grapehttp/client/cmd/util"
 	"grapehttp/pkg/i18n"
 
+	"github.com/fatih/color"
 	"github.com/spf13/cobra"
 )
 
@@ -59,7 +65,7 @@ func NewCmdLs(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command
 	cmd.Flags().BoolP("human-readable", "H", false, "with -l, print sizes in human readable format (e.g., 1K 234M 2G)")
 	cmd.Flags().BoolP("reverse", "r", false, "reverse order while sorting")
 	cmd.Flags().BoolP("recursive", "R", false, "list subdirectories recursively")
-	cmd.Flags().BoolP("classify", "F", false, "append indicator (one of */=>@|) to entries")
+	cmd.Flags().BoolP("classify", "F", false, "append indicator (one of /@) to entries")
 
 	cmd.Flags().BoolP("size", "S", false, "sort by file size")
 	cmd.Flags().BoolP("time", "t", false, "sort by modification time, newest first")
@@ -69,88 +75,189 @@ func NewCmdLs(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command
 }
 
 func RunLs(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, cmd *cobra.Command, args []string) error {
-	cmdArgs := buildArgs(cmd)
-	req := struct {
-		Name  string   `json:"name"`
-		Args  []string `json:"args"`
-		Paths []string `json:"paths"`
-	}{"ls", cmdArgs, args}
-
-	request := f.Gorequest()
-	resp, body, errs := request.Get("http://"+f.Server+"/-/cmd").
-		Set("Authorization", "Basic "+f.Auth()).
-		Send(req).
-		End()
+	req := cmdRequest{
+		Name:  "ls",
+		Paths: args,
+		Options: cmdOptions{
+			All:       cmdutil.GetFlagBool(cmd, "all") || cmdutil.GetFlagBool(cmd, "almost-all"),
+			Recursive: cmdutil.GetFlagBool(cmd, "recursive"),
+		},
+	}
 
-	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+	res, err := runServerCmd(f, req)
+	if err != nil {
 		return err
 	}
 
-	fmt.Printf("%s", body)
-	return nil
-}
-
-func httpServerInfo(f cmdutil.Factory) (*HTTPStaticServer, error) {
-	request := f.Gorequest()
-	s := &HTTPStaticServer{}
-	resp, body, errs := request.Get("http://"+f.Server+"/-/status").
-		Send(``).
-		Set("Authorization", "Basic "+f.Auth()).
-		EndBytes()
-
-	if err := cmdutil.CombineRequestErr(resp, string(body), errs); err != nil {
-		return nil, err
+	color.NoColor = color.NoColor || !cmdutil.GetFlagBool(cmd, "color")
+	showHeader := len(res.Results) > 1 || req.Options.Recursive
+	for i, result := range res.Results {
+		if result.Error != "" {
+			continue
+		}
+		groups, order := groupEntries(result.Entries)
+		for j, dir := range order {
+			if showHeader {
+				if i > 0 || j > 0 {
+					fmt.Fprintln(out)
+				}
+				fmt.Fprintf(out, "%s:\n", dir)
+			}
+			printEntries(out, cmd, groups[dir])
+		}
 	}
 
-	err := json.Unmarshal(body, s)
-	if err != nil {
-		return nil, err
-	}
+	return res.reportErrors(cmdErr)
+}
 
-	return s, nil
+// groupEntries groups a (possibly recursive) listing by parent directory,
+// keeping the order in which the directories were listed.
+func groupEntries(entries []cmdEntry) (map[string][]cmdEntry, []string) {
+	groups := make(map[string][]cmdEntry)
+	order := []string{}
+	for _, e := range entries {
+		dir := path.Dir(e.Path)
+		if _, ok := groups[dir]; !ok {
+			order = append(order, dir)
+		}
+		groups[dir] = append(groups[dir], e)
+	}
+	return groups, order
 }
 
-func buildArgs(cmd *cobra.Command) []string {
-	cmdArgs := []string{}
-	if cmdutil.GetFlagBool(cmd, "all") {
-		cmdArgs = append(cmdArgs, "-a")
+func printEntries(out io.Writer, cmd *cobra.Command, entries []cmdEntry) {
+	filtered := entries[:0:0]
+	for _, e := range entries {
+		if cmdutil.GetFlagBool(cmd, "ignore-backups") && strings.HasSuffix(e.Name, "~") {
+			continue
+		}
+		filtered = append(filtered, e)
 	}
-	if cmdutil.GetFlagBool(cmd, "almost-all") {
-		cmdArgs = append(cmdArgs, "-A")
+	entries = filtered
+
+	bySize, byTime := cmdutil.GetFlagBool(cmd, "size"), cmdutil.GetFlagBool(cmd, "time")
+	sort.SliceStable(entries, func(i, j int) bool {
+		switch {
+		case bySize && entries[i].Size != entries[j].Size:
+			return entries[i].Size > entries[j].Size
+		case byTime && entries[i].ModTime != entries[j].ModTime:
+			return entries[i].ModTime > entries[j].ModTime
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	if cmdutil.GetFlagBool(cmd, "reverse") {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
 	}
-	if cmdutil.GetFlagBool(cmd, "ignore-backups") {
-		cmdArgs = append(cmdArgs, "-B")
+
+	classify := cmdutil.GetFlagBool(cmd, "classify")
+	names := make([]string, len(entries))
+	colored := make([]string, len(entries))
+	for i, e := range entries {
+		names[i], colored[i] = entryName(e, classify)
 	}
-	if cmdutil.GetFlagBool(cmd, "column") {
-		cmdArgs = append(cmdArgs, "-C")
+
+	switch {
+	case cmdutil.GetFlagBool(cmd, "long"):
+		human := cmdutil.GetFlagBool(cmd, "human-readable")
+		for i, e := range entries {
+			size := strconv.FormatInt(e.Size, 10)
+			if human {
+				size = humanSize(e.Size)
+			}
+			mtime := time.Unix(0, e.ModTime*int64(time.Millisecond)).Format("Jan _2 15:04")
+			fmt.Fprintf(out, "%s %10s %s %s\n", e.Mode, size, mtime, colored[i])
+		}
+	case cmdutil.GetFlagBool(cmd, "line"):
+		for _, name := range colored {
+			fmt.Fprintln(out, name)
+		}
+	default:
+		printColumns(out, names, colored)
 	}
-	if cmdutil.GetFlagBool(cmd, "color") {
-		cmdArgs = append(cmdArgs, "--color")
+}
+
+// entryName returns the name with its -F indicator, and the same name
+// colorized by type.
+func entryName(e cmdEntry, classify bool) (string, string) {
+	name, colored := e.Name, e.Name
+	switch e.Type {
+	case "dir":
+		colored = color.BlueString(name)
+		if classify {
+			name, colored = name+"/", colored+"/"
+		}
+	case "symlink":
+		colored = color.CyanString(name)
+		if classify {
+			name, colored = name+"@", colored+"@"
+		}
 	}
-	if cmdutil.GetFlagBool(cmd, "human-readable") {
-		cmdArgs = append(cmdArgs, "-h")
+	return name, colored
+}
+
+// printColumns lays out names in columns that fit into TABLE_WIDTH.
+func printColumns(out io.Writer, names, colored []string) {
+	if len(names) == 0 {
+		return
 	}
-	if cmdutil.GetFlagBool(cmd, "reverse") {
-		cmdArgs = append(cmdArgs, "-r")
+	width := 0
+	for _, name := range names {
+		if len(name)+2 > width {
+			width = len(name) + 2
+		}
 	}
-	if cmdutil.GetFlagBool(cmd, "recursive") {
-		cmdArgs = append(cmdArgs, "-R")
+	cols := TABLE_WIDTH / width
+	if cols < 1 {
+		cols = 1
 	}
-	if cmdutil.GetFlagBool(cmd, "classify") {
-		cmdArgs = append(cmdArgs, "-F")
+	rows := (len(names) + cols - 1) / cols
+	for r := 0; r < rows; r++ {
+		line := ""
+		for c := 0; c < cols; c++ {
+			i := c*rows + r
+			if i >= len(names) {
+				break
+			}
+			line += colored[i]
+			if i+rows < len(names) {
+				line += strings.Repeat(" ", width-len(names[i]))
+			}
+		}
+		fmt.Fprintln(out, line)
 	}
-	if cmdutil.GetFlagBool(cmd, "size") {
-		cmdArgs = append(cmdArgs, "-S")
+}
+
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return strconv.FormatInt(size, 10)
 	}
-	if cmdutil.GetFlagBool(cmd, "time") {
-		cmdArgs = append(cmdArgs, "-t")
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
 	}
-	if cmdutil.GetFlagBool(cmd, "line") {
-		cmdArgs = append(cmdArgs, "-1")
+	return fmt.Sprintf("%.1f%c", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func httpServerInfo(f cmdutil.Factory) (*HTTPStaticServer, error) {
+	request := f.Gorequest()
+	s := &HTTPStaticServer{}
+	resp, body, errs := request.Get("http://"+f.Server+"/-/status").
+		Send(``).
+		Set("Authorization", f.Authorization()).
+		EndBytes()
+
+	if err := cmdutil.CombineRequestErr(resp, string(body), errs); err != nil {
+		return nil, err
 	}
-	if cmdutil.GetFlagBool(cmd, "long") {
-		cmdArgs = append(cmdArgs, "-l")
+
+	err := json.Unmarshal(body, s)
+	if err != nil {
+		return nil, err
 	}
 
-	return cmdArgs
+	return s, nil
 }
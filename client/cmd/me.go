@@ -0,0 +1,214 @@
+/*
+Author: lkong
+Description: test cmd tool
+*/
+
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"grapehttp/client/cmd/templates"
+	cmdutil "grapehttp/client/cmd/util"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// profile is the account of the user as /-/me answers it
+type profile struct {
+	Username string   `json:"username"`
+	Name     string   `json:"name"`
+	Email    string   `json:"email"`
+	Provider string   `json:"provider"`
+	TokenID  string   `json:"tokenId"`
+	Scopes   []string `json:"scopes"`
+	Groups   []string `json:"groups"`
+	Role     string   `json:"role"`
+	Admin    bool     `json:"admin"`
+	User     *struct {
+		Nickname      string    `json:"nickname"`
+		Email         string    `json:"email"`
+		Remark        string    `json:"remark"`
+		LoginCount    int       `json:"loginCount"`
+		LastLoginTime time.Time `json:"lastLoginTime"`
+		LastIP        string    `json:"lastip"`
+		CreateTime    time.Time `json:"createTime"`
+	} `json:"user"`
+}
+
+type login struct {
+	Time time.Time `json:"time"`
+	IP   string    `json:"ip"`
+}
+
+var (
+	whoamiExample = templates.Examples(`
+		# Show your account and your last 5 logins
+		fctl whoami
+
+		# Show your last 20 logins
+		fctl whoami --logins 20`)
+
+	passwdExample = templates.Examples(`
+		# Change your password, the old and the new one are asked for
+		fctl passwd`)
+)
+
+func NewCmdWhoami(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "whoami",
+		Short:   "Show your account and your recent logins",
+		Long:    "Show the account the server knows you as, its groups and your recent logins.",
+		Example: whoamiExample,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(runWhoami(f, out, cmd))
+		},
+	}
+	cmd.Flags().Int("logins", 5, "number of recent logins to show, 0 for none")
+	return cmd
+}
+
+func runWhoami(f cmdutil.Factory, out io.Writer, cmd *cobra.Command) error {
+	request := f.Gorequest()
+	resp, body, errs := request.Get("http://"+f.Server+"/-/me").
+		Set("Authorization", f.Authorization()).
+		End()
+	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+		return fmt.Errorf("%s", strings.TrimRight(err.Error(), "\n"))
+	}
+	p := profile{}
+	if err := json.Unmarshal([]byte(body), &p); err != nil {
+		return err
+	}
+
+	date := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Local().Format("2006-01-02 15:04:05")
+	}
+	fmt.Fprintf(out, "Username:   %s\n", p.Username)
+	fmt.Fprintf(out, "Provider:   %s\n", p.Provider)
+	if p.TokenID != "" {
+		fmt.Fprintf(out, "Token:      %s (%s)\n", p.TokenID, strings.Join(p.Scopes, ","))
+	}
+	if u := p.User; u != nil {
+		fmt.Fprintf(out, "Nickname:   %s\n", u.Nickname)
+		fmt.Fprintf(out, "Email:      %s\n", u.Email)
+		if u.Remark != "" {
+			fmt.Fprintf(out, "Remark:     %s\n", u.Remark)
+		}
+		fmt.Fprintf(out, "Created:    %s\n", date(u.CreateTime))
+		fmt.Fprintf(out, "Last login: %s from %s, %d logins\n", date(u.LastLoginTime), u.LastIP, u.LoginCount)
+	} else {
+		if p.Name != "" {
+			fmt.Fprintf(out, "Name:       %s\n", p.Name)
+		}
+		if p.Email != "" {
+			fmt.Fprintf(out, "Email:      %s\n", p.Email)
+		}
+	}
+	groups := strings.Join(p.Groups, ",")
+	if groups == "" {
+		groups = "-"
+	}
+	fmt.Fprintf(out, "Groups:     %s\n", groups)
+	role := p.Role
+	if role == "" {
+		role = "user"
+	}
+	if role == "admin" && !p.Admin {
+		role += " (not with this token)"
+	}
+	fmt.Fprintf(out, "Role:       %s\n", role)
+
+	n := cmdutil.GetFlagInt(cmd, "logins")
+	if n <= 0 || p.User == nil {
+		return nil
+	}
+	resp, body, errs = f.Gorequest().Get("http://"+f.Server+"/-/me/logins").
+		Set("Authorization", f.Authorization()).
+		Query("limit=" + strconv.Itoa(n)).
+		End()
+	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+		return fmt.Errorf("%s", strings.TrimRight(err.Error(), "\n"))
+	}
+	logins := []login{}
+	if err := json.Unmarshal([]byte(body), &logins); err != nil {
+		return err
+	}
+	fmt.Fprintln(out)
+	table := tablewriter.NewWriter(out)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeader([]string{"Login", "IP"})
+	for _, l := range logins {
+		table.Append([]string{date(l.Time), l.IP})
+	}
+	table.Render()
+	return nil
+}
+
+func NewCmdPasswd(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "passwd",
+		Short: "Change your password",
+		Long: `Change your password, the old one is required.
+
+The new password must satisfy the password policy of the server. The request
+is made with the old password instead of the token of fctl login, and a
+password kept in ~/.grape/config.yaml is replaced by the new one.`,
+		Example: passwdExample,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(runPasswd(f, out))
+		},
+	}
+	return cmd
+}
+
+func runPasswd(f cmdutil.Factory, out io.Writer) error {
+	if f.Username == "" {
+		return fmt.Errorf("no username in %s", viper.ConfigFileUsed())
+	}
+	old, err := readPassword(out, "Old password: ")
+	if err != nil {
+		return err
+	}
+	pass, err := readPassword(out, "New password: ")
+	if err != nil {
+		return err
+	}
+	again, err := readPassword(out, "Repeat the new password: ")
+	if err != nil {
+		return err
+	}
+	if pass != again {
+		return fmt.Errorf("the new passwords differ")
+	}
+
+	auth := base64.StdEncoding.EncodeToString([]byte(f.Username + ":" + old))
+	request := f.Gorequest()
+	resp, body, errs := request.Post("http://"+f.Server+"/-/me/passwd").
+		Set("Authorization", "Basic "+auth).
+		Send(map[string]string{"oldPassword": old, "password": pass}).
+		End()
+	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+		return fmt.Errorf("%s", strings.TrimRight(err.Error(), "\n"))
+	}
+
+	if f.Password != "" {
+		viper.Set("password", pass)
+		if err := writeConfig(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(out, "Password of %s changed\n", f.Username)
+	return nil
+}
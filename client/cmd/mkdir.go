@@ -6,7 +6,6 @@ Description: test cmd tool
 package cmd
 
 import (
-	"fmt"
 	"io"
 
 	"grapehttp/client/cmd/templates"
@@ -43,27 +42,16 @@ func NewCmdMkdir(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Comm
 }
 
 func RunMkdir(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, cmd *cobra.Command, args []string) error {
-	cmdArgs := []string{}
-	if cmdutil.GetFlagBool(cmd, "parents") {
-		cmdArgs = append(cmdArgs, "-p")
+	req := cmdRequest{
+		Name:    "mkdir",
+		Paths:   args,
+		Options: cmdOptions{Parents: cmdutil.GetFlagBool(cmd, "parents")},
 	}
 
-	req := struct {
-		Name  string   `json:"name"`
-		Args  []string `json:"args"`
-		Paths []string `json:"paths"`
-	}{"mkdir", cmdArgs, args}
-
-	request := f.Gorequest()
-	resp, body, errs := request.Get("http://"+f.Server+"/-/cmd").
-		Set("Authorization", "Basic "+f.Auth()).
-		Send(req).
-		End()
-
-	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+	res, err := runServerCmd(f, req)
+	if err != nil {
 		return err
 	}
 
-	fmt.Printf("%s", body)
-	return nil
+	return res.reportErrors(cmdErr)
 }
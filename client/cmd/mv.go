@@ -43,27 +43,21 @@ func NewCmdMv(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command
 }
 
 func RunMv(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, cmd *cobra.Command, args []string) error {
-	cmdArgs := []string{}
-	if cmdutil.GetFlagBool(cmd, "force") {
-		cmdArgs = append(cmdArgs, "-f")
+	req := cmdRequest{
+		Name:    "mv",
+		Paths:   args,
+		Options: cmdOptions{Force: cmdutil.GetFlagBool(cmd, "force")},
 	}
 
-	req := struct {
-		Name  string   `json:"name"`
-		Args  []string `json:"args"`
-		Paths []string `json:"paths"`
-	}{"mv", cmdArgs, args}
-
-	request := f.Gorequest()
-	resp, body, errs := request.Get("http://"+f.Server+"/-/cmd").
-		Set("Authorization", "Basic "+f.Auth()).
-		Send(req).
-		End()
-
-	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+	res, err := runServerCmd(f, req)
+	if err != nil {
 		return err
 	}
 
-	fmt.Printf("%s", body)
-	return nil
+	for _, result := range res.Results {
+		if result.Error == "" {
+			fmt.Fprintf(out, "%s -> %s\n", result.Path, result.Dest)
+		}
+	}
+	return res.reportErrors(cmdErr)
 }
@@ -0,0 +1,8 @@
+// +build !linux
+
+package cmd
+
+// echoOff can not turn off the echo of the terminal here
+func echoOff() func() {
+	return func() {}
+}
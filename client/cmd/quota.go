@@ -0,0 +1,113 @@
+/*
+Author: lkong
+Description: test cmd tool
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"grapehttp/client/cmd/templates"
+	cmdutil "grapehttp/client/cmd/util"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// quotaUsage is a quota as /-/quota answers it, max 0 is no limit
+type quotaUsage struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Bytes    int64  `json:"bytes"`
+	Files    int64  `json:"files"`
+	MaxBytes int64  `json:"maxBytes"`
+	MaxFiles int64  `json:"maxFiles"`
+}
+
+var (
+	quotaExample = templates.Examples(`
+		# Show what you own and the quotas of the directories above /data/upload
+		fctl quota /data/upload
+
+		# Show what alice owns (admins and auditors)
+		fctl quota --user alice`)
+)
+
+func NewCmdQuota(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "quota [PATH]",
+		Short: "Show the quotas and how much of them is used",
+		Long: `Show the bytes and the files you own and your quota, and the quotas of
+PATH and the directories above it.
+
+User quotas are set with fctl add and fctl modify, the quotas of directories
+in their .ghs.yml. Uploads, cp and mv which do not fit are refused.`,
+		Example: quotaExample,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 1 {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			cmdutil.CheckErr(runQuota(f, out, cmd, args))
+		},
+	}
+	cmd.Flags().String("user", "", "show the files of this user instead of yours")
+	return cmd
+}
+
+func runQuota(f cmdutil.Factory, out io.Writer, cmd *cobra.Command, args []string) error {
+	path := "/"
+	if len(args) > 0 {
+		path = args[0]
+	}
+	query := url.Values{"path": {path}}
+	if user := cmdutil.GetFlagString(cmd, "user"); user != "" {
+		query.Set("user", user)
+	}
+	request := f.Gorequest()
+	resp, body, errs := request.Get("http://"+f.Server+"/-/quota").
+		Set("Authorization", f.Authorization()).
+		Query(query.Encode()).
+		End()
+	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+		return fmt.Errorf("%s", strings.TrimRight(err.Error(), "\n"))
+	}
+	report := struct {
+		User   quotaUsage   `json:"user"`
+		Path   string       `json:"path"`
+		Quotas []quotaUsage `json:"quotas"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		return err
+	}
+
+	table := tablewriter.NewWriter(out)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeader([]string{"Quota", "Bytes", "Files"})
+	row := func(name string, q quotaUsage) {
+		table.Append([]string{
+			name,
+			quotaString(humanSize(q.Bytes), humanSize(q.MaxBytes), q.MaxBytes),
+			quotaString(strconv.FormatInt(q.Files, 10), strconv.FormatInt(q.MaxFiles, 10), q.MaxFiles),
+		})
+	}
+	row("user "+report.User.Name, report.User)
+	for _, q := range report.Quotas {
+		row(q.Name, q)
+	}
+	table.Render()
+	return nil
+}
+
+// quotaString is used of max, or only used without a limit
+func quotaString(used, max string, limit int64) string {
+	if limit <= 0 {
+		return used
+	}
+	return used + " / " + max
+}
@@ -0,0 +1,281 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	cmdutil "grapehttp/client/cmd/util"
+
+	"github.com/fatih/color"
+)
+
+// transferReport collects the outcome of a batch of uploads or downloads.
+// Files are skipped when .ghs.yml rules do not allow the transfer, and failed
+// on any other error.
+type transferReport struct {
+	mu      sync.Mutex
+	done    int
+	skipped []string
+	failed  []string
+}
+
+func (r *transferReport) ok() {
+	r.mu.Lock()
+	r.done++
+	r.mu.Unlock()
+}
+
+func (r *transferReport) skip(name string, reason string) {
+	r.mu.Lock()
+	r.skipped = append(r.skipped, fmt.Sprintf("%s: %s", name, reason))
+	r.mu.Unlock()
+}
+
+func (r *transferReport) fail(name string, err error) {
+	r.mu.Lock()
+	r.failed = append(r.failed, fmt.Sprintf("%s: %v", name, err))
+	r.mu.Unlock()
+}
+
+func (r *transferReport) printDetails(out io.Writer) {
+	for _, s := range r.skipped {
+		fmt.Fprintln(out, color.YellowString("skipped %s", s))
+	}
+	for _, s := range r.failed {
+		fmt.Fprintln(out, color.YellowString("failed  %s", s))
+	}
+}
+
+func (r *transferReport) err() error {
+	if len(r.failed) > 0 {
+		return fmt.Errorf("%d of %d files failed", len(r.failed), r.done+len(r.skipped)+len(r.failed))
+	}
+	return nil
+}
+
+// finish prints skipped and failed files and a summary line if summary is
+// set, otherwise the errors were already shown while transferring.
+func (r *transferReport) finish(out io.Writer, verb string, summary bool) error {
+	if summary {
+		r.printDetails(out)
+		fmt.Fprintf(out, "%d %s, %d skipped, %d failed\n", r.done, verb, len(r.skipped), len(r.failed))
+	}
+	return r.err()
+}
+
+// runParallel calls fn for 0..count-1, at most n at a time.
+func runParallel(n, count int, fn func(i int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, n)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// statusError is a non 200 response of the server
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+func isForbidden(err error) bool {
+	se, ok := err.(*statusError)
+	return ok && se.code == http.StatusForbidden
+}
+
+// remoteEntry is a file in the /-/json listing
+type remoteEntry struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Type    string `json:"type"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+// listRemoteDir returns the entries of a remote directory, without the files
+// hidden by .ghs.yml.
+func listRemoteDir(f cmdutil.Factory, dir string) ([]remoteEntry, error) {
+	req, err := f.NewRequest("GET", "/-/json"+escapePath(dir), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{resp.StatusCode, strings.TrimRight(string(body), "\n")}
+	}
+
+	list := struct {
+		Files []remoteEntry `json:"files"`
+	}{}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+	for i := range list.Files {
+		list.Files[i].Path = path.Clean("/" + list.Files[i].Path)
+	}
+	return list.Files, nil
+}
+
+// makeRemoteDirs creates dirs on the server and returns the error message of
+// every directory which could not be created. Parents have to come before
+// their children, so one mkdir -p does it all.
+func makeRemoteDirs(f cmdutil.Factory, dirs []string) (map[string]string, error) {
+	broken := make(map[string]string)
+	if len(dirs) == 0 {
+		return broken, nil
+	}
+	res, err := runServerCmd(f, cmdRequest{Name: "mkdir", Paths: dirs, Options: cmdOptions{Parents: true}})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range res.Results {
+		if r.Error != "" {
+			broken[path.Clean("/"+r.Path)] = r.Error
+		}
+	}
+	return broken, nil
+}
+
+type uploadJob struct {
+	filename string
+	dstDir   string
+}
+
+// collectUploads walks the local directory root and recreates it under dstDir
+// on the server. It returns the files to upload, files in directories the
+// server refused to create are reported as skipped or failed.
+func collectUploads(f cmdutil.Factory, report *transferReport, root, dstDir string) []uploadJob {
+	root = filepath.Clean(root)
+	base := filepath.Base(root)
+	if abs, err := filepath.Abs(root); err == nil {
+		base = filepath.Base(abs)
+	}
+	remoteRoot := path.Join(dstDir, base)
+
+	dirs := []string{}
+	jobs := []uploadJob{}
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			report.fail(p, err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		remote := path.Join(remoteRoot, filepath.ToSlash(rel))
+		if info.IsDir() {
+			dirs = append(dirs, remote)
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Stat(p); err == nil {
+				info = target
+			}
+		}
+		if !info.Mode().IsRegular() {
+			report.skip(p, "not a regular file")
+			return nil
+		}
+		jobs = append(jobs, uploadJob{p, path.Dir(remote)})
+		return nil
+	})
+
+	broken, err := makeRemoteDirs(f, dirs)
+	if err != nil {
+		for _, job := range jobs {
+			report.fail(job.filename, err)
+		}
+		return nil
+	}
+
+	ready := []uploadJob{}
+	for _, job := range jobs {
+		reason, ok := broken[job.dstDir]
+		switch {
+		case !ok:
+			ready = append(ready, job)
+		case strings.Contains(reason, "forbidden"):
+			report.skip(job.filename, job.dstDir+": "+reason)
+		default:
+			report.fail(job.filename, fmt.Errorf("%s: %s", job.dstDir, reason))
+		}
+	}
+	return ready
+}
+
+type downloadJob struct {
+	name       string // local path, relative to the output directory
+	remotePath string
+}
+
+// collectDownloads walks the remote tree below remoteRoot and creates the
+// matching local directories below output. A remoteRoot which is a file is
+// returned as a single job.
+func collectDownloads(f cmdutil.Factory, report *transferReport, output, remoteRoot string) []downloadJob {
+	remoteRoot = path.Clean("/" + remoteRoot)
+	base := path.Base(remoteRoot)
+	jobs := []downloadJob{}
+
+	var walk func(dir string, top bool)
+	walk = func(dir string, top bool) {
+		entries, err := listRemoteDir(f, dir)
+		if se, ok := err.(*statusError); ok && top && se.code == http.StatusBadRequest {
+			jobs = append(jobs, downloadJob{base, remoteRoot})
+			return
+		}
+		if isForbidden(err) {
+			report.skip(dir, err.Error())
+			return
+		}
+		if err != nil {
+			report.fail(dir, err)
+			return
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(dir, remoteRoot), "/")
+		if err := os.MkdirAll(filepath.Join(output, base, filepath.FromSlash(rel)), 0755); err != nil {
+			report.fail(dir, err)
+			return
+		}
+		for _, e := range entries {
+			if e.Type == "dir" {
+				walk(e.Path, false)
+				continue
+			}
+			rel := strings.TrimPrefix(strings.TrimPrefix(e.Path, remoteRoot), "/")
+			jobs = append(jobs, downloadJob{filepath.Join(base, filepath.FromSlash(rel)), e.Path})
+		}
+	}
+	walk(remoteRoot, true)
+	return jobs
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cmdutil "grapehttp/client/cmd/util"
+)
+
+func TestUploadOptions(t *testing.T) {
+	tests := []struct {
+		args []string
+		want UploadOptions
+		err  bool
+	}{
+		{nil, UploadOptions{chunkSize: 8 << 20, retries: 3, jobs: 4}, false},
+		{[]string{"-r", "-j", "8", "--resume", "--chunk-size", "1"},
+			UploadOptions{resume: true, chunkSize: 1 << 20, retries: 3, recursive: true, jobs: 8}, false},
+		{[]string{"--chunk-size", "0"}, UploadOptions{}, true},
+		{[]string{"-j", "0"}, UploadOptions{}, true},
+	}
+	for _, v := range tests {
+		cmd := NewCmdUpload(cmdutil.Factory{}, ioutil.Discard, ioutil.Discard)
+		if err := cmd.ParseFlags(v.args); err != nil {
+			t.Fatal(err)
+		}
+		o := UploadOptions{}
+		err := o.Complete(cmd)
+		if (err != nil) != v.err {
+			t.Errorf("%v: got error %v", v.args, err)
+			continue
+		}
+		if err == nil && o != v.want {
+			t.Errorf("%v: got %+v, want %+v", v.args, o, v.want)
+		}
+	}
+}
+
+func TestRunParallel(t *testing.T) {
+	var mu sync.Mutex
+	running, most, calls := 0, 0, make([]int, 10)
+	runParallel(3, len(calls), func(i int) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		calls[i]++
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	if most > 3 {
+		t.Errorf("%d running at the same time", most)
+	}
+	for i, n := range calls {
+		if n != 1 {
+			t.Errorf("job %d run %d times", i, n)
+		}
+	}
+}
+
+func TestCollectUploads(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "build")
+	for _, name := range []string{"a.txt", "sub/b.txt", "ro/c.txt", "bad/d.txt"} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0755)
+		ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0644)
+	}
+
+	var got cmdRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/-/cmd" || json.NewDecoder(r.Body).Decode(&got) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		res := cmdResponse{Name: got.Name}
+		for _, p := range got.Paths {
+			result := cmdResult{Path: p}
+			switch p {
+			case "/up/build/ro":
+				result.Error = "forbidden"
+			case "/up/build/bad":
+				result.Error = "disk full"
+			}
+			res.Results = append(res.Results, result)
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer ts.Close()
+	f := cmdutil.Factory{Server: strings.TrimPrefix(ts.URL, "http://"), Timeout: 5}
+
+	report := &transferReport{}
+	jobs := collectUploads(f, report, root, "/up")
+	want := cmdRequest{Name: "mkdir", Paths: []string{"/up/build", "/up/build/bad", "/up/build/ro", "/up/build/sub"}, Options: cmdOptions{Parents: true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mkdir: got %+v, want %+v", got, want)
+	}
+	wantJobs := []uploadJob{
+		{filepath.Join(root, "a.txt"), "/up/build"},
+		{filepath.Join(root, "sub", "b.txt"), "/up/build/sub"},
+	}
+	if !reflect.DeepEqual(jobs, wantJobs) {
+		t.Errorf("jobs: got %v, want %v", jobs, wantJobs)
+	}
+	if len(report.skipped) != 1 || !strings.Contains(report.skipped[0], "c.txt") {
+		t.Errorf("skipped: %v", report.skipped)
+	}
+	if len(report.failed) != 1 || !strings.Contains(report.failed[0], "disk full") {
+		t.Errorf("failed: %v", report.failed)
+	}
+}
+
+func TestCollectDownloads(t *testing.T) {
+	listings := map[string]string{
+		"/-/json/lkong":         `{"files":[{"name":"a.txt","path":"lkong/a.txt","type":"file"},{"name":"sub","path":"lkong/sub","type":"dir"},{"name":"secret","path":"lkong/secret","type":"dir"}]}`,
+		"/-/json/lkong/sub":     `{"files":[{"name":"b c.txt","path":"lkong/sub/b c.txt","type":"file"}]}`,
+		"/-/json/lkong/file.gz": "",
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch body, ok := listings[r.URL.Path]; {
+		case r.URL.Path == "/-/json/lkong/secret":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		case ok && body == "":
+			http.Error(w, "not a directory", http.StatusBadRequest)
+		case ok:
+			w.Write([]byte(body))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	f := cmdutil.Factory{Server: strings.TrimPrefix(ts.URL, "http://")}
+
+	output := t.TempDir()
+	report := &transferReport{}
+	jobs := collectDownloads(f, report, output, "lkong/")
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].remotePath < jobs[j].remotePath })
+	want := []downloadJob{
+		{filepath.Join("lkong", "a.txt"), "/lkong/a.txt"},
+		{filepath.Join("lkong", "sub", "b c.txt"), "/lkong/sub/b c.txt"},
+	}
+	if !reflect.DeepEqual(jobs, want) {
+		t.Errorf("jobs: got %v, want %v", jobs, want)
+	}
+	if info, err := os.Stat(filepath.Join(output, "lkong", "sub")); err != nil || !info.IsDir() {
+		t.Errorf("local directory not created: %v", err)
+	}
+	if len(report.skipped) != 1 || !strings.HasPrefix(report.skipped[0], "/lkong/secret") || len(report.failed) != 0 {
+		t.Errorf("report: skipped %v, failed %v", report.skipped, report.failed)
+	}
+
+	// a file is downloaded as it is
+	jobs = collectDownloads(f, &transferReport{}, output, "/lkong/file.gz")
+	if want := []downloadJob{{"file.gz", "/lkong/file.gz"}}; !reflect.DeepEqual(jobs, want) {
+		t.Errorf("file: got %v, want %v", jobs, want)
+	}
+}
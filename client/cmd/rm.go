@@ -6,7 +6,6 @@ Description: test cmd tool
 package cmd
 
 import (
-	"fmt"
 	"io"
 
 	"grapehttp/client/cmd/templates"
@@ -17,14 +16,11 @@ import (
 
 var (
 	rmExample = templates.Examples(`
-	# Command desc
-	fctl rm
+	# Remove files
+	fctl rm /lkong/api.log /lkong/test.txt
 
-	# Command desc
-	fctl rm -u lkong update
-
-	# Command desc
-	fctl rm -c download`)
+	# Remove a directory and its contents
+	fctl rm -r /lkong/tmp`)
 
 	blackPath = []string{"", "/", "/bin", "/boot", "/dev", "/etc", "/home", "/lib", "/lib64", "/media", "/mnt", "/opt", "/proc", "/root", "/run", "/srv", "/sys", "/var", "/usr", "/data"}
 )
@@ -44,35 +40,25 @@ func NewCmdRm(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command
 		},
 	}
 
-	cmd.Flags().BoolP("force", "f", false, "gnore nonexistent files and arguments, never prompt")
+	cmd.Flags().BoolP("force", "f", false, "ignore nonexistent files and arguments, never prompt")
 	cmd.Flags().BoolP("recursive", "r", false, "remove directories and their contents recursively")
 	return cmd
 }
 
 func RunRm(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, cmd *cobra.Command, args []string) error {
-	cmdArgs := []string{}
-	if cmdutil.GetFlagBool(cmd, "force") {
-		cmdArgs = append(cmdArgs, "-f")
-	}
-	if cmdutil.GetFlagBool(cmd, "recursive") {
-		cmdArgs = append(cmdArgs, "-r")
+	req := cmdRequest{
+		Name:  "rm",
+		Paths: args,
+		Options: cmdOptions{
+			Force:     cmdutil.GetFlagBool(cmd, "force"),
+			Recursive: cmdutil.GetFlagBool(cmd, "recursive"),
+		},
 	}
-	req := struct {
-		Name  string   `json:"name"`
-		Args  []string `json:"args"`
-		Paths []string `json:"paths"`
-	}{"rm", cmdArgs, args}
-
-	request := f.Gorequest()
-	resp, body, errs := request.Get("http://"+f.Server+"/-/cmd").
-		Set("Authorization", "Basic "+f.Auth()).
-		Send(req).
-		End()
 
-	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+	res, err := runServerCmd(f, req)
+	if err != nil {
 		return err
 	}
 
-	fmt.Printf("%s", body)
-	return nil
+	return res.reportErrors(cmdErr)
 }
@@ -0,0 +1,510 @@
+/*
+Author: lkong
+Description: test cmd tool
+*/
+
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"grapehttp/client/cmd/templates"
+	cmdutil "grapehttp/client/cmd/util"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/vbauerster/mpb"
+)
+
+// ghsConfig holds the access rules of a server directory, sync never deletes it
+const ghsConfig = ".ghs.yml"
+
+type SyncOptions struct {
+	pull     bool
+	delete   bool
+	dryRun   bool
+	checksum bool
+	include  []string
+	exclude  []string
+	jobs     int
+}
+
+// syncEntry is a file or directory of either side, keyed by its slash
+// separated path relative to the synced directory.
+type syncEntry struct {
+	isDir bool
+	size  int64
+	mtime int64 // unix seconds
+}
+
+var (
+	syncExample = templates.Examples(`
+		# Upload new and changed files of build into /release/build
+		fctl sync build /release/build
+
+		# Mirror /release/build into build, removing files which are gone on the server
+		fctl sync --pull --delete /release/build build
+
+		# Show what would be uploaded, comparing checksums instead of modification times
+		fctl sync -c --dry-run --exclude '*.log' build /release/build`)
+)
+
+func NewCmdSync(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "sync SOURCE_DIR DEST_DIR",
+		Short:   "Synchronize a local directory with a remote directory",
+		Long:    "Synchronize the contents of a local directory to a remote directory, or the reverse with --pull. Only new and changed files are transferred.",
+		Example: syncExample,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 2 {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			options := new(SyncOptions)
+			cmdutil.CheckErr(options.Complete(cmd))
+			cmdutil.CheckErr(options.Run(f, out, cmdErr, args))
+			return
+		},
+	}
+
+	cmd.Flags().Bool("pull", false, "sync from the remote SOURCE_DIR to the local DEST_DIR")
+	cmd.Flags().Bool("delete", false, "delete files in DEST_DIR which do not exist in SOURCE_DIR")
+	cmd.Flags().Bool("dry-run", false, "only show what would be done")
+	cmd.Flags().BoolP("checksum", "c", false, "compare files by sha256 checksum instead of size and modification time")
+	cmd.Flags().StringArray("include", nil, "only sync files matching `PATTERN`, can be repeated")
+	cmd.Flags().StringArray("exclude", nil, "skip files and directories matching `PATTERN`, can be repeated")
+	cmd.Flags().IntP("jobs", "j", 4, "transfer at most `N` files at the same time")
+	return cmd
+}
+
+func (o *SyncOptions) Complete(cmd *cobra.Command) error {
+	o.pull = cmdutil.GetFlagBool(cmd, "pull")
+	o.delete = cmdutil.GetFlagBool(cmd, "delete")
+	o.dryRun = cmdutil.GetFlagBool(cmd, "dry-run")
+	o.checksum = cmdutil.GetFlagBool(cmd, "checksum")
+	o.include = cmdutil.GetFlagStringArray(cmd, "include")
+	o.exclude = cmdutil.GetFlagStringArray(cmd, "exclude")
+	o.jobs = cmdutil.GetFlagInt(cmd, "jobs")
+	if o.jobs < 1 {
+		return fmt.Errorf("--jobs must be at least 1")
+	}
+	for _, pattern := range append(o.include, o.exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchPattern matches pattern against the relative path and the base name
+func matchPattern(pattern, rel string) bool {
+	if ok, _ := path.Match(pattern, rel); ok {
+		return true
+	}
+	ok, _ := path.Match(pattern, path.Base(rel))
+	return ok
+}
+
+// excluded reports whether rel is filtered out. Includes only apply to files,
+// so that directories are still walked for matching files.
+func (o *SyncOptions) excluded(rel string, isDir bool) bool {
+	for _, pattern := range o.exclude {
+		if matchPattern(pattern, rel) {
+			return true
+		}
+	}
+	if isDir || len(o.include) == 0 {
+		return false
+	}
+	for _, pattern := range o.include {
+		if matchPattern(pattern, rel) {
+			return false
+		}
+	}
+	return true
+}
+
+// parentDirs returns all parent directories of rel, nearest first
+func parentDirs(rel string) []string {
+	dirs := []string{}
+	for dir := path.Dir(rel); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+func (o *SyncOptions) localTree(root string, report *transferReport) (map[string]syncEntry, error) {
+	tree := make(map[string]syncEntry)
+	if _, err := os.Stat(root); os.IsNotExist(err) && o.pull {
+		return tree, nil
+	}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			report.fail(p, err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", root)
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Stat(p); err == nil && target.Mode().IsRegular() {
+				info = target
+			}
+		}
+		if o.excluded(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			if !o.pull {
+				report.skip(p, "not a regular file")
+			}
+			return nil
+		}
+		tree[rel] = syncEntry{info.IsDir(), info.Size(), info.ModTime().Unix()}
+		return nil
+	})
+	return tree, err
+}
+
+// remoteTree lists root recursively. Directories the server does not allow to
+// list are returned in blocked, nothing below them is touched.
+func (o *SyncOptions) remoteTree(f cmdutil.Factory, root string, report *transferReport) (map[string]syncEntry, []string, error) {
+	tree := make(map[string]syncEntry)
+	blocked := []string{}
+
+	var walk func(dir, rel string) error
+	walk = func(dir, rel string) error {
+		entries, err := listRemoteDir(f, dir)
+		if err != nil {
+			if rel == "" {
+				return err
+			}
+			if isForbidden(err) {
+				report.skip(dir, err.Error())
+				blocked = append(blocked, rel)
+				return nil
+			}
+			return fmt.Errorf("%s: %v", dir, err)
+		}
+	next:
+		for _, e := range entries {
+			rel := strings.TrimPrefix(strings.TrimPrefix(e.Path, root), "/")
+			isDir := e.Type == "dir"
+			// single child directories are listed collapsed, like a/b/c
+			parents := parentDirs(rel)
+			for _, parent := range parents {
+				if o.excluded(parent, true) {
+					continue next
+				}
+			}
+			if o.excluded(rel, isDir) {
+				continue
+			}
+			for _, parent := range parents {
+				tree[parent] = syncEntry{isDir: true}
+			}
+			tree[rel] = syncEntry{isDir, e.Size, e.ModTime / 1000}
+			if isDir {
+				if err := walk(e.Path, rel); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	err := walk(root, "")
+	if se, ok := err.(*statusError); ok {
+		if se.code == http.StatusNotFound && !o.pull {
+			return tree, blocked, nil
+		}
+		return nil, nil, fmt.Errorf("%s: %v", root, err)
+	}
+	return tree, blocked, err
+}
+
+func isBlocked(rel string, blocked []string) bool {
+	for _, dir := range blocked {
+		if rel == dir || strings.HasPrefix(rel, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *SyncOptions) Run(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, args []string) error {
+	localRoot, remoteRoot := args[0], args[1]
+	if o.pull {
+		localRoot, remoteRoot = args[1], args[0]
+	}
+	localRoot = filepath.Clean(localRoot)
+	remoteRoot = path.Clean("/" + remoteRoot)
+
+	report := &transferReport{}
+	local, err := o.localTree(localRoot, report)
+	if err != nil {
+		return err
+	}
+	remote, blocked, err := o.remoteTree(f, remoteRoot, report)
+	if err != nil {
+		return err
+	}
+	source, dest := local, remote
+	if o.pull {
+		source, dest = remote, local
+	}
+
+	// compare both trees
+	rels := make([]string, 0, len(source))
+	for rel := range source {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	mkdirs, transfers, same := []string{}, []string{}, []string{}
+	for _, rel := range rels {
+		if isBlocked(rel, blocked) {
+			continue
+		}
+		se := source[rel]
+		de, ok := dest[rel]
+		switch {
+		case ok && de.isDir != se.isDir:
+			report.fail(rel, fmt.Errorf("file and directory conflict"))
+		case se.isDir:
+			if !ok {
+				mkdirs = append(mkdirs, rel)
+			}
+		case !ok || de.size != se.size:
+			transfers = append(transfers, rel)
+		case o.checksum:
+			same = append(same, rel)
+		case de.mtime != se.mtime:
+			transfers = append(transfers, rel)
+		default:
+			same = append(same, rel)
+		}
+	}
+	if o.checksum {
+		var mu sync.Mutex
+		unchanged := []string{}
+		runParallel(o.jobs, len(same), func(i int) {
+			equal, err := o.sameChecksum(f, filepath.Join(localRoot, filepath.FromSlash(same[i])), path.Join(remoteRoot, same[i]))
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				report.fail(same[i], err)
+			case equal:
+				unchanged = append(unchanged, same[i])
+			default:
+				transfers = append(transfers, same[i])
+			}
+		})
+		same = unchanged
+		sort.Strings(transfers)
+	}
+
+	deletes := []string{}
+	if o.delete {
+		gone := make(map[string]bool)
+		extra := []string{}
+		for rel := range dest {
+			if _, ok := source[rel]; !ok && !isBlocked(rel, blocked) {
+				extra = append(extra, rel)
+			}
+		}
+		sort.Strings(extra)
+	extra:
+		for _, rel := range extra {
+			for _, parent := range parentDirs(rel) {
+				if gone[parent] {
+					continue extra
+				}
+			}
+			if !o.pull && path.Base(rel) == ghsConfig {
+				continue
+			}
+			gone[rel] = true
+			deletes = append(deletes, rel)
+		}
+	}
+
+	verb := "upload"
+	if o.pull {
+		verb = "download"
+	}
+	if o.dryRun {
+		for _, rel := range mkdirs {
+			fmt.Fprintf(out, "mkdir    %s\n", rel)
+		}
+		for _, rel := range transfers {
+			fmt.Fprintf(out, "%-8s %s\n", verb, rel)
+		}
+		for _, rel := range deletes {
+			fmt.Fprintf(out, "delete   %s\n", rel)
+		}
+		report.printDetails(out)
+		fmt.Fprintf(out, "dry run: %d to %s, %d to delete, %d unchanged, %d skipped, %d failed\n",
+			len(transfers), verb, len(deletes), len(same), len(report.skipped), len(report.failed))
+		return report.err()
+	}
+
+	var deleted int
+	if o.pull {
+		o.pullFiles(f, report, localRoot, remoteRoot, mkdirs, transfers)
+		deleted = o.deleteLocal(report, localRoot, deletes)
+	} else {
+		o.pushFiles(f, report, localRoot, remoteRoot, remote, mkdirs, transfers)
+		deleted = o.deleteRemote(f, report, remoteRoot, deletes)
+	}
+
+	report.printDetails(out)
+	fmt.Fprintf(out, "%d transferred, %d deleted, %d unchanged, %d skipped, %d failed\n",
+		report.done, deleted, len(same), len(report.skipped), len(report.failed))
+	return report.err()
+}
+
+func (o *SyncOptions) sameChecksum(f cmdutil.Factory, localPath, remotePath string) (bool, error) {
+	remote, err := getRemoteChecksum(f, remotePath, "sha256")
+	if err != nil {
+		return false, err
+	}
+	local, err := fileChecksum(localPath, "sha256")
+	if err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(local) == remote, nil
+}
+
+func (o *SyncOptions) pushFiles(f cmdutil.Factory, report *transferReport, localRoot, remoteRoot string,
+	remote map[string]syncEntry, mkdirs, transfers []string) {
+	dirs := []string{}
+	if len(remote) == 0 {
+		// the remote directory may not exist yet
+		dirs = append(dirs, remoteRoot)
+	}
+	for _, rel := range mkdirs {
+		dirs = append(dirs, path.Join(remoteRoot, rel))
+	}
+	broken, err := makeRemoteDirs(f, dirs)
+	if err != nil {
+		for _, rel := range transfers {
+			report.fail(rel, err)
+		}
+		return
+	}
+
+	p := mpb.New()
+	uploader := &UploadOptions{resume: true, chunkSize: 8 << 20, retries: 3}
+	runParallel(o.jobs, len(transfers), func(i int) {
+		rel := transfers[i]
+		dstDir := path.Dir(path.Join(remoteRoot, rel))
+		if reason, ok := broken[dstDir]; ok {
+			if strings.Contains(reason, "forbidden") {
+				report.skip(rel, dstDir+": "+reason)
+			} else {
+				report.fail(rel, fmt.Errorf("%s: %s", dstDir, reason))
+			}
+			return
+		}
+		err := uploader.upload(f, p, filepath.Join(localRoot, filepath.FromSlash(rel)), dstDir)
+		switch {
+		case err == nil:
+			report.ok()
+		case strings.Contains(err.Error(), "forbidden"):
+			report.skip(rel, err.Error())
+		default:
+			report.fail(rel, err)
+		}
+	})
+	p.Stop()
+}
+
+func (o *SyncOptions) pullFiles(f cmdutil.Factory, report *transferReport, localRoot, remoteRoot string, mkdirs, transfers []string) {
+	if err := os.MkdirAll(localRoot, 0755); err != nil {
+		report.fail(localRoot, err)
+		return
+	}
+	for _, rel := range mkdirs {
+		if err := os.MkdirAll(filepath.Join(localRoot, filepath.FromSlash(rel)), 0755); err != nil {
+			report.fail(rel, err)
+		}
+	}
+
+	p := mpb.New()
+	downloader := &DownloadOptions{output: localRoot, parallel: 1}
+	runParallel(o.jobs, len(transfers), func(i int) {
+		rel := transfers[i]
+		if err := downloader.download(f, p, filepath.FromSlash(rel), path.Join(remoteRoot, rel)); err != nil {
+			report.fail(rel, err)
+		} else {
+			report.ok()
+		}
+	})
+	p.Stop()
+}
+
+func (o *SyncOptions) deleteLocal(report *transferReport, localRoot string, deletes []string) int {
+	deleted := 0
+	for _, rel := range deletes {
+		if err := os.RemoveAll(filepath.Join(localRoot, filepath.FromSlash(rel))); err != nil {
+			report.fail(rel, err)
+			continue
+		}
+		deleted++
+	}
+	return deleted
+}
+
+func (o *SyncOptions) deleteRemote(f cmdutil.Factory, report *transferReport, remoteRoot string, deletes []string) int {
+	if len(deletes) == 0 {
+		return 0
+	}
+	paths := make([]string, len(deletes))
+	for i, rel := range deletes {
+		paths[i] = path.Join(remoteRoot, rel)
+	}
+	res, err := runServerCmd(f, cmdRequest{Name: "rm", Paths: paths, Options: cmdOptions{Recursive: true}})
+	if err != nil {
+		color.Yellow("rm: %v", err)
+		for _, rel := range deletes {
+			report.fail(rel, err)
+		}
+		return 0
+	}
+	deleted := 0
+	for _, r := range res.Results {
+		switch {
+		case r.Error == "":
+			deleted++
+		case strings.Contains(r.Error, "forbidden"):
+			report.skip(r.Path, r.Error)
+		default:
+			report.fail(r.Path, fmt.Errorf("%s", r.Error))
+		}
+	}
+	return deleted
+}
@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cmdutil "grapehttp/client/cmd/util"
+)
+
+func TestSyncOptions(t *testing.T) {
+	tests := []struct {
+		args []string
+		want SyncOptions
+		err  bool
+	}{
+		{nil, SyncOptions{include: []string{}, exclude: []string{}, jobs: 4}, false},
+		{[]string{"--pull", "--delete", "--dry-run", "-c", "-j", "2", "--include", "*.go", "--include", "Makefile", "--exclude", "vendor"},
+			SyncOptions{pull: true, delete: true, dryRun: true, checksum: true, include: []string{"*.go", "Makefile"}, exclude: []string{"vendor"}, jobs: 2}, false},
+		{[]string{"--exclude", "[a-"}, SyncOptions{}, true},
+		{[]string{"-j", "0"}, SyncOptions{}, true},
+	}
+	for _, v := range tests {
+		cmd := NewCmdSync(cmdutil.Factory{}, ioutil.Discard, ioutil.Discard)
+		if err := cmd.ParseFlags(v.args); err != nil {
+			t.Fatal(err)
+		}
+		o := SyncOptions{}
+		err := o.Complete(cmd)
+		if (err != nil) != v.err {
+			t.Errorf("%v: got error %v", v.args, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(o, v.want) {
+			t.Errorf("%v: got %+v, want %+v", v.args, o, v.want)
+		}
+	}
+}
+
+func TestSyncExcluded(t *testing.T) {
+	o := SyncOptions{include: []string{"*.go"}, exclude: []string{"vendor", "cmd/*_test.go"}}
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"main.go", false, false},
+		{"cmd/run.go", false, false},
+		{"cmd/run_test.go", false, true},
+		{"README.md", false, true},
+		{"cmd", true, false},
+		{"vendor", true, true},
+		{"lib/vendor", true, true},
+	}
+	for _, v := range tests {
+		if got := o.excluded(v.rel, v.isDir); got != v.want {
+			t.Errorf("excluded(%q, %v) = %v, want %v", v.rel, v.isDir, got, v.want)
+		}
+	}
+
+	if got := parentDirs("a/b/c.txt"); !reflect.DeepEqual(got, []string{"a/b", "a"}) {
+		t.Errorf("parentDirs: got %v", got)
+	}
+	if got := parentDirs("c.txt"); len(got) != 0 {
+		t.Errorf("parentDirs of a top level file: got %v", got)
+	}
+	blocked := []string{"secret"}
+	for rel, want := range map[string]bool{"secret": true, "secret/a.txt": true, "secrets": false, "pub/secret": false} {
+		if got := isBlocked(rel, blocked); got != want {
+			t.Errorf("isBlocked(%q) = %v, want %v", rel, got, want)
+		}
+	}
+}
+
+func TestSyncDryRun(t *testing.T) {
+	mtime := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	local := filepath.Join(t.TempDir(), "build")
+	for name, content := range map[string]string{
+		"same.txt":     "same",
+		"changed.txt":  "old",
+		"new.txt":      "new",
+		"newdir/x.txt": "x",
+		"app.log":      "log",
+	} {
+		p := filepath.Join(local, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		ioutil.WriteFile(p, []byte(content), 0644)
+		os.Chtimes(p, mtime, mtime)
+	}
+
+	ms := mtime.Unix() * 1000
+	listings := map[string]string{
+		"/-/json/rel": fmt.Sprintf(`{"files":[
+			{"path":"rel/same.txt","type":"file","size":4,"mtime":%d},
+			{"path":"rel/changed.txt","type":"file","size":5,"mtime":%d},
+			{"path":"rel/old.txt","type":"file","size":1,"mtime":%d},
+			{"path":"rel/.ghs.yml","type":"file","size":10,"mtime":%d},
+			{"path":"rel/olddir","type":"dir"},
+			{"path":"rel/secret","type":"dir"}]}`, ms, ms, ms, ms),
+		"/-/json/rel/olddir": `{"files":[{"path":"rel/olddir/y.txt","type":"file","size":1}]}`,
+	}
+	var mu sync.Mutex
+	requests := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		if body, ok := listings[r.URL.Path]; ok {
+			w.Write([]byte(body))
+			return
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer ts.Close()
+	f := cmdutil.Factory{Server: strings.TrimPrefix(ts.URL, "http://")}
+
+	tests := []struct {
+		pull bool
+		args []string
+		want string
+	}{
+		{false, []string{local, "/rel"}, `mkdir    newdir
+upload   changed.txt
+upload   new.txt
+upload   newdir/x.txt
+delete   old.txt
+delete   olddir
+skipped /rel/secret: forbidden
+dry run: 3 to upload, 2 to delete, 1 unchanged, 1 skipped, 0 failed
+`},
+		{true, []string{"/rel", local}, `mkdir    olddir
+download .ghs.yml
+download changed.txt
+download old.txt
+download olddir/y.txt
+delete   new.txt
+delete   newdir
+skipped /rel/secret: forbidden
+dry run: 4 to download, 2 to delete, 1 unchanged, 1 skipped, 0 failed
+`},
+	}
+	for _, v := range tests {
+		o := SyncOptions{pull: v.pull, delete: true, dryRun: true, exclude: []string{"*.log"}, jobs: 1}
+		requests = nil
+		out := &bytes.Buffer{}
+		if err := o.Run(f, out, ioutil.Discard, v.args); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != v.want {
+			t.Errorf("%v: got\n%s\nwant\n%s", v.args, out, v.want)
+		}
+		for _, req := range requests {
+			if !strings.HasPrefix(req, "GET /-/json/") {
+				t.Errorf("%v: dry run sent %s", v.args, req)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(local, "new.txt")); err != nil {
+		t.Errorf("dry run deleted: %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Author: lkong
+Description: test cmd tool
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"grapehttp/client/cmd/templates"
+	cmdutil "grapehttp/client/cmd/util"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// apiToken is a token as the server lists it
+type apiToken struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Name     string    `json:"name"`
+	Scopes   []string  `json:"scopes"`
+	Paths    []string  `json:"paths"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	LastUsed time.Time `json:"lastUsed"`
+	Token    string    `json:"token"`
+}
+
+type tokenRequest struct {
+	Username string   `json:"username,omitempty"`
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	Paths    []string `json:"paths,omitempty"`
+	Expires  string   `json:"expires,omitempty"`
+}
+
+var (
+	tokenExample = templates.Examples(`
+		# Create a token for a CI job which may only upload below /ci/builds
+		fctl token create ci-upload --scope read,write --path /ci/builds --expires 90d
+
+		# List your tokens
+		fctl token list
+
+		# Revoke a token
+		fctl token revoke 3f9a1c2e`)
+)
+
+func NewCmdToken(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "token",
+		Short: "Create, list and revoke API tokens",
+		Long: `Create, list and revoke personal API tokens.
+
+A token is sent as "Authorization: Bearer <token>" instead of the username and
+password. Its scopes (read, write, delete, admin) limit what it may do, and
+with --path it only works below the given directories. Admin tokens can not
+be limited to paths.`,
+		Example: tokenExample,
+		Run:     runHelp,
+	}
+	cmd.AddCommand(NewCmdTokenCreate(f, out, cmdErr))
+	cmd.AddCommand(NewCmdTokenList(f, out, cmdErr))
+	cmd.AddCommand(NewCmdTokenRevoke(f, out, cmdErr))
+	return cmd
+}
+
+func NewCmdTokenCreate(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "create NAME",
+		Short: "Create a token and print it",
+		Long:  "Create a token and print it. The token is only shown once.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			req := tokenRequest{
+				Username: cmdutil.GetFlagString(cmd, "user"),
+				Name:     args[0],
+				Scopes:   cmdutil.GetFlagStringSlice(cmd, "scope"),
+				Paths:    cmdutil.GetFlagStringSlice(cmd, "path"),
+				Expires:  cmdutil.GetFlagString(cmd, "expires"),
+			}
+			t, err := createToken(f, f.Authorization(), req)
+			cmdutil.CheckErr(err)
+			fmt.Fprintln(out, t.Token)
+		},
+	}
+	cmd.Flags().StringSlice("scope", []string{"read"}, "scopes of the token: read, write, delete, admin")
+	cmd.Flags().StringSlice("path", nil, "only allow the token below these remote directories")
+	cmd.Flags().String("expires", "", "expiry as a duration (12h, 30d, 4w, 1y) or date (2024-12-31), default never")
+	cmd.Flags().String("user", "", "create the token for another user (admin only)")
+	return cmd
+}
+
+// createToken asks the server for a token with the given Authorization
+func createToken(f cmdutil.Factory, authorization string, req tokenRequest) (*apiToken, error) {
+	request := f.Gorequest()
+	resp, body, errs := request.Post("http://"+f.Server+"/-/token/create").
+		Set("Authorization", authorization).
+		Send(req).
+		End()
+
+	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+		return nil, fmt.Errorf("%s", strings.TrimRight(err.Error(), "\n"))
+	}
+	t := &apiToken{}
+	if err := json.Unmarshal([]byte(body), t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func NewCmdTokenList(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "list",
+		Short:   "List tokens",
+		Long:    "List your tokens, or as admin those of another user or of all users.",
+		Aliases: []string{"ls"},
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(runTokenList(f, out, cmd))
+		},
+	}
+	cmd.Flags().String("user", "", "list the tokens of this user (admins and auditors)")
+	cmd.Flags().Bool("all", false, "list the tokens of all users (admins and auditors)")
+	return cmd
+}
+
+func runTokenList(f cmdutil.Factory, out io.Writer, cmd *cobra.Command) error {
+	query := "user=" + cmdutil.GetFlagString(cmd, "user")
+	if cmdutil.GetFlagBool(cmd, "all") {
+		query = "all=true"
+	}
+	request := f.Gorequest()
+	resp, body, errs := request.Get("http://"+f.Server+"/-/token/list").
+		Set("Authorization", f.Authorization()).
+		Query(query).
+		End()
+
+	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+		return fmt.Errorf("%s", strings.TrimRight(err.Error(), "\n"))
+	}
+	tokens := []apiToken{}
+	if err := json.Unmarshal([]byte(body), &tokens); err != nil {
+		return err
+	}
+
+	date := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Local().Format("2006-01-02 15:04")
+	}
+	table := tablewriter.NewWriter(out)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetColWidth(TABLE_WIDTH)
+	table.SetHeader([]string{"ID", "Username", "Name", "Scopes", "Paths", "Created", "Expires", "Last used"})
+	for _, t := range tokens {
+		paths := strings.Join(t.Paths, ",")
+		if paths == "" {
+			paths = "/"
+		}
+		table.Append([]string{t.ID, t.Username, t.Name, strings.Join(t.Scopes, ","), paths,
+			date(t.Created), date(t.Expires), date(t.LastUsed)})
+	}
+	table.Render()
+	return nil
+}
+
+func NewCmdTokenRevoke(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "revoke ID...",
+		Short: "Revoke tokens",
+		Long:  "Revoke tokens by the ID shown by fctl token list.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) < 1 {
+				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
+			}
+			request := f.Gorequest()
+			resp, body, errs := request.Post("http://"+f.Server+"/-/token/revoke").
+				Set("Authorization", f.Authorization()).
+				Send(map[string][]string{"ids": args}).
+				End()
+
+			if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+				cmdutil.CheckErr(fmt.Errorf("%s", strings.TrimRight(err.Error(), "\n")))
+			}
+			fmt.Fprintf(out, "%s", body)
+		},
+	}
+	return cmd
+}
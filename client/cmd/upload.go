@@ -6,16 +6,18 @@ Description: test cmd tool
 package cmd
 
 import (
-	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
 
 	"grapehttp/client/cmd/templates"
 	cmdutil "grapehttp/client/cmd/util"
@@ -26,10 +28,40 @@ import (
 	"github.com/vbauerster/mpb/decor"
 )
 
+const uploadOffsetHeader = "Upload-Offset"
+
+type UploadOptions struct {
+	resume    bool
+	chunkSize int64
+	retries   int
+	verify    bool
+	recursive bool
+	jobs      int
+}
+
+// stagedUpload is the server side state of a resumable upload
+type stagedUpload struct {
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+	Mtime  int64  `json:"mtime"`
+}
+
 var (
 	uploadExample = templates.Examples(`
 		# Upload multiple files to http server
-		fctl upload test.txt api.txt /lkong`)
+		fctl upload test.txt api.txt /lkong
+
+		# Upload a directory tree, 8 files at a time
+		fctl upload -r -j 8 build /lkong
+
+		# Continue an interrupted upload
+		fctl upload --resume bigfile.tar.gz /lkong
+
+		# Compare the uploaded file with the server checksum
+		fctl upload --verify bigfile.tar.gz /lkong`)
 )
 
 func NewCmdUpload(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
@@ -42,73 +74,104 @@ func NewCmdUpload(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Com
 			if len(args) < 2 {
 				cmdutil.CheckErr(cmdutil.UsageErrorf(cmd, "Unexpected args: %v", args))
 			}
-			cmdutil.CheckErr(RunUpload(f, out, cmdErr, cmd, args))
+			options := new(UploadOptions)
+			cmdutil.CheckErr(options.Complete(cmd))
+			cmdutil.CheckErr(options.Run(f, out, cmdErr, args))
 			return
 		},
 		Aliases: []string{"up"},
 	}
 
+	cmd.Flags().Bool("resume", false, "continue interrupted uploads instead of starting over")
+	cmd.Flags().Int64("chunk-size", 8, "size of each uploaded chunk in MiB")
+	cmd.Flags().Int("retries", 3, "times to retry a failed chunk before giving up")
+	cmd.Flags().Bool("verify", false, "compare the sha256 checksum of each file with the server, fail on mismatch")
+	cmd.Flags().BoolP("recursive", "r", false, "upload directories and their contents recursively")
+	cmd.Flags().IntP("jobs", "j", 4, "upload at most `N` files at the same time")
 	return cmd
 }
 
-func RunUpload(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, cmd *cobra.Command, args []string) error {
-	var wg sync.WaitGroup
-	p := mpb.New(mpb.WithWaitGroup(&wg))
-	dstDir := args[len(args)-1]
-	url := "http://" + strings.Replace(f.Server+"/"+dstDir, "//", "/", -1)
-	args = append(args[:len(args)-1], args[len(args):]...) //删除最后一个
+func (o *UploadOptions) Complete(cmd *cobra.Command) error {
+	o.resume = cmdutil.GetFlagBool(cmd, "resume")
+	o.chunkSize = cmdutil.GetFlagInt64(cmd, "chunk-size") << 20
+	o.retries = cmdutil.GetFlagInt(cmd, "retries")
+	o.verify = cmdutil.GetFlagBool(cmd, "verify")
+	o.recursive = cmdutil.GetFlagBool(cmd, "recursive")
+	o.jobs = cmdutil.GetFlagInt(cmd, "jobs")
+	if o.chunkSize <= 0 {
+		return fmt.Errorf("--chunk-size must be positive")
+	}
+	if o.jobs < 1 {
+		return fmt.Errorf("--jobs must be at least 1")
+	}
+	return nil
+}
+
+func (o *UploadOptions) Run(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, args []string) error {
+	p := mpb.New()
+	dstDir := path.Clean("/" + args[len(args)-1])
+	args = args[:len(args)-1]
 
+	report := &transferReport{}
+	jobs := []uploadJob{}
 	for _, file := range args {
-		// make sure file is not dir
-		pass, err := checkFile(file)
-		if pass {
-			wg.Add(1)
-			//go upload(&wg, p, file, url)
-			go upload(f, &wg, p, file, url)
-		} else {
+		isDir, err := checkFile(file)
+		switch {
+		case err != nil:
 			color.Yellow("%v", err)
-			continue
+			report.fail(file, err)
+		case isDir && !o.recursive:
+			err := fmt.Errorf("file: %s is a dir, use -r to upload it", file)
+			color.Yellow("%v", err)
+			report.fail(file, err)
+		case isDir:
+			jobs = append(jobs, collectUploads(f, report, file, dstDir)...)
+		default:
+			jobs = append(jobs, uploadJob{file, dstDir})
 		}
 	}
 
-	wg.Wait()
+	runParallel(o.jobs, len(jobs), func(i int) {
+		if err := o.upload(f, p, jobs[i].filename, jobs[i].dstDir); err != nil {
+			report.fail(jobs[i].filename, err)
+		} else {
+			report.ok()
+		}
+	})
 	p.Stop()
-	return nil
+	return report.finish(out, "uploaded", o.recursive)
 }
 
-func upload(f cmdutil.Factory, wg *sync.WaitGroup, p *mpb.Progress, filename string, url string) error {
-	name := filepath.Base(filename)
-	defer wg.Done()
-	bodyBuf := &bytes.Buffer{}
-	bodyWriter := multipart.NewWriter(bodyBuf)
+// uploadKey identifies an upload of the same local file to the same place,
+// so that --resume can find it again on the server.
+func uploadKey(filename string, info os.FileInfo, dstDir string) string {
+	abs, _ := filepath.Abs(filename)
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s:%d:%d:%s", abs, info.Size(), info.ModTime().UnixNano(), dstDir)))
+	return hex.EncodeToString(sum[:])
+}
 
-	//关键的一步操作
-	fileWriter, err := bodyWriter.CreateFormFile("file", name)
+// upload sends filename to dstDir in chunks. Each chunk is streamed from disk,
+// so memory usage does not depend on the file size.
+func (o *UploadOptions) upload(f cmdutil.Factory, p *mpb.Progress, filename string, dstDir string) error {
+	name := filepath.Base(filename)
+	fh, err := os.Open(filename)
 	if err != nil {
 		color.Yellow("%s: %v", name, err)
 		return err
 	}
-
-	//打开文件句柄操作
-	fh, err := os.Open(filename)
 	defer fh.Close()
+	fileInfo, err := fh.Stat()
 	if err != nil {
 		color.Yellow("%s: %v", name, err)
 		return err
 	}
 
-	//iocopy
-	_, err = io.Copy(fileWriter, fh)
+	up, err := createUpload(f, dstDir, name, fileInfo, uploadKey(filename, fileInfo, dstDir), o.resume)
 	if err != nil {
 		color.Yellow("%s: %v", name, err)
 		return err
 	}
 
-	contentType := bodyWriter.FormDataContentType()
-	bodyWriter.Close()
-
-	fileInfo, _ := fh.Stat()
-
 	// create bar with appropriate decorators
 	bar := p.AddBar(fileInfo.Size(),
 		mpb.PrependDecorators(
@@ -121,44 +184,140 @@ func upload(f cmdutil.Factory, wg *sync.WaitGroup, p *mpb.Progress, filename str
 	if !f.Cool {
 		p.RemoveBar(bar)
 	}
+	if up.Offset > 0 {
+		bar.IncrBy(int(up.Offset))
+	}
 
-	reader := bar.ProxyReader(bodyBuf)
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", url, reader)
-	if err != nil {
+	offset, failures := up.Offset, 0
+	for offset < up.Size {
+		size := up.Size - offset
+		if size > o.chunkSize {
+			size = o.chunkSize
+		}
+		chunk := io.NewSectionReader(fh, offset, size)
+		next, err := patchUpload(f, up.ID, offset, bar.ProxyReader(chunk), size)
+		if err == nil {
+			offset, failures = next, 0
+			continue
+		}
+		failures++
+		if failures > o.retries {
+			p.RemoveBar(bar)
+			color.Yellow("%s: %v, rerun with --resume to continue", name, err)
+			return err
+		}
+		// the chunk may be partially written, sync up with the server
+		if next, err := uploadOffset(f, up.ID); err == nil {
+			offset = next
+		}
+	}
+
+	if err := finishUpload(f, up.ID); err != nil {
 		p.RemoveBar(bar)
 		color.Yellow("%s: %v", name, err)
 		return err
 	}
-	req.Header.Set("Content-Type", contentType)
-	req.Header.Set("Username", f.Username)
-	req.Header.Set("Authorization", "Basic "+f.Auth())
-	resp, err := client.Do(req)
-	//resp, err := http.Post(url, contentType, reader)
+	if o.verify {
+		if err := verifyRemoteChecksum(f, filename, path.Join(dstDir, name)); err != nil {
+			p.RemoveBar(bar)
+			color.Yellow("%s: %v", name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// createUpload starts an upload of a file with the given info, the server
+// keeps its modification time.
+func createUpload(f cmdutil.Factory, dstDir, name string, info os.FileInfo, key string, resume bool) (*stagedUpload, error) {
+	req := struct {
+		Path   string `json:"path"`
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		Mtime  int64  `json:"mtime"`
+		Key    string `json:"key"`
+		Resume bool   `json:"resume"`
+	}{dstDir, name, info.Size(), info.ModTime().UnixNano() / 1e6, key, resume}
+
+	request := f.Gorequest()
+	resp, body, errs := request.Post("http://"+f.Server+"/-/upload").
+		Set("Authorization", f.Authorization()).
+		Send(req).
+		End()
+
+	if err := cmdutil.CombineRequestErr(resp, body, errs); err != nil {
+		return nil, fmt.Errorf("%s", strings.TrimRight(err.Error(), "\n"))
+	}
+
+	up := &stagedUpload{}
+	if err := json.Unmarshal([]byte(body), up); err != nil {
+		return nil, err
+	}
+	return up, nil
+}
+
+// patchUpload appends a chunk at offset and returns the offset reported by
+// the server afterwards.
+func patchUpload(f cmdutil.Factory, id string, offset int64, chunk io.Reader, size int64) (int64, error) {
+	req, err := f.NewRequest("PATCH", "/-/upload/"+id, chunk)
 	if err != nil {
-		p.RemoveBar(bar)
-		color.Yellow("%s: %v", name, err)
-		return err
+		return offset, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return offset, err
 	}
 	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	next := offset
+	if v, err := strconv.ParseInt(resp.Header.Get(uploadOffsetHeader), 10, 64); err == nil {
+		next = v
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return next, fmt.Errorf("%s", strings.TrimRight(string(body), "\n"))
+	}
+	return next, nil
+}
 
-	resp_body, err := ioutil.ReadAll(resp.Body)
+func uploadOffset(f cmdutil.Factory, id string) (int64, error) {
+	req, err := f.NewRequest("HEAD", "/-/upload/"+id, nil)
 	if err != nil {
-		p.RemoveBar(bar)
-		color.Yellow("%s: %v", name, err)
-		return err
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
 	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		p.RemoveBar(bar)
-		//color.Yellow("%s: %v", name, resp.Status)
-		color.Yellow("%s: %v", name, string(resp_body))
-		return fmt.Errorf(strings.TrimRight(string(resp_body), "\n"))
+		return 0, fmt.Errorf("upload %s: %s", id, resp.Status)
 	}
+	return strconv.ParseInt(resp.Header.Get(uploadOffsetHeader), 10, 64)
+}
 
+func finishUpload(f cmdutil.Factory, id string) error {
+	req, err := f.NewRequest("POST", "/-/upload/"+id, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", strings.TrimRight(string(body), "\n"))
+	}
 	return nil
 }
 
-func checkFile(file string) (pass bool, err error) {
+// checkFile reports whether file is a directory.
+func checkFile(file string) (isDir bool, err error) {
 	f, err := os.Stat(file)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -167,10 +326,5 @@ func checkFile(file string) (pass bool, err error) {
 			return false, err
 		}
 	}
-
-	if f.IsDir() {
-		return false, fmt.Errorf("file: %s is a dir", file)
-	}
-
-	return true, nil
+	return f.IsDir(), nil
 }
@@ -22,7 +22,13 @@ var (
 		fctl add lkong pwd1234 lkong@tencent.com 
 
 		# Add a new user lkong with nickname and remark
-		fctl add lkong pwd1234 lkong@tencent.com -n lkong -r "test for add sub command"`))
+		fctl add lkong pwd1234 lkong@tencent.com -n lkong -r "test for add sub command"
+
+		# Add an auditor, who may read but not change anything
+		fctl add alice pwd12345 alice@tencent.com --role auditor
+
+		# Add a user who may own 10G in at most 10000 files
+		fctl add bob pwd12345 bob@tencent.com --quota-bytes 10G --quota-files 10000`))
 )
 
 func NewCmdUserAdd(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
@@ -41,6 +47,8 @@ func NewCmdUserAdd(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Co
 
 	cmd.Flags().StringP("nickname", "n", "", "Specify the user nickname.")
 	cmd.Flags().StringP("remark", "r", "", "Specify the user remark.")
+	cmd.Flags().String("role", "", "Specify the user role, one of admin, auditor or user.")
+	addQuotaFlags(cmd)
 	return cmd
 }
 
@@ -68,18 +76,29 @@ func RunUserAdd(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, cmd *cobra.C
 	}
 
 	remark := cmdutil.GetFlagString(cmd, "remark")
+	role := cmdutil.GetFlagString(cmd, "role")
+	if role != "" && !isRole(role) {
+		return fmt.Errorf("unknown role %s, use admin, auditor or user", role)
+	}
+	quotaBytes, quotaFiles, err := quotaFlags(cmd)
+	if err != nil {
+		return err
+	}
 	req := user{
-		Username: args[0],
-		Password: args[1],
-		Email:    args[2],
-		Nickname: nickname,
-		Remark:   remark,
-		Status:   1,
+		Username:   args[0],
+		Password:   args[1],
+		Email:      args[2],
+		Nickname:   nickname,
+		Remark:     remark,
+		Role:       role,
+		Status:     1,
+		QuotaBytes: quotaBytes,
+		QuotaFiles: quotaFiles,
 	}
 
 	request := f.Gorequest()
 	resp, body, errs := request.Get("http://"+f.Server+"/-/user/add").
-		Set("Authorization", "Basic "+f.Auth()).
+		Set("Authorization", f.Authorization()).
 		Send(req).
 		End()
 
@@ -47,7 +47,7 @@ func RunUserDel(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, cmd *cobra.C
 	}{args}
 	request := f.Gorequest()
 	resp, body, errs := request.Get("http://"+f.Server+"/-/user/del").
-		Set("Authorization", "Basic "+f.Auth()).
+		Set("Authorization", f.Authorization()).
 		Send(req).
 		End()
 
@@ -47,7 +47,7 @@ func RunUserDisable(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, cmd *cob
 	}{args}
 	request := f.Gorequest()
 	resp, body, errs := request.Get("http://"+f.Server+"/-/user/disable").
-		Set("Authorization", "Basic "+f.Auth()).
+		Set("Authorization", f.Authorization()).
 		Send(req).
 		End()
 
@@ -47,7 +47,7 @@ func RunUserEnable(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, cmd *cobr
 	}{args}
 	request := f.Gorequest()
 	resp, body, errs := request.Get("http://"+f.Server+"/-/user/enable").
-		Set("Authorization", "Basic "+f.Auth()).
+		Set("Authorization", f.Authorization()).
 		Send(req).
 		End()
 
@@ -47,7 +47,7 @@ func RunUserGet(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, cmd *cobra.C
 	}{args[0]}
 	request := f.Gorequest()
 	resp, body, errs := request.Get("http://"+f.Server+"/-/user/get").
-		Set("Authorization", "Basic "+f.Auth()).
+		Set("Authorization", f.Authorization()).
 		Send(req).
 		End()
 
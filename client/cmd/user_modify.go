@@ -8,6 +8,7 @@ package cmd
 import (
 	"fmt"
 	"io"
+	"strings"
 
 	"grapehttp/client/cmd/templates"
 	cmdutil "grapehttp/client/cmd/util"
@@ -21,7 +22,11 @@ type UserModifyOptions struct {
 	nickname string
 	email    string
 	remark   string
+	role     string
 	status   int
+
+	quotaBytes *int64
+	quotaFiles *int64
 }
 
 var (
@@ -36,14 +41,33 @@ var (
 		fctl modify lkong -n newnickname
 
 		# Modify user lkong's remark
-		fctl modify lkong -r newremark`))
+		fctl modify lkong -r newremark
+
+		# Make lkong an admin, and take the role away again
+		fctl modify lkong --role admin
+		fctl modify lkong --role user
+
+		# Let lkong own 20G, and lift the limit again
+		fctl modify lkong --quota-bytes 20G
+		fctl modify lkong --quota-bytes 0`))
 )
 
 func NewCmdUserModify(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
-		Use:     "modify USERNAME",
-		Short:   i18n.T("Modify user's email, password, nickname and remark"),
-		Long:    "Modify user's email, password, nickname and remark",
+		Use:   "modify USERNAME",
+		Short: i18n.T("Modify user's email, password, nickname, remark, role and quotas"),
+		Long: `Modify user's email, password, nickname, remark, role and quotas.
+
+Admins may do everything, auditors may read the users, groups, audit log and
+files but not change them, users have no role. The only admin can not be
+demoted.
+
+A new password must satisfy the password policy of the server: by default it
+has at least 8 characters, is not the user name and is not one of the last 5
+passwords of the user.
+
+The quotas limit the bytes and the number of files the user owns, see fctl
+quota. Quotas which are not given are kept, 0 lifts them.`,
 		Example: modifyExample,
 		Run: func(cmd *cobra.Command, args []string) {
 			cmdutil.CheckErr(validateUserModifyArgs(cmd, args))
@@ -62,6 +86,8 @@ func NewCmdUserModify(f cmdutil.Factory, out io.Writer, cmdErr io.Writer) *cobra
 	cmd.Flags().StringP("email", "e", "", "Specify the user email.")
 	cmd.Flags().StringP("remark", "r", "", "Specify the user remark.")
 	cmd.Flags().StringP("nickname", "n", "", "Specify the user nickname.")
+	cmd.Flags().String("role", "", "Specify the user role, one of admin, auditor or user.")
+	addQuotaFlags(cmd)
 	return cmd
 }
 
@@ -78,17 +104,24 @@ func validateUserModifyArgs(cmd *cobra.Command, args []string) error {
 }
 
 func (o *UserModifyOptions) RunUserModify(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, args []string) error {
+	if o.password != "" && strings.EqualFold(o.password, args[0]) {
+		return fmt.Errorf("password must not be the user name")
+	}
 	req := user{
 		Username: args[0],
 		Password: o.password,
 		Email:    o.email,
 		Nickname: o.nickname,
 		Remark:   o.remark,
+		Role:     o.role,
+
+		QuotaBytes: o.quotaBytes,
+		QuotaFiles: o.quotaFiles,
 	}
 
 	request := f.Gorequest()
 	resp, body, errs := request.Get("http://"+f.Server+"/-/user/modify").
-		Set("Authorization", "Basic "+f.Auth()).
+		Set("Authorization", f.Authorization()).
 		Send(req).
 		End()
 
@@ -105,10 +138,16 @@ func (o *UserModifyOptions) Complete(cmd *cobra.Command) error {
 	o.nickname = cmdutil.GetFlagString(cmd, "nickname")
 	o.email = cmdutil.GetFlagString(cmd, "email")
 	o.remark = cmdutil.GetFlagString(cmd, "remark")
-	return nil
+	o.role = cmdutil.GetFlagString(cmd, "role")
+	var err error
+	o.quotaBytes, o.quotaFiles, err = quotaFlags(cmd)
+	return err
 }
 
 func (o *UserModifyOptions) Validate() error {
+	if o.role != "" && !isRole(o.role) {
+		return fmt.Errorf("unknown role %s, use admin, auditor or user", o.role)
+	}
 	if o.email != "" {
 		if !isEmail(o.email) {
 			return fmt.Errorf("%s is not a email format", o.email)
@@ -50,7 +50,7 @@ func RunUserSearch(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, cmd *cobr
 	}{args[0]}
 	request := f.Gorequest()
 	resp, body, errs := request.Get("http://"+f.Server+"/-/user/search").
-		Set("Authorization", "Basic "+f.Auth()).
+		Set("Authorization", f.Authorization()).
 		Send(req).
 		End()
 
@@ -66,14 +66,18 @@ func RunUserSearch(f cmdutil.Factory, out io.Writer, cmdErr io.Writer, cmd *cobr
 	table := tablewriter.NewWriter(out)
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
 	table.SetColWidth(TABLE_WIDTH)
-	table.SetHeader([]string{"Username", "Nickname", "Email", "Status", "Logincount", "Lastlogintime"})
+	table.SetHeader([]string{"Username", "Nickname", "Email", "Role", "Status", "Logincount", "Lastlogintime"})
 	for _, user := range users {
 		status := strconv.Itoa(user.Status)
 		if user.Status == 0 {
 			status = color.RedString("0")
 		}
 
-		table.Append([]string{user.Username, user.Nickname, user.Email, status,
+		role := user.Role
+		if role == "" {
+			role = "user"
+		}
+		table.Append([]string{user.Username, user.Nickname, user.Email, role, status,
 			strconv.Itoa(user.Logincount), user.Lastlogintime.Format("2006-01-02 15:04:05")})
 	}
 	table.Render()
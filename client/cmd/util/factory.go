@@ -4,6 +4,8 @@ import (
 	"encoding/base64"
 	"flag"
 	"github.com/parnurzeal/gorequest"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -24,10 +26,12 @@ type Factory struct {
 	Timeout  int
 	Username string
 	Password string
+	Token    string
 	Cool     bool
 }
 
 func NewFactory() Factory {
+	readConfig()
 	flags := pflag.NewFlagSet("", pflag.ContinueOnError)
 	f := Factory{
 		flags:    flags,
@@ -35,6 +39,7 @@ func NewFactory() Factory {
 		Timeout:  viper.GetInt("timeout"),
 		Username: viper.GetString("username"),
 		Password: viper.GetString("password"),
+		Token:    viper.GetString("token"),
 		Cool:     viper.GetBool("cool"),
 	}
 
@@ -69,6 +74,27 @@ func (f *Factory) Auth() string {
 	return base64.StdEncoding.EncodeToString([]byte(f.Username + ":" + f.Password))
 }
 
+// Authorization is the value of the Authorization header, the API token
+// if fctl login stored one and the username and password otherwise.
+func (f *Factory) Authorization() string {
+	if f.Token != "" {
+		return "Bearer " + f.Token
+	}
+	return "Basic " + f.Auth()
+}
+
+// NewRequest returns a http request to the server with the auth headers set,
+// for streaming calls which can not go through gorequest.
+func (f *Factory) NewRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, "http://"+f.Server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", f.Authorization())
+	req.Header.Set("Username", f.Username)
+	return req, nil
+}
+
 func (f *Factory) Gorequest() *gorequest.SuperAgent {
 	request := gorequest.New()
 	request.DoNotClearSuperAgent = true
@@ -77,7 +103,9 @@ func (f *Factory) Gorequest() *gorequest.SuperAgent {
 		Set("Username", "cc")
 }
 
-func init() {
+// readConfig loads config.yaml from ~/.grape or the working directory. It is
+// read by NewFactory instead of init, so the commands can be tested without.
+func readConfig() {
 	viper.AddConfigPath(filepath.Join(homedir.HomeDir(), RecommendedHomeDir))
 	viper.AddConfigPath(".")
 	viper.SetConfigType("yaml")
@@ -72,7 +72,7 @@ func NewCmdVersion(f cmdutil.Factory, out io.Writer) *cobra.Command {
 func retrieveServerVersion(f cmdutil.Factory) (*version.Info, error) {
 	request := f.Gorequest()
 	resp, body, errs := request.Get("http://"+f.Server+"/-/status").
-		Set("Authorization", "Basic "+f.Auth()).
+		Set("Authorization", f.Authorization()).
 		Send(``).
 		End()
 
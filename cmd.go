@@ -2,33 +2,73 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/ghodss/yaml"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
 )
 
-type cmd struct {
-	Name  string   `json:"name"`
-	Args  []string `json:"args"`
-	Paths []string `json:"paths"`
+// cmdRequest is the body of /-/cmd. For mv and cp the last path is the
+// destination, the rest are sources.
+type cmdRequest struct {
+	Name    string     `json:"name"`
+	Paths   []string   `json:"paths"`
+	Options cmdOptions `json:"options"`
+}
+
+type cmdOptions struct {
+	All       bool `json:"all"`       // ls: include entries starting with .
+	Recursive bool `json:"recursive"` // ls, rm, cp: descend into directories
+	Parents   bool `json:"parents"`   // mkdir: make parent directories as needed
+	Force     bool `json:"force"`     // rm: ignore nonexistent, mv/cp: overwrite existing
+}
+
+type cmdEntry struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Type    string `json:"type"`
+	Size    int64  `json:"size"`
+	Mode    string `json:"mode"`
+	ModTime int64  `json:"mtime"`
+}
+
+type cmdResult struct {
+	Path    string     `json:"path"`
+	Dest    string     `json:"dest,omitempty"`
+	Entries []cmdEntry `json:"entries,omitempty"`
+	Error   string     `json:"error,omitempty"`
+	Code    int        `json:"code,omitempty"` // status of quota errors, 413 or 507
+}
+
+type cmdResponse struct {
+	Name    string      `json:"name"`
+	Results []cmdResult `json:"results"`
 }
 
 var cmds = []string{"ls", "mkdir", "rm", "mv", "cp"}
 
+var (
+	errOutsideRoot = errors.New("path outside of root")
+	errFound       = errors.New("found")
+)
+
 func (s *HTTPStaticServer) hCmd(w http.ResponseWriter, r *http.Request) {
-	data, _ := ioutil.ReadAll(r.Body)
-	log.Println(string(data))
-	c := cmd{}
-	if err := json.Unmarshal(data, &c); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	c := cmdRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	rec := auditOf(r)
+	rec.Action = "cmd." + c.Name
+	for _, p := range c.Paths {
+		rec.Paths = append(rec.Paths, "/"+cleanName(p))
+	}
 
 	// check command
 	if !canExec(c) {
@@ -36,69 +76,359 @@ func (s *HTTPStaticServer) hCmd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//这里更安全期间，需要校验s.Root的路径，防止出现rm -rf /这种情况，但是在grapehttp启动时，已经
-	//校验过，所以这里就不用再校验
-	// check permission
-	for _, path := range c.Paths {
-		auth := s.readAccessConf(path, r)
-		// check access first
-		if auth.noAccess(r) {
-			log.Printf("%s have no access permission", c.Name)
-			http.Error(w, "access forbidden", http.StatusForbidden)
-			return
+	minPaths := 1
+	if c.Name == "mv" || c.Name == "cp" {
+		minPaths = 2
+	}
+	if len(c.Paths) < minPaths {
+		http.Error(w, fmt.Sprintf("%s: missing operand", c.Name), http.StatusBadRequest)
+		return
+	}
+
+	resp := cmdResponse{Name: c.Name, Results: []cmdResult{}}
+	switch c.Name {
+	case "ls":
+		for _, p := range c.Paths {
+			resp.Results = append(resp.Results, s.cmdLs(r, p, c.Options))
+		}
+	case "mkdir":
+		for _, p := range c.Paths {
+			resp.Results = append(resp.Results, s.cmdMkdir(r, p, c.Options))
+		}
+	case "rm":
+		for _, p := range c.Paths {
+			resp.Results = append(resp.Results, s.cmdRm(r, p, c.Options))
 		}
+	case "mv", "cp":
+		dst := c.Paths[len(c.Paths)-1]
+		srcs := c.Paths[:len(c.Paths)-1]
+		for _, p := range srcs {
+			resp.Results = append(resp.Results, s.cmdTransfer(r, c.Name, p, dst, len(srcs) > 1, c.Options))
+		}
+	}
 
-		if !auth.canDelete(r) {
-			if c.Name == "rm" || c.Name == "mv" || c.Name == "cp" {
-				log.Printf("%s have no delete permission", c.Name)
-				http.Error(w, fmt.Sprintf("%s forbidden", c.Name), http.StatusForbidden)
-				return
-			}
+	failed := 0
+	for _, res := range resp.Results {
+		if res.Error != "" {
+			failed++
 		}
+	}
+	if failed == len(resp.Results) {
+		rec.Result = "error"
+	} else if failed > 0 {
+		rec.Result = "partial"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// errNoSuchFile is the error of paths which do not exist, or which the user
+// may not know about
+func errNoSuchFile(path string) string {
+	return fmt.Sprintf("%s: no such file or directory", path)
+}
+
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// relError strips s.Root from error messages, so clients never see the
+// server side layout.
+func (s *HTTPStaticServer) relError(err error) string {
+	msg := err.Error()
+	if root, e := filepath.EvalSymlinks(filepath.Clean(s.Root)); e == nil {
+		root, _ = filepath.Abs(root)
+		msg = strings.Replace(msg, root, "", -1)
+	}
+	return strings.Replace(msg, filepath.Clean(s.Root), "", -1)
+}
+
+func (s *HTTPStaticServer) cmdLs(r *http.Request, requestPath string, opts cmdOptions) (res cmdResult) {
+	res.Path = requestPath
+	if s.hidden(r, cleanName(requestPath)) {
+		res.Error = errNoSuchFile(requestPath)
+		return
+	}
+	auth := s.readAccessConf(requestPath, r)
+	if !auth.can(r, permList) {
+		res.Error = "access forbidden"
+		return
+	}
+	info, err := s.storage.Stat(cleanName(requestPath))
+	if err != nil {
+		res.Error = s.relError(err)
+		return
+	}
+	if !info.IsDir() {
+		res.Entries = []cmdEntry{newCmdEntry(filepath.ToSlash(filepath.Clean("/"+requestPath)), info)}
+		return
+	}
 
-		if !auth.canUpload(r) {
-			if c.Name == "mkdir" || c.Name == "mv" || c.Name == "cp" {
-				log.Printf("%s have no delete permission", c.Name)
-				http.Error(w, fmt.Sprintf("%s forbidden", c.Name), http.StatusForbidden)
-				return
+	res.Entries = []cmdEntry{}
+	var walk func(dir string, ac AccessConf) error
+	walk = func(dir string, ac AccessConf) error {
+		infos, err := s.storage.ReadDir(cleanName(dir))
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if !opts.All && strings.HasPrefix(info.Name(), ".") {
+				continue
+			}
+			if isInternalPath(filepath.Join(dir, info.Name())) {
+				continue
+			}
+			if !ac.canAccess(info.Name()) {
+				continue
+			}
+			p := filepath.ToSlash(filepath.Join(dir, info.Name()))
+			res.Entries = append(res.Entries, newCmdEntry(p, info))
+			if opts.Recursive && info.IsDir() {
+				sub := s.readAccessConf(p, r)
+				if !sub.can(r, permList) {
+					continue
+				}
+				if err := walk(p, sub); err != nil {
+					return err
+				}
 			}
 		}
+		return nil
+	}
+	if err := walk(filepath.ToSlash(filepath.Clean("/"+requestPath)), auth); err != nil {
+		res.Error = s.relError(err)
 	}
+	return
+}
 
-	// complete Args
-	// absPath完全可用的path
-	// 这里加filepath.Clean是为了防止错误中出现//dir//file这样的不美观路径
-	absPaths := []string{}
-	for _, p := range c.Paths {
-		absPaths = append(absPaths, filepath.Clean(filepath.Join(s.Root, p)))
+func newCmdEntry(path string, info os.FileInfo) cmdEntry {
+	e := cmdEntry{
+		Name:    info.Name(),
+		Path:    path,
+		Type:    "file",
+		Size:    info.Size(),
+		Mode:    info.Mode().String(),
+		ModTime: info.ModTime().UnixNano() / 1e6,
 	}
+	switch {
+	case info.IsDir():
+		e.Type = "dir"
+	case info.Mode()&os.ModeSymlink != 0:
+		e.Type = "symlink"
+	}
+	return e
+}
 
-	c.Args = append(c.Args, absPaths...)
-	cmd := exec.Command(c.Name, c.Args...)
-	bytes, _ := cmd.CombinedOutput()
+func (s *HTTPStaticServer) cmdMkdir(r *http.Request, requestPath string, opts cmdOptions) (res cmdResult) {
+	res.Path = requestPath
+	auth := s.readAccessConf(requestPath, r)
+	name := cleanName(requestPath)
+	if s.hidden(r, name) || !auth.can(r, permWrite) || path.Base(name) == ghsFileName {
+		res.Error = "mkdir forbidden"
+		return
+	}
+	// the directories which are made belong to the user
+	created := []string{}
+	for dir := name; dir != "." && dir != ""; dir = path.Dir(dir) {
+		if _, err := s.storage.Stat(dir); err == nil {
+			break
+		}
+		created = append(created, dir)
+	}
+	var err error
+	if opts.Parents {
+		err = s.storage.MkdirAll(name)
+	} else {
+		err = s.storage.Mkdir(name)
+	}
+	if err != nil {
+		res.Error = s.relError(err)
+		return
+	}
+	s.owners.set(getUser(r), created...)
+	return
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(strings.Replace(string(bytes), filepath.Clean(s.Root), "", 1)))
+func (s *HTTPStaticServer) cmdRm(r *http.Request, requestPath string, opts cmdOptions) (res cmdResult) {
+	res.Path = requestPath
+	auth := s.readAccessConf(requestPath, r)
+	name := cleanName(requestPath)
+	if name == "" {
+		res.Error = errRemoveRoot.Error()
+		return
+	}
+	if s.hidden(r, name) {
+		res.Error = errNoSuchFile(requestPath)
+		return
+	}
+	if !s.canRemove(r, &auth, name) {
+		res.Error = "rm forbidden"
+		return
+	}
+	// a symlink is removed, not what it points to
+	info, err := lstatStorage(s.storage, name)
+	if err != nil {
+		if !(opts.Force && os.IsNotExist(err)) {
+			res.Error = s.relError(err)
+		}
+		return
+	}
+	if info.IsDir() && !opts.Recursive {
+		res.Error = fmt.Sprintf("cannot remove %s: is a directory", requestPath)
+		return
+	}
+	if opts.Recursive {
+		err = s.storage.RemoveAll(name)
+	} else {
+		err = s.storage.Remove(name)
+	}
+	if err != nil {
+		res.Error = s.relError(err)
+		return
+	}
+	s.owners.remove(name)
+	s.Index.remove(name)
+	return
 }
 
-//生成权限控制文件
-//默认所有人都有访问，上传，删除权限
-func genGhs(dir string) error {
-	j := `{"upload":true,"delete":true,"noaccess":false}`
-	y, err := yaml.JSONToYAML([]byte(j))
+// cmdTransfer moves or copies src to dst. If dst is an existing directory, or
+// multiple sources are given, src is placed inside of it.
+func (s *HTTPStaticServer) cmdTransfer(r *http.Request, name, src, dst string, multi bool, opts cmdOptions) (res cmdResult) {
+	res.Path = src
+	res.Dest = dst
+	srcAuth := s.readAccessConf(src, r)
+	dstAuth := s.readAccessConf(dst, r)
+	srcName, dstName := cleanName(src), cleanName(dst)
+	if s.hidden(r, srcName) {
+		res.Error = errNoSuchFile(src)
+		return
+	}
+	if s.hidden(r, dstName) {
+		res.Error = "access forbidden"
+		return
+	}
+	if name == "mv" && !s.canRename(r, &srcAuth, srcName) {
+		res.Error = fmt.Sprintf("%s forbidden", name)
+		return
+	}
+	// mv moves a symlink, not what it points to
+	stat := s.storage.Stat
+	if name == "mv" {
+		stat = func(name string) (os.FileInfo, error) { return lstatStorage(s.storage, name) }
+	}
+	srcInfo, err := stat(srcName)
 	if err != nil {
-		return err
+		res.Error = s.relError(err)
+		return
+	}
+	if name == "cp" {
+		need := permRead
+		if srcInfo.IsDir() {
+			need |= permList
+		}
+		if !srcAuth.can(r, need) {
+			res.Error = "access forbidden"
+			return
+		}
+	}
+	if info, err := s.storage.Stat(dstName); err == nil && info.IsDir() {
+		dstName = path.Join(dstName, path.Base(srcName))
+		res.Dest = filepath.ToSlash(filepath.Join(dst, path.Base(srcName)))
+	} else if multi {
+		res.Error = fmt.Sprintf("target %s is not a directory", dst)
+		return
+	}
+	if srcName == "" || dstName == srcName || strings.HasPrefix(dstName, srcName+"/") {
+		res.Error = fmt.Sprintf("cannot %s %s into itself", name, src)
+		return
+	}
+	if _, err := lstatStorage(s.storage, dstName); err == nil && !opts.Force {
+		res.Error = fmt.Sprintf("%s already exists", res.Dest)
+		return
+	}
+	if !s.canWrite(r, &dstAuth, dstName) {
+		res.Error = fmt.Sprintf("%s forbidden", name)
+		return
 	}
 
-	err = ioutil.WriteFile(filepath.Join(dir, ".ghs.yml"), y, 0644)
+	bytes, files := s.Index.usage(srcName)
+	from := ""
+	if name == "mv" {
+		from = srcName
+	}
+	release, code, err := s.reserveQuota(getUser(r), dstName, from, bytes, files)
 	if err != nil {
-		return err
+		res.Error, res.Code = err.Error(), code
+		return
 	}
+	defer release()
 
-	return nil
+	if name == "mv" {
+		err = s.storage.Rename(srcName, dstName)
+	} else {
+		if srcInfo.IsDir() && !opts.Recursive {
+			res.Error = fmt.Sprintf("omitting directory %s", src)
+			return
+		}
+		// copied rules would apply to the copy
+		if !dstAuth.can(r, permAdmin) && containsGhs(s.storage, srcName) {
+			res.Error = fmt.Sprintf("cp forbidden, %s contains %s", src, ghsFileName)
+			return
+		}
+		err = copyTree(s.storage, srcName, dstName)
+	}
+	if err != nil {
+		res.Error = s.relError(err)
+		return
+	}
+	if name == "mv" {
+		s.owners.rename(srcName, dstName)
+		s.Index.remove(srcName)
+	} else {
+		s.owners.setTree(s.storage, getUser(r), dstName)
+	}
+	s.indexWritten(dstName)
+	return
+}
+
+func containsGhs(st Storage, name string) bool {
+	found := false
+	walkStorage(st, name, func(name string, info os.FileInfo, err error) error {
+		if err == nil && path.Base(name) == ghsFileName {
+			found = true
+			return errFound
+		}
+		return nil
+	})
+	return found
+}
+
+// copyTree copies a file or a directory recursively. Symlinks are skipped so
+// that a copy can never reach outside of the source tree.
+func copyTree(st Storage, src, dst string) error {
+	return walkStorage(st, src, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := path.Join(dst, strings.TrimPrefix(strings.TrimPrefix(name, src), "/"))
+		switch {
+		case info.IsDir():
+			return st.MkdirAll(target)
+		case info.Mode().IsRegular():
+			return copyStorageFile(st, name, target)
+		default:
+			log.Printf("cp: skip non-regular file %s", name)
+			return nil
+		}
+	})
 }
 
-func canExec(c cmd) bool {
+func canExec(c cmdRequest) bool {
 	for _, name := range cmds {
 		if name == c.Name {
 			return true
@@ -13,44 +13,148 @@ import (
 	"grapehttp/pkg/vinfo"
 )
 
+// Rbac is the database of the users and groups. Type is sqlite, mysql or
+// postgres. Name is the database of mysql and postgres and the alias of the
+// database in the models with all of them.
 type Rbac struct {
-	Host string `yaml:"db_host"`
-	Port string `yaml:"db_port"`
-	User string `yaml:"db_user"`
-	Pass string `yaml:"db_pass"`
-	Name string `yaml:"db_name"`
+	Type    string `yaml:"db_type"`
+	Host    string `yaml:"db_host"`
+	Port    string `yaml:"db_port"`
+	User    string `yaml:"db_user"`
+	Pass    string `yaml:"db_pass"`
+	Name    string `yaml:"db_name"`
+	Path    string `yaml:"db_path"`    // file of the sqlite database
+	SSLMode string `yaml:"db_sslmode"` // sslmode of postgres
+}
+
+// Driver is the type of the database. Configurations of older versions have
+// no type but a mysql server.
+func (r Rbac) Driver() string {
+	if r.Type != "" {
+		return r.Type
+	}
+	if r.Host != "" {
+		return "mysql"
+	}
+	return "sqlite"
+}
+
+// Alias is the name of the database in the models
+func (r Rbac) Alias() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return "default"
+}
+
+// Storage selects where the files are kept, the root directory or an
+// S3-compatible bucket.
+type Storage struct {
+	Type      string `yaml:"type"`
+	Endpoint  string `yaml:"endpoint"`
+	Bucket    string `yaml:"bucket"`
+	Region    string `yaml:"region"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	Prefix    string `yaml:"prefix"`
 }
 
 type Configure struct {
-	Conf            *os.File `yaml:"-"`
-	Addr            string   `yaml:"addr"`
-	DbInit          bool     `yaml:"-"`
-	DbInitForce     bool     `yaml:"-"`
-	Count           bool     `yaml:"count"`
-	AdminUsername   string   `yaml:"admin_username"`
-	AdminPassword   string   `yaml:"admin_password"`
-	AdminEmail      string   `yaml:"admin_email"`
-	Root            string   `yaml:"root"`
-	Rbac            Rbac     `yaml:"rbac"`
-	HTTPAuth        string   `yaml:"httpauth"`
-	SimpleAuth      bool     `yaml:"simpleauth"`
-	Cert            string   `yaml:"cert"`
-	Key             string   `yaml:"key"`
-	Cors            bool     `yaml:"cors"`
-	Theme           string   `yaml:"theme"`
-	XHeaders        bool     `yaml:"xheaders"`
-	Upload          bool     `yaml:"upload"`
-	Delete          bool     `yaml:"delete"`
-	NoAccess        bool     `yaml:"noaccess"`
-	PlistProxy      string   `yaml:"plistproxy"`
-	Title           string   `yaml:"title"`
-	Debug           bool     `yaml:"debug"`
-	GoogleTrackerId string   `yaml:"google-tracker-id"`
-	Auth            struct {
-		Type   string `yaml:"type"`
-		OpenID string `yaml:"openid"`
-		HTTP   string `yaml:"http"`
-	} `yaml:"auth"`
+	Conf            *os.File       `yaml:"-"`
+	Addr            string         `yaml:"addr"`
+	DbInit          bool           `yaml:"-"`
+	DbInitForce     bool           `yaml:"-"`
+	Command         string         `yaml:"-"`
+	MigrateTo       int            `yaml:"-"`
+	Count           bool           `yaml:"count"`
+	AdminUsername   string         `yaml:"admin_username"`
+	AdminPassword   string         `yaml:"admin_password"`
+	AdminEmail      string         `yaml:"admin_email"`
+	Root            string         `yaml:"root"`
+	Rbac            Rbac           `yaml:"rbac"`
+	Storage         Storage        `yaml:"storage"`
+	ContentIndex    bool           `yaml:"content_index"`
+	ContentMaxSize  string         `yaml:"content_max_size"`
+	HTTPAuth        string         `yaml:"httpauth"`
+	SimpleAuth      bool           `yaml:"simpleauth"`
+	Cert            string         `yaml:"cert"`
+	Key             string         `yaml:"key"`
+	Cors            bool           `yaml:"cors"`
+	Theme           string         `yaml:"theme"`
+	XHeaders        bool           `yaml:"xheaders"`
+	Upload          bool           `yaml:"upload"`
+	Delete          bool           `yaml:"delete"`
+	NoAccess        bool           `yaml:"noaccess"`
+	PlistProxy      string         `yaml:"plistproxy"`
+	Title           string         `yaml:"title"`
+	Debug           bool           `yaml:"debug"`
+	GoogleTrackerId string         `yaml:"google-tracker-id"`
+	Auth            Auth           `yaml:"auth"`
+	Password        PasswordPolicy `yaml:"password"`
+	TokenFile       string         `yaml:"token_file"`
+	Audit           Audit          `yaml:"audit"`
+}
+
+// AdminName is the name of the first admin, the one `grapehttp -d` creates
+// and the admin with simpleauth
+func (c Configure) AdminName() string {
+	if c.AdminUsername != "" {
+		return c.AdminUsername
+	}
+	return "admin"
+}
+
+// Audit is the log of the file and user operations, JSON lines in File
+// which is rotated when it grows over MaxSize. DB copies the records into
+// the database too.
+type Audit struct {
+	Disable  bool   `yaml:"disable"`
+	File     string `yaml:"file"`
+	MaxSize  string `yaml:"max_size"`
+	MaxFiles int    `yaml:"max_files"`
+	DB       bool   `yaml:"db"`
+}
+
+// PasswordPolicy applies to the passwords of database users. Argon2* tune
+// the cost of the hashes, hashes made with less are upgraded on login.
+type PasswordPolicy struct {
+	MinLength     int    `yaml:"min_length"`
+	History       int    `yaml:"history"`
+	Argon2Memory  uint32 `yaml:"argon2_memory"`
+	Argon2Time    uint32 `yaml:"argon2_time"`
+	Argon2Threads uint8  `yaml:"argon2_threads"`
+}
+
+// Auth selects how users log in. Type is a comma separated list of http,
+// ldap, oidc and openid, tried in that order for every request.
+type Auth struct {
+	Type          string              `yaml:"type"`
+	OpenID        string              `yaml:"openid"`
+	HTTP          string              `yaml:"http"`
+	Users         map[string]string   `yaml:"users"`
+	Groups        map[string][]string `yaml:"groups"`   // members of groups with simpleauth, external users as ldap:name
+	Admins        []string            `yaml:"admins"`   // admins besides those of the user database
+	Auditors      []string            `yaml:"auditors"` // auditors besides those of the user database
+	SessionSecret string              `yaml:"session_secret"`
+	OIDC          OIDC                `yaml:"oidc"`
+	LDAP          LDAP                `yaml:"ldap"`
+}
+
+// OIDC is an OpenID Connect provider, found with discovery from the issuer.
+type OIDC struct {
+	Issuer        string   `yaml:"issuer"`
+	ClientID      string   `yaml:"client_id"`
+	ClientSecret  string   `yaml:"client_secret"`
+	RedirectURL   string   `yaml:"redirect_url"`
+	Scopes        []string `yaml:"scopes"`
+	UsernameClaim string   `yaml:"username_claim"`
+}
+
+// LDAP checks passwords with a bind as BindDN, where %s is the username.
+type LDAP struct {
+	URL                string `yaml:"url"`
+	BindDN             string `yaml:"bind_dn"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
 }
 
 var (
@@ -99,6 +203,11 @@ func LoadConfig() (Configure, error) {
 	Gcfg.Auth.OpenID = defaultOpenID
 	Gcfg.GoogleTrackerId = "UA-81205425-2"
 	Gcfg.Title = "Go HTTP File Server"
+	Gcfg.Storage.Type = "local"
+	Gcfg.Storage.Region = "us-east-1"
+	Gcfg.ContentMaxSize = "1M"
+	Gcfg.Password.MinLength = 8
+	Gcfg.Password.History = 5
 
 	kingpin.HelpFlag.Short('h')
 	kingpin.Version(getVersion())
@@ -108,9 +217,19 @@ func LoadConfig() (Configure, error) {
 	kingpin.Flag("cert", "tls cert.pem path").StringVar(&Gcfg.Cert)
 	kingpin.Flag("key", "tls key.pem path").StringVar(&Gcfg.Key)
 	kingpin.Flag("simpleauth", "Simple http auth or not").BoolVar(&Gcfg.SimpleAuth)
-	kingpin.Flag("auth-type", "Auth type <http|openid>").StringVar(&Gcfg.Auth.Type)
+	kingpin.Flag("auth-type", "Auth types, comma separated <http|ldap|oidc|openid>").StringVar(&Gcfg.Auth.Type)
 	kingpin.Flag("auth-http", "HTTP basic auth (ex: user:pass)").StringVar(&Gcfg.Auth.HTTP)
 	kingpin.Flag("auth-openid", "OpenID auth identity url").StringVar(&Gcfg.Auth.OpenID)
+	kingpin.Flag("auth-oidc-issuer", "OpenID Connect issuer url").StringVar(&Gcfg.Auth.OIDC.Issuer)
+	kingpin.Flag("auth-oidc-client-id", "OpenID Connect client id").StringVar(&Gcfg.Auth.OIDC.ClientID)
+	kingpin.Flag("auth-oidc-client-secret", "OpenID Connect client secret").StringVar(&Gcfg.Auth.OIDC.ClientSecret)
+	kingpin.Flag("auth-ldap-url", "LDAP server (ex: ldaps://ldap.example.org)").StringVar(&Gcfg.Auth.LDAP.URL)
+	kingpin.Flag("auth-ldap-bind-dn", "LDAP DN to bind as (ex: uid=%s,ou=people,dc=example,dc=org)").StringVar(&Gcfg.Auth.LDAP.BindDN)
+	kingpin.Flag("password-min-length", "shortest password of database users, default 8").IntVar(&Gcfg.Password.MinLength)
+	kingpin.Flag("token-file", "file of the API tokens, default <root>/.ghs-tokens/tokens.json").StringVar(&Gcfg.TokenFile)
+	kingpin.Flag("audit-file", "file of the audit log, default <root>/.ghs-audit/audit.log").StringVar(&Gcfg.Audit.File)
+	kingpin.Flag("audit-db", "copy the audit log into the database").BoolVar(&Gcfg.Audit.DB)
+	kingpin.Flag("session-secret", "key to sign the login session cookies with").StringVar(&Gcfg.Auth.SessionSecret)
 	kingpin.Flag("theme", "web theme, one of <black|green>").StringVar(&Gcfg.Theme)
 	kingpin.Flag("upload", "enable upload support").BoolVar(&Gcfg.Upload)
 	kingpin.Flag("delete", "enable delete support").BoolVar(&Gcfg.Delete)
@@ -120,14 +239,31 @@ func LoadConfig() (Configure, error) {
 	kingpin.Flag("plistproxy", "plist proxy when server is not https").Short('p').StringVar(&Gcfg.PlistProxy)
 	kingpin.Flag("title", "server title").StringVar(&Gcfg.Title)
 	kingpin.Flag("google-tracker-id", "set to empty to disable it").StringVar(&Gcfg.GoogleTrackerId)
+	kingpin.Flag("storage", "storage backend, one of <local|s3>").StringVar(&Gcfg.Storage.Type)
+	kingpin.Flag("s3-endpoint", "S3 endpoint url (ex: http://127.0.0.1:9000)").StringVar(&Gcfg.Storage.Endpoint)
+	kingpin.Flag("s3-bucket", "S3 bucket").StringVar(&Gcfg.Storage.Bucket)
+	kingpin.Flag("s3-region", "S3 region, default us-east-1").StringVar(&Gcfg.Storage.Region)
+	kingpin.Flag("s3-access-key", "S3 access key").StringVar(&Gcfg.Storage.AccessKey)
+	kingpin.Flag("s3-secret-key", "S3 secret key").StringVar(&Gcfg.Storage.SecretKey)
+	kingpin.Flag("s3-prefix", "key prefix inside of the bucket").StringVar(&Gcfg.Storage.Prefix)
+	kingpin.Flag("content-index", "index the content of text files for search").BoolVar(&Gcfg.ContentIndex)
+	kingpin.Flag("content-max-size", "largest file to index the content of, default 1M").StringVar(&Gcfg.ContentMaxSize)
+	kingpin.Flag("db-type", "user database, one of <sqlite|mysql|postgres>").StringVar(&Gcfg.Rbac.Type)
+	kingpin.Flag("db-path", "file of the sqlite user database, default <root>/.ghs-users/users.db").StringVar(&Gcfg.Rbac.Path)
 	kingpin.Flag("db", "init db").Short('d').BoolVar(&Gcfg.DbInit)
 	kingpin.Flag("force", "force init db first drop db then rebuild it").Short('f').BoolVar(&Gcfg.DbInitForce)
 
-	kingpin.Parse() // first parse conf
+	kingpin.Command("serve", "run the file server").Default()
+	migrate := kingpin.Command("migrate", "change the schema of the user database")
+	migrate.Command("status", "show the applied and the pending migrations")
+	migrate.Command("up", "apply the pending migrations").Arg("version", "stop at this schema version").Default("-1").IntVar(&Gcfg.MigrateTo)
+	migrate.Command("down", "undo the last migration").Arg("version", "undo the migrations down to this schema version").Default("-1").IntVar(&Gcfg.MigrateTo)
+
+	Gcfg.Command = kingpin.Parse() // first parse conf
 
 	if Gcfg.Conf != nil {
 		defer func() {
-			kingpin.Parse() // command line priority high than conf
+			Gcfg.Command = kingpin.Parse() // command line priority high than conf
 		}()
 		ymlData, err := ioutil.ReadAll(Gcfg.Conf)
 		if err != nil {
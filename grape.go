@@ -1,14 +1,9 @@
 package main
 
 import (
-	"bytes"
-	"encoding/base64"
 	"encoding/json"
-	"grapehttp/config"
-	. "grapehttp/lib"
 	"grapehttp/models/admin"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -19,50 +14,78 @@ type userinfo struct {
 	Nickname string `json:"nickname"`
 }
 
-const basicScheme string = "Basic "
-
 func (s *HTTPStaticServer) hUserAdd(w http.ResponseWriter, r *http.Request) {
-	if !isAdmin(r) {
-		http.Error(w, "only `admin` user have operation authority", http.StatusInternalServerError)
+	if s.noUserStore(w) {
 		return
 	}
 
 	data, _ := ioutil.ReadAll(r.Body)
-	log.Println(string(data))
+	auditOf(r).Detail = redact(data)
 	user := &admin.User{}
 	if err := json.Unmarshal(data, user); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	auditOf(r).Target = user.Username
+	role, err := admin.ParseRole(user.Role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user.Role = role
+	if user.Quotabytes < 0 || user.Quotafiles < 0 {
+		http.Error(w, "quotas can not be negative", http.StatusBadRequest)
+		return
+	}
 
 	user.Createtime = time.Now()
-	user.Password = Pwdhash(user.Password)
-	err := user.Insert()
-	if err != nil {
+	pass := user.Password
+	user.Password = ""
+	if err := user.SetPassword(pass); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.users.AddUser(user); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	userRoles.reset()
 
 	w.Write([]byte("Success\n"))
 }
 
 func (s *HTTPStaticServer) hUserModify(w http.ResponseWriter, r *http.Request) {
-	if !isAdmin(r) {
-		http.Error(w, "only `admin` user have operation authority", http.StatusInternalServerError)
+	if s.noUserStore(w) {
 		return
 	}
 
 	data, _ := ioutil.ReadAll(r.Body)
-	log.Println(string(data))
+	auditOf(r).Detail = redact(data)
 	user := &admin.User{}
 	if err := json.Unmarshal(data, user); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	auditOf(r).Target = user.Username
+	// a missing role keeps the role, "user" takes it away, the same for the
+	// quotas and 0
+	role := struct {
+		Role       *string `json:"role"`
+		QuotaBytes *int64  `json:"quotaBytes"`
+		QuotaFiles *int64  `json:"quotaFiles"`
+	}{}
+	json.Unmarshal(data, &role)
 
-	userInfo := admin.GetUserOnlyByUsername(user.Username)
+	userInfo, err := s.users.User(user.Username)
+	if err != nil {
+		http.Error(w, "user "+user.Username+": "+err.Error(), http.StatusNotFound)
+		return
+	}
 	if user.Password != "" {
-		userInfo.Password = Pwdhash(user.Password)
+		if err := userInfo.SetPassword(user.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
 	if user.Email != "" {
@@ -77,22 +100,45 @@ func (s *HTTPStaticServer) hUserModify(w http.ResponseWriter, r *http.Request) {
 		userInfo.Nickname = user.Nickname
 	}
 
-	if err := userInfo.Update(); err != nil {
+	if role.Role != nil {
+		newRole, err := admin.ParseRole(*role.Role)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if newRole != admin.RoleAdmin && s.refuseLastAdmin(w, user.Username) {
+			return
+		}
+		userInfo.Role = newRole
+	}
+
+	if role.QuotaBytes != nil {
+		userInfo.Quotabytes = *role.QuotaBytes
+	}
+	if role.QuotaFiles != nil {
+		userInfo.Quotafiles = *role.QuotaFiles
+	}
+	if userInfo.Quotabytes < 0 || userInfo.Quotafiles < 0 {
+		http.Error(w, "quotas can not be negative", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.users.UpdateUser(&userInfo); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	forgetCredentials(user.Username)
+	userRoles.reset()
 
 	w.Write([]byte("Success\n"))
 }
 
 func (s *HTTPStaticServer) hUserDisable(w http.ResponseWriter, r *http.Request) {
-	if !isAdmin(r) {
-		http.Error(w, "only `admin` user have operation authority", http.StatusInternalServerError)
+	if s.noUserStore(w) {
 		return
 	}
 
 	data, _ := ioutil.ReadAll(r.Body)
-	log.Println(string(data))
 	user := struct {
 		Usernames []string `json:"usernames"`
 	}{}
@@ -100,27 +146,35 @@ func (s *HTTPStaticServer) hUserDisable(w http.ResponseWriter, r *http.Request)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	auditOf(r).Target = strings.Join(user.Usernames, ",")
 
 	for _, username := range user.Usernames {
-		userInfo := admin.GetUserOnlyByUsername(username)
+		userInfo, err := s.users.User(username)
+		if err != nil {
+			http.Error(w, "user "+username+": "+err.Error(), http.StatusNotFound)
+			return
+		}
+		if s.refuseLastAdmin(w, username) {
+			return
+		}
 		userInfo.Status = 0
-		if err := userInfo.Update(); err != nil {
+		if err := s.users.UpdateUser(&userInfo); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		forgetCredentials(username)
 	}
+	userRoles.reset()
 
 	w.Write([]byte("Success\n"))
 }
 
 func (s *HTTPStaticServer) hUserEnable(w http.ResponseWriter, r *http.Request) {
-	if !isAdmin(r) {
-		http.Error(w, "only `admin` user have operation authority", http.StatusInternalServerError)
+	if s.noUserStore(w) {
 		return
 	}
 
 	data, _ := ioutil.ReadAll(r.Body)
-	log.Println(string(data))
 	user := struct {
 		Usernames []string `json:"usernames"`
 	}{}
@@ -128,27 +182,31 @@ func (s *HTTPStaticServer) hUserEnable(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	auditOf(r).Target = strings.Join(user.Usernames, ",")
 
 	for _, username := range user.Usernames {
-		userInfo := admin.GetUserOnlyByUsername(username)
+		userInfo, err := s.users.User(username)
+		if err != nil {
+			http.Error(w, "user "+username+": "+err.Error(), http.StatusNotFound)
+			return
+		}
 		userInfo.Status = 1
-		if err := userInfo.Update(); err != nil {
+		if err := s.users.UpdateUser(&userInfo); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
+	userRoles.reset()
 
 	w.Write([]byte("Success\n"))
 }
 
 func (s *HTTPStaticServer) hUserDel(w http.ResponseWriter, r *http.Request) {
-	if !isAdmin(r) {
-		http.Error(w, "only `admin` user have operation authority", http.StatusInternalServerError)
+	if s.noUserStore(w) {
 		return
 	}
 
 	data, _ := ioutil.ReadAll(r.Body)
-	log.Println(string(data))
 	user := struct {
 		Usernames []string `json:"usernames"`
 	}{}
@@ -156,26 +214,30 @@ func (s *HTTPStaticServer) hUserDel(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	auditOf(r).Target = strings.Join(user.Usernames, ",")
 
 	for _, username := range user.Usernames {
-		userInfo, _ := admin.GetUserByUsername(username)
-		if err := userInfo.Delete(); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if s.refuseLastAdmin(w, username) {
+			return
+		}
+		if err := s.users.DeleteUser(username); err != nil {
+			http.Error(w, username+": "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		forgetCredentials(username)
 	}
+	userGroups.reset()
+	userRoles.reset()
 
 	w.Write([]byte("Success\n"))
 }
 
 func (s *HTTPStaticServer) hUserGet(w http.ResponseWriter, r *http.Request) {
-	if !isAdmin(r) {
-		http.Error(w, "only `admin` user have operation authority", http.StatusInternalServerError)
+	if s.noUserStore(w) {
 		return
 	}
 
 	data, _ := ioutil.ReadAll(r.Body)
-	log.Println(string(data))
 	user := struct {
 		Username string `json:"username"`
 	}{}
@@ -184,7 +246,7 @@ func (s *HTTPStaticServer) hUserGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userInfo, err := admin.GetUserByUsername(user.Username)
+	userInfo, err := s.users.User(user.Username)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -196,19 +258,18 @@ func (s *HTTPStaticServer) hUserGet(w http.ResponseWriter, r *http.Request) {
 		}
 	*/
 
+	userInfo.Password = ""
 	resp, _ := json.MarshalIndent(userInfo, "", "    ")
 
 	w.Write(resp)
 }
 
 func (s *HTTPStaticServer) hUserSearch(w http.ResponseWriter, r *http.Request) {
-	if !isAdmin(r) {
-		http.Error(w, "only `admin` user have operation authority", http.StatusInternalServerError)
+	if s.noUserStore(w) {
 		return
 	}
 
 	data, _ := ioutil.ReadAll(r.Body)
-	log.Println(string(data))
 	user := struct {
 		Username string `json:"username"`
 	}{}
@@ -217,19 +278,24 @@ func (s *HTTPStaticServer) hUserSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users := admin.SearchUserByUsername(user.Username)
+	users, err := s.users.SearchUsers(user.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, u := range users {
+		u.Password = ""
+	}
 	resp, _ := json.Marshal(users)
 	w.Write(resp)
 }
 
 func (s *HTTPStaticServer) hUserList(w http.ResponseWriter, r *http.Request) {
-	if !isAdmin(r) {
-		http.Error(w, "only `admin` user have operation authority", http.StatusInternalServerError)
+	if s.noUserStore(w) {
 		return
 	}
 
 	data, _ := ioutil.ReadAll(r.Body)
-	log.Println(string(data))
 	num := struct {
 		Limit  int `json:"limit"`
 		Offset int `json:"offset"`
@@ -239,61 +305,46 @@ func (s *HTTPStaticServer) hUserList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users := admin.ListUserByUsername(num.Offset, num.Limit)
+	users, err := s.users.ListUsers(num.Offset, num.Limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, u := range users {
+		u.Password = ""
+	}
 	resp, _ := json.Marshal(users)
 	w.Write(resp)
 }
 
-func grapeAuthFunc(user, pass string, r *http.Request) bool {
-	userInfo, err := admin.GetUsableUserByUsername(user)
+// refuseLastAdmin refuses to demote, disable or delete the only admin, no
+// one could manage the users any more
+func (s *HTTPStaticServer) refuseLastAdmin(w http.ResponseWriter, username string) bool {
+	last, err := s.lastAdmin(username)
 	if err != nil {
-		return false
-	}
-
-	if Strtomd5(pass) != userInfo.Password {
-		log.Printf("user: %s login failed", user)
-		return false
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
 	}
-
-	if !config.Gcfg.Debug {
+	if last {
+		http.Error(w, username+" is the only admin", http.StatusBadRequest)
 		return true
 	}
-
-	log.Printf("user: %s login success", user)
-	// 更新登陆时间
-	userInfo = admin.UpdateLoginTime(&userInfo)
-	userInfo.Logincount += 1
-	userInfo.Update()
-	return true
+	return false
 }
 
-func isAdmin(r *http.Request) bool {
-
-	if getUser(r) == "admin" {
+// noUserStore refuses the management of users without a user database
+func (s *HTTPStaticServer) noUserStore(w http.ResponseWriter) bool {
+	if s.users == nil {
+		http.Error(w, "users are set in auth.users of the configuration with simpleauth", http.StatusBadRequest)
 		return true
 	}
-
 	return false
 }
 
+// getUser returns the name of the authenticated user, empty if anonymous
 func getUser(r *http.Request) string {
-	// Confirm the request is sending Basic Authentication credentials.
-	auth := r.Header.Get("Authorization")
-	if !strings.HasPrefix(auth, basicScheme) {
-		return ""
-	}
-
-	str, err := base64.StdEncoding.DecodeString(auth[len(basicScheme):])
-	if err != nil {
-		return ""
+	if id := identityOf(r); id != nil {
+		return id.Username
 	}
-
-	creds := bytes.SplitN(str, []byte(":"), 2)
-	if len(creds) != 2 {
-		return ""
-	}
-
-	givenUser := string(creds[0])
-	//givenPass := string(creds[1])
-	return givenUser
+	return ""
 }
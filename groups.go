@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"grapehttp/config"
+	"grapehttp/models/admin"
+)
+
+// groupCache remembers the groups of users for a while, the rules of
+// .ghs.yml are checked several times for every request. Users are told apart
+// by their source, see (*Identity).source.
+type groupCache struct {
+	lookup func(source, username string) ([]string, error)
+
+	mu      sync.Mutex
+	entries map[string]groupCacheEntry
+}
+
+type groupCacheEntry struct {
+	groups  []string
+	expires time.Time
+}
+
+const groupCacheTTL = 30 * time.Second
+
+func newGroupCache(lookup func(source, username string) ([]string, error)) *groupCache {
+	return &groupCache{lookup: lookup, entries: make(map[string]groupCacheEntry)}
+}
+
+// userGroups resolves the group membership for the rules of .ghs.yml
+var userGroups = newGroupCache(nil)
+
+// groups returns the groups of username of source, none if they can not be
+// looked up
+func (c *groupCache) groups(source, username string) []string {
+	if c.lookup == nil || username == "" {
+		return nil
+	}
+	key := userKey(source, username)
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.groups
+	}
+	groups, err := c.lookup(source, username)
+	if err != nil {
+		log.Printf("groups of %s: %v", key, err)
+		return nil
+	}
+	c.mu.Lock()
+	c.entries[key] = groupCacheEntry{groups, now.Add(groupCacheTTL)}
+	c.mu.Unlock()
+	return groups
+}
+
+// reset forgets all memberships, after groups were changed
+func (c *groupCache) reset() {
+	c.mu.Lock()
+	c.entries = make(map[string]groupCacheEntry)
+	c.mu.Unlock()
+}
+
+// staticGroups looks up the groups of auth.groups in the configuration,
+// whose members are named like userKey
+func staticGroups(members map[string][]string) func(source, username string) ([]string, error) {
+	return func(source, username string) ([]string, error) {
+		key := userKey(source, username)
+		groups := []string{}
+		for group, usernames := range members {
+			for _, u := range usernames {
+				if u == key {
+					groups = append(groups, group)
+					break
+				}
+			}
+		}
+		sort.Strings(groups)
+		return groups, nil
+	}
+}
+
+// newGroupLookup returns where the groups of users are found: auth.groups
+// of the configuration with simpleauth, else the user store. Users of other
+// sources only have the groups auth.groups gives to source:username.
+func newGroupLookup(gcfg config.Configure, users UserStore) func(source, username string) ([]string, error) {
+	static := staticGroups(gcfg.Auth.Groups)
+	return func(source, username string) ([]string, error) {
+		if users == nil || source != "" {
+			return static(source, username)
+		}
+		return users.GroupsOf(username)
+	}
+}
+
+// staticGroupsOnly refuses changes of the groups of the configuration
+func (s *HTTPStaticServer) staticGroupsOnly(w http.ResponseWriter) bool {
+	if s.users == nil {
+		http.Error(w, "groups are set in auth.groups of the configuration with simpleauth", http.StatusBadRequest)
+		return true
+	}
+	return false
+}
+
+func (s *HTTPStaticServer) hGroupAdd(w http.ResponseWriter, r *http.Request) {
+	if s.staticGroupsOnly(w) {
+		return
+	}
+
+	data, _ := ioutil.ReadAll(r.Body)
+	group := &admin.Group{}
+	if err := json.Unmarshal(data, group); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if group.Name == "" {
+		http.Error(w, "group name is required", http.StatusBadRequest)
+		return
+	}
+	auditOf(r).Target = group.Name
+	auditOf(r).Detail = map[string]interface{}{"members": group.Members}
+
+	group.Createtime = time.Now()
+	if err := s.users.AddGroup(group); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	userGroups.reset()
+
+	w.Write([]byte("Success\n"))
+}
+
+func (s *HTTPStaticServer) hGroupDel(w http.ResponseWriter, r *http.Request) {
+	if s.staticGroupsOnly(w) {
+		return
+	}
+
+	data, _ := ioutil.ReadAll(r.Body)
+	req := struct {
+		Names []string `json:"names"`
+	}{}
+	if err := json.Unmarshal(data, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auditOf(r).Target = strings.Join(req.Names, ",")
+
+	for _, name := range req.Names {
+		if _, err := s.users.Group(name); err != nil {
+			http.Error(w, name+": "+err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := s.users.DeleteGroup(name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	userGroups.reset()
+
+	w.Write([]byte("Success\n"))
+}
+
+// hGroupMembers adds the users to the group, or removes them with remove
+func (s *HTTPStaticServer) hGroupMembers(remove bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.staticGroupsOnly(w) {
+			return
+		}
+
+		data, _ := ioutil.ReadAll(r.Body)
+		req := struct {
+			Name      string   `json:"name"`
+			Usernames []string `json:"usernames"`
+		}{}
+		if err := json.Unmarshal(data, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		auditOf(r).Target = req.Name
+		auditOf(r).Detail = map[string]interface{}{"usernames": req.Usernames}
+
+		if _, err := s.users.Group(req.Name); err != nil {
+			http.Error(w, req.Name+": "+err.Error(), http.StatusNotFound)
+			return
+		}
+		var err error
+		if remove {
+			err = s.users.RemoveMembers(req.Name, req.Usernames...)
+		} else {
+			for _, username := range req.Usernames {
+				if _, err := s.users.User(username); err != nil {
+					http.Error(w, "user "+username+": "+err.Error(), http.StatusNotFound)
+					return
+				}
+			}
+			err = s.users.AddMembers(req.Name, req.Usernames...)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		userGroups.reset()
+
+		w.Write([]byte("Success\n"))
+	}
+}
+
+func (s *HTTPStaticServer) hGroupGet(w http.ResponseWriter, r *http.Request) {
+	data, _ := ioutil.ReadAll(r.Body)
+	req := struct {
+		Name string `json:"name"`
+	}{}
+	if err := json.Unmarshal(data, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var group admin.Group
+	var err error
+	if s.users == nil {
+		members, ok := config.Gcfg.Auth.Groups[req.Name]
+		if !ok {
+			err = errors.New("no such group")
+		}
+		group = admin.Group{Name: req.Name, Members: members}
+	} else {
+		group, err = s.users.Group(req.Name)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, _ := json.MarshalIndent(group, "", "    ")
+	w.Write(resp)
+}
+
+func (s *HTTPStaticServer) hGroupList(w http.ResponseWriter, r *http.Request) {
+	groups := []*admin.Group{}
+	var err error
+	if s.users == nil {
+		for name, members := range config.Gcfg.Auth.Groups {
+			groups = append(groups, &admin.Group{Name: name, Members: members})
+		}
+		sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	} else {
+		groups, err = s.users.Groups()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, _ := json.Marshal(groups)
+	w.Write(resp)
+}
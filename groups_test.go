@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"grapehttp/config"
+	"grapehttp/models/admin"
+)
+
+func TestAccessConfGroups(t *testing.T) {
+	saved := userGroups
+	defer func() { userGroups = saved }()
+	userGroups = newGroupCache(staticGroups(map[string][]string{
+		"devs": {"alice", "bob"},
+		"ops":  {"bob", "carol"},
+		"gone": {"dave"},
+	}))
+
+	c := &AccessConf{
+		NoAccess: false,
+		Users:    []UserControl{{Username: "alice", Upload: false, NoAccess: true}},
+		Groups: []GroupControl{
+			{Group: "devs", Upload: true},
+			{Group: "ops", Delete: true},
+			{Group: "gone", NoAccess: true},
+		},
+	}
+	tests := []struct {
+		user                     string
+		upload, delete, noaccess bool
+	}{
+		{"alice", false, false, true}, // the user rule wins over the groups
+		{"bob", true, true, false},    // the rules of the groups add up
+		{"carol", false, true, false},
+		{"dave", false, false, true},
+		{"eve", false, false, false}, // no group, the defaults
+		{"", false, false, false},
+	}
+	for _, v := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if v.user != "" {
+			r = withIdentity(r, &Identity{Username: v.user, Provider: "static"})
+		}
+		if c.canUpload(r) != v.upload || c.canDelete(r) != v.delete || c.noAccess(r) != v.noaccess {
+			t.Errorf("%q: got upload=%v delete=%v noaccess=%v", v.user, c.canUpload(r), c.canDelete(r), c.noAccess(r))
+		}
+	}
+}
+
+func TestGroupSources(t *testing.T) {
+	users := newMemUserStore()
+	users.AddUser(&admin.User{Username: "bob", Status: 1})
+	users.AddGroup(&admin.Group{Name: "devs", Members: []string{"bob"}})
+	gcfg := config.Configure{}
+	gcfg.Auth.Groups = map[string][]string{"ops": {"ldap:bob"}}
+	groups := newGroupCache(newGroupLookup(gcfg, users))
+
+	// users of ldap and oidc are not the bob of the user store
+	tests := []struct {
+		source string
+		want   []string
+	}{
+		{"", []string{"devs"}},
+		{"ldap", []string{"ops"}},
+		{"oidc", []string{}},
+	}
+	for _, v := range tests {
+		if got := groups.groups(v.source, "bob"); !reflect.DeepEqual(got, v.want) {
+			t.Errorf("groups of %s: got %v, want %v", userKey(v.source, "bob"), got, v.want)
+		}
+	}
+}
@@ -7,17 +7,21 @@ import (
 	"io/ioutil"
 	"log"
 	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
+	pathpkg "path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"regexp"
 
-	"github.com/go-yaml/yaml"
+	"grapehttp/pkg/homedir"
+
 	"github.com/gorilla/mux"
 	"github.com/shogo82148/androidbinary/apk"
 )
@@ -48,12 +52,29 @@ type HTTPStaticServer struct {
 	PlistProxy      string
 	GoogleTrackerId string
 	AuthType        string
-
-	indexes []IndexFileItem
-	m       *mux.Router
-}
-
-func NewHTTPStaticServer(root string) *HTTPStaticServer {
+	Index           *searchIndex
+
+	storage   Storage
+	stageDir  string // partial uploads, on the local filesystem
+	watcher   *indexWatcher
+	stop      chan struct{} // closed by Close
+	stopOnce  sync.Once
+	indexDone chan struct{} // closed when runIndex returns
+	acl       *aclCache
+	uploads   uploadLocks
+	checksums checksumCache
+	reserved  quotaReservations
+	webdav    http.Handler
+	tokens    *tokenStore
+	owners    *ownerStore
+	users     UserStore // nil with simpleauth
+	audit     *auditLog
+	m         *mux.Router
+}
+
+// NewHTTPStaticServer serves files from storage, or from the local directory
+// root if storage is nil.
+func NewHTTPStaticServer(root string, storage Storage) *HTTPStaticServer {
 	if root == "" {
 		root = "./"
 	}
@@ -61,49 +82,93 @@ func NewHTTPStaticServer(root string) *HTTPStaticServer {
 	if !strings.HasSuffix(root, "/") {
 		root = root + "/"
 	}
-	log.Printf("root path: %s\n", root)
+	stageDir := filepath.Join(root, uploadStageDir)
+	index := newSearchIndex(filepath.Join(root, indexDir, indexFileName))
+	tokens := newTokenStore(filepath.Join(root, tokenDir, tokenFileName))
+	owners := newOwnerStore(filepath.Join(root, ownerDir, ownerFileName))
+	audit := newAuditLog(filepath.Join(root, auditDir, auditFileName))
+	if storage == nil {
+		storage = NewLocalStorage(root)
+		log.Printf("root path: %s\n", root)
+	} else {
+		stageDir = filepath.Join(os.TempDir(), "grapehttp-uploads")
+		index = newSearchIndex(filepath.Join(os.TempDir(), "grapehttp-index", indexFileName))
+		tokens = newTokenStore(filepath.Join(homedir.HomeDir(), ".grapehttp", tokenFileName))
+		owners = newOwnerStore(filepath.Join(homedir.HomeDir(), ".grapehttp", ownerFileName))
+		audit = newAuditLog(filepath.Join(homedir.HomeDir(), ".grapehttp", auditFileName))
+		// changes can not be watched, so the server reports its own
+		storage = indexedStorage{storage, index}
+	}
 	m := mux.NewRouter()
 	s := &HTTPStaticServer{
-		Root:  root,
-		Theme: "black",
-		m:     m,
-	}
-
-	go func() {
-		time.Sleep(1 * time.Second)
-		for {
-			startTime := time.Now()
-			log.Println("Started making search index")
-			s.makeIndex()
-			log.Printf("Completed search index in %v", time.Since(startTime))
-			//time.Sleep(time.Second * 1)
-			time.Sleep(time.Minute * 10)
-		}
-	}()
-
-	m.HandleFunc("/-/status", s.hStatus)
-	m.HandleFunc("/-/cmd", s.hCmd)
-	m.HandleFunc("/-/user/add", s.hUserAdd)
-	m.HandleFunc("/-/user/del", s.hUserDel)
-	m.HandleFunc("/-/user/modify", s.hUserModify)
-	m.HandleFunc("/-/user/get", s.hUserGet)
-	m.HandleFunc("/-/user/search", s.hUserSearch)
-	m.HandleFunc("/-/user/list", s.hUserList)
-	m.HandleFunc("/-/user/enable", s.hUserEnable)
-	m.HandleFunc("/-/user/disable", s.hUserDisable)
-	m.HandleFunc("/-/zip/{path:.*}", s.hZip)
-	m.HandleFunc("/-/unzip/{zip_path:.*}/-/{path:.*}", s.hUnzip)
-	m.HandleFunc("/-/json/{path:.*}", s.hJSONList)
+		Root:     root,
+		Theme:    "black",
+		Index:    index,
+		storage:  storage,
+		stageDir: stageDir,
+		tokens:   tokens,
+		owners:   owners,
+		audit:    audit,
+		m:        m,
+
+		stop:      make(chan struct{}),
+		indexDone: make(chan struct{}),
+	}
+	s.acl = newACLCache(storage, s.defaultAccessConf)
+	s.webdav = newWebdavHandler(s)
+
+	go s.runIndex()
+
+	// every route goes through authorize, see access
+	m.HandleFunc("/-/status", s.authorize(anyone, s.hStatus))
+	m.HandleFunc("/-/cmd", s.authorize(anyone.audit("cmd"), s.hCmd))
+	m.HandleFunc("/-/upload", s.authorize(anyone, s.hUploadCreate)).Methods("POST")
+	m.HandleFunc("/-/upload/{id}", s.authorize(anyone, s.hUploadStatus)).Methods("GET", "HEAD")
+	m.HandleFunc("/-/upload/{id}", s.authorize(anyone, s.hUploadPatch)).Methods("PATCH")
+	m.HandleFunc("/-/upload/{id}", s.authorize(anyone.audit("upload"), s.hUploadFinish)).Methods("POST")
+	m.HandleFunc("/-/upload/{id}", s.authorize(anyone, s.hUploadAbort)).Methods("DELETE")
+	m.HandleFunc("/-/user/add", s.authorize(adminOnly.audit("user.add"), s.hUserAdd))
+	m.HandleFunc("/-/user/del", s.authorize(adminOnly.audit("user.del"), s.hUserDel))
+	m.HandleFunc("/-/user/modify", s.authorize(adminOnly.audit("user.modify"), s.hUserModify))
+	m.HandleFunc("/-/user/get", s.authorize(auditors, s.hUserGet))
+	m.HandleFunc("/-/user/search", s.authorize(auditors, s.hUserSearch))
+	m.HandleFunc("/-/user/list", s.authorize(auditors, s.hUserList))
+	m.HandleFunc("/-/user/enable", s.authorize(adminOnly.audit("user.enable"), s.hUserEnable))
+	m.HandleFunc("/-/user/disable", s.authorize(adminOnly.audit("user.disable"), s.hUserDisable))
+	m.HandleFunc("/-/group/add", s.authorize(adminOnly.audit("group.add"), s.hGroupAdd))
+	m.HandleFunc("/-/group/del", s.authorize(adminOnly.audit("group.del"), s.hGroupDel))
+	m.HandleFunc("/-/group/get", s.authorize(auditors, s.hGroupGet))
+	m.HandleFunc("/-/group/list", s.authorize(auditors, s.hGroupList))
+	m.HandleFunc("/-/group/adduser", s.authorize(adminOnly.audit("group.adduser"), s.hGroupMembers(false)))
+	m.HandleFunc("/-/group/deluser", s.authorize(adminOnly.audit("group.deluser"), s.hGroupMembers(true)))
+	m.HandleFunc("/-/token/create", s.authorize(signedIn.audit("token.create"), s.hTokenCreate)).Methods("POST")
+	m.HandleFunc("/-/token/list", s.authorize(signedIn, s.hTokenList)).Methods("GET")
+	m.HandleFunc("/-/token/revoke", s.authorize(signedIn.audit("token.revoke"), s.hTokenRevoke)).Methods("POST")
+	m.HandleFunc("/-/me", s.authorize(signedIn, s.hMe)).Methods("GET")
+	m.HandleFunc("/-/me/passwd", s.authorize(signedIn.audit("user.passwd"), s.hMePasswd)).Methods("POST")
+	m.HandleFunc("/-/me/logins", s.authorize(signedIn, s.hMeLogins)).Methods("GET")
+	m.HandleFunc("/-/quota", s.authorize(signedIn, s.hQuota)).Methods("GET")
+	m.HandleFunc("/-/audit", s.authorize(auditors, s.hAudit)).Methods("GET")
+	m.HandleFunc("/-/acl/check", s.authorize(signedIn, s.hACLCheck)).Methods("GET")
+	m.HandleFunc("/-/acl/get", s.authorize(access{target: aclTarget, check: needPerm(permAdmin)}, s.hACLGet)).Methods("GET")
+	m.HandleFunc("/-/acl/set", s.authorize(access{target: aclTarget, check: needPerm(permAdmin), action: "acl.set"}, s.hACLSet)).Methods("POST")
+	m.HandleFunc("/-/acl/patch", s.authorize(access{target: aclTarget, check: needPerm(permAdmin), action: "acl.patch"}, s.hACLPatch)).Methods("POST")
+	m.HandleFunc("/-/zip/{path:.*}", s.authorize(onPath("path", needPerm(permRead|permList)).audit("download"), s.hZip))
+	m.HandleFunc("/-/unzip/{zip_path:.*}/-/{path:.*}", s.authorize(onPath("zip_path", needPerm(permRead)).audit("download"), s.hUnzip))
+	m.HandleFunc("/-/json/{path:.*}", s.authorize(onPath("path", needPerm(permList)), s.hJSONList))
+	m.HandleFunc("/-/checksum/{path:.*}", s.authorize(onPath("path", needPerm(permRead)), s.hChecksum))
+	m.Handle(webdavPrefix, s.authorize(anyone.audit("webdav"), s.hWebdav))
+	m.PathPrefix(webdavPrefix + "/").HandlerFunc(s.authorize(anyone.audit("webdav"), s.hWebdav))
 	// routers for Apple *.ipa
-	m.HandleFunc("/-/ipa/plist/{path:.*}", s.hPlist)
-	m.HandleFunc("/-/ipa/link/{path:.*}", s.hIpaLink)
+	m.HandleFunc("/-/ipa/plist/{path:.*}", s.authorize(access{target: plistTarget, check: needPerm(permRead)}, s.hPlist))
+	m.HandleFunc("/-/ipa/link/{path:.*}", s.authorize(onPath("path", needPerm(permRead|permShare)), s.hIpaLink))
 
 	// TODO: /ipa/info
-	m.HandleFunc("/-/info/{path:.*}", s.hInfo)
+	m.HandleFunc("/-/info/{path:.*}", s.authorize(onPath("path", needPerm(permRead)), s.hInfo))
 
-	m.HandleFunc("/{path:.*}", s.hIndex).Methods("GET", "HEAD")
-	m.HandleFunc("/{path:.*}", s.hUpload).Methods("POST")
-	m.HandleFunc("/{path:.*}", s.hDelete).Methods("DELETE")
+	m.HandleFunc("/{path:.*}", s.authorize(onPath("path", s.canGet).audit("download"), s.hIndex)).Methods("GET", "HEAD")
+	m.HandleFunc("/{path:.*}", s.authorize(onPath("path", needAnyPerm(permWrite|permOverwrite)).audit("upload"), s.hUpload)).Methods("POST")
+	m.HandleFunc("/{path:.*}", s.authorize(onPath("path", s.canRemove).audit("delete"), s.hDelete)).Methods("DELETE")
 	return s
 }
 
@@ -113,19 +178,36 @@ func (s *HTTPStaticServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (s *HTTPStaticServer) hIndex(w http.ResponseWriter, r *http.Request) {
 	path := mux.Vars(r)["path"]
-	relPath := filepath.Join(s.Root, path)
-
-	if r.FormValue("raw") == "false" || isDir(relPath) {
+	name := cleanName(path)
+	info, err := s.storage.Stat(name)
+	if r.FormValue("raw") == "false" || (err == nil && info.IsDir()) {
+		auditOf(r).skip = true
 		if r.Method == "HEAD" {
 			return
 		}
 		tmpl.ExecuteTemplate(w, "index", s)
-	} else {
-		if r.FormValue("download") == "true" {
-			w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filepath.Base(path)))
+		return
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, s.relError(err), http.StatusForbidden)
 		}
-		http.ServeFile(w, r, relPath)
+		return
+	}
+
+	f, err := s.storage.Open(name)
+	if err != nil {
+		http.Error(w, s.relError(err), http.StatusInternalServerError)
+		return
 	}
+	defer f.Close()
+	if r.FormValue("download") == "true" {
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filepath.Base(path)))
+	}
+	s.setDigestHeader(w, r, name)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
 }
 
 func (s *HTTPStaticServer) hStatus(w http.ResponseWriter, r *http.Request) {
@@ -136,7 +218,16 @@ func (s *HTTPStaticServer) hStatus(w http.ResponseWriter, r *http.Request) {
 		}
 	*/
 
-	data, _ := json.MarshalIndent(s, "", "    ")
+	// the broken .ghs.yml files may name hidden paths, only admins and
+	// auditors see them
+	status := struct {
+		*HTTPStaticServer
+		ACLErrors map[string]string `json:"aclErrors,omitempty"`
+	}{HTTPStaticServer: s}
+	if canAudit(r) {
+		status.ACLErrors = s.acl.errors()
+	}
+	data, _ := json.MarshalIndent(status, "", "    ")
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(data)
 }
@@ -144,64 +235,101 @@ func (s *HTTPStaticServer) hStatus(w http.ResponseWriter, r *http.Request) {
 func (s *HTTPStaticServer) hDelete(w http.ResponseWriter, req *http.Request) {
 	// only can delete file now
 	path := mux.Vars(req)["path"]
-	auth := s.readAccessConf(path, req)
-	log.Printf("%#v", auth)
-	if !auth.canDelete(req) {
-		http.Error(w, "Delete forbidden", http.StatusForbidden)
-		return
-	}
-	err := os.Remove(filepath.Join(s.Root, path))
+	err := s.storage.Remove(cleanName(path))
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		http.Error(w, s.relError(err), 500)
 		return
 	}
+	s.owners.remove(cleanName(path))
 	w.Write([]byte("Success"))
 }
 
 func (s *HTTPStaticServer) hUpload(w http.ResponseWriter, req *http.Request) {
 	path := mux.Vars(req)["path"]
-	dirpath := filepath.Join(s.Root, path)
 
-	// check auth
-	auth := s.readAccessConf(path, req)
-	// check access first
-	if auth.noAccess(req) {
-		http.Error(w, "Access forbidden", http.StatusForbidden)
+	// stream the multipart body straight into the staging area, instead of
+	// letting ParseMultipartForm buffer it
+	reader, err := req.MultipartReader()
+	if err != nil {
+		log.Println("Parse form file:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	if !auth.canUpload(req) {
-		http.Error(w, "Upload forbidden", http.StatusForbidden)
-		return
+	var part *multipart.Part
+	for {
+		part, err = reader.NextPart()
+		if err != nil {
+			log.Println("Parse form file:", err)
+			http.Error(w, "http: no such file", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			break
+		}
+		part.Close()
 	}
+	defer part.Close()
 
-	file, header, err := req.FormFile("file")
+	name := filepath.Base(filepath.FromSlash(part.FileName()))
+	dstName, code, err := s.checkUploadDest(req, path, name)
 	if err != nil {
-		log.Println("Parse form file:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, s.relError(err), code)
 		return
 	}
-	defer func() {
-		file.Close()
-		req.MultipartForm.RemoveAll() // Seen from go source code, req.MultipartForm not nil after call FormFile(..)
-	}()
-	dstPath := filepath.Join(dirpath, header.Filename)
-	dst, err := os.Create(dstPath)
+	if code, err := s.checkQuota(getUser(req), dstName, "", 0, 1); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if err := os.MkdirAll(s.stageDir, 0755); err != nil {
+		http.Error(w, "File create "+s.relError(err), http.StatusInternalServerError)
+		return
+	}
+	staged := s.stagePath(newUploadID())
+	dst, err := os.Create(staged)
 	if err != nil {
 		log.Println("Create file:", err)
-		http.Error(w, "File create "+strings.Replace(err.Error(), filepath.Clean(s.Root), "", 1), http.StatusInternalServerError)
+		http.Error(w, "File create "+s.relError(err), http.StatusInternalServerError)
 		return
 	}
-	defer dst.Close()
-	if _, err := io.Copy(dst, file); err != nil {
+	// stop storing at the first byte over the quota, the rest is only
+	// counted for the error
+	left := s.quotaLeft(getUser(req), dstName)
+	var src io.Reader = part
+	if left >= 0 {
+		src = io.LimitReader(part, left+1)
+	}
+	size, err := io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && left >= 0 && size > left {
+		var rest int64
+		rest, err = io.Copy(ioutil.Discard, part)
+		size += rest
+	}
+	if err == nil {
+		release, code, quotaErr := s.reserveQuota(getUser(req), dstName, "", size, 1)
+		if quotaErr != nil {
+			os.Remove(staged)
+			http.Error(w, quotaErr.Error(), code)
+			return
+		}
+		defer release()
+		err = s.commitUpload(staged, dstName)
+	}
+	if err != nil {
+		os.Remove(staged)
 		log.Println("Handle upload file:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, s.relError(err), http.StatusInternalServerError)
 		return
 	}
+	s.owners.set(getUser(req), dstName)
+	s.indexWritten(dstName)
+	auditOf(req).Paths = []string{"/" + dstName}
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":     true,
-		"destination": dstPath,
+		"destination": "/" + dstName,
 	})
 }
 
@@ -235,7 +363,10 @@ func parseApkInfo(path string) (ai *ApkInfo) {
 
 func (s *HTTPStaticServer) hInfo(w http.ResponseWriter, r *http.Request) {
 	path := mux.Vars(r)["path"]
-	relPath := filepath.Join(s.Root, path)
+	relPath, ok := s.localFile(w, path)
+	if !ok {
+		return
+	}
 	if !isFile(relPath) {
 		http.Error(w, "Not a file", 403)
 		return
@@ -268,17 +399,29 @@ func (s *HTTPStaticServer) hInfo(w http.ResponseWriter, r *http.Request) {
 
 func (s *HTTPStaticServer) hZip(w http.ResponseWriter, r *http.Request) {
 	path := mux.Vars(r)["path"]
-	CompressToZip(w, filepath.Join(s.Root, path))
+	// leave out what the user may not see
+	CompressToZip(w, s.storage, path, func(name string, info os.FileInfo) bool {
+		dir := name
+		if !info.IsDir() {
+			dir = pathpkg.Dir(name)
+		}
+		auth := s.readAccessConf(dir, r)
+		return auth.canAccess(info.Name()) && auth.can(r, permRead|permList)
+	})
 }
 
 func (s *HTTPStaticServer) hUnzip(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	zipPath, path := vars["zip_path"], vars["path"]
+	zipFile, ok := s.localFile(w, zipPath)
+	if !ok {
+		return
+	}
 	ctype := mime.TypeByExtension(filepath.Ext(path))
 	if ctype != "" {
 		w.Header().Set("Content-Type", ctype)
 	}
-	err := ExtractFromZip(filepath.Join(s.Root, zipPath), path, w)
+	err := ExtractFromZip(zipFile, path, w)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -304,7 +447,10 @@ func (s *HTTPStaticServer) hPlist(w http.ResponseWriter, r *http.Request) {
 		path = path[0:len(path)-6] + ".ipa"
 	}
 
-	relPath := filepath.Join(s.Root, path)
+	relPath, ok := s.localFile(w, path)
+	if !ok {
+		return
+	}
 	plinfo, err := parseIPA(relPath)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
@@ -383,7 +529,27 @@ func (s *HTTPStaticServer) genPlistLink(httpPlistLink string) (plistUrl string,
 
 func (s *HTTPStaticServer) hFileOrDirectory(w http.ResponseWriter, r *http.Request) {
 	path := mux.Vars(r)["path"]
-	http.ServeFile(w, r, filepath.Join(s.Root, path))
+	relPath, ok := s.localFile(w, path)
+	if !ok {
+		return
+	}
+	http.ServeFile(w, r, relPath)
+}
+
+// localFile returns the local path for handlers which need a real file, they
+// are not available with other storages.
+func (s *HTTPStaticServer) localFile(w http.ResponseWriter, path string) (string, bool) {
+	l, ok := s.storage.(*LocalStorage)
+	if !ok {
+		http.Error(w, "Not supported by this storage", http.StatusNotImplemented)
+		return "", false
+	}
+	relPath, err := l.LocalPath(path)
+	if err != nil {
+		http.Error(w, s.relError(err), http.StatusForbidden)
+		return "", false
+	}
+	return relPath, true
 }
 
 type HTTPFileInfo struct {
@@ -392,11 +558,13 @@ type HTTPFileInfo struct {
 	Type    string `json:"type"`
 	Size    int64  `json:"size"`
 	ModTime int64  `json:"mtime"`
+
+	Snippets []contentSnippet `json:"snippets,omitempty"`
 }
 
 type AccessTable struct {
-	Regex string `yaml:"regex"`
-	Allow bool   `yaml:"allow"`
+	Regex string `yaml:"regex" json:"regex"`
+	Allow bool   `yaml:"allow" json:"allow"`
 }
 
 type UserControl struct {
@@ -406,26 +574,52 @@ type UserControl struct {
 	Upload   bool
 	Delete   bool
 	NoAccess bool
+	Perms    []string // replaces upload, delete and noaccess if set
+}
+
+// GroupControl is the rule of the members of a group
+type GroupControl struct {
+	Group    string
+	Upload   bool
+	Delete   bool
+	NoAccess bool
+	Perms    []string
 }
 
+// AccessConf is the access rules of a directory, from its .ghs.yml or its
+// parent. A rule grants the permissions of perms (see permSet), or without
+// it those of the older upload, delete and noaccess flags. The rule of a
+// user is its entry in users, else the entries of its groups together,
+// else the defaults.
 type AccessConf struct {
-	Upload       bool          `yaml:"upload" json:"upload"`
-	Delete       bool          `yaml:"delete" json:"delete"`
-	NoAccess     bool          `yaml:"noaccess" json:"noaccess"`
-	Username     string        `yaml:"username" json:"username"`
-	Users        []UserControl `yaml:"users" json:"users"`
-	AccessTables []AccessTable `yaml:"accessTables"`
+	Upload       bool           `yaml:"upload" json:"upload"`
+	Delete       bool           `yaml:"delete" json:"delete"`
+	NoAccess     bool           `yaml:"noaccess" json:"noaccess"`
+	Perms        []string       `yaml:"perms" json:"perms"`
+	Username     string         `yaml:"username" json:"username"`
+	Users        []UserControl  `yaml:"users" json:"users"`
+	Groups       []GroupControl `yaml:"groups" json:"groups"`
+	AccessTables []AccessTable  `yaml:"accessTables"`
+	Quota        *DirQuota      `yaml:"quota" json:"-"` // of the directory itself, see dirQuotas
+
+	path string // storage name the conf was read for
 }
 
-var reCache = make(map[string]*regexp.Regexp)
+// reCache keeps the compiled regexps of accessTables, handlers share it
+var reCache = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: make(map[string]*regexp.Regexp)}
 
 func (c *AccessConf) canAccess(fileName string) bool {
 	for _, table := range c.AccessTables {
-		pattern, ok := reCache[table.Regex]
+		reCache.Lock()
+		pattern, ok := reCache.m[table.Regex]
 		if !ok {
 			pattern, _ = regexp.Compile(table.Regex)
-			reCache[table.Regex] = pattern
+			reCache.m[table.Regex] = pattern
 		}
+		reCache.Unlock()
 		// skip wrong format regex
 		if pattern == nil {
 			continue
@@ -438,141 +632,126 @@ func (c *AccessConf) canAccess(fileName string) bool {
 }
 
 func (c *AccessConf) canDelete(r *http.Request) bool {
-	/*
-		session, err := store.Get(r, defaultSessionName)
-		if err != nil {
-			return c.Delete
-		}
-		val := session.Values["user"]
-		if val == nil {
-			return c.Delete
-		}
-		userInfo := val.(*UserInfo)
-	*/
-
-	if isAdmin(r) {
-		return true
-	}
-
-	for _, rule := range c.Users {
-		if rule.Username == getUser(r) {
-			return rule.Delete
-		}
-	}
-	return c.Delete
+	return c.can(r, permDelete)
 }
 
 func (c *AccessConf) canUpload(r *http.Request) bool {
-	/*
-		session, err := store.Get(r, defaultSessionName)
-		if err != nil {
-			return c.Upload
-		}
-		val := session.Values["user"]
-		if val == nil {
-			return c.Upload
-		}
-		userInfo := val.(*UserInfo)
-		for _, rule := range c.Users {
-			if rule.Username == userInfo.Username {
-				return rule.Upload
-			}
-		}
-	*/
-	if isAdmin(r) {
-		return true
-	}
-	for _, rule := range c.Users {
-		if rule.Username == getUser(r) {
-			return rule.Upload
-		}
-	}
-	return c.Upload
+	return c.can(r, permWrite)
 }
 
+// noAccess reports whether the user may neither list nor read anything
 func (c *AccessConf) noAccess(r *http.Request) bool {
-	/*
-		session, err := store.Get(r, defaultSessionName)
-		if err != nil {
-			return c.NoAccess
-		}
-		val := session.Values["user"]
-		if val == nil {
-			return c.NoAccess
-		}
-		userInfo := val.(*UserInfo)
-		for _, rule := range c.Users {
-			if rule.Username == userInfo.Username {
-				return rule.NoAccess
-			}
-		}
-	*/
-
-	if isAdmin(r) {
-		return false
-	}
-	for _, rule := range c.Users {
-		if rule.Username == getUser(r) {
-			return rule.NoAccess
-		}
-	}
-	return c.NoAccess
+	return c.perms(r)&(permRead|permList) == 0
 }
 
+const (
+	searchLimit    = 50
+	searchMaxLimit = 1000
+)
+
+// hJSONList lists a directory, or searches below it with ?search=, see
+// searchQuery. ?content=true searches the content of text files and returns
+// snippets of the matching lines. Search results are sorted by ?sort= (path,
+// name, size or mtime) and ?order=desc, and paged with ?offset= and ?limit=;
+// total is the number of results the user may see.
 func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
 	requestPath := mux.Vars(r)["path"]
-	localPath := filepath.Join(s.Root, requestPath)
 	search := r.FormValue("search")
 	auth := s.readAccessConf(requestPath, r)
-	auth.Upload = auth.canUpload(r)
-	auth.Delete = auth.canDelete(r)
-
-	// path string -> info os.FileInfo
-	fileInfoMap := make(map[string]os.FileInfo, 0)
-
+	perms := auth.perms(r)
+	auth.Upload = perms&permWrite != 0
+	auth.Delete = perms&permDelete != 0
+	auth.Perms = perms.names()
+
+	var items []IndexFileItem
+	var snippets map[string][]contentSnippet
+	offset, limit := 0, 0
 	if search != "" {
-		results := s.findIndex(search)
-		if len(results) > 50 { // max 50
-			results = results[:50]
+		query, err := parseQuery(search)
+		if err != nil {
+			http.Error(w, "Bad search: "+err.Error(), http.StatusBadRequest)
+			return
 		}
-		for _, item := range results {
-			if filepath.HasPrefix(item.Path, requestPath) {
-				fileInfoMap[item.Path] = item.Info
-			}
+		query.content = r.FormValue("content") == "true"
+		if query.content && s.Index.getContentMax() <= 0 {
+			http.Error(w, "Content search is disabled, start the server with --content-index", http.StatusBadRequest)
+			return
+		}
+		offset, _ = strconv.Atoi(r.FormValue("offset"))
+		limit, _ = strconv.Atoi(r.FormValue("limit"))
+		if offset < 0 {
+			offset = 0
+		}
+		if limit <= 0 {
+			limit = searchLimit
+		}
+		if limit > searchMaxLimit {
+			limit = searchMaxLimit
+		}
+		items = s.filterAccess(r, s.findIndex(query, requestPath))
+		if query.content {
+			items, snippets = s.matchContent(r, query, items)
+		}
+		err = sortIndexItems(items, r.FormValue("sort"), r.FormValue("order") == "desc", s.historyDirSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 	} else {
-		infos, err := ioutil.ReadDir(localPath)
+		if info, err := s.storage.Stat(requestPath); err != nil {
+			http.NotFound(w, r)
+			return
+		} else if !info.IsDir() {
+			http.Error(w, requestPath+" is not a directory", http.StatusBadRequest)
+			return
+		}
+		infos, err := s.storage.ReadDir(requestPath)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			http.Error(w, s.relError(err), 500)
 			return
 		}
 		for _, info := range infos {
-			fileInfoMap[filepath.Join(requestPath, info.Name())] = info
+			path := filepath.Join(requestPath, info.Name())
+			if isInternalPath(path) || !auth.canAccess(info.Name()) {
+				continue
+			}
+			items = append(items, IndexFileItem{path, info})
+		}
+	}
+	total := len(items)
+	if search != "" {
+		if offset > len(items) {
+			offset = len(items)
+		}
+		items = items[offset:]
+		if len(items) > limit {
+			items = items[:limit]
 		}
 	}
 
 	// turn file list -> json
 	lrs := make([]HTTPFileInfo, 0)
-	for path, info := range fileInfoMap {
-		if !auth.canAccess(info.Name()) {
-			continue
-		}
+	for _, item := range items {
+		path, info := item.Path, item.Info
 		lr := HTTPFileInfo{
 			Name:    info.Name(),
 			Path:    path,
 			ModTime: info.ModTime().UnixNano() / 1e6,
 		}
 		if search != "" {
-			name, err := filepath.Rel(requestPath, path)
+			name, err := filepath.Rel(cleanName(requestPath), path)
 			if err != nil {
 				log.Println(requestPath, path, err)
 			}
 			lr.Name = filepath.ToSlash(name) // fix for windows
+			lr.Snippets = snippets[path]
 		}
 		if info.IsDir() {
-			name := deepPath(localPath, info.Name())
-			lr.Name = name
-			lr.Path = filepath.Join(filepath.Dir(path), name)
+			if search == "" {
+				name := s.deepPath(r, requestPath, info.Name())
+				lr.Name = name
+				lr.Path = filepath.Join(filepath.Dir(path), name)
+			}
 			lr.Type = "dir"
 			lr.Size = s.historyDirSize(lr.Path)
 		} else {
@@ -584,74 +763,178 @@ func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
 
 	data, _ := json.Marshal(map[string]interface{}{
 		"files": lrs,
+		"total": total,
 		"auth":  auth,
 	})
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(data)
 }
 
-var dirSizeMap = make(map[string]int64)
-
-func (s *HTTPStaticServer) makeIndex() error {
-	var indexes = make([]IndexFileItem, 0)
-	var err = filepath.Walk(s.Root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Printf("WARN: Visit path: %s error: %v", strconv.Quote(path), err)
-			return filepath.SkipDir
-			// return err
+// filterAccess drops the search results the .ghs.yml rules hide from the
+// user, in their directory or in any directory above.
+func (s *HTTPStaticServer) filterAccess(r *http.Request, items []IndexFileItem) []IndexFileItem {
+	confs := make(map[string]*AccessConf)
+	conf := func(dir string) *AccessConf {
+		auth, ok := confs[dir]
+		if !ok {
+			ac := s.readAccessConf(dir, r)
+			auth = &ac
+			confs[dir] = auth
 		}
-		if info.IsDir() {
-			return nil
+		return auth
+	}
+	visible := make(map[string]bool)
+	var dirVisible func(dir string) bool
+	dirVisible = func(dir string) bool {
+		if dir == "." {
+			return true
+		}
+		v, ok := visible[dir]
+		if !ok {
+			parent := pathpkg.Dir(dir)
+			v = dirVisible(parent) && conf(parent).canAccess(pathpkg.Base(dir))
+			visible[dir] = v
 		}
+		return v
+	}
 
-		path, _ = filepath.Rel(s.Root, path)
-		path = filepath.ToSlash(path)
-		indexes = append(indexes, IndexFileItem{path, info})
-		return nil
-	})
-	s.indexes = indexes
-	dirSizeMap = make(map[string]int64)
-	return err
+	filtered := items[:0]
+	for _, item := range items {
+		dir := pathpkg.Dir(item.Path)
+		if !dirVisible(dir) || !conf(dir).can(r, permList) || !conf(dir).canAccess(item.Info.Name()) {
+			continue
+		}
+		filtered = append(filtered, item)
+	}
+	return filtered
 }
 
-func (s *HTTPStaticServer) historyDirSize(dir string) int64 {
-	var size int64
-	if size, ok := dirSizeMap[dir]; ok {
-		return size
-	}
-	for _, fitem := range s.indexes {
-		if filepath.HasPrefix(fitem.Path, dir) {
-			size += fitem.Info.Size()
+// matchContent reads the text files found by a content search and keeps
+// the ones matching query, with snippets of their matching lines. Files the
+// user may list but not read are dropped, their content must not show.
+func (s *HTTPStaticServer) matchContent(r *http.Request, query *searchQuery, items []IndexFileItem) ([]IndexFileItem, map[string][]contentSnippet) {
+	max := s.Index.getContentMax()
+	readable := make(map[string]bool)
+	snippets := make(map[string][]contentSnippet)
+	matched := items[:0]
+	for _, item := range items {
+		dir := pathpkg.Dir(item.Path)
+		ok, seen := readable[dir]
+		if !seen {
+			auth := s.readAccessConf(dir, r)
+			ok = auth.can(r, permRead)
+			readable[dir] = ok
+		}
+		if !ok {
+			continue
+		}
+		data, err := s.readContent(item.Path, max)
+		if err != nil {
+			continue
+		}
+		ok, found := query.matchContent(newQueryTarget(item.Path, item.Info), data)
+		if !ok {
+			continue
 		}
+		snippets[item.Path] = found
+		matched = append(matched, item)
 	}
-	dirSizeMap[dir] = size
-	return size
+	return matched, snippets
 }
 
-func (s *HTTPStaticServer) findIndex(text string) []IndexFileItem {
-	ret := make([]IndexFileItem, 0)
-	for _, item := range s.indexes {
-		ok := true
-		// search algorithm, space for AND
-		for _, keyword := range strings.Fields(text) {
-			needContains := true
-			if strings.HasPrefix(keyword, "-") {
-				needContains = false
-				keyword = keyword[1:]
-			}
-			if keyword == "" {
-				continue
+func (s *HTTPStaticServer) readContent(name string, max int64) ([]byte, error) {
+	f, err := s.storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(io.LimitReader(f, max))
+}
+
+// runIndex loads the saved search index and keeps it up to date until Close.
+// With LocalStorage changes are watched, and the storage is only scanned
+// again when events were lost; otherwise it is scanned every indexRescanEvery.
+func (s *HTTPStaticServer) runIndex() {
+	defer close(s.indexDone)
+	if err := s.Index.load(); err == nil {
+		log.Printf("Loaded search index from %s", s.Index.file)
+	} else if !os.IsNotExist(err) {
+		log.Printf("WARN: load search index: %v", err)
+	}
+	if w, err := newIndexWatcher(s.storage, s.Index, s.acl.changed); err == nil {
+		s.watcher = w
+		s.Index.setWatching(true)
+		defer w.close()
+	} else if err != errNoWatcher {
+		log.Printf("WARN: watch changes: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(indexSaveDelay)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
 			}
-			ok = (needContains == strings.Contains(strings.ToLower(item.Path), strings.ToLower(keyword)))
-			if !ok {
-				break
+			if err := s.Index.save(); err != nil {
+				log.Printf("WARN: save search index: %v", err)
 			}
 		}
-		if ok {
-			ret = append(ret, item)
+	}()
+
+	wait := time.After(1 * time.Second)
+	for {
+		var rescan <-chan struct{}
+		if s.Index.isWatching() {
+			rescan = s.watcher.rescan
+		}
+		select {
+		case <-wait:
+		case <-rescan:
+		case <-s.stop:
+			return
+		}
+		startTime := time.Now()
+		log.Println("Started making search index")
+		if err := s.makeIndex(); err != nil {
+			log.Printf("WARN: make search index: %v", err)
+		}
+		s.checkAccessConfs()
+		log.Printf("Completed search index in %v", time.Since(startTime))
+		if err := s.Index.save(); err != nil {
+			log.Printf("WARN: save search index: %v", err)
+		}
+		s.cleanStaleUploads()
+		wait = nil
+		if !s.Index.isWatching() {
+			wait = time.After(indexRescanEvery)
 		}
 	}
-	return ret
+}
+
+// Close stops keeping the search index up to date, a running scan is
+// waited for.
+func (s *HTTPStaticServer) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.indexDone
+	return nil
+}
+
+func (s *HTTPStaticServer) makeIndex() error {
+	var onDir func(name string)
+	if s.watcher != nil {
+		onDir = s.watcher.add
+	}
+	return s.Index.scan(s.storage, onDir)
+}
+
+func (s *HTTPStaticServer) historyDirSize(dir string) int64 {
+	return s.Index.dirSize(dir)
+}
+
+func (s *HTTPStaticServer) findIndex(query *searchQuery, dir string) []IndexFileItem {
+	return s.Index.search(query, dir)
 }
 
 func (s *HTTPStaticServer) defaultAccessConf() AccessConf {
@@ -662,43 +945,38 @@ func (s *HTTPStaticServer) defaultAccessConf() AccessConf {
 	}
 }
 
+// readAccessConf returns the access configuration of requestPath, from the
+// .ghs.yml of its directory and the ones above, see aclCache
 func (s *HTTPStaticServer) readAccessConf(requestPath string, r *http.Request) (ac AccessConf) {
-	requestPath = filepath.Clean(requestPath)
-	ac.Username = r.Header.Get("Username")
-	if requestPath == "/" || requestPath == "" || requestPath == "." {
-		ac = s.defaultAccessConf()
-	} else {
-		parentPath := filepath.Dir(requestPath)
-		ac = s.readAccessConf(parentPath, r)
-	}
-	relPath := filepath.Join(s.Root, requestPath)
-	if isFile(relPath) {
-		relPath = filepath.Dir(relPath)
-	}
-	cfgFile := filepath.Join(relPath, ".ghs.yml")
-	data, err := ioutil.ReadFile(cfgFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return
-		}
-		log.Printf("Err read .ghs.yml: %v", err)
-	}
-	err = yaml.Unmarshal(data, &ac)
+	name := cleanName(requestPath)
+	ac = s.acl.get(name).conf
+	ac.path = name
+	return
+}
+
+func readStorageFile(st Storage, name string) ([]byte, error) {
+	f, err := st.Open(name)
 	if err != nil {
-		log.Printf("Err format .ghs.yml: %v", err)
+		return nil, err
 	}
-	return
+	defer f.Close()
+	return ioutil.ReadAll(f)
 }
 
-func deepPath(basedir, name string) string {
+// deepPath follows name down the directories which contain nothing but one
+// more directory, it stops at those the user may not see
+func (s *HTTPStaticServer) deepPath(r *http.Request, basedir, name string) string {
 	isDir := true
 	// loop max 5, incase of for loop not finished
 	maxDepth := 5
 	for depth := 0; depth <= maxDepth && isDir; depth += 1 {
-		finfos, err := ioutil.ReadDir(filepath.Join(basedir, name))
+		finfos, err := s.storage.ReadDir(pathpkg.Join(basedir, name))
 		if err != nil || len(finfos) != 1 {
 			break
 		}
+		if s.hidden(r, cleanName(pathpkg.Join(basedir, name, finfos[0].Name()))) {
+			break
+		}
 		if finfos[0].IsDir() {
 			name = filepath.ToSlash(filepath.Join(name, finfos[0].Name()))
 		} else {
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The search index lives in indexDir under Root, or in a temporary directory
+// with other storages than LocalStorage. It is saved every indexSaveDelay
+// while it changes and loaded on start, so search works right away and the
+// first scan only has to catch up with changes made while the server was
+// down.
+const (
+	indexDir         = ".ghs-index"
+	indexFileName    = "index.gob"
+	indexVersion     = 2
+	indexSaveDelay   = 30 * time.Second
+	indexRescanEvery = 10 * time.Minute
+)
+
+var errNoWatcher = errors.New("watching changes is not supported")
+
+type indexEntry struct {
+	path  string
+	size  int64
+	mtime int64 // unix nano
+	dir   bool
+	gen   uint64 // scan generation which saw the entry last
+
+	content bool // the content was looked at, for the content index
+	text    bool // the content is text and in searchIndex.content
+}
+
+func (e *indexEntry) Name() string       { return path.Base(e.path) }
+func (e *indexEntry) Size() int64        { return e.size }
+func (e *indexEntry) ModTime() time.Time { return time.Unix(0, e.mtime) }
+func (e *indexEntry) IsDir() bool        { return e.dir }
+func (e *indexEntry) Sys() interface{}   { return nil }
+func (e *indexEntry) Mode() os.FileMode {
+	if e.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// searchIndex holds every file and directory of the storage. Substring
+// lookups go through a trigram index of the lower cased paths, only paths
+// containing all trigrams of the keywords are compared. Directory sizes are
+// kept up to date on every change.
+//
+// With contentMax set, the lower cased content of text files up to that size
+// is indexed the same way. An entry gets a new id whenever its content is
+// indexed, so the id lists stay sorted.
+type searchIndex struct {
+	mu         sync.RWMutex
+	file       string // where the index is saved, "" to keep it in memory only
+	contentMax int64  // 0 disables the content index
+	ids        map[string]uint32
+	docs       []*indexEntry // by id, nil once removed
+	dead       int
+	grams      map[uint32][]uint32 // trigram -> sorted ids
+	content    map[uint32][]uint32 // content trigram -> sorted ids
+	dirSizes   map[string]int64
+	dirFiles   map[string]int64 // number of files below a directory
+	gen        uint64
+	files      int
+	dirs       int
+	updated    time.Time
+	scanned    time.Time
+	saved      time.Time
+	scanning   bool
+	watching   bool
+	dirty      bool
+}
+
+func newSearchIndex(file string) *searchIndex {
+	ix := &searchIndex{file: file}
+	ix.reset()
+	return ix
+}
+
+func (ix *searchIndex) reset() {
+	ix.ids = make(map[string]uint32)
+	ix.docs = nil
+	ix.dead = 0
+	ix.grams = make(map[uint32][]uint32)
+	ix.content = make(map[uint32][]uint32)
+	ix.dirSizes = make(map[string]int64)
+	ix.dirFiles = make(map[string]int64)
+	ix.files, ix.dirs = 0, 0
+}
+
+func (ix *searchIndex) setContentMax(max int64) {
+	ix.mu.Lock()
+	ix.contentMax = max
+	ix.mu.Unlock()
+}
+
+func (ix *searchIndex) getContentMax() int64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.contentMax
+}
+
+// trigrams returns the distinct trigrams of s, sorted
+func trigrams(s string) []uint32 {
+	if len(s) < 3 {
+		return nil
+	}
+	seen := make(map[uint32]bool, len(s))
+	grams := make([]uint32, 0, len(s)-2)
+	for i := 0; i+3 <= len(s); i++ {
+		g := uint32(s[i])<<16 | uint32(s[i+1])<<8 | uint32(s[i+2])
+		if !seen[g] {
+			seen[g] = true
+			grams = append(grams, g)
+		}
+	}
+	sort.Slice(grams, func(i, j int) bool { return grams[i] < grams[j] })
+	return grams
+}
+
+// addUsage adds size and files to the size and the number of files of every
+// parent directory of name, "" being the root.
+func (ix *searchIndex) addUsage(name string, size, files int64) {
+	if size == 0 && files == 0 {
+		return
+	}
+	for dir := name; dir != ""; {
+		dir = path.Dir(dir)
+		if dir == "." {
+			dir = ""
+		}
+		ix.dirSizes[dir] += size
+		ix.dirFiles[dir] += files
+	}
+}
+
+// put adds or updates name in the index, without looking at its content
+func (ix *searchIndex) put(name string, info os.FileInfo) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.putLocked(name, info.Size(), info.ModTime().UnixNano(), info.IsDir(), nil)
+}
+
+// putFile adds or updates name, and indexes its content if it is new or
+// changed and small enough.
+func (ix *searchIndex) putFile(st Storage, name string, info os.FileInfo) {
+	var content *fileContent
+	if max := ix.needsContent(name, info); max > 0 {
+		content = readContent(st, name, max)
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.putLocked(name, info.Size(), info.ModTime().UnixNano(), info.IsDir(), content)
+}
+
+// needsContent returns the content size limit if the content of name has to
+// be read, or 0.
+func (ix *searchIndex) needsContent(name string, info os.FileInfo) int64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if ix.contentMax <= 0 || info.IsDir() || info.Size() > ix.contentMax {
+		return 0
+	}
+	if id, ok := ix.ids[name]; ok {
+		e := ix.docs[id]
+		if e.content && e.size == info.Size() && e.mtime == info.ModTime().UnixNano() {
+			return 0
+		}
+	}
+	return ix.contentMax
+}
+
+// fileContent is what the content index keeps of a file
+type fileContent struct {
+	text  bool
+	grams []uint32
+}
+
+// readContent returns the trigrams of a text file, files with a NUL byte in
+// the first 8000 bytes are taken as binary. It returns nil if the file can
+// not be read.
+func readContent(st Storage, name string, max int64) *fileContent {
+	f, err := st.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, max+1))
+	if err != nil || int64(len(data)) > max {
+		return nil
+	}
+	head := data
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return &fileContent{}
+	}
+	return &fileContent{text: true, grams: trigrams(strings.ToLower(string(data)))}
+}
+
+// putLocked adds or updates an entry. A file whose content was indexed
+// before is added again when it changed, so the old content is dropped.
+func (ix *searchIndex) putLocked(name string, size, mtime int64, dir bool, content *fileContent) {
+	if dir {
+		size = 0
+	}
+	ix.updated = time.Now()
+	ix.dirty = true
+	if id, ok := ix.ids[name]; ok {
+		e := ix.docs[id]
+		unchanged := e.size == size && e.mtime == mtime
+		if e.dir == dir && content == nil && (unchanged || !e.content) {
+			if !dir {
+				ix.addUsage(name, size-e.size, 0)
+			}
+			e.size, e.mtime, e.gen = size, mtime, ix.gen
+			return
+		}
+		// a file replaced by a directory or the other way round, or new
+		// content
+		ix.removeLocked(id)
+	}
+
+	id := uint32(len(ix.docs))
+	e := &indexEntry{path: name, size: size, mtime: mtime, dir: dir, gen: ix.gen}
+	ix.docs = append(ix.docs, e)
+	ix.ids[name] = id
+	for _, g := range trigrams(strings.ToLower(name)) {
+		ix.grams[g] = append(ix.grams[g], id)
+	}
+	if content != nil {
+		e.content, e.text = true, content.text
+		for _, g := range content.grams {
+			ix.content[g] = append(ix.content[g], id)
+		}
+	}
+	if dir {
+		ix.dirs++
+	} else {
+		ix.files++
+		ix.addUsage(name, size, 1)
+	}
+}
+
+func (ix *searchIndex) removeLocked(id uint32) {
+	e := ix.docs[id]
+	delete(ix.ids, e.path)
+	ix.docs[id] = nil
+	ix.dead++
+	if e.dir {
+		ix.dirs--
+		delete(ix.dirSizes, e.path)
+		delete(ix.dirFiles, e.path)
+	} else {
+		ix.files--
+		ix.addUsage(e.path, -e.size, -1)
+	}
+	ix.updated = time.Now()
+	ix.dirty = true
+}
+
+// remove drops name and, for a directory, everything below it
+func (ix *searchIndex) remove(name string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	id, ok := ix.ids[name]
+	if !ok {
+		return
+	}
+	if ix.docs[id].dir {
+		for _, child := range ix.candidatesLocked(ix.grams, []string{strings.ToLower(name) + "/"}) {
+			if e := ix.docs[child]; e != nil && strings.HasPrefix(e.path, name+"/") {
+				ix.removeLocked(child)
+			}
+		}
+	}
+	ix.removeLocked(id)
+	ix.compactLocked()
+}
+
+// compactLocked drops removed entries from the trigram lists once they make
+// up a good part of the index.
+func (ix *searchIndex) compactLocked() {
+	if ix.dead < 1024 || ix.dead < len(ix.ids)/4 {
+		return
+	}
+	newIDs := ix.renumberLocked()
+	docs := ix.docs
+	ix.docs = make([]*indexEntry, 0, len(ix.ids))
+	for _, e := range docs {
+		if e != nil {
+			ix.docs = append(ix.docs, e)
+		}
+	}
+	for name, id := range ix.ids {
+		ix.ids[name] = newIDs[id]
+	}
+	ix.grams = remapLists(ix.grams, newIDs)
+	ix.content = remapLists(ix.content, newIDs)
+	ix.dead = 0
+}
+
+// renumberLocked maps the ids of the entries left to consecutive ids, in
+// the same order.
+func (ix *searchIndex) renumberLocked() map[uint32]uint32 {
+	newIDs := make(map[uint32]uint32, len(ix.ids))
+	for id, e := range ix.docs {
+		if e != nil {
+			newIDs[uint32(id)] = uint32(len(newIDs))
+		}
+	}
+	return newIDs
+}
+
+// remapLists returns the trigram lists with the ids mapped by newIDs, ids
+// not in newIDs are dropped.
+func remapLists(lists map[uint32][]uint32, newIDs map[uint32]uint32) map[uint32][]uint32 {
+	remapped := make(map[uint32][]uint32, len(lists))
+	for g, list := range lists {
+		ids := make([]uint32, 0, len(list))
+		for _, id := range list {
+			if newID, ok := newIDs[id]; ok {
+				ids = append(ids, newID)
+			}
+		}
+		if len(ids) > 0 {
+			remapped[g] = ids
+		}
+	}
+	return remapped
+}
+
+// candidatesLocked returns the ids of all entries which contain every trigram
+// of the lower cased keywords in grams. Without any trigram to look up, that
+// is every entry.
+func (ix *searchIndex) candidatesLocked(grams map[uint32][]uint32, keywords []string) []uint32 {
+	lists := [][]uint32{}
+	for _, k := range keywords {
+		for _, g := range trigrams(k) {
+			list, ok := grams[g]
+			if !ok {
+				return nil
+			}
+			lists = append(lists, list)
+		}
+	}
+	if len(lists) == 0 {
+		all := make([]uint32, 0, len(ix.ids))
+		for id, e := range ix.docs {
+			if e != nil {
+				all = append(all, uint32(id))
+			}
+		}
+		return all
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	result := lists[0]
+	for _, list := range lists[1:] {
+		if result = intersect(result, list); len(result) == 0 {
+			break
+		}
+	}
+	return result
+}
+
+// intersect returns the ids in both sorted lists
+func intersect(a, b []uint32) []uint32 {
+	merged := []uint32{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			merged = append(merged, a[i])
+			i++
+			j++
+		}
+	}
+	return merged
+}
+
+// search returns the entries below dir matching q, in no particular order.
+// With q.content set, these are the text files which may match, the caller
+// has to check their content with q.matchContent.
+func (ix *searchIndex) search(q *searchQuery, dir string) []IndexFileItem {
+	dir = cleanName(dir)
+	pathLiterals, contentLiterals := q.literals()
+	if dir != "" {
+		pathLiterals = append(pathLiterals, strings.ToLower(dir)+"/")
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	candidates := ix.candidatesLocked(ix.grams, pathLiterals)
+	if q.content {
+		candidates = intersect(candidates, ix.candidatesLocked(ix.content, contentLiterals))
+	}
+	ret := make([]IndexFileItem, 0)
+	for _, id := range candidates {
+		e := ix.docs[id]
+		if e == nil || (dir != "" && !strings.HasPrefix(e.path, dir+"/")) || (q.content && !e.text) {
+			continue
+		}
+		target := newQueryTarget(e.path, e)
+		if e.dir {
+			target.size = ix.dirSizes[e.path]
+		}
+		if !q.matches(target) {
+			continue
+		}
+		c := *e
+		ret = append(ret, IndexFileItem{e.path, &c})
+	}
+	return ret
+}
+
+// counted reports whether the storage was scanned, or a saved index of a
+// scan loaded, so the usage of the directories is known
+func (ix *searchIndex) counted() bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return !ix.scanned.IsZero()
+}
+
+// dirSize returns the total size of the files below dir
+func (ix *searchIndex) dirSize(dir string) int64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.dirSizes[cleanName(dir)]
+}
+
+// usage returns the size and the number of the files below the storage name,
+// or of the file name itself
+func (ix *searchIndex) usage(name string) (size, files int64) {
+	name = cleanName(name)
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if id, ok := ix.ids[name]; ok && !ix.docs[id].dir {
+		return ix.docs[id].size, 1
+	}
+	return ix.dirSizes[name], ix.dirFiles[name]
+}
+
+// filesUsage returns the size and the number of the files among names,
+// directories are not counted
+func (ix *searchIndex) filesUsage(names []string) (size, files int64) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	for _, name := range names {
+		if id, ok := ix.ids[name]; ok && !ix.docs[id].dir {
+			size += ix.docs[id].size
+			files++
+		}
+	}
+	return
+}
+
+// addTree puts name and everything below it into the index. onDir is called
+// for every directory before it is read.
+func (ix *searchIndex) addTree(st Storage, name string, onDir func(name string)) error {
+	return walkStorage(st, name, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("WARN: Visit path: %s error: %v", name, err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if name == "" {
+			if onDir != nil {
+				onDir(name)
+			}
+			return nil
+		}
+		if isInternalPath(name) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() && onDir != nil {
+			onDir(name)
+		}
+		ix.putFile(st, name, info)
+		return nil
+	})
+}
+
+// refresh updates name after a change, it is removed if it does not exist
+// any more.
+func (ix *searchIndex) refresh(st Storage, name string) {
+	if name == "" || isInternalPath(name) {
+		return
+	}
+	info, err := st.Stat(name)
+	if err != nil {
+		ix.remove(name)
+		return
+	}
+	ix.putFile(st, name, info)
+}
+
+// scan walks the whole storage, updates the index and drops whatever was not
+// seen. Changes reported while the scan runs are kept.
+func (ix *searchIndex) scan(st Storage, onDir func(name string)) error {
+	ix.mu.Lock()
+	ix.gen++
+	gen := ix.gen
+	ix.scanning = true
+	ix.mu.Unlock()
+
+	err := ix.addTree(st, "", onDir)
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.scanning = false
+	if err != nil {
+		return err
+	}
+	for id, e := range ix.docs {
+		if e != nil && e.gen < gen {
+			ix.removeLocked(uint32(id))
+		}
+	}
+	ix.compactLocked()
+	ix.scanned = time.Now()
+	return nil
+}
+
+func (ix *searchIndex) setWatching(watching bool) {
+	ix.mu.Lock()
+	ix.watching = watching
+	ix.mu.Unlock()
+}
+
+func (ix *searchIndex) isWatching() bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.watching
+}
+
+type indexRecord struct {
+	Path    string
+	Size    int64
+	ModTime int64
+	Dir     bool
+	Content bool
+	Text    bool
+}
+
+type indexSnapshot struct {
+	Version int
+	Scanned time.Time
+	Entries []indexRecord
+	Content map[uint32][]uint32 // by the position in Entries
+}
+
+// save writes the index to ix.file if it changed since the last save
+func (ix *searchIndex) save() error {
+	ix.mu.Lock()
+	if ix.file == "" || !ix.dirty {
+		ix.mu.Unlock()
+		return nil
+	}
+	snap := indexSnapshot{Version: indexVersion, Scanned: ix.scanned, Entries: make([]indexRecord, 0, len(ix.ids))}
+	for _, e := range ix.docs {
+		if e != nil {
+			snap.Entries = append(snap.Entries, indexRecord{e.path, e.size, e.mtime, e.dir, e.content, e.text})
+		}
+	}
+	snap.Content = remapLists(ix.content, ix.renumberLocked())
+	ix.dirty = false
+	ix.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(ix.file), 0755); err != nil {
+		return err
+	}
+	tmp := ix.file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(&snap); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, ix.file); err != nil {
+		return err
+	}
+	ix.mu.Lock()
+	ix.saved = time.Now()
+	ix.mu.Unlock()
+	return nil
+}
+
+// load replaces the index with the one saved in ix.file
+func (ix *searchIndex) load() error {
+	if ix.file == "" {
+		return nil
+	}
+	f, err := os.Open(ix.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var snap indexSnapshot
+	if err := gob.NewDecoder(f).Decode(&snap); err != nil && err != io.EOF {
+		return err
+	}
+	if snap.Version != indexVersion {
+		return fmt.Errorf("index version %d not supported", snap.Version)
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.reset()
+	for _, r := range snap.Entries {
+		ix.putLocked(r.Path, r.Size, r.ModTime, r.Dir, nil)
+		e := ix.docs[len(ix.docs)-1]
+		e.content, e.text = r.Content, r.Text
+	}
+	if snap.Content != nil {
+		ix.content = snap.Content
+	}
+	ix.scanned = snap.Scanned
+	ix.dirty = false
+	return nil
+}
+
+// indexedStorage updates the index after every change made through it, for
+// storages whose changes can not be watched.
+type indexedStorage struct {
+	Storage
+	ix *searchIndex
+}
+
+func (st indexedStorage) Create(name string) (io.WriteCloser, error) {
+	w, err := st.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &indexedWriter{WriteCloser: w, st: st, name: cleanName(name)}, nil
+}
+
+func (st indexedStorage) Mkdir(name string) error {
+	err := st.Storage.Mkdir(name)
+	if err == nil {
+		st.ix.refresh(st.Storage, cleanName(name))
+	}
+	return err
+}
+
+func (st indexedStorage) MkdirAll(name string) error {
+	err := st.Storage.MkdirAll(name)
+	if err == nil {
+		for dir := cleanName(name); dir != "." && dir != ""; dir = path.Dir(dir) {
+			st.ix.refresh(st.Storage, dir)
+		}
+	}
+	return err
+}
+
+func (st indexedStorage) Remove(name string) error {
+	err := st.Storage.Remove(name)
+	if err == nil {
+		st.ix.remove(cleanName(name))
+	}
+	return err
+}
+
+func (st indexedStorage) RemoveAll(name string) error {
+	err := st.Storage.RemoveAll(name)
+	if err == nil {
+		st.ix.remove(cleanName(name))
+	}
+	return err
+}
+
+func (st indexedStorage) Rename(oldname, newname string) error {
+	err := st.Storage.Rename(oldname, newname)
+	if err == nil {
+		st.ix.remove(cleanName(oldname))
+		st.ix.addTree(st.Storage, cleanName(newname), nil)
+	}
+	return err
+}
+
+type indexedWriter struct {
+	io.WriteCloser
+	st   indexedStorage
+	name string
+}
+
+func (w *indexedWriter) Close() error {
+	err := w.WriteCloser.Close()
+	w.st.ix.refresh(w.st.Storage, w.name)
+	return err
+}
+
+// MarshalJSON reports the index status in /-/status
+func (ix *searchIndex) MarshalJSON() ([]byte, error) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	ms := func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return t.UnixNano() / 1e6
+	}
+	return json.Marshal(map[string]interface{}{
+		"files":    ix.files,
+		"dirs":     ix.dirs,
+		"updated":  ms(ix.updated),
+		"scanned":  ms(ix.scanned),
+		"saved":    ms(ix.saved),
+		"scanning": ix.scanning,
+		"watching": ix.watching,
+		"content":  ix.contentMax > 0,
+	})
+}
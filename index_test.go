@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (f fakeInfo) Name() string       { return f.name }
+func (f fakeInfo) Size() int64        { return f.size }
+func (f fakeInfo) Mode() os.FileMode  { return 0644 }
+func (f fakeInfo) ModTime() time.Time { return time.Date(2017, 7, 14, 12, 0, 0, 0, time.Local) }
+func (f fakeInfo) IsDir() bool        { return f.dir }
+func (f fakeInfo) Sys() interface{}   { return nil }
+
+func searchPaths(ix *searchIndex, text, dir string) string {
+	q, err := parseQuery(text)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	paths := []string{}
+	for _, item := range ix.search(q, dir) {
+		paths = append(paths, item.Path)
+	}
+	sort.Strings(paths)
+	return strings.Join(paths, ",")
+}
+
+func TestSearchIndex(t *testing.T) {
+	ix := newSearchIndex("")
+	ix.put("docs", fakeInfo{"docs", 0, true})
+	ix.put("docs/Readme.md", fakeInfo{"Readme.md", 10, false})
+	ix.put("docs/api", fakeInfo{"api", 0, true})
+	ix.put("docs/api/readme.txt", fakeInfo{"readme.txt", 5, false})
+	ix.put("src", fakeInfo{"src", 0, true})
+	ix.put("src/main.go", fakeInfo{"main.go", 100, false})
+
+	tests := []struct {
+		text string
+		dir  string
+		want string
+	}{
+		{"readme", "", "docs/Readme.md,docs/api/readme.txt"},
+		{"README -txt", "", "docs/Readme.md"},
+		{"readme", "docs/api", "docs/api/readme.txt"},
+		{"readme", "/docs/", "docs/Readme.md,docs/api/readme.txt"},
+		{"readme", "doc", ""},
+		{"go", "", "src/main.go"},
+		{"", "src", "src/main.go"},
+		{"docs", "", "docs/Readme.md,docs/api/readme.txt"},
+		{"nothing", "", ""},
+		{"main OR api", "", "docs/api/readme.txt,src/main.go"},
+		{"readme OR main -docs", "", "src/main.go"},
+		{`"api/read"`, "", "docs/api/readme.txt"},
+		{"*.md", "", "docs/Readme.md"},
+		{"src/*.go", "", "src/main.go"},
+		{"/^docs/.*txt$/", "", "docs/api/readme.txt"},
+		{"ext:md,go", "", "docs/Readme.md,src/main.go"},
+		{"size:>=10", "", "docs/Readme.md,src/main.go"},
+		{"size:<1k -ext:go", "", "docs/Readme.md,docs/api/readme.txt"},
+		{"type:dir", "", "docs,docs/api,src"},
+		{"type:dir size:>10", "", "docs,src"},
+		{"type:file OR type:dir api", "", "docs/api,docs/api/readme.txt"},
+		{"mtime:<7d", "", ""},
+		{"mtime:>7d", "", "docs/Readme.md,docs/api/readme.txt,src/main.go"},
+		{"mtime:2017-07-14 main", "", "src/main.go"},
+		{"mtime:>2017-07-14", "", ""},
+		{"OR main", "", "error: OR needs a term on both sides"},
+		{`"open`, "", "error: missing closing \""},
+		{"size:lots", "", `error: bad size "lots"`},
+	}
+	for _, v := range tests {
+		if got := searchPaths(ix, v.text, v.dir); got != v.want {
+			t.Fatalf("search(%q, %q) = %q, want %q", v.text, v.dir, got, v.want)
+		}
+	}
+
+	if size := ix.dirSize("docs"); size != 15 {
+		t.Fatalf("dirSize(docs) = %d, want 15", size)
+	}
+	if size := ix.dirSize(""); size != 115 {
+		t.Fatalf("dirSize() = %d, want 115", size)
+	}
+	ix.put("docs/api/readme.txt", fakeInfo{"readme.txt", 8, false})
+	if size := ix.dirSize("docs"); size != 18 {
+		t.Fatalf("dirSize(docs) after update = %d, want 18", size)
+	}
+	if size, files := ix.usage("docs"); size != 18 || files != 2 {
+		t.Fatalf("usage(docs) = %d, %d, want 18, 2", size, files)
+	}
+	if size, files := ix.usage("src/main.go"); size != 100 || files != 1 {
+		t.Fatalf("usage(src/main.go) = %d, %d, want 100, 1", size, files)
+	}
+	if size, files := ix.filesUsage([]string{"docs", "docs/Readme.md", "src/main.go", "gone"}); size != 110 || files != 2 {
+		t.Fatalf("filesUsage = %d, %d, want 110, 2", size, files)
+	}
+
+	ix.remove("docs/api")
+	if got := searchPaths(ix, "readme", ""); got != "docs/Readme.md" {
+		t.Fatalf("search after remove = %q", got)
+	}
+	if size := ix.dirSize(""); size != 110 {
+		t.Fatalf("dirSize() after remove = %d, want 110", size)
+	}
+	if _, files := ix.usage(""); files != 2 {
+		t.Fatalf("usage() after remove: %d files, want 2", files)
+	}
+	if ix.files != 2 || ix.dirs != 2 {
+		t.Fatalf("%d files and %d dirs, want 2 and 2", ix.files, ix.dirs)
+	}
+}
+
+func TestSearchIndexScanAndSave(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ghs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "root")
+	os.MkdirAll(filepath.Join(root, "a/b"), 0755)
+	os.MkdirAll(filepath.Join(root, uploadStageDir), 0755)
+	ioutil.WriteFile(filepath.Join(root, "a/b/one.txt"), []byte("1"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "a/two.txt"), []byte("22"), 0644)
+	ioutil.WriteFile(filepath.Join(root, uploadStageDir, "part.txt"), []byte("333"), 0644)
+
+	st := NewLocalStorage(root)
+	file := filepath.Join(root, indexDir, indexFileName)
+	ix := newSearchIndex(file)
+	if err := ix.scan(st, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchPaths(ix, "txt", ""); got != "a/b/one.txt,a/two.txt" {
+		t.Fatalf("search after scan = %q", got)
+	}
+
+	os.Remove(filepath.Join(root, "a/two.txt"))
+	if err := ix.scan(st, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchPaths(ix, "txt", ""); got != "a/b/one.txt" {
+		t.Fatalf("search after rescan = %q", got)
+	}
+	if err := ix.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newSearchIndex(file)
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchPaths(loaded, "txt", ""); got != "a/b/one.txt" {
+		t.Fatalf("search after load = %q", got)
+	}
+	if size := loaded.dirSize("a"); size != 1 {
+		t.Fatalf("dirSize(a) after load = %d, want 1", size)
+	}
+	// the index file itself is not indexed
+	if err := loaded.scan(st, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchPaths(loaded, "index", ""); got != "" {
+		t.Fatalf("internal files indexed: %q", got)
+	}
+}
+
+func TestContentIndex(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ghs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	os.MkdirAll(filepath.Join(tmp, "logs"), 0755)
+	ioutil.WriteFile(filepath.Join(tmp, "logs/api.log"), []byte("started\nERROR connection refused\nretry\n"), 0644)
+	ioutil.WriteFile(filepath.Join(tmp, "logs/web.log"), []byte("all good\n"), 0644)
+	ioutil.WriteFile(filepath.Join(tmp, "logs/core.bin"), []byte("error\x00connection"), 0644)
+	ioutil.WriteFile(filepath.Join(tmp, "big.txt"), []byte(strings.Repeat("connection ", 20)), 0644)
+
+	st := NewLocalStorage(tmp)
+	file := filepath.Join(tmp, indexDir, indexFileName)
+	ix := newSearchIndex(file)
+	ix.setContentMax(100)
+	if err := ix.scan(st, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	find := func(ix *searchIndex, text string) string {
+		q, err := parseQuery(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.content = true
+		found := []string{}
+		for _, item := range ix.search(q, "") {
+			data, _ := ioutil.ReadFile(filepath.Join(tmp, item.Path))
+			if ok, snippets := q.matchContent(newQueryTarget(item.Path, item.Info), data); ok {
+				for _, s := range snippets {
+					m := s.Matches[0]
+					found = append(found, fmt.Sprintf("%s:%d:%s", item.Path, s.Line, s.Text[m[0]:m[1]]))
+				}
+			}
+		}
+		sort.Strings(found)
+		return strings.Join(found, ",")
+	}
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"connection", "logs/api.log:2:connection"},
+		{`"error connection"`, "logs/api.log:2:ERROR connection"},
+		{"error refused", "logs/api.log:2:ERROR"},
+		{"retry OR good", "logs/api.log:3:retry,logs/web.log:1:good"},
+		{"/ret.y/ ext:log", "logs/api.log:3:retry"},
+		{"good OR retry -refused", "logs/web.log:1:good"},
+		{"ext:txt", ""},
+	}
+	for _, v := range tests {
+		if got := find(ix, v.text); got != v.want {
+			t.Fatalf("content search %q = %q, want %q", v.text, got, v.want)
+		}
+	}
+
+	// changed content replaces the old one
+	ioutil.WriteFile(filepath.Join(tmp, "logs/web.log"), []byte("connection lost\n"), 0644)
+	os.Chtimes(filepath.Join(tmp, "logs/web.log"), time.Now(), time.Now().Add(time.Hour))
+	ix.refresh(st, "logs/web.log")
+	if got := find(ix, "good OR connection"); got != "logs/api.log:2:connection,logs/web.log:1:connection" {
+		t.Fatalf("content search after change = %q", got)
+	}
+	if err := ix.save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newSearchIndex(file)
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := find(loaded, "lost"); got != "logs/web.log:1:lost" {
+		t.Fatalf("content search after load = %q", got)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	s := permServer(t, map[string]string{"a.txt": "a"})
+	for deadline := time.Now().Add(10 * time.Second); searchPaths(s.Index, "a.txt", "") != "a.txt"; {
+		if time.Now().After(deadline) {
+			t.Fatal("a.txt not indexed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("close does not stop the index")
+	}
+	s.Close()
+
+	// changes are not watched any more
+	ioutil.WriteFile(filepath.Join(s.Root, "b.txt"), []byte("b"), 0644)
+	time.Sleep(200 * time.Millisecond)
+	if got := searchPaths(s.Index, "b.txt", ""); got != "" {
+		t.Errorf("indexed after close: %q", got)
+	}
+}
@@ -0,0 +1,196 @@
+// +build linux
+
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB
+
+// indexWatcher keeps the index up to date with inotify, it needs one watch
+// per directory. When the kernel runs out of watches or drops events, rescan
+// is signalled and the server falls back to periodic scans. onChange is
+// told about changed .ghs.yml files and removed or moved directories.
+type indexWatcher struct {
+	fd       int
+	file     *os.File // fd, read through the runtime poller so close ends run
+	root     string // local path of the storage root
+	st       Storage
+	ix       *searchIndex
+	onChange func(name string)
+	rescan   chan struct{}
+	done     chan struct{} // closed when run returns
+
+	mu     sync.Mutex
+	names  map[int32]string // watch descriptor -> directory
+	wds    map[string]int32
+	failed bool
+	closed bool
+}
+
+func newIndexWatcher(st Storage, ix *searchIndex, onChange func(name string)) (*indexWatcher, error) {
+	l, ok := st.(*LocalStorage)
+	if !ok {
+		return nil, errNoWatcher
+	}
+	root, err := l.LocalPath("")
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &indexWatcher{
+		fd:       fd,
+		file:     os.NewFile(uintptr(fd), "inotify"),
+		root:     root,
+		st:       st,
+		ix:       ix,
+		onChange: onChange,
+		rescan:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		names:    make(map[int32]string),
+		wds:      make(map[string]int32),
+	}
+	go w.run()
+	return w, nil
+}
+
+// add watches the directory name
+func (w *indexWatcher) add(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failed || w.closed {
+		return
+	}
+	localPath := filepath.Join(w.root, filepath.FromSlash(name))
+	wd, err := syscall.InotifyAddWatch(w.fd, localPath, inotifyMask|syscall.IN_ONLYDIR|syscall.IN_DONT_FOLLOW)
+	if err == syscall.ENOSPC {
+		log.Printf("WARN: out of inotify watches, raise fs.inotify.max_user_watches; search index falls back to rescans")
+		w.fail()
+		return
+	}
+	if err != nil {
+		return
+	}
+	w.names[int32(wd)] = name
+	w.wds[name] = int32(wd)
+}
+
+// fail stops relying on events, the caller holds w.mu
+func (w *indexWatcher) fail() {
+	w.failed = true
+	w.ix.setWatching(false)
+	w.signalRescan()
+}
+
+func (w *indexWatcher) signalRescan() {
+	select {
+	case w.rescan <- struct{}{}:
+	default:
+	}
+}
+
+// close stops watching and waits for the pending events to be handled
+func (w *indexWatcher) close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	w.mu.Unlock()
+	w.file.Close()
+	<-w.done
+}
+
+// removeTree drops the watches of name and its subdirectories, they would
+// report wrong paths after a move.
+func (w *indexWatcher) removeTree(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	for dir, wd := range w.wds {
+		if dir == name || strings.HasPrefix(dir, name+"/") {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.wds, dir)
+			delete(w.names, wd)
+		}
+	}
+}
+
+func (w *indexWatcher) run() {
+	defer close(w.done)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil || n <= 0 {
+			w.mu.Lock()
+			if !w.closed {
+				log.Printf("WARN: inotify read: %v", err)
+				w.fail()
+			}
+			w.mu.Unlock()
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(ev.Len)
+			name := strings.TrimRight(string(buf[start:offset]), "\x00")
+			w.handle(ev.Wd, ev.Mask, name)
+		}
+	}
+}
+
+func (w *indexWatcher) handle(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.signalRescan()
+		return
+	}
+	w.mu.Lock()
+	dir, ok := w.names[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.names, wd)
+		if ok && w.wds[dir] == wd {
+			delete(w.wds, dir)
+		}
+		ok = false
+	}
+	w.mu.Unlock()
+	if !ok || name == "" {
+		return
+	}
+
+	full := path.Join(dir, name)
+	if isInternalPath(full) {
+		return
+	}
+	if path.Base(full) == ghsFileName || (mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO) != 0) {
+		w.onChange(full)
+	}
+	switch {
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		if mask&syscall.IN_ISDIR != 0 {
+			w.removeTree(full)
+		}
+		w.ix.remove(full)
+	case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && mask&syscall.IN_ISDIR != 0:
+		// files may have been created before the watch was added
+		w.ix.addTree(w.st, full, w.add)
+	default:
+		w.ix.refresh(w.st, full)
+	}
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+package main
+
+// indexWatcher is only implemented with inotify, elsewhere the index is kept
+// up to date by periodic scans.
+type indexWatcher struct {
+	rescan chan struct{}
+}
+
+func newIndexWatcher(st Storage, ix *searchIndex, onChange func(name string)) (*indexWatcher, error) {
+	return nil, errNoWatcher
+}
+
+func (w *indexWatcher) add(name string) {}
+
+func (w *indexWatcher) close() {}
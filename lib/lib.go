@@ -24,6 +24,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"grapehttp/pkg/passhash"
 )
 
 const TimeZone = "8"
@@ -201,9 +203,9 @@ func Strtomd5(s string) string {
 	return rs
 }
 
-//password hash function
+//password hash function, argon2id in the encoded format of passhash
 func Pwdhash(str string) string {
-	return Strtomd5(str)
+	return passhash.Hash(str)
 }
 
 func Md5(str string) string {
@@ -6,16 +6,17 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 
 	"grapehttp/config"
 	"grapehttp/models"
+	"grapehttp/pkg/passhash"
 	"grapehttp/pkg/vinfo"
 
 	"github.com/go-yaml/yaml"
-	"github.com/goji/httpauth"
 	"github.com/gorilla/handlers"
 	accesslog "github.com/mash/go-accesslog"
 )
@@ -39,8 +40,15 @@ func main() {
 		log.Fatal(err)
 	}
 
-	if gcfg.Conf == nil && !gcfg.SimpleAuth {
-		log.Fatal("no configire file specified, you need to specify `--simpleauth` to avoid database connection")
+	// cost of the password hashes
+	if p := gcfg.Password; p.Argon2Memory > 0 {
+		passhash.Default.Memory = p.Argon2Memory
+	}
+	if p := gcfg.Password; p.Argon2Time > 0 {
+		passhash.Default.Time = p.Argon2Time
+	}
+	if p := gcfg.Password; p.Argon2Threads > 0 {
+		passhash.Default.Threads = p.Argon2Threads
 	}
 
 	// db init
@@ -52,11 +60,24 @@ func main() {
 	}
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
 
-	// check Root first
-	if !canRoot(gcfg.Root) {
-		log.Fatal(fmt.Errorf("can not use root: %s", gcfg.Root))
+	var storage Storage
+	switch gcfg.Storage.Type {
+	case "", "local":
+		// check Root first
+		if !canRoot(gcfg.Root) {
+			log.Fatal(fmt.Errorf("can not use root: %s", gcfg.Root))
+		}
+	case "s3":
+		st := gcfg.Storage
+		s3, err := NewS3Storage(st.Endpoint, st.Bucket, st.Region, st.AccessKey, st.SecretKey, st.Prefix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		storage = s3
+	default:
+		log.Fatal(fmt.Errorf("unknown storage: %s", gcfg.Storage.Type))
 	}
-	ss := NewHTTPStaticServer(gcfg.Root)
+	ss := NewHTTPStaticServer(gcfg.Root, storage)
 	ss.Theme = gcfg.Theme
 	ss.Title = gcfg.Title
 	ss.GoogleTrackerId = gcfg.GoogleTrackerId
@@ -64,12 +85,49 @@ func main() {
 	ss.Delete = gcfg.Delete
 	ss.NoAccess = gcfg.NoAccess
 	ss.AuthType = gcfg.Auth.Type
-	usage, err := getUsage(gcfg.Root)
-	if err != nil {
-		log.Fatal(fmt.Errorf("can not get root usage: %v", err))
+	if !gcfg.SimpleAuth {
+		ss.users = dbUserStore{}
+	}
+	if gcfg.ContentIndex {
+		max, err := parseSize(gcfg.ContentMaxSize)
+		if err != nil {
+			log.Fatal(fmt.Errorf("content_max_size: %v", err))
+		}
+		ss.Index.setContentMax(max)
+	}
+	if a := gcfg.Audit; a.Disable {
+		ss.audit = nil
+	} else {
+		if a.File != "" {
+			ss.audit = newAuditLog(a.File)
+		}
+		if a.MaxSize != "" {
+			max, err := parseSize(a.MaxSize)
+			if err != nil {
+				log.Fatal(fmt.Errorf("audit.max_size: %v", err))
+			}
+			ss.audit.maxSize = max
+		}
+		if a.MaxFiles > 0 {
+			ss.audit.maxFiles = a.MaxFiles
+		}
+		if a.DB {
+			if gcfg.SimpleAuth {
+				log.Fatal("audit.db needs the database, it is not supported with `--simpleauth`")
+			}
+			ss.audit.db = insertAuditRecord
+		}
+	}
+	if s3, ok := storage.(*S3Storage); ok {
+		ss.Usage = "s3://" + path.Join(s3.Bucket, s3.Prefix)
+	} else {
+		usage, err := getUsage(gcfg.Root)
+		if err != nil {
+			log.Fatal(fmt.Errorf("can not get root usage: %v", err))
+		}
+		//ss.Usage = strings.Split(string(usage), "\n")[1]
+		ss.Usage = string(usage)
 	}
-	//ss.Usage = strings.Split(string(usage), "\n")[1]
-	ss.Usage = string(usage)
 	v := vinfo.Get()
 	marshalled, _ := json.Marshal(&v)
 	ss.Version = string(marshalled)
@@ -87,28 +145,32 @@ func main() {
 
 	hdlr = accesslog.NewLoggingHandler(hdlr, l)
 
-	// HTTP Basic Authentication
-	userpass := strings.SplitN(gcfg.Auth.HTTP, ":", 2)
-	switch gcfg.Auth.Type {
-	case "http":
-		if len(userpass) == 2 {
-			user, pass := userpass[0], userpass[1]
-
-			if gcfg.SimpleAuth {
-				hdlr = httpauth.SimpleBasicAuth(user, pass)(hdlr)
-			} else {
-				authOpts := httpauth.AuthOptions{
-					Realm:    "Restricted",
-					User:     user,
-					Password: pass,
-					AuthFunc: grapeAuthFunc,
-					//UnauthorizedHandler: hdlr,
-				}
-				hdlr = httpauth.BasicAuth(authOpts)(hdlr)
-			}
+	// Authentication, the identity of the request is kept in its context
+	if gcfg.TokenFile != "" {
+		ss.tokens = newTokenStore(gcfg.TokenFile)
+	}
+	if err := ss.tokens.load(); err != nil {
+		log.Fatal(fmt.Errorf("can not load tokens: %v", err))
+	}
+	if err := ss.owners.load(); err != nil {
+		log.Fatal(fmt.Errorf("can not load file owners: %v", err))
+	}
+	auths, required, err := newAuthenticators(gcfg, ss.tokens, ss.users)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setSessionSecret(gcfg.Auth.SessionSecret)
+	userGroups = newGroupCache(newGroupLookup(gcfg, ss.users))
+	userRoles = newRoleCache(newRoleLookup(gcfg, ss.users))
+	for _, a := range auths {
+		if lp, ok := a.(loginProvider); ok {
+			lp.handleLogin(http.DefaultServeMux)
+			handleSession(http.DefaultServeMux)
+			break
 		}
-	case "openid":
-		handleOpenID(false) // FIXME(ssx): set secure default to false
+	}
+	if len(auths) > 0 {
+		hdlr = newAuthHandler(auths, required, hdlr)
 	}
 	// CORS
 	if gcfg.Cors {
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"grapehttp/models/admin"
+)
+
+const meDefaultLogins = 20
+
+// profile is the account of the signed in user, User is set for the users
+// of the user database
+type profile struct {
+	*Identity
+	Groups []string    `json:"groups"`
+	Role   string      `json:"role"`
+	Admin  bool        `json:"admin"`
+	User   *admin.User `json:"user,omitempty"`
+}
+
+// dbIdentity reports whether the password of id is kept in the user store
+func (s *HTTPStaticServer) dbIdentity(id *Identity) bool {
+	return s.users != nil && (id.Provider == "db" || id.Provider == "token" && id.Source == "")
+}
+
+func (s *HTTPStaticServer) hMe(w http.ResponseWriter, r *http.Request) {
+	id := identityOf(r)
+	p := profile{
+		Identity: id,
+		Groups:   userGroups.groups(id.source(), id.Username),
+		Role:     userRoles.role(id.source(), id.Username),
+		Admin:    isAdmin(r),
+	}
+	if p.Groups == nil {
+		p.Groups = []string{}
+	}
+	if s.dbIdentity(id) {
+		if u, err := s.users.User(id.Username); err == nil {
+			u.Password = ""
+			p.User = &u
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(p)
+}
+
+// hMePasswd changes the password of the signed in user, the old one is
+// required
+func (s *HTTPStaticServer) hMePasswd(w http.ResponseWriter, r *http.Request) {
+	if s.noUserStore(w) {
+		return
+	}
+	id := identityOf(r)
+	auditOf(r).Target = id.Username
+	if id.Provider == "token" && !id.allows(scopeAdmin, "") {
+		http.Error(w, "passwords can only be changed with a password or an admin token", http.StatusForbidden)
+		return
+	}
+	if !s.dbIdentity(id) {
+		http.Error(w, fmt.Sprintf("the password of %s users is not kept by grapehttp", id.Provider), http.StatusBadRequest)
+		return
+	}
+	req := struct {
+		OldPassword string `json:"oldPassword"`
+		Password    string `json:"password"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u, err := s.users.User(id.Username)
+	if err != nil {
+		http.Error(w, "user "+id.Username+": "+err.Error(), http.StatusNotFound)
+		return
+	}
+	if ok, _ := u.CheckPassword(req.OldPassword); !ok {
+		http.Error(w, "wrong old password", http.StatusForbidden)
+		return
+	}
+	if err := u.SetPassword(req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.users.UpdateUser(&u); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	forgetCredentials(u.Username)
+	w.Write([]byte("Success\n"))
+}
+
+// hMeLogins answers the last ?limit= logins of the signed in user, newest
+// first
+func (s *HTTPStaticServer) hMeLogins(w http.ResponseWriter, r *http.Request) {
+	id := identityOf(r)
+	limit := meDefaultLogins
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			http.Error(w, fmt.Sprintf("bad limit %q", l), http.StatusBadRequest)
+			return
+		}
+	}
+	logins := []*admin.Login{}
+	if s.dbIdentity(id) {
+		var err error
+		if logins, err = s.users.Logins(id.Username, limit); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(logins)
+}
@@ -8,6 +8,14 @@ import (
 	"time"
 )
 
+// newOrm returns an Ormer on the user database, whose alias is rbac.db_name
+// of the configuration
+func newOrm() orm.Ormer {
+	o := orm.NewOrm()
+	o.Using(config.Gcfg.Rbac.Alias())
+	return o
+}
+
 func InitData() {
 	InsertUser()
 }
@@ -16,13 +24,14 @@ func InitData() {
 func InsertUser() {
 	log.Println("insert user ...")
 	u := new(User)
-	u.Username = config.Gcfg.AdminUsername
+	u.Username = config.Gcfg.AdminName()
 	u.Nickname = "HttpAdmin"
 	u.Password = lib.Pwdhash(config.Gcfg.AdminPassword)
 	u.Email = config.Gcfg.AdminEmail
 	u.Remark = "God in Grapehttp Country"
 	// 2 stand for close, but it has very high authority
 	u.Status = 1
+	u.Role = RoleAdmin
 	//u.Createtime = lib.GetTime()
 	u.Createtime = time.Now()
 	err := u.Insert()
@@ -34,7 +43,7 @@ func InsertUser() {
 }
 
 func (m *User) Insert() error {
-	if _, err := orm.NewOrm().Insert(m); err != nil {
+	if _, err := newOrm().Insert(m); err != nil {
 		return err
 	}
 	return nil
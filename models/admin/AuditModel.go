@@ -0,0 +1,40 @@
+package admin
+
+import (
+	"time"
+
+	"github.com/astaxie/beego/orm"
+)
+
+// Audit is a record of the audit log, kept in the database besides the
+// audit file when audit.db is set. Paths and Detail are JSON.
+type Audit struct {
+	Id       int64
+	Time     time.Time `orm:"type(datetime);index" json:"time"`
+	Username string    `orm:"size(32);index" json:"user"`
+	Provider string    `orm:"null;size(16)" json:"provider"`
+	Ip       string    `orm:"size(64)" json:"ip"`
+	Action   string    `orm:"size(32);index" json:"action"`
+	Paths    string    `orm:"null;type(text)" json:"paths"`
+	Target   string    `orm:"null;size(255)" json:"target"`
+	Detail   string    `orm:"null;type(text)" json:"detail"`
+	Status   int       `json:"status"`
+	Result   string    `orm:"size(16)" json:"result"`
+	Bytes    int64     `json:"bytes"`
+}
+
+func (a *Audit) TableName() string {
+	return "tb_http_audit"
+}
+
+func init() {
+	orm.RegisterModel(new(Audit))
+}
+
+func (a *Audit) Insert() error {
+	o := newOrm()
+	if _, err := o.Insert(a); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package admin
+
+import (
+	"time"
+
+	"github.com/astaxie/beego/orm"
+)
+
+type Group struct {
+	Id         int64
+	Name       string    `orm:"unique;size(32)" json:"name"`
+	Remark     string    `orm:"null;size(200)" json:"remark"`
+	Createtime time.Time `orm:"type(datetime)" json:"createTime"`
+	Members    []string  `orm:"-" json:"members"`
+}
+
+func (g *Group) TableName() string {
+	return "tb_http_group"
+}
+
+// GroupMember puts the user Username into the group Groupname
+type GroupMember struct {
+	Id        int64
+	Groupname string `orm:"size(32);index"`
+	Username  string `orm:"size(32);index"`
+}
+
+func (m *GroupMember) TableName() string {
+	return "tb_http_group_member"
+}
+
+func (m *GroupMember) TableUnique() [][]string {
+	return [][]string{{"Groupname", "Username"}}
+}
+
+func init() {
+	orm.RegisterModel(new(Group), new(GroupMember))
+}
+
+// GetGroupByName returns the group with its members
+func GetGroupByName(name string) (group Group, err error) {
+	o := newOrm()
+
+	group = Group{Name: name}
+	if err = o.Read(&group, "Name"); err != nil {
+		return group, err
+	}
+	group.Members, err = GroupMembers(name)
+	return group, err
+}
+
+// ListGroups returns all groups with their members
+func ListGroups() ([]*Group, error) {
+	o := newOrm()
+
+	groups := make([]*Group, 0)
+	if _, err := o.QueryTable("tb_http_group").OrderBy("name").All(&groups); err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		members, err := GroupMembers(g.Name)
+		if err != nil {
+			return nil, err
+		}
+		g.Members = members
+	}
+	return groups, nil
+}
+
+// GroupMembers returns the usernames of the members of the group name
+func GroupMembers(name string) ([]string, error) {
+	o := newOrm()
+
+	members := make([]*GroupMember, 0)
+	if _, err := o.QueryTable("tb_http_group_member").Filter("groupname", name).OrderBy("username").All(&members); err != nil {
+		return nil, err
+	}
+	usernames := []string{}
+	for _, m := range members {
+		usernames = append(usernames, m.Username)
+	}
+	return usernames, nil
+}
+
+// GroupsOfUser returns the names of the groups username is a member of
+func GroupsOfUser(username string) ([]string, error) {
+	o := newOrm()
+
+	members := make([]*GroupMember, 0)
+	if _, err := o.QueryTable("tb_http_group_member").Filter("username", username).All(&members); err != nil {
+		return nil, err
+	}
+	groups := []string{}
+	for _, m := range members {
+		groups = append(groups, m.Groupname)
+	}
+	return groups, nil
+}
+
+func (g *Group) Insert() error {
+	if _, err := newOrm().Insert(g); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete removes the group and its memberships
+func (g *Group) Delete() error {
+	o := newOrm()
+	if _, err := o.QueryTable("tb_http_group_member").Filter("groupname", g.Name).Delete(); err != nil {
+		return err
+	}
+	if _, err := o.Delete(g); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AddMembers puts the users into the group, users already in it are skipped
+func (g *Group) AddMembers(usernames ...string) error {
+	o := newOrm()
+	for _, username := range usernames {
+		m := GroupMember{Groupname: g.Name, Username: username}
+		if _, _, err := o.ReadOrCreate(&m, "Groupname", "Username"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveMembers takes the users out of the group
+func (g *Group) RemoveMembers(usernames ...string) error {
+	if len(usernames) == 0 {
+		return nil
+	}
+	o := newOrm()
+	if _, err := o.QueryTable("tb_http_group_member").Filter("groupname", g.Name).Filter("username__in", usernames).Delete(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RemoveUserFromGroups takes username out of all groups, when it is deleted
+func RemoveUserFromGroups(username string) error {
+	o := newOrm()
+	if _, err := o.QueryTable("tb_http_group_member").Filter("username", username).Delete(); err != nil {
+		return err
+	}
+	return nil
+}
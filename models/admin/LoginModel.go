@@ -0,0 +1,43 @@
+package admin
+
+import (
+	"time"
+
+	"github.com/astaxie/beego/orm"
+)
+
+// Login is a successful login of a database user
+type Login struct {
+	Id       int64     `json:"-"`
+	Username string    `orm:"size(32);index" json:"username"`
+	Time     time.Time `orm:"type(datetime)" json:"time"`
+	Ip       string    `orm:"size(64)" json:"ip"`
+}
+
+func (l *Login) TableName() string {
+	return "tb_http_login"
+}
+
+func init() {
+	orm.RegisterModel(new(Login))
+}
+
+func (l *Login) Insert() error {
+	if _, err := newOrm().Insert(l); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ListLogins returns the last limit logins of username, newest first
+func ListLogins(username string, limit int) ([]*Login, error) {
+	logins := make([]*Login, 0)
+	_, err := newOrm().QueryTable("tb_http_login").Filter("username", username).OrderBy("-time").Limit(limit).All(&logins)
+	return logins, err
+}
+
+// DeleteLogins removes the logins of username
+func DeleteLogins(username string) error {
+	_, err := newOrm().QueryTable("tb_http_login").Filter("username", username).Delete()
+	return err
+}
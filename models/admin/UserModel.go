@@ -13,6 +13,7 @@
 package admin
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/astaxie/beego/orm"
@@ -24,7 +25,8 @@ type User struct {
 	Id            int64
 	Logincount    int       `orm:"column(logincount)" form:"logincount" json:"loginCount"`
 	Username      string    `orm:"unique;size(32)" form:"Username"  valid:"Required;MaxSize(20);MinSize(6)" json:"username"`
-	Password      string    `orm:"size(32)" form:"Password" valid:"Required;MaxSize(20);MinSize(6)" json:"password"`
+	Password      string    `orm:"size(128)" form:"Password" valid:"Required;MaxSize(20);MinSize(6)" json:"password,omitempty"`
+	Oldpasswords  string    `orm:"null;type(text)" form:"-" json:"-"`
 	Repassword    string    `orm:"-" form:"Repassword" valid:"Required" json:"repassword"`
 	Nickname      string    `orm:"unique;size(32)" form:"Nickname" valid:"Required;MaxSize(20);MinSize(2)" json:"nickname"`
 	Email         string    `orm:"size(32)" form:"Email" valid:"Email" json:"email"`
@@ -33,6 +35,29 @@ type User struct {
 	Lastlogintime time.Time `orm:"null;type(datetime)" form:"-" json:"lastLoginTime"`
 	Createtime    time.Time `orm:"type(datetime)" json:"createTime"`
 	Lastip        string    `json:"lastip"`
+	Role          string    `orm:"size(16)" json:"role"`
+	Quotabytes    int64     `orm:"column(quotabytes);default(0)" json:"quotaBytes"` // 0 for no limit
+	Quotafiles    int64     `orm:"column(quotafiles);default(0)" json:"quotaFiles"`
+}
+
+// Roles of users besides the plain ones: admins may do everything, auditors
+// may read what admins can but not change it
+const (
+	RoleAdmin   = "admin"
+	RoleAuditor = "auditor"
+	RoleUser    = "user" // no role, stored empty
+)
+
+// ParseRole returns the role to store for role, an error if there is no
+// such role
+func ParseRole(role string) (string, error) {
+	switch role {
+	case RoleAdmin, RoleAuditor:
+		return role, nil
+	case RoleUser, "":
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown role %q, use %s, %s or %s", role, RoleAdmin, RoleAuditor, RoleUser)
 }
 
 func (u *User) TableName() string {
@@ -44,8 +69,7 @@ func init() {
 }
 
 func GetUserByUsername(username string) (user User, err error) {
-	o := orm.NewOrm()
-	o.Using("caj")
+	o := newOrm()
 
 	user = User{Username: username}
 	err = o.Read(&user, "Username")
@@ -53,8 +77,7 @@ func GetUserByUsername(username string) (user User, err error) {
 }
 
 func GetUsableUserByUsername(username string) (user User, err error) {
-	o := orm.NewOrm()
-	o.Using("caj")
+	o := newOrm()
 
 	user = User{Username: username, Status: 1}
 	err = o.Read(&user, "Username", "Status")
@@ -62,42 +85,39 @@ func GetUsableUserByUsername(username string) (user User, err error) {
 }
 
 func GetUserOnlyByUsername(username string) (user User) {
-	o := orm.NewOrm()
-	o.Using("caj")
+	o := newOrm()
 
 	user = User{Username: username}
 	o.Read(&user, "Username")
 	return user
 }
 
-func SearchUserByUsername(username string) []*User {
-	o := orm.NewOrm()
-	o.Using("caj")
+func SearchUserByUsername(username string) ([]*User, error) {
+	o := newOrm()
 
 	qs := o.QueryTable("tb_http_user")
 	qs = qs.Filter("username__icontains", username)
 	//qs = qs.Filter("status", 1)
 	users := make([]*User, 0)
-	qs.All(&users)
+	_, err := qs.All(&users)
 
-	return users
+	return users, err
 }
 
-func ListUserByUsername(offset, limit int) []*User {
-	o := orm.NewOrm()
-	o.Using("caj")
+func ListUserByUsername(offset, limit int) ([]*User, error) {
+	o := newOrm()
 
 	qs := o.QueryTable("tb_http_user")
 	qs = qs.Limit(limit, offset)
 	//qs = qs.Filter("status", 1)
 	users := make([]*User, 0)
-	qs.All(&users)
+	_, err := qs.All(&users)
 
-	return users
+	return users, err
 }
 
 func (m *User) Read(fields ...string) error {
-	if err := orm.NewOrm().Read(m, fields...); err != nil {
+	if err := newOrm().Read(m, fields...); err != nil {
 		return err
 	}
 	return nil
@@ -105,20 +125,20 @@ func (m *User) Read(fields ...string) error {
 
 func UpdateLoginTime(u *User) User {
 	u.Lastlogintime = GetTime()
-	o := orm.NewOrm()
+	o := newOrm()
 	o.Update(u)
 	return *u
 }
 
 func (m *User) Update(fields ...string) error {
-	if _, err := orm.NewOrm().Update(m, fields...); err != nil {
+	if _, err := newOrm().Update(m, fields...); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (m *User) Delete() error {
-	if _, err := orm.NewOrm().Delete(m); err != nil {
+	if _, err := newOrm().Delete(m); err != nil {
 		return err
 	}
 	return nil
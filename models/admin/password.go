@@ -0,0 +1,73 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"grapehttp/config"
+	"grapehttp/pkg/passhash"
+)
+
+// ErrPasswordPolicy is wrapped by the errors of SetPassword for passwords
+// the policy refuses
+var ErrPasswordPolicy = errors.New("password policy")
+
+type policyError string
+
+func (e policyError) Error() string { return string(e) }
+func (e policyError) Is(target error) bool {
+	return target == ErrPasswordPolicy
+}
+
+// CheckPassword reports whether pass is the password of the user, and
+// whether its hash is of an older format or weaker parameters. A hash to
+// replace it is set then, the caller saves the user.
+func (u *User) CheckPassword(pass string) (ok, rehashed bool) {
+	ok, err := passhash.Verify(pass, u.Password)
+	if err != nil {
+		log.Printf("user: %s password hash: %v", u.Username, err)
+		return false, false
+	}
+	if ok && passhash.NeedsRehash(u.Password) {
+		u.Password = passhash.Hash(pass)
+		return true, true
+	}
+	return ok, false
+}
+
+// SetPassword checks pass against the password policy and sets it. The
+// hash of the old password is remembered to refuse its reuse. It does not
+// save the user.
+func (u *User) SetPassword(pass string) error {
+	policy := config.Gcfg.Password
+	if len([]rune(pass)) < policy.MinLength {
+		return policyError(fmt.Sprintf("password must have at least %d characters", policy.MinLength))
+	}
+	if u.Username != "" && strings.EqualFold(pass, u.Username) {
+		return policyError("password must not be the user name")
+	}
+
+	var history []string
+	if u.Password != "" {
+		history = append(history, u.Password)
+	}
+	for _, h := range strings.Split(u.Oldpasswords, "\n") {
+		if h != "" {
+			history = append(history, h)
+		}
+	}
+	if len(history) > policy.History {
+		history = history[:policy.History]
+	}
+	for _, h := range history {
+		if ok, _ := passhash.Verify(pass, h); ok {
+			return policyError(fmt.Sprintf("password must differ from the last %d passwords", policy.History))
+		}
+	}
+
+	u.Password = passhash.Hash(pass)
+	u.Oldpasswords = strings.Join(history, "\n")
+	return nil
+}
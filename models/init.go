@@ -16,13 +16,18 @@ package models
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/astaxie/beego/orm"
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 	"grapehttp/config"
 	"grapehttp/models/admin"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 var (
@@ -33,8 +38,9 @@ var (
 )
 
 func Run() {
-	if config.Gcfg.SimpleAuth && (config.Gcfg.DbInit || config.Gcfg.DbInitForce) {
-		log.Fatal("db init not support with `--simpleauth` or set `simpleauth: true` in configure file")
+	migrate := strings.HasPrefix(config.Gcfg.Command, "migrate ")
+	if config.Gcfg.SimpleAuth && (config.Gcfg.DbInit || config.Gcfg.DbInitForce || migrate) {
+		log.Fatal("db init and migrate not support with `--simpleauth` or set `simpleauth: true` in configure file")
 
 	}
 	if config.Gcfg.SimpleAuth {
@@ -47,43 +53,90 @@ func Run() {
 	}
 
 	Connect()
+	if migrate {
+		if err := RunMigrate(config.Gcfg.Command, config.Gcfg.MigrateTo); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if err := CheckSchema(); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func Connect() {
-	log.Printf("database start to connect")
-	rbac := config.Gcfg.Rbac
-	var dns string
-	db_type := "mysql"
-	db_host := rbac.Host
-	db_port := rbac.Port
-	if db_port == "" {
-		db_port = "3306"
-	}
-	db_user := rbac.User
-	db_pass := rbac.Pass
-	db_name := rbac.Name
-	switch db_type {
+// SqliteDir is the directory of the sqlite database below the root, unless
+// rbac.db_path is set
+const SqliteDir = ".ghs-users"
+
+// dataSource registers the driver of the user database and returns its name
+// and the data source name to connect with. Without dbname the server is
+// connected to, not the database, for Createdb.
+func dataSource(rbac config.Rbac, dbname bool) (driver, dsn string, err error) {
+	name := ""
+	if dbname {
+		name = rbac.Name
+	}
+	switch driver = rbac.Driver(); driver {
 	case "mysql":
 		orm.RegisterDriver("mysql", orm.DRMySQL)
-		//orm.DefaultTimeLoc = time.UTC
-		dns = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8", db_user, db_pass, db_host, db_port, db_name)
-		break
+		port := rbac.Port
+		if port == "" {
+			port = "3306"
+		}
+		dsn = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8", rbac.User, rbac.Pass, rbac.Host, port, name)
+	case "postgres":
+		orm.RegisterDriver("postgres", orm.DRPostgres)
+		if name == "" {
+			name = "postgres"
+		}
+		u := url.URL{Scheme: "postgres", User: url.UserPassword(rbac.User, rbac.Pass), Host: rbac.Host, Path: "/" + name}
+		if rbac.Port != "" {
+			u.Host += ":" + rbac.Port
+		}
+		if rbac.SSLMode != "" {
+			u.RawQuery = "sslmode=" + url.QueryEscape(rbac.SSLMode)
+		}
+		dsn = u.String()
+	case "sqlite":
+		if !sqliteBuilt {
+			return "", "", errors.New("db driver sqlite is not built in: build with `make TAGS=sqlite`, use mysql or postgres, or run with --simpleauth")
+		}
+		orm.RegisterDriver("sqlite", orm.DRSqlite)
+		path := rbac.Path
+		if path == "" {
+			path = filepath.Join(config.Gcfg.Root, SqliteDir, "users.db")
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return "", "", err
+		}
+		dsn = "file:" + path + "?_pragma=busy_timeout(5000)"
 	default:
-		log.Printf("db driver not support: %s", db_type)
-		return
+		return "", "", fmt.Errorf("db driver not support: %s, use sqlite, mysql or postgres", driver)
 	}
+	return driver, dsn, nil
+}
 
-	err := orm.RegisterDataBase("default", db_type, dns)
+func Connect() {
+	log.Printf("database start to connect")
+	rbac := config.Gcfg.Rbac
+	driver, dsn, err := dataSource(rbac, true)
 	if err != nil {
-		log.Printf("register data:" + err.Error())
-		panic(err.Error())
+		log.Fatal(err)
 	}
 
-	err = orm.RegisterDataBase(rbac.Name, db_type, dns)
+	err = orm.RegisterDataBase("default", driver, dsn)
 	if err != nil {
-		log.Printf("register data:" + err.Error())
+		log.Println("register data:", err)
 		panic(err.Error())
 	}
+
+	if rbac.Alias() != "default" {
+		err = orm.RegisterDataBase(rbac.Alias(), driver, dsn)
+		if err != nil {
+			log.Println("register data:", err)
+			panic(err.Error())
+		}
+	}
 }
 
 func Createtb() {
@@ -95,57 +148,62 @@ func Syncdb(force bool) {
 	//安全起见禁止drop database
 	Createdb(false)
 	Connect()
-	Createconfig()
+	// the tables are created by the migrations, existing ones are kept
+	if err := Migrate(LatestVersion()); err != nil {
+		log.Fatalf("database migrate error: %v", err)
+	}
 	Createtb()
 	log.Printf("sync db end, please reopen app again")
 }
 
-func Createconfig() {
-	name := config.Gcfg.Rbac.Name // database alias name
-	force := true                 // drop table force
-	verbose := true               // print log
-	err := orm.RunSyncdb(name, force, verbose)
-	if err != nil {
-		log.Fatalf("database config set to force error:%s", err.Error())
-	}
-}
-
-//创建数据库
+// 创建数据库, sqlite creates its file on the first connection
 func Createdb(force bool) {
 	rbac := config.Gcfg.Rbac
-
-	db_type := "mysql" // current only support mysql
-	db_host := rbac.Host
-	db_port := rbac.Port
-	db_user := rbac.User
-	db_pass := rbac.Pass
+	driver := rbac.Driver()
+	if driver == "sqlite" {
+		return
+	}
 	db_name := rbac.Name
 
-	var dns string
-	var sqlstring, sql1string string
-
-	dns = fmt.Sprintf("%s:%s@tcp(%s:%s)/?charset=utf8", db_user, db_pass, db_host, db_port)
-	sqlstring = fmt.Sprintf("CREATE DATABASE if not exists `%s` CHARSET utf8 COLLATE utf8_general_ci", db_name)
-	sql1string = fmt.Sprintf("DROP DATABASE IF EXISTS `%s`", db_name)
+	var sqlstring, sql1string, exists string
+	switch driver {
+	case "mysql":
+		sqlstring = fmt.Sprintf("CREATE DATABASE if not exists `%s` CHARSET utf8 COLLATE utf8_general_ci", db_name)
+		sql1string = fmt.Sprintf("DROP DATABASE IF EXISTS `%s`", db_name)
+	case "postgres":
+		// postgres has no CREATE DATABASE IF NOT EXISTS
+		exists = "SELECT 1 FROM pg_database WHERE datname = $1"
+		sqlstring = fmt.Sprintf(`CREATE DATABASE "%s" ENCODING 'UTF8'`, db_name)
+		sql1string = fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, db_name)
+	}
 	if force {
 		fmt.Println(sql1string)
 	}
 	fmt.Println(sqlstring)
 
-	db, err := sql.Open(db_type, dns)
+	_, dns, err := dataSource(rbac, false)
 	if err != nil {
 		panic(err.Error())
 	}
+	db, err := sql.Open(driver, dns)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer db.Close()
 	if force {
 		_, err = db.Exec(sql1string)
 	}
-	_, err1 := db.Exec(sqlstring)
+	var err1 error
+	if exists != "" && db.QueryRow(exists, db_name).Scan(new(int)) == nil {
+		log.Printf("database %s exists", db_name)
+	} else {
+		_, err1 = db.Exec(sqlstring)
+	}
 	if err != nil || err1 != nil {
 		log.Printf("db exec error：%v, %v", err, err1)
-		panic(err.Error())
+		panic(fmt.Sprint(err, err1))
 	} else {
 		log.Printf("database %s created", db_name)
 	}
-	defer db.Close()
 	log.Printf("create database end")
 }
@@ -0,0 +1,436 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/orm"
+	"grapehttp/config"
+)
+
+// migration changes the user database from version-1 to version, down undoes
+// it. The tables of older releases were created by beego on startup, so up
+// must cope with a database which has them already.
+type migration struct {
+	version int
+	name    string
+	up      func(m *migrator) error
+	down    func(m *migrator) error
+}
+
+// migrations are in order of version, append new ones, never change applied
+// ones
+var migrations = []migration{
+	{1, "create tb_http_user", func(m *migrator) error {
+		return m.createTable("tb_http_user", `
+			id {id},
+			logincount integer NOT NULL DEFAULT 0,
+			username varchar(32) NOT NULL UNIQUE,
+			password varchar(32) NOT NULL DEFAULT '',
+			nickname varchar(32) NOT NULL UNIQUE,
+			email varchar(32) NOT NULL DEFAULT '',
+			remark varchar(200),
+			status integer NOT NULL DEFAULT 2,
+			lastlogintime {datetime},
+			createtime {datetime} NOT NULL,
+			lastip varchar(255) NOT NULL DEFAULT ''`)
+	}, func(m *migrator) error {
+		return m.exec("DROP TABLE tb_http_user")
+	}},
+	{2, "argon2id hashes and password history", func(m *migrator) error {
+		switch m.driver {
+		case "mysql":
+			if err := m.exec("ALTER TABLE tb_http_user MODIFY password varchar(128) NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+		case "postgres":
+			if err := m.exec("ALTER TABLE tb_http_user ALTER COLUMN password TYPE varchar(128)"); err != nil {
+				return err
+			}
+		}
+		// sqlite does not enforce the length of columns
+		return m.addColumn("tb_http_user", "oldpasswords", "{text}")
+	}, func(m *migrator) error {
+		// password stays wide, the hashes in it do not fit 32 characters
+		return m.exec("ALTER TABLE tb_http_user DROP COLUMN oldpasswords")
+	}},
+	{3, "create tb_http_group and tb_http_group_member", func(m *migrator) error {
+		err := m.createTable("tb_http_group", `
+			id {id},
+			name varchar(32) NOT NULL UNIQUE,
+			remark varchar(200),
+			createtime {datetime} NOT NULL`)
+		if err != nil {
+			return err
+		}
+		return m.createTable("tb_http_group_member", `
+			id {id},
+			groupname varchar(32) NOT NULL,
+			username varchar(32) NOT NULL,
+			UNIQUE (groupname, username)`, "groupname", "username")
+	}, func(m *migrator) error {
+		return m.exec("DROP TABLE tb_http_group_member", "DROP TABLE tb_http_group")
+	}},
+	{4, "create tb_http_audit", func(m *migrator) error {
+		return m.createTable("tb_http_audit", `
+			id {id},
+			time {datetime} NOT NULL,
+			username varchar(32) NOT NULL,
+			provider varchar(16),
+			ip varchar(64) NOT NULL,
+			action varchar(32) NOT NULL,
+			paths {text},
+			target varchar(255),
+			detail {text},
+			status integer NOT NULL DEFAULT 0,
+			result varchar(16) NOT NULL,
+			bytes bigint NOT NULL DEFAULT 0`, "time", "username", "action")
+	}, func(m *migrator) error {
+		return m.exec("DROP TABLE tb_http_audit")
+	}},
+	{5, "create tb_http_login", func(m *migrator) error {
+		return m.createTable("tb_http_login", `
+			id {id},
+			username varchar(32) NOT NULL,
+			time {datetime} NOT NULL,
+			ip varchar(64) NOT NULL`, "username")
+	}, func(m *migrator) error {
+		return m.exec("DROP TABLE tb_http_login")
+	}},
+	{6, "user roles", func(m *migrator) error {
+		if err := m.addColumn("tb_http_user", "role", "varchar(16) NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+		// the admin user was the only admin
+		_, err := m.tx.Exec(m.bind("UPDATE tb_http_user SET role = 'admin' WHERE username = ?"), config.Gcfg.AdminName())
+		return err
+	}, func(m *migrator) error {
+		return m.exec("ALTER TABLE tb_http_user DROP COLUMN role")
+	}},
+	{7, "user quotas", func(m *migrator) error {
+		if err := m.addColumn("tb_http_user", "quotabytes", "bigint NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		return m.addColumn("tb_http_user", "quotafiles", "bigint NOT NULL DEFAULT 0")
+	}, func(m *migrator) error {
+		return m.exec("ALTER TABLE tb_http_user DROP COLUMN quotafiles", "ALTER TABLE tb_http_user DROP COLUMN quotabytes")
+	}},
+}
+
+// LatestVersion is the schema version this grapehttp runs with
+func LatestVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// columnTypes are the types of the DDL of the migrations per driver
+var columnTypes = map[string]*strings.Replacer{
+	"mysql": strings.NewReplacer(
+		"{id}", "bigint AUTO_INCREMENT NOT NULL PRIMARY KEY",
+		"{datetime}", "datetime",
+		"{text}", "longtext"),
+	"postgres": strings.NewReplacer(
+		"{id}", "bigserial NOT NULL PRIMARY KEY",
+		"{datetime}", "timestamp with time zone",
+		"{text}", "text"),
+	"sqlite": strings.NewReplacer(
+		"{id}", "integer NOT NULL PRIMARY KEY AUTOINCREMENT",
+		"{datetime}", "datetime",
+		"{text}", "text"),
+}
+
+// migrator runs the statements of one migration in its transaction. MySQL
+// commits DDL on its own, a failed migration may be half done there.
+type migrator struct {
+	driver string
+	tx     *sql.Tx
+}
+
+// bind rewrites the ? placeholders of query to $1, $2... for postgres
+func (m *migrator) bind(query string) string {
+	if m.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (m *migrator) exec(stmts ...string) error {
+	for _, stmt := range stmts {
+		stmt = columnTypes[m.driver].Replace(stmt)
+		if _, err := m.tx.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %v", strings.Join(strings.Fields(stmt), " "), err)
+		}
+	}
+	return nil
+}
+
+func (m *migrator) count(query string, args ...interface{}) (n int, err error) {
+	err = m.tx.QueryRow(m.bind(query), args...).Scan(&n)
+	return n, err
+}
+
+func (m *migrator) hasTable(table string) (bool, error) {
+	query := "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+	switch m.driver {
+	case "postgres":
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?"
+	case "sqlite":
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	}
+	n, err := m.count(query, table)
+	return n > 0, err
+}
+
+func (m *migrator) hasColumn(table, column string) (bool, error) {
+	query := "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?"
+	switch m.driver {
+	case "postgres":
+		query = "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?"
+	case "sqlite":
+		query = "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+	}
+	n, err := m.count(query, table, column)
+	return n > 0, err
+}
+
+// createTable creates table with its indexes, unless an older release did
+func (m *migrator) createTable(table, columns string, indexes ...string) error {
+	if ok, err := m.hasTable(table); err != nil || ok {
+		return err
+	}
+	stmts := []string{fmt.Sprintf("CREATE TABLE %s (%s\n)", table, columns)}
+	for _, column := range indexes {
+		stmts = append(stmts, fmt.Sprintf("CREATE INDEX %s_%s ON %s (%s)", table, column, table, column))
+	}
+	return m.exec(stmts...)
+}
+
+// addColumn adds column to table, unless an older release did
+func (m *migrator) addColumn(table, column, typ string) error {
+	if ok, err := m.hasColumn(table, column); err != nil || ok {
+		return err
+	}
+	return m.exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, typ))
+}
+
+// SchemaStatus is a migration and when it was applied, zero if it is pending
+type SchemaStatus struct {
+	Version int
+	Name    string
+	Applied time.Time
+}
+
+// schemaDB returns the user database and its driver, with the
+// schema_version table which keeps one row per applied migration
+func schemaDB() (*sql.DB, string, error) {
+	rbac := config.Gcfg.Rbac
+	db, err := orm.GetDB(rbac.Alias())
+	if err != nil {
+		return nil, "", err
+	}
+	driver := rbac.Driver()
+	create := columnTypes[driver].Replace("CREATE TABLE IF NOT EXISTS schema_version (version integer NOT NULL PRIMARY KEY, name varchar(64) NOT NULL, applied {datetime} NOT NULL)")
+	if _, err := db.Exec(create); err != nil {
+		return nil, "", fmt.Errorf("schema_version: %v", err)
+	}
+	return db, driver, nil
+}
+
+// applied returns the applied migrations by version
+func applied(db *sql.DB) (map[int]time.Time, error) {
+	rows, err := db.Query("SELECT version, applied FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var t interface{}
+		if err := rows.Scan(&version, &t); err != nil {
+			return nil, err
+		}
+		versions[version] = scanTime(t)
+	}
+	return versions, rows.Err()
+}
+
+// scanTime reads a datetime column, which the mysql driver returns as text
+// without parseTime in the data source
+func scanTime(v interface{}) time.Time {
+	switch v := v.(type) {
+	case time.Time:
+		return v
+	case []byte:
+		return scanTime(string(v))
+	case string:
+		for _, layout := range []string{"2006-01-02 15:04:05.999999999-07:00", "2006-01-02 15:04:05", time.RFC3339Nano} {
+			if t, err := time.ParseInLocation(layout, v, time.UTC); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// SchemaVersion returns the version of the user database, 0 if it has no
+// migration applied
+func SchemaVersion() (int, error) {
+	db, _, err := schemaDB()
+	if err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// Status returns every migration known to this grapehttp with the time it
+// was applied
+func Status() ([]SchemaStatus, error) {
+	db, _, err := schemaDB()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	status := []SchemaStatus{}
+	for _, mg := range migrations {
+		status = append(status, SchemaStatus{mg.version, mg.name, versions[mg.version]})
+	}
+	return status, nil
+}
+
+// Migrate applies or undoes migrations until the database is at version,
+// one transaction per migration
+func Migrate(version int) error {
+	if version < 0 || version > LatestVersion() {
+		return fmt.Errorf("no schema version %d, the latest is %d", version, LatestVersion())
+	}
+	db, driver, err := schemaDB()
+	if err != nil {
+		return err
+	}
+	current, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > LatestVersion() {
+		return fmt.Errorf("schema version %d is newer than this grapehttp knows of (%d)", current, LatestVersion())
+	}
+	for current != version {
+		var mg migration
+		var step func(m *migrator) error
+		var record string
+		var args []interface{}
+		if current < version {
+			mg = migrations[current]
+			step, record = mg.up, "INSERT INTO schema_version (version, name, applied) VALUES (?, ?, ?)"
+			args = []interface{}{mg.version, mg.name, time.Now().UTC()}
+		} else {
+			mg = migrations[current-1]
+			step, record = mg.down, "DELETE FROM schema_version WHERE version = ?"
+			args = []interface{}{mg.version}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		m := &migrator{driver: driver, tx: tx}
+		if err := step(m); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d %s: %v", mg.version, mg.name, err)
+		}
+		if _, err := tx.Exec(m.bind(record), args...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d %s: %v", mg.version, mg.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d %s: %v", mg.version, mg.name, err)
+		}
+		if current < version {
+			current = mg.version
+			log.Printf("migrated up to %d: %s", current, mg.name)
+		} else {
+			current = mg.version - 1
+			log.Printf("migrated down to %d: undid %s", current, mg.name)
+		}
+	}
+	return nil
+}
+
+// CheckSchema fails unless the user database is at LatestVersion
+func CheckSchema() error {
+	version, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	switch {
+	case version < LatestVersion():
+		return fmt.Errorf("user database is at schema version %d, %d is needed: run `grapehttp migrate up`", version, LatestVersion())
+	case version > LatestVersion():
+		return fmt.Errorf("user database is at schema version %d, newer than this grapehttp (%d): upgrade grapehttp or run `migrate down %d` with the newer one", version, LatestVersion(), LatestVersion())
+	}
+	return nil
+}
+
+// RunMigrate runs `grapehttp migrate status|up|down [version]`. Up goes to
+// the latest version and down undoes the last migration unless version is
+// given, it is -1 otherwise.
+func RunMigrate(command string, version int) error {
+	switch command {
+	case "migrate status":
+		status, err := Status()
+		if err != nil {
+			return err
+		}
+		current := 0
+		for _, st := range status {
+			applied := "pending"
+			if !st.Applied.IsZero() {
+				applied = st.Applied.Local().Format("2006-01-02 15:04:05")
+				current = st.Version
+			}
+			fmt.Printf("%3d  %-48s %s\n", st.Version, st.Name, applied)
+		}
+		fmt.Printf("schema version %d, latest %d\n", current, LatestVersion())
+		return nil
+	case "migrate up":
+		if version < 0 {
+			version = LatestVersion()
+		}
+	case "migrate down":
+		if version < 0 {
+			current, err := SchemaVersion()
+			if err != nil {
+				return err
+			}
+			if current == 0 {
+				log.Printf("no migration to undo")
+				return nil
+			}
+			version = current - 1
+		}
+	default:
+		return fmt.Errorf("unknown command: %s", command)
+	}
+	return Migrate(version)
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrations(t *testing.T) {
+	for i, mg := range migrations {
+		if mg.version != i+1 || mg.name == "" || mg.up == nil || mg.down == nil {
+			t.Errorf("migration %d: %+v", i, mg)
+		}
+	}
+	for driver := range columnTypes {
+		if s := columnTypes[driver].Replace("{id} {datetime} {text}"); strings.Contains(s, "{") {
+			t.Errorf("%s: got %q", driver, s)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	query := "SELECT COUNT(*) FROM t WHERE a = ? AND b = ?"
+	if got := (&migrator{driver: "postgres"}).bind(query); got != "SELECT COUNT(*) FROM t WHERE a = $1 AND b = $2" {
+		t.Errorf("postgres: got %q", got)
+	}
+	if got := (&migrator{driver: "sqlite"}).bind(query); got != query {
+		t.Errorf("sqlite: got %q", got)
+	}
+}
+
+func TestScanTime(t *testing.T) {
+	want := time.Date(2024, 12, 31, 8, 0, 0, 0, time.UTC)
+	for _, v := range []interface{}{want, []byte("2024-12-31 08:00:00"), "2024-12-31 08:00:00+00:00"} {
+		if got := scanTime(v); !got.Equal(want) {
+			t.Errorf("%v: got %v", v, got)
+		}
+	}
+}
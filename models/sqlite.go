@@ -0,0 +1,10 @@
+//go:build sqlite
+// +build sqlite
+
+package models
+
+// the sqlite driver is not in vendor, see the README
+import _ "modernc.org/sqlite"
+
+// sqliteBuilt reports whether the sqlite driver is built in, with -tags sqlite
+const sqliteBuilt = true
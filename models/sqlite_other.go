@@ -0,0 +1,7 @@
+//go:build !sqlite
+// +build !sqlite
+
+package models
+
+// sqliteBuilt reports whether the sqlite driver is built in, with -tags sqlite
+const sqliteBuilt = false
@@ -6,16 +6,18 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"path"
 	"strings"
 
 	openid "github.com/codeskyblue/openid-go"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 )
 
 var (
 	nonceStore         = openid.NewSimpleNonceStore()
 	discoveryCache     = openid.NewSimpleDiscoveryCache()
-	store              = sessions.NewCookieStore([]byte("something-very-secret"))
+	store              = sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
 	defaultSessionName = "ghs-session"
 )
 
@@ -34,79 +36,123 @@ func init() {
 	gob.Register(&M{})
 }
 
-func handleOpenID(secure bool) {
-	http.HandleFunc("/-/login", func(w http.ResponseWriter, r *http.Request) {
-		nextUrl := r.FormValue("next")
-		referer := r.Referer()
-		if nextUrl == "" && strings.Contains(referer, "://"+r.Host) {
-			nextUrl = referer
-		}
-		scheme := "http"
-		if secure {
-			scheme = "https"
-		}
-		if url, err := openid.RedirectURL("https://login.netease.com/openid",
-			scheme+"://"+r.Host+"/-/openidcallback?next="+nextUrl, ""); err == nil {
-			http.Redirect(w, r, url, 303)
-		} else {
-			log.Println("Should not got error here:", err)
-		}
+// setSessionSecret sets the key the session cookies are signed with. Without
+// one a random key is used and logins are lost when the server restarts.
+func setSessionSecret(secret string) {
+	if secret == "" {
+		log.Println("auth.session_secret is not set, sessions end when the server restarts")
+		return
+	}
+	store = sessions.NewCookieStore([]byte(secret))
+}
+
+// sessionIdentity returns the identity a login page stored in the session
+func sessionIdentity(r *http.Request) *Identity {
+	session, err := store.Get(r, defaultSessionName)
+	if err != nil {
+		return nil
+	}
+	id, _ := session.Values["user"].(*Identity)
+	return id
+}
+
+// saveSessionIdentity stores id in the session and sends the user on to next
+func saveSessionIdentity(w http.ResponseWriter, r *http.Request, id *Identity, next string) {
+	session, err := store.Get(r, defaultSessionName)
+	if err != nil && session == nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	session.Values["user"] = id
+	if err := session.Save(r, w); err != nil {
+		log.Println("session save error:", err)
+	}
+	if next == "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+	http.Redirect(w, r, next, 302)
+}
+
+// loginNext is the page to return to after the login
+func loginNext(r *http.Request) string {
+	nextUrl := r.FormValue("next")
+	referer := r.Referer()
+	if nextUrl == "" && strings.Contains(referer, "://"+r.Host) {
+		nextUrl = referer[strings.Index(referer, "://"+r.Host)+len("://"+r.Host):]
+	}
+	return nextUrl
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+// handleSession serves the pages shared by the login providers
+func handleSession(mux *http.ServeMux) {
+	mux.HandleFunc("/-/user", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		data, _ := json.Marshal(sessionIdentity(r))
+		w.Write(data)
 	})
 
-	http.HandleFunc("/-/openidcallback", func(w http.ResponseWriter, r *http.Request) {
-		id, err := openid.Verify("http://"+r.Host+r.URL.String(), discoveryCache, nonceStore)
-		if err != nil {
-			io.WriteString(w, "Authentication check failed.")
-			return
-		}
+	mux.HandleFunc("/-/logout", func(w http.ResponseWriter, r *http.Request) {
 		session, err := store.Get(r, defaultSessionName)
-		if err != nil {
+		if err != nil && session == nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		user := &UserInfo{
-			Id:       id,
-			Email:    r.FormValue("openid.sreg.email"),
-			Name:     r.FormValue("openid.sreg.fullname"),
-			NickName: r.FormValue("openid.sreg.nickname"),
-		}
-		session.Values["user"] = user
-		if err := session.Save(r, w); err != nil {
-			log.Println("session save error:", err)
-		}
-
+		delete(session.Values, "user")
+		session.Options.MaxAge = -1
 		nextUrl := r.FormValue("next")
+		_ = session.Save(r, w)
+		if nextUrl == "" {
+			nextUrl = r.Referer()
+		}
 		if nextUrl == "" {
 			nextUrl = "/"
 		}
 		http.Redirect(w, r, nextUrl, 302)
 	})
+}
 
-	http.HandleFunc("/-/user", func(w http.ResponseWriter, r *http.Request) {
-		session, err := store.Get(r, defaultSessionName)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+// openIDAuth logs users in with an OpenID 2.0 provider
+type openIDAuth struct {
+	URL string
+}
+
+func (a *openIDAuth) Authenticate(r *http.Request) (*Identity, error) {
+	return sessionIdentity(r), nil
+}
+
+func (a *openIDAuth) handleLogin(mux *http.ServeMux) {
+	mux.HandleFunc("/-/login", func(w http.ResponseWriter, r *http.Request) {
+		callback := requestScheme(r) + "://" + r.Host + "/-/openidcallback?next=" + loginNext(r)
+		if url, err := openid.RedirectURL(a.URL, callback, ""); err == nil {
+			http.Redirect(w, r, url, 303)
+		} else {
+			log.Println("openid redirect:", err)
+			http.Error(w, "OpenID provider not available", http.StatusBadGateway)
 		}
-		val := session.Values["user"]
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		data, _ := json.Marshal(val)
-		w.Write(data)
 	})
 
-	http.HandleFunc("/-/logout", func(w http.ResponseWriter, r *http.Request) {
-		session, err := store.Get(r, defaultSessionName)
+	mux.HandleFunc("/-/openidcallback", func(w http.ResponseWriter, r *http.Request) {
+		id, err := openid.Verify(requestScheme(r)+"://"+r.Host+r.URL.String(), discoveryCache, nonceStore)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			io.WriteString(w, "Authentication check failed.")
 			return
 		}
-		delete(session.Values, "user")
-		session.Options.MaxAge = -1
-		nextUrl := r.FormValue("next")
-		_ = session.Save(r, w)
-		if nextUrl == "" {
-			nextUrl = r.Referer()
+		user := &Identity{
+			Username: r.FormValue("openid.sreg.nickname"),
+			Email:    r.FormValue("openid.sreg.email"),
+			Name:     r.FormValue("openid.sreg.fullname"),
+			Provider: "openid",
 		}
-		http.Redirect(w, r, nextUrl, 302)
+		if user.Username == "" {
+			user.Username = path.Base(strings.TrimRight(id, "/"))
+		}
+		saveSessionIdentity(w, r, user, r.FormValue("next"))
 	})
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	ownerDir      = ".ghs-owners"
+	ownerFileName = "owners.json"
+)
+
+var errNotOwner = errors.New("not the owner")
+
+// ownerStore remembers who created the files, for the delete-own
+// permission. Names are storage names.
+type ownerStore struct {
+	file string
+
+	mu     sync.Mutex
+	owners map[string]string
+}
+
+func newOwnerStore(file string) *ownerStore {
+	return &ownerStore{file: file, owners: make(map[string]string)}
+}
+
+func (o *ownerStore) load() error {
+	data, err := ioutil.ReadFile(o.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := json.Unmarshal(data, &o.owners); err != nil {
+		return fmt.Errorf("%s: %v", o.file, err)
+	}
+	return nil
+}
+
+// saveLocked writes the owners to a temporary file which replaces the old one
+func (o *ownerStore) saveLocked() error {
+	data, err := json.Marshal(o.owners)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(o.file), 0700); err != nil {
+		return err
+	}
+	tmp := o.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.file)
+}
+
+func (o *ownerStore) get(name string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.owners[cleanName(name)]
+}
+
+// owned returns the names username owns
+func (o *ownerStore) owned(username string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	names := []string{}
+	for name, owner := range o.owners {
+		if owner == username {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// set makes username the owner of the names, anonymous users own nothing
+func (o *ownerStore) set(username string, names ...string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, name := range names {
+		if username == "" {
+			delete(o.owners, cleanName(name))
+		} else {
+			o.owners[cleanName(name)] = username
+		}
+	}
+	return o.saveLocked()
+}
+
+// setTree makes username the owner of name and everything below it
+func (o *ownerStore) setTree(st Storage, username, name string) error {
+	names := []string{}
+	walkStorage(st, name, func(name string, info os.FileInfo, err error) error {
+		if err == nil {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return o.set(username, names...)
+}
+
+// remove forgets the owners of name and everything below it
+func (o *ownerStore) remove(name string) error {
+	return o.rename(name, "")
+}
+
+// rename moves the owners of oldname and everything below it to newname,
+// or forgets them if newname is empty
+func (o *ownerStore) rename(oldname, newname string) error {
+	oldname = cleanName(oldname)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	changed := false
+	for name, owner := range o.owners {
+		if name != oldname && !strings.HasPrefix(name, oldname+"/") {
+			continue
+		}
+		delete(o.owners, name)
+		if newname != "" {
+			o.owners[cleanName(newname)+strings.TrimPrefix(name, oldname)] = owner
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return o.saveLocked()
+}
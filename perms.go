@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// permSet is a set of the permissions the rules of .ghs.yml grant
+type permSet uint16
+
+const (
+	permRead      permSet = 1 << iota // download files
+	permList                          // list directories and search them
+	permWrite                         // create files and directories
+	permOverwrite                     // replace existing files
+	permRename                        // move or rename files
+	permDelete                        // delete any file
+	permDeleteOwn                     // delete the files the user created
+	permShare                         // make install links of ipa files
+	permAdmin                         // everything, and change the .ghs.yml below
+
+	permAll permSet = 1<<iota - 1
+)
+
+const ghsFileName = ".ghs.yml"
+
+var permNames = []struct {
+	name string
+	perm permSet
+}{
+	{"read", permRead},
+	{"list", permList},
+	{"write", permWrite},
+	{"overwrite", permOverwrite},
+	{"rename", permRename},
+	{"delete", permDelete},
+	{"delete-own", permDeleteOwn},
+	{"share", permShare},
+	{"admin", permAdmin},
+}
+
+// parsePerms reads the permission names of a rule
+func parsePerms(names []string) (permSet, error) {
+	var p permSet
+	for _, name := range names {
+		found := false
+		for _, pn := range permNames {
+			if pn.name == strings.TrimSpace(name) {
+				p |= pn.perm
+				found = true
+			}
+		}
+		if !found {
+			return p, fmt.Errorf("unknown permission %q", name)
+		}
+	}
+	return p, nil
+}
+
+func (p permSet) names() []string {
+	names := []string{}
+	for _, pn := range permNames {
+		if p&pn.perm != 0 {
+			names = append(names, pn.name)
+		}
+	}
+	return names
+}
+
+// rulePerms returns the permissions of a rule, perms if it is set, else
+// the ones of the upload, delete and noaccess flags of older versions.
+func rulePerms(perms []string, upload, delete, noAccess bool) permSet {
+	if perms != nil {
+		p, err := parsePerms(perms)
+		if err != nil {
+			log.Printf("Err format %s: %v", ghsFileName, err)
+		}
+		return p
+	}
+	var p permSet
+	if !noAccess {
+		p |= permRead | permList
+	}
+	if upload {
+		p |= permWrite | permOverwrite
+	}
+	if delete {
+		p |= permDelete | permRename
+	}
+	return p
+}
+
+// perms resolves the permissions of the user of r, see AccessConf. An
+// admin of the directory has all of them, an auditor may read and list, and
+// tokens only have those of their scopes.
+func (c *AccessConf) perms(r *http.Request) permSet {
+	p, _ := c.effective(r)
+	return p
+}
+
+// effective returns the permissions of the user of r and the rule they
+// come from
+func (c *AccessConf) effective(r *http.Request) (permSet, string) {
+	if isAdmin(r) {
+		return permAll, "admin"
+	}
+	p, rule := c.granted(r)
+	if p&permAdmin != 0 {
+		p = permAll
+	}
+	// auditors read everything
+	if canAudit(r) && p&(permRead|permList) != permRead|permList {
+		p, rule = p|permRead|permList, "auditor"
+	}
+	return p & identityOf(r).tokenPerms(c.path), rule
+}
+
+// granted returns the permissions the rules give the user of r, and the
+// rule they come from
+func (c *AccessConf) granted(r *http.Request) (permSet, string) {
+	p, rule := c.rule(r)
+	if rule == "" {
+		p, rule = rulePerms(c.Perms, c.Upload, c.Delete, c.NoAccess), "defaults"
+	}
+	return p, rule
+}
+
+// rule returns the permissions of the entry of the user of r in users, or
+// of the entries of its groups together, and which entries they are. The
+// rule is empty if there is no entry for the user.
+func (c *AccessConf) rule(r *http.Request) (permSet, string) {
+	username := getUser(r)
+	for _, rule := range c.Users {
+		if rule.Username == username {
+			return rulePerms(rule.Perms, rule.Upload, rule.Delete, rule.NoAccess), "user " + username
+		}
+	}
+
+	if len(c.Groups) > 0 {
+		member := make(map[string]bool)
+		for _, g := range userGroups.groups(identityOf(r).source(), username) {
+			member[g] = true
+		}
+		var p permSet
+		found := []string{}
+		for _, rule := range c.Groups {
+			if member[rule.Group] {
+				p |= rulePerms(rule.Perms, rule.Upload, rule.Delete, rule.NoAccess)
+				found = append(found, rule.Group)
+			}
+		}
+		if len(found) > 0 {
+			return p, "groups " + strings.Join(found, ",")
+		}
+	}
+	return 0, ""
+}
+
+// can reports whether the user of r has all permissions of p
+func (c *AccessConf) can(r *http.Request, p permSet) bool {
+	return c.perms(r)&p == p
+}
+
+// tokenPerms limits the permissions of API tokens to their scopes
+func (id *Identity) tokenPerms(name string) permSet {
+	if id == nil || id.Provider != "token" {
+		return permAll
+	}
+	if id.allows(scopeAdmin, name) {
+		return permAll
+	}
+	var p permSet
+	if id.allows(scopeRead, name) {
+		p |= permRead | permList
+	}
+	if id.allows(scopeWrite, name) {
+		p |= permWrite | permOverwrite | permShare
+	}
+	if id.allows(scopeDelete, name) {
+		p |= permDelete | permDeleteOwn
+		if p&permWrite != 0 {
+			p |= permRename
+		}
+	}
+	return p
+}
+
+// canWrite reports whether the user of r may create the storage name, or
+// replace it if it exists. Only admins of the directory may write .ghs.yml.
+func (s *HTTPStaticServer) canWrite(r *http.Request, auth *AccessConf, name string) bool {
+	if path.Base(name) == ghsFileName {
+		return auth.can(r, permAdmin)
+	}
+	if _, err := s.storage.Stat(name); err == nil {
+		return auth.can(r, permOverwrite)
+	}
+	return auth.can(r, permWrite)
+}
+
+// canRemove reports whether the user of r may delete the storage name: with
+// delete, or with delete-own if the user created it and everything below.
+func (s *HTTPStaticServer) canRemove(r *http.Request, auth *AccessConf, name string) bool {
+	if path.Base(name) == ghsFileName {
+		return auth.can(r, permAdmin)
+	}
+	p := auth.perms(r)
+	if p&permDelete != 0 {
+		return true
+	}
+	username := getUser(r)
+	if p&permDeleteOwn == 0 || username == "" {
+		return false
+	}
+	owned := true
+	walkStorage(s.storage, name, func(name string, info os.FileInfo, err error) error {
+		if err != nil || s.owners.get(name) != username {
+			owned = false
+			return errNotOwner
+		}
+		return nil
+	})
+	return owned
+}
+
+// canRename reports whether the user of r may move the storage name away
+func (s *HTTPStaticServer) canRename(r *http.Request, auth *AccessConf, name string) bool {
+	if path.Base(name) == ghsFileName {
+		return auth.can(r, permAdmin)
+	}
+	return auth.can(r, permRename)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRulePerms(t *testing.T) {
+	tests := []struct {
+		perms                    []string
+		upload, delete, noaccess bool
+		want                     permSet
+	}{
+		{nil, false, false, false, permRead | permList},
+		{nil, true, true, false, permRead | permList | permWrite | permOverwrite | permDelete | permRename},
+		{nil, true, false, true, permWrite | permOverwrite},
+		{[]string{}, true, true, false, 0},
+		{[]string{"write"}, false, false, true, permWrite},
+		{[]string{"list", "delete-own"}, true, false, false, permList | permDeleteOwn},
+	}
+	for _, v := range tests {
+		if got := rulePerms(v.perms, v.upload, v.delete, v.noaccess); got != v.want {
+			t.Errorf("%v %v %v %v: got %v, want %v", v.perms, v.upload, v.delete, v.noaccess, got.names(), v.want.names())
+		}
+	}
+	if _, err := parsePerms([]string{"read", "execute"}); err == nil {
+		t.Error("unknown permission accepted")
+	}
+}
+
+// permServer serves a temporary root with the given files
+func permServer(t *testing.T, files map[string]string) *HTTPStaticServer {
+	root := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewHTTPStaticServer(root, nil)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func permRequest(s *HTTPStaticServer, user, method, target string, body []byte, contentType string) int {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if user != "" {
+		r = withIdentity(r, &Identity{Username: user, Provider: "static"})
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w.Code
+}
+
+func upload(s *HTTPStaticServer, user, dir, name string) int {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	fw, _ := mw.CreateFormFile("file", name)
+	fw.Write([]byte("data"))
+	mw.Close()
+	return permRequest(s, user, "POST", dir, buf.Bytes(), mw.FormDataContentType())
+}
+
+func TestPermsEnforced(t *testing.T) {
+	s := permServer(t, map[string]string{
+		"drop/.ghs.yml":   "perms: [write]\n",
+		"drop/old.txt":    "old",
+		"pub/.ghs.yml":    "perms: [read]\n",
+		"pub/a.txt":       "a",
+		"own/.ghs.yml":    "perms: [read, list, write, delete-own]\n",
+		"sub/.ghs.yml":    "perms: [read, list]\nusers:\n- username: alice\n  perms: [admin]\n",
+		"sub/x/b.txt":     "b",
+		"legacy/.ghs.yml": "upload: true\ndelete: false\n",
+		"legacy/c.txt":    "c",
+	})
+
+	tests := []struct {
+		name   string
+		status func() int
+		want   int
+	}{
+		// a drop box: new files only
+		{"drop upload", func() int { return upload(s, "bob", "/drop", "new.txt") }, 200},
+		{"drop overwrite", func() int { return upload(s, "bob", "/drop", "old.txt") }, 403},
+		{"drop list", func() int { return permRequest(s, "bob", "GET", "/-/json/drop", nil, "") }, 403},
+		{"drop download", func() int { return permRequest(s, "bob", "GET", "/drop/old.txt", nil, "") }, 403},
+		// download only
+		{"pub download", func() int { return permRequest(s, "bob", "GET", "/pub/a.txt", nil, "") }, 200},
+		{"pub list", func() int { return permRequest(s, "bob", "GET", "/-/json/pub", nil, "") }, 403},
+		{"pub zip", func() int { return permRequest(s, "bob", "GET", "/-/zip/pub", nil, "") }, 403},
+		{"pub checksum", func() int { return permRequest(s, "bob", "GET", "/-/checksum/pub/a.txt", nil, "") }, 200},
+		// delete own files only
+		{"own upload", func() int { return upload(s, "bob", "/own", "bob.txt") }, 200},
+		{"own delete other", func() int { return permRequest(s, "eve", "DELETE", "/own/bob.txt", nil, "") }, 403},
+		{"own delete", func() int { return permRequest(s, "bob", "DELETE", "/own/bob.txt", nil, "") }, 200},
+		// admin of a subtree
+		{"sub rules by user", func() int { return upload(s, "bob", "/sub", ".ghs.yml") }, 403},
+		{"sub rules by admin", func() int { return upload(s, "alice", "/sub/x", ".ghs.yml") }, 200},
+		{"sub delete by admin", func() int { return permRequest(s, "alice", "DELETE", "/sub/x/b.txt", nil, "") }, 200},
+		{"sub delete", func() int { return permRequest(s, "bob", "DELETE", "/sub/x/.ghs.yml", nil, "") }, 403},
+		// upload of older versions replaces files, delete: false refuses
+		{"legacy overwrite", func() int { return upload(s, "bob", "/legacy", "c.txt") }, 200},
+		{"legacy delete", func() int { return permRequest(s, "bob", "DELETE", "/legacy/c.txt", nil, "") }, 403},
+	}
+	for _, v := range tests {
+		if got := v.status(); got != v.want {
+			t.Errorf("%s: got %d, want %d", v.name, got, v.want)
+		}
+	}
+}
+
+func TestPermsCmd(t *testing.T) {
+	s := permServer(t, map[string]string{
+		"ro/.ghs.yml":  "perms: [read, list]\n",
+		"ro/a.txt":     "a",
+		"mv/.ghs.yml":  "perms: [read, list, write, rename]\n",
+		"mv/b.txt":     "b",
+		"dst/.ghs.yml": "perms: [list, write]\n",
+		"dst/c.txt":    "c",
+	})
+	cmd := func(user, body string) string {
+		r := httptest.NewRequest("POST", "/-/cmd", strings.NewReader(body))
+		r = withIdentity(r, &Identity{Username: user, Provider: "static"})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	tests := []struct {
+		body    string
+		allowed bool
+	}{
+		{`{"name":"rm","paths":["/ro/a.txt"]}`, false},
+		{`{"name":"mkdir","paths":["/ro/d"]}`, false},
+		{`{"name":"mv","paths":["/ro/a.txt","/dst"]}`, false},
+		{`{"name":"cp","paths":["/ro/a.txt","/dst"]}`, true},
+		{`{"name":"cp","paths":["/mv/b.txt","/dst/c.txt"],"options":{"force":true}}`, false},
+		{`{"name":"mv","paths":["/mv/b.txt","/dst"]}`, true},
+		{`{"name":"mkdir","paths":["/mv/d"]}`, true},
+	}
+	for _, v := range tests {
+		out := cmd("bob", v.body)
+		if strings.Contains(out, `"error"`) == v.allowed {
+			t.Errorf("%s: got %s", v.body, out)
+		}
+	}
+}
+
+func TestPermsContentSearch(t *testing.T) {
+	s := permServer(t, map[string]string{
+		"secret/.ghs.yml": "perms: [list]\n",
+		"secret/a.txt":    "db_password=hunter2\n",
+		"pub/b.txt":       "hunter2 is public\n",
+	})
+	s.Index.setContentMax(1024)
+	if err := s.Index.scan(s.storage, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := permRequest(s, "bob", "GET", "/secret/a.txt", nil, ""); got != 403 {
+		t.Fatalf("download from a list-only directory: got %d, want 403", got)
+	}
+	r := httptest.NewRequest("GET", "/-/json/?search=hunter2&content=true", nil)
+	r = withIdentity(r, &Identity{Username: "bob", Provider: "static"})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("content search: got %d", w.Code)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, "db_password") || strings.Contains(body, "secret/a.txt") {
+		t.Errorf("content search shows a file the user can not read: %s", body)
+	}
+	if !strings.Contains(body, "pub/b.txt") {
+		t.Errorf("content search misses a readable file: %s", body)
+	}
+}
+
+func TestPermsWebdav(t *testing.T) {
+	s := permServer(t, map[string]string{
+		"ro/.ghs.yml":  "perms: [read, list]\n",
+		"ro/a.txt":     "a",
+		"new/.ghs.yml": "perms: [read, list, write]\n",
+		"new/b.txt":    "b",
+		"rw/.ghs.yml":  "perms: [read, list, write, overwrite, rename, delete]\n",
+		"rw/c.txt":     "c",
+		"rw/d.txt":     "d",
+		"own/.ghs.yml": "perms: [read, list, write, delete-own]\n",
+	})
+	dav := func(user, method, target string, header ...string) func() int {
+		return func() int {
+			var body io.Reader
+			if method == "PUT" {
+				body = strings.NewReader("data")
+			}
+			r := httptest.NewRequest(method, webdavPrefix+target, body)
+			for i := 0; i+1 < len(header); i += 2 {
+				r.Header.Set(header[i], header[i+1])
+			}
+			if user != "" {
+				r = withIdentity(r, &Identity{Username: user, Provider: "static"})
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			return w.Code
+		}
+	}
+	to := func(name string) string { return "http://example.com" + webdavPrefix + name }
+
+	tests := []struct {
+		name   string
+		status func() int
+		want   int
+	}{
+		{"anonymous put", dav("", "PUT", "/ro/x.txt"), 401},
+		{"put", dav("bob", "PUT", "/new/x.txt"), 201},
+		{"put read only", dav("bob", "PUT", "/ro/x.txt"), 403},
+		{"put overwrite", dav("bob", "PUT", "/new/b.txt"), 403},
+		{"put overwrite allowed", dav("bob", "PUT", "/rw/c.txt"), 201},
+		{"mkcol", dav("bob", "MKCOL", "/new/dir"), 201},
+		{"mkcol read only", dav("bob", "MKCOL", "/ro/dir"), 403},
+		{"delete", dav("bob", "DELETE", "/new/b.txt"), 403},
+		{"delete allowed", dav("bob", "DELETE", "/rw/d.txt"), 204},
+		// delete own files only
+		{"own put", dav("bob", "PUT", "/own/bob.txt"), 201},
+		{"own delete other", dav("eve", "DELETE", "/own/bob.txt"), 403},
+		{"own delete", dav("bob", "DELETE", "/own/bob.txt"), 204},
+		// copy needs read on the source, write and overwrite on the destination
+		{"copy", dav("bob", "COPY", "/ro/a.txt", "Destination", to("/new/a.txt")), 201},
+		{"copy overwrite", dav("bob", "COPY", "/ro/a.txt", "Destination", to("/new/b.txt")), 403},
+		{"copy overwrite allowed", dav("bob", "COPY", "/ro/a.txt", "Destination", to("/rw/c.txt"), "Overwrite", "T"), 204},
+		{"copy into read only", dav("bob", "COPY", "/rw/c.txt", "Destination", to("/ro/c.txt")), 403},
+		// move needs rename on the source
+		{"move", dav("bob", "MOVE", "/rw/c.txt", "Destination", to("/rw/e.txt")), 201},
+		{"move without rename", dav("bob", "MOVE", "/new/b.txt", "Destination", to("/rw/b.txt")), 403},
+		{"move into read only", dav("bob", "MOVE", "/rw/e.txt", "Destination", to("/ro/e.txt")), 403},
+	}
+	for _, v := range tests {
+		if got := v.status(); got != v.want {
+			t.Errorf("%s: got %d, want %d", v.name, got, v.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, "rw", "e.txt")); err != nil {
+		t.Errorf("moved file: %v", err)
+	}
+}
+
+func TestOwnerStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "owners.json")
+	o := newOwnerStore(file)
+	o.set("bob", "a", "a/b", "a/b/c", "ab")
+	o.rename("a/b", "x/b")
+	o.remove("ab")
+
+	o = newOwnerStore(file)
+	if err := o.load(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "bob", "a/b": "", "a/b/c": "", "x/b": "bob", "x/b/c": "bob", "ab": ""}
+	for name, owner := range want {
+		if got := o.get(name); got != owner {
+			t.Errorf("%s: got %q, want %q", name, got, owner)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Package passhash hashes passwords with argon2id of golang.org/x/crypto
+// into the PHC string format used by the reference implementation:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+//
+// Verify also accepts the unsalted md5 hex digests of older versions, so
+// that they can be replaced on the next login, see NeedsRehash.
+package passhash
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Params are the cost parameters of new hashes
+type Params struct {
+	Memory  uint32 // KiB
+	Time    uint32 // passes over the memory
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// Default are the parameters Hash uses, the second recommended option of
+// RFC 9106. 64M and 3 passes take a few hundred milliseconds.
+var Default = Params{Memory: 64 * 1024, Time: 3, Threads: 2, SaltLen: 16, KeyLen: 32}
+
+var (
+	ErrUnknownFormat = errors.New("passhash: unknown hash format")
+	ErrBadParams     = errors.New("passhash: bad parameters")
+)
+
+// Hash returns the encoded argon2id hash of password with a random salt
+func Hash(password string) string {
+	return HashWith(password, Default)
+}
+
+// HashWith is Hash with other parameters
+func HashWith(password string, p Params) string {
+	salt := make([]byte, p.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// Verify reports whether password matches the encoded hash
+func Verify(password, encoded string) (bool, error) {
+	if isMD5(encoded) {
+		sum := md5.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(encoded))) == 1, nil
+	}
+	p, salt, key, err := decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	got := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(got, key) == 1, nil
+}
+
+// NeedsRehash reports whether encoded is a legacy md5 digest or an argon2id
+// hash weaker than Default
+func NeedsRehash(encoded string) bool {
+	p, _, _, err := decode(encoded)
+	if err != nil {
+		return true
+	}
+	return p.Memory < Default.Memory || p.Time < Default.Time || p.Threads < Default.Threads
+}
+
+func isMD5(encoded string) bool {
+	if len(encoded) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
+
+func decode(encoded string) (p Params, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	var threads uint32
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &threads); err != nil {
+		return p, nil, nil, ErrBadParams
+	}
+	if p.Time < 1 || threads < 1 || threads > 255 || p.Memory < 8*threads || p.Memory > 4<<20 {
+		return p, nil, nil, ErrBadParams
+	}
+	p.Threads = uint8(threads)
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) < 16 {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	return p, salt, key, nil
+}
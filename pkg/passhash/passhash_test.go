@@ -0,0 +1,47 @@
+package passhash
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashAndVerify(t *testing.T) {
+	old := Default
+	defer func() { Default = old }()
+	Default = Params{Memory: 64, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+	h := Hash("s3cret")
+	if !strings.HasPrefix(h, "$argon2id$v=19$m=64,t=1,p=1$") || h == Hash("s3cret") {
+		t.Fatalf("hash %q is not salted argon2id", h)
+	}
+	if ok, err := Verify("s3cret", h); !ok || err != nil {
+		t.Fatalf("verify good password: %v %v", ok, err)
+	}
+	if ok, _ := Verify("S3cret", h); ok {
+		t.Fatal("verify bad password succeeded")
+	}
+	if NeedsRehash(h) {
+		t.Fatal("fresh hash needs a rehash")
+	}
+	Default.Time = 2
+	if !NeedsRehash(h) {
+		t.Fatal("weaker hash needs no rehash")
+	}
+
+	// md5 hex digest of "admin"
+	legacy := "21232f297a57a5a743894a0e4a801fc3"
+	if ok, _ := Verify("admin", legacy); !ok {
+		t.Fatal("legacy md5 password refused")
+	}
+	if ok, _ := Verify("admin2", legacy); ok {
+		t.Fatal("bad legacy md5 password accepted")
+	}
+	if !NeedsRehash(legacy) {
+		t.Fatal("legacy md5 needs no rehash")
+	}
+	for _, bad := range []string{"", "$argon2id$v=19$m=64,t=1,p=1$c2FsdA", "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA", "$argon2id$v=19$m=1,t=0,p=1$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA"} {
+		if ok, err := Verify("x", bad); ok || err == nil {
+			t.Fatalf("verify %q: %v %v", bad, ok, err)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// searchQuery is a parsed search text. The terms of a clause are joined by
+// OR, every clause has to match.
+//
+//	foo "two words"      path contains foo and "two words"
+//	-tmp                 path does not contain tmp
+//	a OR b               path contains a or b
+//	*.tar.gz  /^a.*z$/   glob on the file name (the path if it has a /), regexp on the path
+//	ext:jpg,png  type:dir  size:>100M  mtime:<7d  mtime:>=2024-01-31
+//
+// Files are returned unless a type: term is used. With content set, the
+// words, phrases and regexps are looked up in the lines of text files
+// instead of the path.
+type searchQuery struct {
+	clauses [][]queryTerm
+	anyType bool // a type: term was given
+	content bool
+}
+
+type queryTerm struct {
+	negate  bool
+	literal string // lower cased text every match contains, for the trigram lookup
+	match   func(t *queryTarget) bool
+	text    *regexp.Regexp // for words, phrases and regexps, which can match content
+}
+
+// queryTarget is an index entry being matched
+type queryTarget struct {
+	path  string
+	lower string // lower cased path
+	name  string // lower cased base name
+	size  int64  // total size of the files below for directories
+	mtime time.Time
+	dir   bool
+}
+
+func newQueryTarget(name string, info os.FileInfo) *queryTarget {
+	return &queryTarget{
+		path:  name,
+		lower: strings.ToLower(name),
+		name:  strings.ToLower(path.Base(name)),
+		size:  info.Size(),
+		mtime: info.ModTime(),
+		dir:   info.IsDir(),
+	}
+}
+
+func (t queryTerm) matches(target *queryTarget) bool {
+	return t.match(target) != t.negate
+}
+
+// matches reports whether target matches q. With content set, terms which
+// match content are taken as matching, matchContent decides on them.
+func (q *searchQuery) matches(target *queryTarget) bool {
+	if !q.anyType && target.dir {
+		return false
+	}
+next:
+	for _, clause := range q.clauses {
+		for _, term := range clause {
+			if (q.content && term.text != nil) || term.matches(target) {
+				continue next
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// literals returns text every match contains in its path, and in its content
+// with content set, from clauses without OR.
+func (q *searchQuery) literals() (pathLiterals, contentLiterals []string) {
+	for _, clause := range q.clauses {
+		term := clause[0]
+		if len(clause) > 1 || term.negate || term.literal == "" {
+			continue
+		}
+		if q.content && term.text != nil {
+			contentLiterals = append(contentLiterals, term.literal)
+		} else {
+			pathLiterals = append(pathLiterals, term.literal)
+		}
+	}
+	return pathLiterals, contentLiterals
+}
+
+// contentSnippets is the most matching lines returned per file
+const contentSnippets = 3
+
+// snippetWidth is the most bytes of a line returned in a snippet
+const snippetWidth = 200
+
+// contentSnippet is a matching line, Matches are the byte offsets of the
+// matching text in Text.
+type contentSnippet struct {
+	Line    int      `json:"line"`
+	Text    string   `json:"text"`
+	Matches [][2]int `json:"matches"`
+}
+
+// matchContent decides on the terms deferred by matches, for a file with
+// data as content. It returns whether the file matches, and snippets of
+// the lines matching a term.
+func (q *searchQuery) matchContent(target *queryTarget, data []byte) (bool, []contentSnippet) {
+	lines := strings.Split(string(data), "\n")
+	found := func(re *regexp.Regexp) bool {
+		for _, line := range lines {
+			if re.MatchString(line) {
+				return true
+			}
+		}
+		return false
+	}
+	positive := []*regexp.Regexp{}
+	for _, clause := range q.clauses {
+		ok := false
+		for _, term := range clause {
+			if term.text != nil && !term.negate {
+				positive = append(positive, term.text)
+			}
+			switch {
+			case ok:
+			case term.text == nil:
+				ok = term.matches(target)
+			default:
+				ok = found(term.text) != term.negate
+			}
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+
+	snippets := []contentSnippet{}
+	for i, line := range lines {
+		if len(snippets) == contentSnippets {
+			break
+		}
+		line = strings.TrimRight(line, "\r")
+		matches := [][2]int{}
+		for _, re := range positive {
+			for _, m := range re.FindAllStringIndex(line, -1) {
+				if m[1] > m[0] {
+					matches = append(matches, [2]int{m[0], m[1]})
+				}
+			}
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		sort.Slice(matches, func(i, j int) bool { return matches[i][0] < matches[j][0] })
+		snippets = append(snippets, makeSnippet(i+1, line, matches))
+	}
+	return true, snippets
+}
+
+// makeSnippet cuts long lines down to snippetWidth around the first match
+func makeSnippet(line int, text string, matches [][2]int) contentSnippet {
+	start := 0
+	if len(text) > snippetWidth && matches[0][0] > snippetWidth/4 {
+		start = matches[0][0] - snippetWidth/4
+	}
+	end := start + snippetWidth
+	if end > len(text) {
+		end = len(text)
+	}
+	// do not split UTF-8 sequences
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	snippet := contentSnippet{Line: line, Text: text[start:end], Matches: [][2]int{}}
+	for _, m := range matches {
+		if m[0] >= start && m[1] <= end {
+			snippet.Matches = append(snippet.Matches, [2]int{m[0] - start, m[1] - start})
+		}
+	}
+	return snippet
+}
+
+type queryToken struct {
+	text   string
+	negate bool
+	quoted bool
+	regexp bool
+}
+
+// regexpEnd returns the index of the / closing the regexp started at i, the
+// first / before a blank or the end of text, or 0 if there is none. A lone /
+// is part of a path.
+func regexpEnd(text string, i int) int {
+	for end := i + 1; end < len(text); end++ {
+		if text[end] == '/' && (end+1 == len(text) || text[end+1] == ' ' || text[end+1] == '\t') {
+			return end
+		}
+	}
+	return 0
+}
+
+func tokenizeQuery(text string) ([]queryToken, error) {
+	tokens := []queryToken{}
+	for i := 0; i < len(text); {
+		if text[i] == ' ' || text[i] == '\t' {
+			i++
+			continue
+		}
+		tok := queryToken{}
+		if text[i] == '-' && i+1 < len(text) && text[i+1] != ' ' {
+			tok.negate = true
+			i++
+		}
+		switch {
+		case text[i] == '"' || (text[i] == '/' && regexpEnd(text, i) > 0):
+			delim := text[i]
+			end := i + 1
+			if delim == '/' {
+				end = regexpEnd(text, i)
+			}
+			for end < len(text) && text[end] != delim {
+				end++
+			}
+			if end >= len(text) {
+				return nil, fmt.Errorf("missing closing %c", delim)
+			}
+			tok.text = text[i+1 : end]
+			tok.quoted = delim == '"'
+			tok.regexp = delim == '/'
+			if tok.regexp {
+				tok.text = strings.Replace(tok.text, `\/`, "/", -1)
+			}
+			i = end + 1
+		default:
+			end := strings.IndexAny(text[i:], " \t")
+			if end < 0 {
+				end = len(text) - i
+			}
+			tok.text = text[i : i+end]
+			i += end
+		}
+		tokens = append(tokens, tok)
+	}
+	return tokens, nil
+}
+
+// parseQuery parses the search text of /-/json, see searchQuery
+func parseQuery(text string) (*searchQuery, error) {
+	tokens, err := tokenizeQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	q := &searchQuery{}
+	or := false
+	for i, tok := range tokens {
+		if tok.text == "OR" && !tok.quoted && !tok.negate {
+			if i == 0 || i == len(tokens)-1 || or {
+				return nil, fmt.Errorf("OR needs a term on both sides")
+			}
+			or = true
+			continue
+		}
+		term, err := q.parseTerm(tok)
+		if err != nil {
+			return nil, err
+		}
+		if or {
+			last := len(q.clauses) - 1
+			q.clauses[last] = append(q.clauses[last], term)
+			or = false
+		} else {
+			q.clauses = append(q.clauses, []queryTerm{term})
+		}
+	}
+	return q, nil
+}
+
+func (q *searchQuery) parseTerm(tok queryToken) (queryTerm, error) {
+	term := queryTerm{negate: tok.negate}
+	text := strings.ToLower(tok.text)
+	switch {
+	case tok.regexp:
+		re, err := regexp.Compile("(?i)" + tok.text)
+		if err != nil {
+			return term, fmt.Errorf("bad regexp /%s/: %v", tok.text, err)
+		}
+		term.match = func(t *queryTarget) bool { return re.MatchString(t.path) }
+		term.text = re
+	case tok.quoted:
+		term.literal = text
+		term.match = func(t *queryTarget) bool { return strings.Contains(t.lower, text) }
+		term.text = regexp.MustCompile("(?i)" + regexp.QuoteMeta(text))
+	case strings.HasPrefix(text, "ext:"):
+		exts := strings.Split(text[len("ext:"):], ",")
+		for i, ext := range exts {
+			exts[i] = "." + strings.TrimPrefix(ext, ".")
+		}
+		if len(exts) == 1 {
+			term.literal = exts[0]
+		}
+		term.match = func(t *queryTarget) bool {
+			for _, ext := range exts {
+				if strings.HasSuffix(t.name, ext) {
+					return true
+				}
+			}
+			return false
+		}
+	case strings.HasPrefix(text, "type:"):
+		var dir bool
+		switch text[len("type:"):] {
+		case "dir", "d", "directory":
+			dir = true
+		case "file", "f":
+			dir = false
+		default:
+			return term, fmt.Errorf("bad type %q, use type:file or type:dir", tok.text)
+		}
+		q.anyType = true
+		term.match = func(t *queryTarget) bool { return t.dir == dir }
+	case strings.HasPrefix(text, "size:"):
+		op, value := splitOp(text[len("size:"):])
+		size, err := parseSize(value)
+		if err != nil {
+			return term, err
+		}
+		term.match = func(t *queryTarget) bool { return compareOp(op, t.size, size) }
+	case strings.HasPrefix(text, "mtime:"):
+		match, err := parseMtime(text[len("mtime:"):])
+		if err != nil {
+			return term, err
+		}
+		term.match = match
+	case strings.ContainsAny(text, "*?["):
+		if _, err := path.Match(text, ""); err != nil {
+			return term, fmt.Errorf("bad pattern %q", tok.text)
+		}
+		term.literal = globLiteral(text)
+		term.match = func(t *queryTarget) bool {
+			subject := t.name
+			if strings.Contains(text, "/") {
+				subject = t.lower
+			}
+			ok, _ := path.Match(text, subject)
+			return ok
+		}
+	default:
+		term.literal = text
+		term.match = func(t *queryTarget) bool { return strings.Contains(t.lower, text) }
+		term.text = regexp.MustCompile("(?i)" + regexp.QuoteMeta(text))
+	}
+	return term, nil
+}
+
+// globLiteral returns the longest run of plain characters in a pattern
+func globLiteral(pattern string) string {
+	longest, run := "", ""
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*', '?', '[':
+			if len(run) > len(longest) {
+				longest = run
+			}
+			run = ""
+			if c == '[' {
+				for i < len(pattern) && pattern[i] != ']' {
+					i++
+				}
+			}
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				run += pattern[i : i+1]
+			}
+		default:
+			run += pattern[i : i+1]
+		}
+	}
+	if len(run) > len(longest) {
+		longest = run
+	}
+	return longest
+}
+
+func splitOp(s string) (string, string) {
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(s, op) {
+			return op, s[len(op):]
+		}
+	}
+	return "=", s
+}
+
+func compareOp(op string, a, b int64) bool {
+	switch op {
+	case ">=":
+		return a >= b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case "<":
+		return a < b
+	}
+	return a == b
+}
+
+// parseSize parses sizes like 100, 1.5K or 100M, units are powers of 1024
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	num := strings.TrimSuffix(strings.ToUpper(s), "B")
+	if n := len(num); n > 0 {
+		if i := strings.IndexByte("KMGTP", num[n-1]); i >= 0 {
+			mult = int64(1) << (10 * uint(i+1))
+			num = num[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return int64(f * float64(mult)), nil
+}
+
+var ageUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+	'y': 365 * 24 * time.Hour,
+}
+
+// parseMtime parses an age like <7d (modified within the last 7 days) or a
+// date like >=2024-01-31.
+func parseMtime(s string) (func(t *queryTarget) bool, error) {
+	op, value := splitOp(s)
+	if n := len(value); n > 1 {
+		if unit, ok := ageUnits[value[n-1]]; ok {
+			if age, err := strconv.ParseFloat(value[:n-1], 64); err == nil {
+				if op == "=" {
+					return nil, fmt.Errorf("mtime:%s needs < or >", value)
+				}
+				cutoff := time.Now().Add(-time.Duration(age * float64(unit))).UnixNano()
+				// a smaller age is a later time
+				op = strings.NewReplacer("<", ">", ">", "<").Replace(op)
+				return func(t *queryTarget) bool { return compareOp(op, t.mtime.UnixNano(), cutoff) }, nil
+			}
+		}
+	}
+	day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("bad mtime %q, use an age like 7d or a date like 2006-01-02", s)
+	}
+	start, end := day.UnixNano(), day.AddDate(0, 0, 1).UnixNano()
+	return func(t *queryTarget) bool {
+		mtime := t.mtime.UnixNano()
+		switch op {
+		case ">":
+			return mtime >= end
+		case ">=":
+			return mtime >= start
+		case "<":
+			return mtime < start
+		case "<=":
+			return mtime < end
+		}
+		return mtime >= start && mtime < end
+	}, nil
+}
+
+// sortIndexItems sorts search results by name, path, size or mtime.
+// Directories are sorted by the total size of their files.
+func sortIndexItems(items []IndexFileItem, by string, desc bool, dirSize func(string) int64) error {
+	size := func(item IndexFileItem) int64 {
+		if item.Info.IsDir() {
+			return dirSize(item.Path)
+		}
+		return item.Info.Size()
+	}
+	var less func(a, b IndexFileItem) bool
+	switch by {
+	case "", "path":
+		less = func(a, b IndexFileItem) bool { return a.Path < b.Path }
+	case "name":
+		less = func(a, b IndexFileItem) bool {
+			if a.Info.Name() != b.Info.Name() {
+				return a.Info.Name() < b.Info.Name()
+			}
+			return a.Path < b.Path
+		}
+	case "size":
+		less = func(a, b IndexFileItem) bool {
+			if sa, sb := size(a), size(b); sa != sb {
+				return sa < sb
+			}
+			return a.Path < b.Path
+		}
+	case "mtime":
+		less = func(a, b IndexFileItem) bool {
+			if !a.Info.ModTime().Equal(b.Info.ModTime()) {
+				return a.Info.ModTime().Before(b.Info.ModTime())
+			}
+			return a.Path < b.Path
+		}
+	default:
+		return fmt.Errorf("bad sort %q, use name, path, size or mtime", by)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if desc {
+			return less(items[j], items[i])
+		}
+		return less(items[i], items[j])
+	})
+	return nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Quotas limit the bytes and the number of files a user owns, kept in the
+// user store, and those below a directory, set in its .ghs.yml:
+//
+//	quota:
+//	  bytes: 10G
+//	  files: 10000
+//
+// The usage comes from the search index, for users together with the owner
+// store. Writes which do not fit are refused with 413 if they are larger
+// than the quota itself, else with 507. A write reserves its share of the
+// quotas until it is in the index, so concurrent writes can not overfill
+// them; until the first scan of the index the usage is not known and writes
+// with a quota are refused with 503.
+
+// DirQuota is the quota of a .ghs.yml, Bytes is a size like 500M or 10G
+// (see parseSize). Zero is no limit.
+type DirQuota struct {
+	Bytes string `yaml:"bytes,omitempty" json:"bytes,omitempty"`
+	Files int64  `yaml:"files,omitempty" json:"files,omitempty"`
+}
+
+func (q *DirQuota) validate() error {
+	if q.Bytes != "" {
+		if _, err := parseSize(q.Bytes); err != nil {
+			return err
+		}
+	}
+	if q.Files < 0 {
+		return errors.New("files can not be negative")
+	}
+	return nil
+}
+
+func (q *DirQuota) maxBytes() int64 {
+	if q.Bytes == "" {
+		return 0
+	}
+	n, _ := parseSize(q.Bytes)
+	return n
+}
+
+// quotaUsage is what a quota allows and how much of it is used
+type quotaUsage struct {
+	Kind     string `json:"kind"` // "user" or "dir"
+	Name     string `json:"name"` // the username, or the directory as /path
+	Bytes    int64  `json:"bytes"`
+	Files    int64  `json:"files"`
+	MaxBytes int64  `json:"maxBytes"` // 0 for no limit
+	MaxFiles int64  `json:"maxFiles"`
+}
+
+func (q quotaUsage) limited() bool {
+	return q.MaxBytes > 0 || q.MaxFiles > 0
+}
+
+// quotaError is a write which does not fit into a quota
+type quotaError struct {
+	quota        quotaUsage
+	bytes, files int64 // what the write adds
+}
+
+func (e *quotaError) Error() string {
+	what := "quota of user " + e.quota.Name
+	if e.quota.Kind == "dir" {
+		what = "quota of " + e.quota.Name
+	}
+	q := e.quota
+	if q.MaxBytes > 0 && q.Bytes+e.bytes > q.MaxBytes {
+		msg := fmt.Sprintf("%s exceeded: %s of %s used", what, sizeString(q.Bytes), sizeString(q.MaxBytes))
+		if e.bytes > 0 {
+			msg += fmt.Sprintf(", %s more do not fit", sizeString(e.bytes))
+		}
+		return msg
+	}
+	return fmt.Sprintf("%s exceeded: %d of %d files used, %d more do not fit", what, q.Files, q.MaxFiles, e.files)
+}
+
+// status is 413 for writes which would not even fit into the empty quota,
+// 507 for those which do not fit into what is left of it
+func (e *quotaError) status() int {
+	q := e.quota
+	if q.MaxBytes > 0 && e.bytes > q.MaxBytes || q.MaxFiles > 0 && e.files > q.MaxFiles {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInsufficientStorage
+}
+
+// sizeString formats n in the units of parseSize
+func sizeString(n int64) string {
+	const units = "KMGTP"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", f, units[i])
+}
+
+var errQuotaNotCounted = errors.New("the usage of the quotas is not counted yet, try again later")
+
+// quotaReservations are the bytes and files of the writes which fit into
+// their quotas and are not in the search index yet
+type quotaReservations struct {
+	checking sync.Mutex // held from the check of a write to its reservation
+
+	mu      sync.Mutex
+	pending map[string][2]int64 // quotaKey -> bytes, files
+}
+
+func quotaKey(q quotaUsage) string {
+	return q.Kind + " " + q.Name
+}
+
+// count adds the reserved bytes and files to the usage of q
+func (r *quotaReservations) count(q *quotaUsage) {
+	r.mu.Lock()
+	p := r.pending[quotaKey(*q)]
+	r.mu.Unlock()
+	q.Bytes, q.Files = q.Bytes+p[0], q.Files+p[1]
+}
+
+func (r *quotaReservations) add(quotas []quotaUsage, bytes, files int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending == nil {
+		r.pending = make(map[string][2]int64)
+	}
+	for _, q := range quotas {
+		key := quotaKey(q)
+		p := r.pending[key]
+		p[0], p[1] = p[0]+bytes, p[1]+files
+		if p == [2]int64{} {
+			delete(r.pending, key)
+		} else {
+			r.pending[key] = p
+		}
+	}
+}
+
+// userUsage returns the quota of username and the size and number of the
+// files it owns
+func (s *HTTPStaticServer) userUsage(username string) quotaUsage {
+	q := quotaUsage{Kind: "user", Name: username}
+	if username == "" {
+		return q
+	}
+	q.Bytes, q.Files = s.Index.filesUsage(s.owners.owned(username))
+	if s.users == nil {
+		return q
+	}
+	u, err := s.users.User(username)
+	if err != nil {
+		// not a user of the store
+		return q
+	}
+	q.MaxBytes, q.MaxFiles = u.Quotabytes, u.Quotafiles
+	return q
+}
+
+// dirQuotas returns the quotas of dir and the directories above it, the
+// closest first
+func (s *HTTPStaticServer) dirQuotas(dir string) []quotaUsage {
+	var quotas []quotaUsage
+	for e := s.acl.get(cleanName(dir)); e != nil; e = e.parent {
+		if e.conf.Quota == nil {
+			continue
+		}
+		q := quotaUsage{Kind: "dir", Name: "/" + e.dir, MaxBytes: e.conf.Quota.maxBytes(), MaxFiles: e.conf.Quota.Files}
+		if !q.limited() {
+			continue
+		}
+		q.Bytes, q.Files = s.Index.usage(e.dir)
+		quotas = append(quotas, q)
+	}
+	return quotas
+}
+
+// writeQuotas returns the quotas a write of username to the storage name
+// counts against, less the file it replaces. For a move, from is the
+// source: quotas it is already counted in, and the one of its owner, are
+// left out.
+func (s *HTTPStaticServer) writeQuotas(username, name, from string) []quotaUsage {
+	var oldBytes, oldFiles int64
+	if info, err := s.storage.Stat(name); err == nil && !info.IsDir() {
+		oldBytes, oldFiles = info.Size(), 1
+	}
+	var quotas []quotaUsage
+	if q := s.userUsage(username); from == "" && q.limited() {
+		if s.owners.get(name) == username {
+			q.Bytes, q.Files = q.Bytes-oldBytes, q.Files-oldFiles
+		}
+		s.reserved.count(&q)
+		quotas = append(quotas, q)
+	}
+	dir := path.Dir(name)
+	if dir == "." {
+		dir = ""
+	}
+	for _, q := range s.dirQuotas(dir) {
+		d := strings.TrimPrefix(q.Name, "/")
+		if from != "" && (d == "" || from == d || strings.HasPrefix(from, d+"/")) {
+			continue
+		}
+		q.Bytes, q.Files = q.Bytes-oldBytes, q.Files-oldFiles
+		s.reserved.count(&q)
+		quotas = append(quotas, q)
+	}
+	return quotas
+}
+
+// checkQuota returns the status and the error to answer if bytes in files
+// written by username to the storage name do not fit into a quota, see
+// writeQuotas
+func (s *HTTPStaticServer) checkQuota(username, name, from string, bytes, files int64) (int, error) {
+	return s.fitQuotas(s.writeQuotas(username, name, from), bytes, files)
+}
+
+func (s *HTTPStaticServer) fitQuotas(quotas []quotaUsage, bytes, files int64) (int, error) {
+	if len(quotas) > 0 && !s.Index.counted() {
+		return http.StatusServiceUnavailable, errQuotaNotCounted
+	}
+	for _, q := range quotas {
+		if q.MaxBytes > 0 && q.Bytes+bytes > q.MaxBytes || q.MaxFiles > 0 && q.Files+files > q.MaxFiles {
+			err := &quotaError{q, bytes, files}
+			return err.status(), err
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// reserveQuota is checkQuota for a write about to be made. Its bytes and
+// files are counted against the quotas until release is called, which has
+// to be once the write is in the index, see indexWritten.
+func (s *HTTPStaticServer) reserveQuota(username, name, from string, bytes, files int64) (release func(), code int, err error) {
+	s.reserved.checking.Lock()
+	defer s.reserved.checking.Unlock()
+	quotas := s.writeQuotas(username, name, from)
+	if code, err := s.fitQuotas(quotas, bytes, files); err != nil {
+		return nil, code, err
+	}
+	s.reserved.add(quotas, bytes, files)
+	return func() { s.reserved.add(quotas, -bytes, -files) }, http.StatusOK, nil
+}
+
+// indexWritten puts name and what is below it into the search index right
+// after a write, before the watcher reports it
+func (s *HTTPStaticServer) indexWritten(name string) {
+	s.Index.addTree(s.storage, name, nil)
+}
+
+// quotaLeft returns how many bytes username may still write to the storage
+// name, -1 for no limit
+func (s *HTTPStaticServer) quotaLeft(username, name string) int64 {
+	left := int64(-1)
+	for _, q := range s.writeQuotas(username, name, "") {
+		if q.MaxBytes <= 0 {
+			continue
+		}
+		n := q.MaxBytes - q.Bytes
+		if n < 0 {
+			n = 0
+		}
+		if left < 0 || n < left {
+			left = n
+		}
+	}
+	return left
+}
+
+// quotaReport is the answer of /-/quota
+type quotaReport struct {
+	User   quotaUsage   `json:"user"`
+	Path   string       `json:"path"`
+	Quotas []quotaUsage `json:"quotas"` // of ?path= and the directories above
+}
+
+// hQuota reports the usage and the quota of ?user= and the quotas of the
+// directories containing ?path=. Users may see their own, admins and
+// auditors anybody's.
+func (s *HTTPStaticServer) hQuota(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("user")
+	if username == "" {
+		username = getUser(r)
+	}
+	if username != getUser(r) && !canAudit(r) {
+		http.Error(w, "only admins and auditors can see the quotas of other users", http.StatusForbidden)
+		return
+	}
+	name := cleanName(r.FormValue("path"))
+	if s.hidden(r, name) {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := s.storage.Stat(name); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	report := quotaReport{
+		User:   s.userUsage(username),
+		Path:   "/" + name,
+		Quotas: s.dirQuotas(name),
+	}
+	if report.Quotas == nil {
+		report.Quotas = []quotaUsage{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(report)
+}
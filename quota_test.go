@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"grapehttp/models/admin"
+)
+
+func TestQuotas(t *testing.T) {
+	s := permServer(t, map[string]string{
+		"box/.ghs.yml":     "perms: [read, list, write, overwrite, delete]\nquota:\n  bytes: 1K\n  files: 4\n",
+		"box/a.txt":        "aaaa",
+		"box/sub/.ghs.yml": "quota:\n  files: 100\n",
+		"src/.ghs.yml":     "perms: [read, list, write, rename]\n",
+		"src/big.txt":      strings.Repeat("x", 2000),
+		"src/small.txt":    "s",
+		"free/.ghs.yml":    "perms: [read, list, write]\n",
+		"dav/.ghs.yml":     "perms: [read, list, write, overwrite]\nquota:\n  bytes: 1K\n",
+	})
+	users := newMemUserStore()
+	s.users = users
+	users.AddUser(&admin.User{Username: "carol", Nickname: "Carol", Status: 1, Quotabytes: 6})
+	scan := func() {
+		if err := s.Index.scan(s.storage, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := func(user, body string) cmdResult {
+		r := httptest.NewRequest("POST", "/-/cmd", strings.NewReader(body))
+		r = withIdentity(r, &Identity{Username: user, Provider: "static"})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		resp := cmdResponse{}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || len(resp.Results) != 1 {
+			t.Fatalf("%s: %v %+v", body, err, resp)
+		}
+		return resp.Results[0]
+	}
+
+	// the two .ghs.yml, a.txt and b.txt fill the 4 files of box
+	scan()
+	if code := upload(s, "bob", "/box", "b.txt"); code != 200 {
+		t.Fatalf("upload b.txt: got %d", code)
+	}
+	scan()
+	if code := upload(s, "bob", "/box", "c.txt"); code != 507 {
+		t.Errorf("upload over the quota: got %d, want 507", code)
+	}
+	if code := upload(s, "bob", "/box", "b.txt"); code != 200 {
+		t.Errorf("replace b.txt: got %d, want 200", code)
+	}
+	// the quota of box/sub does not lift the one of box
+	if code := upload(s, "bob", "/box/sub", "c.txt"); code != 507 {
+		t.Errorf("upload below box: got %d, want 507", code)
+	}
+	body := `{"path":"/box","name":"x.bin","size":2000}`
+	if code := permRequest(s, "bob", "POST", "/-/upload", []byte(body), ""); code != 413 {
+		t.Errorf("resumable upload larger than the quota: got %d, want 413", code)
+	}
+
+	if res := cmd("bob", `{"name":"rm","paths":["/box/a.txt"]}`); res.Error != "" {
+		t.Fatal(res.Error)
+	}
+	scan()
+	if res := cmd("bob", `{"name":"cp","paths":["/src/big.txt","/box"]}`); res.Code != 413 {
+		t.Errorf("cp larger than the quota: got %+v", res)
+	}
+	if res := cmd("bob", `{"name":"mv","paths":["/src/small.txt","/box"]}`); res.Error != "" {
+		t.Errorf("mv into box: got %+v", res)
+	}
+	scan()
+	if res := cmd("bob", `{"name":"cp","paths":["/box/b.txt","/box/d.txt"]}`); res.Code != 507 {
+		t.Errorf("cp within the full box: got %+v", res)
+	}
+
+	// carol may own 6 bytes
+	if code := upload(s, "carol", "/free", "c1.txt"); code != 200 {
+		t.Fatalf("upload c1.txt: got %d", code)
+	}
+	scan()
+	if code := upload(s, "carol", "/free", "c2.txt"); code != 507 {
+		t.Errorf("upload over the user quota: got %d, want 507", code)
+	}
+	r := httptest.NewRequest("GET", "/-/quota?path=/box", nil)
+	r = withIdentity(r, &Identity{Username: "carol", Provider: "static"})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	report := quotaReport{}
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	want := quotaUsage{Kind: "user", Name: "carol", Bytes: 4, Files: 1, MaxBytes: 6}
+	if report.User != want {
+		t.Errorf("user: got %+v, want %+v", report.User, want)
+	}
+	if len(report.Quotas) != 1 || report.Quotas[0].Name != "/box" || report.Quotas[0].Files != 4 || report.Quotas[0].MaxBytes != 1024 {
+		t.Errorf("quotas: got %+v", report.Quotas)
+	}
+	if code := permRequest(s, "bob", "GET", "/-/quota?user=carol", nil, ""); code != 403 {
+		t.Errorf("quota of another user: got %d, want 403", code)
+	}
+
+	// WebDAV needs the length of a PUT, copies stop at the quota
+	dav := func(method, target, body string, length int64, header ...string) int {
+		r := httptest.NewRequest(method, webdavPrefix+target, strings.NewReader(body))
+		r.ContentLength = length
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		r = withIdentity(r, &Identity{Username: "bob", Provider: "static"})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := dav("PUT", "/dav/a.txt", strings.Repeat("a", 2000), 2000); code != 413 {
+		t.Errorf("webdav put larger than the quota: got %d, want 413", code)
+	}
+	if code := dav("PUT", "/dav/a.txt", "aaaaa", -1); code != 411 {
+		t.Errorf("webdav put of unknown length: got %d, want 411", code)
+	}
+	if code := dav("PUT", "/dav/a.txt", "aaaaa", 5); code != 201 {
+		t.Errorf("webdav put: got %d, want 201", code)
+	}
+	if code := dav("COPY", "/src/big.txt", "", 0, "Destination", "http://example.com"+webdavPrefix+"/dav/big.txt"); code != 413 {
+		t.Errorf("webdav copy larger than the quota: got %d, want 413", code)
+	}
+	if _, err := s.storage.Stat("dav/big.txt"); err == nil {
+		t.Error("webdav copy over the quota kept")
+	}
+	// an overwritten destination stays when the copy does not fit
+	if code := dav("COPY", "/src/big.txt", "", 0, "Destination", "http://example.com"+webdavPrefix+"/dav/a.txt", "Overwrite", "T"); code != 413 {
+		t.Errorf("webdav copy over a file larger than the quota: got %d, want 413", code)
+	}
+	if info, err := s.storage.Stat("dav/a.txt"); err != nil || info.Size() != 5 {
+		t.Errorf("webdav copy over the quota replaced the destination: %v", err)
+	}
+	if code := dav("COPY", "/dav/a.txt", "", 0, "Destination", "http://example.com"+webdavPrefix+"/dav/b.txt"); code != 201 {
+		t.Errorf("webdav copy: got %d, want 201", code)
+	}
+	if code := dav("MOVE", "/src/big.txt", "", 0, "Destination", "http://example.com"+webdavPrefix+"/dav/big.txt"); code != 413 {
+		t.Errorf("webdav move larger than the quota: got %d, want 413", code)
+	}
+	if _, err := s.storage.Stat("src/big.txt"); err != nil {
+		t.Errorf("webdav move over the quota: %v", err)
+	}
+	if _, err := s.storage.Stat("dav/big.txt"); err == nil {
+		t.Error("webdav move over the quota kept")
+	}
+
+	if _, err := parseAccessConf(AccessConf{}, []byte("quota:\n  bytes: lots\n")); err == nil {
+		t.Error("bad quota accepted")
+	}
+}
+
+func TestQuotaReservations(t *testing.T) {
+	s := permServer(t, map[string]string{
+		"box/.ghs.yml":  "perms: [read, list, write]\nquota:\n  files: 3\n",
+		"par/.ghs.yml":  "perms: [read, list, write]\nquota:\n  files: 3\n",
+		"free/.ghs.yml": "perms: [read, list, write]\n",
+	})
+	users := newMemUserStore()
+	s.users = users
+	users.AddUser(&admin.User{Username: "carol", Status: 1, Quotabytes: 6})
+
+	// the usage is not known before the first scan
+	if code := upload(s, "bob", "/box", "a.txt"); code != 503 {
+		t.Errorf("upload before the scan: got %d, want 503", code)
+	}
+	if code := upload(s, "bob", "/free", "a.txt"); code != 200 {
+		t.Errorf("upload without a quota before the scan: got %d, want 200", code)
+	}
+	if err := s.Index.scan(s.storage, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// writes count at once, without waiting for the index
+	for name, want := range map[string]int{"a.txt": 200, "b.txt": 200} {
+		if code := upload(s, "bob", "/box", name); code != want {
+			t.Errorf("upload %s: got %d, want %d", name, code, want)
+		}
+	}
+	if code := upload(s, "bob", "/box", "c.txt"); code != 507 {
+		t.Errorf("upload over the quota: got %d, want 507", code)
+	}
+	if code := upload(s, "carol", "/free", "c1.txt"); code != 200 {
+		t.Errorf("upload c1.txt: got %d", code)
+	}
+	if code := upload(s, "carol", "/free", "c2.txt"); code != 507 {
+		t.Errorf("upload over the user quota: got %d, want 507", code)
+	}
+
+	// concurrent uploads do not overfill the quota
+	var wg sync.WaitGroup
+	codes := make(chan int, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes <- upload(s, "bob", "/par", fmt.Sprintf("%d.txt", i))
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+	stored := 0
+	for code := range codes {
+		if code == 200 {
+			stored++
+		}
+	}
+	if stored != 2 {
+		t.Errorf("concurrent uploads: %d stored, want 2", stored)
+	}
+	if s.reserved.pending != nil && len(s.reserved.pending) != 0 {
+		t.Errorf("reservations left: %v", s.reserved.pending)
+	}
+}
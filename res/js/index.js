@@ -28,6 +28,15 @@ var vm = new Vue({
       email: "",
       name: "",
     },
+    me: null,
+    logins: [],
+    passwd: {
+      old: "",
+      new: "",
+      again: "",
+      message: "",
+      ok: false,
+    },
     location: window.location,
     breadcrumb: [],
     showHidden: false,
@@ -109,6 +118,9 @@ var vm = new Vue({
         }
       }.bind(this)
     })
+    $.getJSON("/-/me", function(ret) {
+      this.me = ret;
+    }.bind(this))
     this.myDropzone = new Dropzone("#upload-form", {
       paramName: "file",
       maxFilesize: 10240,
@@ -132,6 +144,40 @@ var vm = new Vue({
       }
       return m.format('YYYY-MM-DD HH:mm:ss');
     },
+    showAccount: function() {
+      this.passwd.message = "";
+      if (this.me.user) {
+        $.getJSON("/-/me/logins?limit=10", function(ret) {
+          this.logins = ret;
+        }.bind(this))
+      }
+      $("#account-modal").modal("show");
+    },
+    changePassword: function() {
+      var passwd = this.passwd;
+      passwd.ok = false;
+      if (passwd.new !== passwd.again) {
+        passwd.message = "The new passwords differ";
+        return;
+      }
+      $.ajax({
+        url: "/-/me/passwd",
+        method: "POST",
+        contentType: "application/json",
+        data: JSON.stringify({
+          oldPassword: passwd.old,
+          password: passwd.new,
+        }),
+        success: function() {
+          passwd.old = passwd.new = passwd.again = "";
+          passwd.message = "Password changed";
+          passwd.ok = true;
+        },
+        error: function(err) {
+          passwd.message = err.responseText;
+        }
+      });
+    },
     toggleHidden: function() {
       this.showHidden = !this.showHidden;
     },
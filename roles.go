@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"grapehttp/config"
+	"grapehttp/models/admin"
+)
+
+// roleCache remembers the roles of users for a while, like groupCache
+type roleCache struct {
+	lookup func(source, username string) (string, error)
+
+	mu      sync.Mutex
+	entries map[string]roleCacheEntry
+}
+
+type roleCacheEntry struct {
+	role    string
+	expires time.Time
+}
+
+const roleCacheTTL = 30 * time.Second
+
+func newRoleCache(lookup func(source, username string) (string, error)) *roleCache {
+	return &roleCache{lookup: lookup, entries: make(map[string]roleCacheEntry)}
+}
+
+// userRoles resolves the roles for isAdmin and canAudit
+var userRoles = newRoleCache(newRoleLookup(config.Configure{}, nil))
+
+// role returns the role of username of source, none if it can not be
+// looked up
+func (c *roleCache) role(source, username string) string {
+	if username == "" {
+		return ""
+	}
+	key := userKey(source, username)
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.role
+	}
+	role, err := c.lookup(source, username)
+	if err != nil {
+		log.Printf("role of %s: %v", key, err)
+		return ""
+	}
+	c.mu.Lock()
+	c.entries[key] = roleCacheEntry{role, now.Add(roleCacheTTL)}
+	c.mu.Unlock()
+	return role
+}
+
+// reset forgets all roles, after users were changed
+func (c *roleCache) reset() {
+	c.mu.Lock()
+	c.entries = make(map[string]roleCacheEntry)
+	c.mu.Unlock()
+}
+
+// newRoleLookup returns where the roles of users are found: auth.admins and
+// auth.auditors of the configuration, named like userKey, then the role of
+// the user store. With simpleauth admin_username is an admin too. Users of
+// other sources only have the roles of the configuration.
+func newRoleLookup(gcfg config.Configure, users UserStore) func(source, username string) (string, error) {
+	static := map[string]string{}
+	if users == nil {
+		static[gcfg.AdminName()] = admin.RoleAdmin
+	}
+	for _, username := range gcfg.Auth.Auditors {
+		static[username] = admin.RoleAuditor
+	}
+	for _, username := range gcfg.Auth.Admins {
+		static[username] = admin.RoleAdmin
+	}
+	return func(source, username string) (string, error) {
+		if role, ok := static[userKey(source, username)]; ok {
+			return role, nil
+		}
+		if users == nil || source != "" {
+			return "", nil
+		}
+		u, err := users.ActiveUser(username)
+		if err != nil {
+			// not a user of the store, or a disabled one
+			return "", nil
+		}
+		return u.Role, nil
+	}
+}
+
+// lastAdmin reports whether username is the only admin left, who must not
+// be demoted, disabled or deleted
+func (s *HTTPStaticServer) lastAdmin(username string) (bool, error) {
+	if userRoles.role("", username) != admin.RoleAdmin {
+		return false, nil
+	}
+	if len(config.Gcfg.Auth.Admins) > 0 {
+		return false, nil
+	}
+	users, err := s.users.SearchUsers("")
+	if err != nil {
+		return false, err
+	}
+	for _, u := range users {
+		if u.Role == admin.RoleAdmin && u.Status == 1 && u.Username != username {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func isAdmin(r *http.Request) bool {
+	id := identityOf(r)
+	return userRoles.role(id.source(), getUser(r)) == admin.RoleAdmin && id.allows(scopeAdmin, "")
+}
+
+// canAudit reports whether the user of r may read what admins can: the
+// users, groups and audit log. Admins and auditors may.
+func canAudit(r *http.Request) bool {
+	if isAdmin(r) {
+		return true
+	}
+	id := identityOf(r)
+	return userRoles.role(id.source(), getUser(r)) == admin.RoleAuditor && id.allows(scopeRead, "")
+}
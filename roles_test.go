@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"grapehttp/config"
+	"grapehttp/models/admin"
+)
+
+func TestRoles(t *testing.T) {
+	saved := userRoles
+	defer func() { userRoles = saved }()
+
+	s := permServer(t, map[string]string{
+		"secret/.ghs.yml": "perms: []\n",
+		"secret/a.txt":    "a",
+	})
+	users := newMemUserStore()
+	s.users = users
+	for _, u := range []admin.User{
+		{Username: "alice", Nickname: "Alice", Role: admin.RoleAdmin, Status: 1},
+		{Username: "carol", Nickname: "Carol", Role: admin.RoleAuditor, Status: 1},
+		{Username: "bob", Nickname: "Bob", Status: 1},
+		{Username: "admin", Nickname: "Admin", Status: 1},
+	} {
+		u := u
+		users.AddUser(&u)
+	}
+	gcfg := config.Configure{}
+	gcfg.Auth.Admins = []string{"boss"}
+	userRoles = newRoleCache(newRoleLookup(gcfg, users))
+
+	tests := []struct {
+		user, method, target string
+		body                 string
+		want                 int
+	}{
+		// the name admin means nothing with a user store
+		{"admin", "POST", "/-/user/list", `{"limit":10}`, 403},
+		{"alice", "POST", "/-/user/list", `{"limit":10}`, 200},
+		{"boss", "POST", "/-/user/list", `{"limit":10}`, 200},
+		{"carol", "POST", "/-/user/list", `{"limit":10}`, 200},
+		{"carol", "GET", "/-/audit", "", 200},
+		{"carol", "GET", "/secret/a.txt", "", 200},
+		{"carol", "POST", "/-/user/add", `{"username":"dave","password":"dave-secret"}`, 403},
+		{"carol", "DELETE", "/secret/a.txt", "", 403},
+		{"bob", "POST", "/-/user/list", `{"limit":10}`, 403},
+		{"bob", "GET", "/secret/a.txt", "", 403},
+		{"alice", "POST", "/-/user/modify", `{"username":"bob","role":"root"}`, 400},
+	}
+	for _, tt := range tests {
+		if code := permRequest(s, tt.user, tt.method, tt.target, []byte(tt.body), ""); code != tt.want {
+			t.Errorf("%s %s %s: got %d, want %d", tt.user, tt.method, tt.target, code, tt.want)
+		}
+	}
+
+	// boss of the configuration keeps alice from being the only admin
+	userRoles = newRoleCache(newRoleLookup(config.Configure{}, users))
+	if code := permRequest(s, "alice", "POST", "/-/user/modify", []byte(`{"username":"alice","role":"user"}`), ""); code != 400 {
+		t.Errorf("demote the only admin: got %d, want 400", code)
+	}
+	if code := permRequest(s, "alice", "POST", "/-/user/del", []byte(`{"usernames":["alice"]}`), ""); code != 400 {
+		t.Errorf("delete the only admin: got %d, want 400", code)
+	}
+	if code := permRequest(s, "alice", "POST", "/-/user/modify", []byte(`{"username":"bob","role":"admin"}`), ""); code != 200 {
+		t.Fatalf("promote bob: got %d", code)
+	}
+	if code := permRequest(s, "bob", "POST", "/-/user/modify", []byte(`{"username":"alice","role":"user","email":"a@example.org"}`), ""); code != 200 {
+		t.Fatalf("demote alice: got %d", code)
+	}
+	if u, _ := users.User("alice"); u.Role != "" || u.Email != "a@example.org" {
+		t.Errorf("alice: got %+v", u)
+	}
+	if code := permRequest(s, "alice", "POST", "/-/user/list", []byte(`{"limit":10}`), ""); code != 403 {
+		t.Errorf("demoted alice: got %d, want 403", code)
+	}
+	// a role which is not given keeps the role
+	permRequest(s, "bob", "POST", "/-/user/modify", []byte(`{"username":"bob","remark":"boss"}`), "")
+	if u, _ := users.User("bob"); u.Role != admin.RoleAdmin {
+		t.Errorf("bob lost the role: %+v", u)
+	}
+
+	// users of other providers, and their tokens, are no local users
+	gcfg.Auth.Auditors = []string{"ldap:carol"}
+	userRoles = newRoleCache(newRoleLookup(gcfg, users))
+	for _, v := range []struct {
+		id   *Identity
+		role string
+	}{
+		{&Identity{Username: "bob", Provider: "db"}, admin.RoleAdmin},
+		{&Identity{Username: "bob", Provider: "token"}, admin.RoleAdmin},
+		{&Identity{Username: "bob", Provider: "oidc"}, ""},
+		{&Identity{Username: "bob", Provider: "ldap"}, ""},
+		{&Identity{Username: "bob", Provider: "token", Source: "oidc"}, ""},
+		{&Identity{Username: "carol", Provider: "ldap"}, admin.RoleAuditor},
+		{&Identity{Username: "carol", Provider: "token", Source: "ldap"}, admin.RoleAuditor},
+	} {
+		if got := userRoles.role(v.id.source(), v.id.Username); got != v.role {
+			t.Errorf("%+v: got role %q, want %q", v.id, got, v.role)
+		}
+	}
+	r := withIdentity(httptest.NewRequest("GET", "/", nil), &Identity{Username: "bob", Provider: "oidc"})
+	if isAdmin(r) || canAudit(r) {
+		t.Error("an oidc user named like an admin of the user store is an admin")
+	}
+
+	// the admin of simpleauth
+	userRoles = newRoleCache(newRoleLookup(config.Configure{AdminUsername: "root"}, nil))
+	if !isAdmin(withIdentity(httptest.NewRequest("GET", "/", nil), &Identity{Username: "root", Provider: "static"})) {
+		t.Error("admin_username is no admin with simpleauth")
+	}
+	if isAdmin(withIdentity(httptest.NewRequest("GET", "/", nil), &Identity{Username: "root", Provider: "token", Scopes: []string{"read"}})) {
+		t.Error("admin with a read token")
+	}
+}
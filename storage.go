@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage is where HTTPStaticServer keeps its files. Names are slash
+// separated and relative to the storage root, "" is the root itself. Errors
+// for missing files satisfy os.IsNotExist.
+type Storage interface {
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir returns the directory entries sorted by name
+	ReadDir(name string) ([]os.FileInfo, error)
+	// Open returns a seekable reader, so files can be served in ranges
+	Open(name string) (File, error)
+	// Create creates or truncates a file, its content is visible after Close
+	Create(name string) (io.WriteCloser, error)
+	Mkdir(name string) error
+	MkdirAll(name string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldname, newname string) error
+}
+
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+var errRemoveRoot = errors.New("refusing to remove root directory")
+
+// cleanName turns a request path into a storage name
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+// walkStorage works like filepath.Walk on a Storage. Names passed to fn are
+// storage names, filepath.SkipDir is honoured.
+func walkStorage(st Storage, name string, fn filepath.WalkFunc) error {
+	name = cleanName(name)
+	info, err := st.Stat(name)
+	if err != nil {
+		err = fn(name, nil, err)
+	} else {
+		err = walkStorageDir(st, name, info, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkStorageDir(st Storage, name string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(name, info, nil)
+	}
+	infos, err := st.ReadDir(name)
+	err1 := fn(name, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+	for _, info := range infos {
+		err := walkStorageDir(st, path.Join(name, info.Name()), info, fn)
+		if err != nil {
+			if !info.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LocalStorage keeps files in a directory of the local filesystem
+type LocalStorage struct {
+	Root string
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{Root: root}
+}
+
+// LocalPath maps a name onto the local filesystem and makes sure that the
+// result, after following any symlinks, is still under Root. The path itself
+// does not need to exist, its nearest existing ancestor is checked instead.
+func (l *LocalStorage) LocalPath(name string) (string, error) {
+	root, err := filepath.EvalSymlinks(filepath.Clean(l.Root))
+	if err != nil {
+		return "", err
+	}
+	root, _ = filepath.Abs(root)
+
+	localPath := filepath.Join(root, filepath.FromSlash(filepath.Clean("/"+name)))
+	existing, rest := localPath, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	if !withinDir(root, real) {
+		return "", errOutsideRoot
+	}
+	return filepath.Join(real, rest), nil
+}
+
+// linkPath is LocalPath for the entry name itself: only its directory is
+// resolved, so a symlink is removed or renamed instead of what it points to
+func (l *LocalStorage) linkPath(name string) (string, error) {
+	name = cleanName(name)
+	if name == "" {
+		return l.LocalPath("")
+	}
+	dir, err := l.LocalPath(path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path.Base(name)), nil
+}
+
+func (l *LocalStorage) Stat(name string) (os.FileInfo, error) {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+// Lstat is Stat without following a symlink name
+func (l *LocalStorage) Lstat(name string) (os.FileInfo, error) {
+	p, err := l.linkPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(p)
+}
+
+func (l *LocalStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadDir(p)
+}
+
+func (l *LocalStorage) Open(name string) (File, error) {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (l *LocalStorage) Create(name string) (io.WriteCloser, error) {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(p)
+}
+
+func (l *LocalStorage) Mkdir(name string) error {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, 0755)
+}
+
+func (l *LocalStorage) MkdirAll(name string) error {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, 0755)
+}
+
+func (l *LocalStorage) Remove(name string) error {
+	p, err := l.linkPath(name)
+	if err != nil {
+		return err
+	}
+	if root, _ := l.LocalPath(""); p == root {
+		return errRemoveRoot
+	}
+	return os.Remove(p)
+}
+
+func (l *LocalStorage) RemoveAll(name string) error {
+	p, err := l.linkPath(name)
+	if err != nil {
+		return err
+	}
+	if root, _ := l.LocalPath(""); p == root {
+		return errRemoveRoot
+	}
+	return os.RemoveAll(p)
+}
+
+func (l *LocalStorage) Rename(oldname, newname string) error {
+	oldpath, err := l.linkPath(oldname)
+	if err != nil {
+		return err
+	}
+	newpath, err := l.linkPath(newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+func (l *LocalStorage) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := l.LocalPath(name)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, atime, mtime)
+}
+
+// lstatStorage is Stat of st, which does not follow a symlink name if st
+// has symlinks
+func lstatStorage(st Storage, name string) (os.FileInfo, error) {
+	if l, ok := st.(interface {
+		Lstat(name string) (os.FileInfo, error)
+	}); ok {
+		return l.Lstat(name)
+	}
+	return st.Stat(name)
+}
+
+// copyStorageFile copies a file within a Storage.
+func copyStorageFile(st Storage, src, dst string) error {
+	in, err := st.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := st.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// sortInfos sorts directory entries by name, like ioutil.ReadDir
+func sortInfos(infos []os.FileInfo) {
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	emptyPayloadHash    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	unsignedPayloadHash = "UNSIGNED-PAYLOAD"
+	amzDateFormat       = "20060102T150405Z"
+)
+
+// S3Storage keeps files in a bucket of an S3 compatible object store, like
+// AWS S3 or MinIO. Directories are key prefixes, empty directories are kept
+// as zero sized objects ending with "/". Requests use path style urls and
+// are signed with AWS signature version 4.
+type S3Storage struct {
+	Endpoint  *url.URL
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Prefix    string // all keys are stored below this prefix
+	Client    *http.Client
+}
+
+func NewS3Storage(endpoint, bucket, region, accessKey, secretKey, prefix string) (*S3Storage, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is required")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Storage{
+		Endpoint:  u,
+		Bucket:    bucket,
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Prefix:    cleanName(prefix),
+		Client:    http.DefaultClient,
+	}, nil
+}
+
+func (s *S3Storage) key(name string) string {
+	return strings.TrimPrefix(path.Join(s.Prefix, cleanName(name)), "/")
+}
+
+// dirKey is the prefix of all keys in a directory
+func (s *S3Storage) dirKey(name string) string {
+	if k := s.key(name); k != "" {
+		return k + "/"
+	}
+	return ""
+}
+
+// s3Error is the error document returned by the server
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: %s", http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+func (s *S3Storage) request(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := *s.Endpoint
+	u.Path = "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		payloadHash = unsignedPayloadHash
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	signV4(req, payloadHash, s.AccessKey, s.SecretKey, s.Region, time.Now())
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		e := &s3Error{StatusCode: resp.StatusCode}
+		data, _ := ioutil.ReadAll(resp.Body)
+		xml.Unmarshal(data, e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// do runs a request without a body of interest and maps missing keys onto
+// os.ErrNotExist.
+func (s *S3Storage) do(op, name, method, key string, query url.Values, header http.Header) (*http.Response, error) {
+	resp, err := s.request(method, key, query, header, nil, 0)
+	if e, ok := err.(*s3Error); ok && e.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return resp, err
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// list calls fn for every page of ListObjectsV2 below prefix, until fn
+// returns false.
+func (s *S3Storage) list(prefix, delimiter string, maxKeys int, fn func(*s3ListResult) bool) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	for {
+		resp, err := s.request("GET", "", query, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		result := &s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if !fn(result) || !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// listKeys returns all keys below prefix
+func (s *S3Storage) listKeys(prefix string) ([]string, error) {
+	keys := []string{}
+	err := s.list(prefix, "", 0, func(r *s3ListResult) bool {
+		for _, c := range r.Contents {
+			keys = append(keys, c.Key)
+		}
+		return true
+	})
+	return keys, err
+}
+
+type s3FileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	dir   bool
+}
+
+func (fi *s3FileInfo) Name() string       { return fi.name }
+func (fi *s3FileInfo) Size() int64        { return fi.size }
+func (fi *s3FileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *s3FileInfo) IsDir() bool        { return fi.dir }
+func (fi *s3FileInfo) Sys() interface{}   { return nil }
+func (fi *s3FileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (s *S3Storage) Stat(name string) (os.FileInfo, error) {
+	name = cleanName(name)
+	base := path.Base("/" + name)
+	if name == "" {
+		return &s3FileInfo{name: base, dir: true}, nil
+	}
+	resp, err := s.do("stat", name, "HEAD", s.key(name), nil, nil)
+	if err == nil {
+		resp.Body.Close()
+		mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return &s3FileInfo{name: base, size: resp.ContentLength, mtime: mtime}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// no such object, maybe a directory
+	var dir *s3FileInfo
+	err = s.list(s.dirKey(name), "", 1, func(r *s3ListResult) bool {
+		if len(r.Contents) > 0 {
+			dir = &s3FileInfo{name: base, mtime: r.Contents[0].LastModified, dir: true}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dir == nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return dir, nil
+}
+
+func (s *S3Storage) ReadDir(name string) ([]os.FileInfo, error) {
+	name = cleanName(name)
+	prefix := s.dirKey(name)
+	infos := []os.FileInfo{}
+	found := false
+	err := s.list(prefix, "/", 0, func(r *s3ListResult) bool {
+		for _, c := range r.Contents {
+			found = true
+			if c.Key == prefix {
+				// directory marker
+				continue
+			}
+			infos = append(infos, &s3FileInfo{name: strings.TrimPrefix(c.Key, prefix), size: c.Size, mtime: c.LastModified})
+		}
+		for _, p := range r.CommonPrefixes {
+			found = true
+			infos = append(infos, &s3FileInfo{name: strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"), dir: true})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found && name != "" {
+		info, err := s.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+		}
+	}
+	sortInfos(infos)
+	return infos, nil
+}
+
+// s3File reads an object with ranged GET requests, starting at the current
+// offset on the first Read after a Seek.
+type s3File struct {
+	s      *S3Storage
+	key    string
+	info   *s3FileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (s *S3Storage) Open(name string) (File, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{s: s, key: s.key(name), info: info.(*s3FileInfo)}, nil
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.info.dir {
+		return 0, &os.PathError{Op: "read", Path: f.key, Err: syscall.EISDIR}
+	}
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", f.offset)}}
+		resp, err := f.s.request("GET", f.key, nil, header, nil, 0)
+		if err != nil {
+			return 0, err
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	if err == io.EOF && f.offset < f.info.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p)) - 1
+	if end >= f.info.size {
+		end = f.info.size - 1
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, end)}}
+	resp, err := f.s.request("GET", f.key, nil, header, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.ReadFull(resp.Body, p[:end-off+1])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek %s: negative position", f.key)
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// s3Writer buffers the content in a temporary file, S3 needs the size of an
+// object before it can be uploaded.
+type s3Writer struct {
+	*os.File
+	s   *S3Storage
+	key string
+}
+
+func (s *S3Storage) Create(name string) (io.WriteCloser, error) {
+	tmp, err := ioutil.TempFile("", "ghs-s3-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{File: tmp, s: s, key: s.key(name)}, nil
+}
+
+func (w *s3Writer) Close() error {
+	defer os.Remove(w.File.Name())
+	defer w.File.Close()
+	size, err := w.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := w.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := http.Header{}
+	if ctype := mime.TypeByExtension(path.Ext(w.key)); ctype != "" {
+		header.Set("Content-Type", ctype)
+	}
+	resp, err := w.s.request("PUT", w.key, nil, header, w.File, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) putMarker(name string) error {
+	resp, err := s.request("PUT", s.dirKey(name), nil, nil, http.NoBody, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Mkdir(name string) error {
+	name = cleanName(name)
+	if _, err := s.Stat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	parent, err := s.Stat(path.Dir(name))
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
+	}
+	if !parent.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	return s.putMarker(name)
+}
+
+func (s *S3Storage) MkdirAll(name string) error {
+	name = cleanName(name)
+	info, err := s.Stat(name)
+	if err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if info, err := s.Stat(dir); err == nil && !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+	}
+	return s.putMarker(name)
+}
+
+func (s *S3Storage) deleteKey(key string) error {
+	resp, err := s.request("DELETE", key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Remove(name string) error {
+	name = cleanName(name)
+	if name == "" {
+		return errRemoveRoot
+	}
+	info, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return s.deleteKey(s.key(name))
+	}
+	prefix := s.dirKey(name)
+	empty := true
+	err = s.list(prefix, "", 2, func(r *s3ListResult) bool {
+		for _, c := range r.Contents {
+			if c.Key != prefix {
+				empty = false
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	return s.deleteKey(prefix)
+}
+
+func (s *S3Storage) RemoveAll(name string) error {
+	name = cleanName(name)
+	if name == "" {
+		return errRemoveRoot
+	}
+	keys, err := s.listKeys(s.dirKey(name))
+	if err != nil {
+		return err
+	}
+	for _, key := range append(keys, s.key(name)) {
+		if err := s.deleteKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3Storage) copyKey(src, dst string) error {
+	source := "/" + s.Bucket + "/" + uriEncode(src, false)
+	resp, err := s.request("PUT", dst, nil, http.Header{"X-Amz-Copy-Source": {source}}, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Rename copies every object to its new key and deletes the old one, it is
+// not atomic.
+func (s *S3Storage) Rename(oldname, newname string) error {
+	info, err := s.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if err := s.copyKey(s.key(oldname), s.key(newname)); err != nil {
+			return err
+		}
+		return s.deleteKey(s.key(oldname))
+	}
+	if cleanName(oldname) == "" {
+		return fmt.Errorf("rename: can not move root directory")
+	}
+	oldPrefix, newPrefix := s.dirKey(oldname), s.dirKey(newname)
+	keys, err := s.listKeys(oldPrefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.copyKey(key, newPrefix+strings.TrimPrefix(key, oldPrefix)); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		if err := s.deleteKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uriEncode escapes everything but unreserved characters, as required for
+// canonical requests. Slashes are kept unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signV4 adds an AWS signature version 4 Authorization header to req. All
+// headers set on req are signed.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region string, t time.Time) {
+	amzDate := t.UTC().Format(amzDateFormat)
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
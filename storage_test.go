@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalPath(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ghs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	tmp, _ = filepath.EvalSymlinks(tmp)
+
+	root := filepath.Join(tmp, "root")
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	os.MkdirAll(filepath.Join(tmp, "outside"), 0755)
+	os.Symlink(filepath.Join(tmp, "outside"), filepath.Join(root, "escape"))
+	os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "inside"))
+
+	l := &LocalStorage{Root: root + "/"}
+	tests := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{"/", root, true},
+		{"sub", filepath.Join(root, "sub"), true},
+		{"/sub/new/file", filepath.Join(root, "sub/new/file"), true},
+		{"../outside", filepath.Join(root, "outside"), true},
+		{"/sub/../../outside", filepath.Join(root, "outside"), true},
+		{"/inside/file", filepath.Join(root, "sub/file"), true},
+		{"/escape", "", false},
+		{"/escape/new", "", false},
+	}
+	for _, v := range tests {
+		got, err := l.LocalPath(v.path)
+		if (err == nil) != v.ok {
+			t.Fatalf("LocalPath(%q) error: %v", v.path, err)
+		}
+		if v.ok && got != v.want {
+			t.Fatalf("LocalPath(%q) = %q, want %q", v.path, got, v.want)
+		}
+	}
+}
+
+func TestLocalStorageLinks(t *testing.T) {
+	s := permServer(t, map[string]string{
+		"data/a.txt":   "a",
+		"data/d/b.txt": "b",
+	})
+	root := s.Root
+	os.Symlink(filepath.Join(root, "data", "a.txt"), filepath.Join(root, "file-link"))
+	os.Symlink(filepath.Join(root, "data", "d"), filepath.Join(root, "dir-link"))
+	os.Symlink(filepath.Join(root, "data", "a.txt"), filepath.Join(root, "mv-link"))
+	cmd := func(body string) string {
+		r := httptest.NewRequest("POST", "/-/cmd", strings.NewReader(body))
+		r = withIdentity(r, &Identity{Username: "admin", Provider: "static"})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	// rm and mv act on the links, their targets stay
+	if out := cmd(`{"name":"rm","paths":["/file-link"]}`); strings.Contains(out, `"error"`) {
+		t.Fatalf("rm file link: %s", out)
+	}
+	if out := cmd(`{"name":"rm","paths":["/dir-link"]}`); strings.Contains(out, `"error"`) {
+		t.Fatalf("rm directory link: %s", out)
+	}
+	if out := cmd(`{"name":"mv","paths":["/mv-link","/moved-link"]}`); strings.Contains(out, `"error"`) {
+		t.Fatalf("mv link: %s", out)
+	}
+	for _, name := range []string{"file-link", "dir-link", "mv-link"} {
+		if _, err := os.Lstat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("%s: still there, %v", name, err)
+		}
+	}
+	if info, err := os.Lstat(filepath.Join(root, "moved-link")); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("moved-link is no symlink: %v", err)
+	}
+	for _, name := range []string{"data/a.txt", "data/d/b.txt"} {
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Errorf("target %s: %v", name, err)
+		}
+	}
+}
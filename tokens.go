@@ -0,0 +1,409 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes of API tokens. Tokens of other providers are not restricted.
+const (
+	scopeRead   = "read"
+	scopeWrite  = "write"
+	scopeDelete = "delete"
+	scopeAdmin  = "admin" // implies the others
+)
+
+var tokenScopes = []string{scopeRead, scopeWrite, scopeDelete, scopeAdmin}
+
+const (
+	tokenDir      = ".ghs-tokens"
+	tokenFileName = "tokens.json"
+	tokenPrefix   = "ghs_"
+)
+
+// apiToken is a personal access token. Only the sha256 of the secret is
+// kept, the secret itself is shown once when the token is created.
+type apiToken struct {
+	ID       string    `json:"id"`
+	Hash     string    `json:"hash,omitempty"`
+	Username string    `json:"username"`
+	Name     string    `json:"name"`
+	Scopes   []string  `json:"scopes"`
+	Paths    []string  `json:"paths,omitempty"`
+	Source   string    `json:"source,omitempty"` // of the user, see (*Identity).source
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires,omitempty"`
+	LastUsed time.Time `json:"lastUsed,omitempty"`
+}
+
+func (t *apiToken) expired(now time.Time) bool {
+	return !t.Expires.IsZero() && now.After(t.Expires)
+}
+
+// tokenStore keeps the tokens of all users in a JSON file
+type tokenStore struct {
+	file string
+
+	mu     sync.Mutex
+	tokens map[string]*apiToken // by hash
+	saved  time.Time
+}
+
+func newTokenStore(file string) *tokenStore {
+	return &tokenStore{file: file, tokens: make(map[string]*apiToken)}
+}
+
+func (ts *tokenStore) load() error {
+	data, err := ioutil.ReadFile(ts.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var tokens []*apiToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("%s: %v", ts.file, err)
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, t := range tokens {
+		ts.tokens[t.Hash] = t
+	}
+	return nil
+}
+
+// saveLocked writes the tokens to a temporary file which replaces the old one
+func (ts *tokenStore) saveLocked() error {
+	tokens := make([]*apiToken, 0, len(ts.tokens))
+	for _, t := range ts.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ts.file), 0700); err != nil {
+		return err
+	}
+	tmp := ts.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	ts.saved = time.Now()
+	return os.Rename(tmp, ts.file)
+}
+
+func tokenHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes in hex
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// create adds a token and returns it with its secret. The ID is random as
+// well, it tells nothing about the secret.
+func (ts *tokenStore) create(t *apiToken) (string, error) {
+	secret, err := randomHex(24)
+	if err != nil {
+		return "", err
+	}
+	secret = tokenPrefix + secret
+	t.Hash = tokenHash(secret)
+	t.Created = time.Now()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, ok := ts.tokens[t.Hash]; ok {
+		return "", errors.New("duplicate token, try again")
+	}
+	for t.ID = ""; t.ID == "" || ts.hasIDLocked(t.ID); {
+		if t.ID, err = randomHex(8); err != nil {
+			return "", err
+		}
+	}
+	ts.tokens[t.Hash] = t
+	if err := ts.saveLocked(); err != nil {
+		delete(ts.tokens, t.Hash)
+		return "", err
+	}
+	return secret, nil
+}
+
+func (ts *tokenStore) hasIDLocked(id string) bool {
+	for _, t := range ts.tokens {
+		if t.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the unexpired token of secret
+func (ts *tokenStore) lookup(secret string) *apiToken {
+	now := time.Now()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.tokens[tokenHash(secret)]
+	if !ok || t.expired(now) {
+		return nil
+	}
+	// last use is saved at most once a minute
+	t.LastUsed = now
+	if now.Sub(ts.saved) > time.Minute {
+		ts.saveLocked()
+	}
+	c := *t
+	return &c
+}
+
+// list returns the tokens of username, or of all users if it is empty,
+// without their hashes
+func (ts *tokenStore) list(username string) []apiToken {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	out := []apiToken{}
+	for _, t := range ts.tokens {
+		if username == "" || t.Username == username {
+			c := *t
+			c.Hash = ""
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// revoke removes the token id of username, of any user if username is empty
+func (ts *tokenStore) revoke(id, username string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for hash, t := range ts.tokens {
+		if t.ID == id && (username == "" || t.Username == username) {
+			delete(ts.tokens, hash)
+			return ts.saveLocked()
+		}
+	}
+	return os.ErrNotExist
+}
+
+// tokenAuth authenticates requests with "Authorization: Bearer <token>".
+// userActive, if set, refuses the tokens of disabled or deleted users.
+type tokenAuth struct {
+	store      *tokenStore
+	userActive func(username string) bool
+}
+
+func (a *tokenAuth) Authenticate(r *http.Request) (*Identity, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, nil
+	}
+	t := a.store.lookup(strings.TrimSpace(auth[len("Bearer "):]))
+	if t == nil || (a.userActive != nil && !a.userActive(t.Username)) {
+		return nil, errors.New("invalid or expired token")
+	}
+	return &Identity{
+		Username: t.Username,
+		Provider: "token",
+		TokenID:  t.ID,
+		Scopes:   t.Scopes,
+		Paths:    t.Paths,
+		Source:   t.Source,
+	}, nil
+}
+
+// allows reports whether the identity may use scope on the storage name.
+// Only tokens are restricted, and a token with paths only below them, the
+// admin scope too: such a token is no admin of the whole server.
+func (id *Identity) allows(scope, name string) bool {
+	if id == nil || id.Provider != "token" {
+		return true
+	}
+	ok := false
+	for _, s := range id.Scopes {
+		if s == scope || s == scopeAdmin {
+			ok = true
+		}
+	}
+	if !ok || len(id.Paths) == 0 {
+		return ok
+	}
+	name = cleanName(name)
+	for _, p := range id.Paths {
+		p = cleanName(p)
+		if p == "" || name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExpiry reads an expiry given as a duration like 30d or 12h, or as
+// a date like 2024-12-31
+func parseExpiry(s string, now time.Time) (time.Time, error) {
+	if s == "" || s == "never" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	n, unit := 0, ""
+	if _, err := fmt.Sscanf(s, "%d%s", &n, &unit); err == nil && n > 0 {
+		switch unit {
+		case "h":
+			return now.Add(time.Duration(n) * time.Hour), nil
+		case "d":
+			return now.AddDate(0, 0, n), nil
+		case "w":
+			return now.AddDate(0, 0, 7*n), nil
+		case "y":
+			return now.AddDate(n, 0, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad expiry %q, use e.g. 30d, 12h or 2024-12-31", s)
+}
+
+func (s *HTTPStaticServer) hTokenCreate(w http.ResponseWriter, r *http.Request) {
+	id := identityOf(r)
+	// a token can not make a token with more rights than itself
+	if id.Provider == "token" && !id.allows(scopeAdmin, "") {
+		http.Error(w, "tokens can only be created with a password or an admin token", http.StatusForbidden)
+		return
+	}
+	req := struct {
+		Username string   `json:"username"`
+		Name     string   `json:"name"`
+		Scopes   []string `json:"scopes"`
+		Paths    []string `json:"paths"`
+		Expires  string   `json:"expires"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" {
+		req.Username = id.Username
+	}
+	auditOf(r).Target = req.Username
+	if req.Username != id.Username && !isAdmin(r) {
+		http.Error(w, "only admins can create tokens of other users", http.StatusForbidden)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{scopeRead}
+	}
+	for _, scope := range req.Scopes {
+		known := false
+		for _, s := range tokenScopes {
+			known = known || s == scope
+		}
+		if !known {
+			http.Error(w, fmt.Sprintf("unknown scope %q, use %s", scope, strings.Join(tokenScopes, ", ")), http.StatusBadRequest)
+			return
+		}
+		if scope == scopeAdmin && !isAdmin(r) {
+			http.Error(w, "only admins can create admin tokens", http.StatusForbidden)
+			return
+		}
+		if scope == scopeAdmin && len(req.Paths) > 0 {
+			http.Error(w, "admin tokens can not be limited to paths", http.StatusBadRequest)
+			return
+		}
+	}
+	paths := []string{}
+	for _, p := range req.Paths {
+		paths = append(paths, "/"+cleanName(p))
+	}
+	expires, err := parseExpiry(req.Expires, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// admins name the users of the user store
+	source := ""
+	if req.Username == id.Username {
+		source = id.source()
+	}
+	t := &apiToken{Username: req.Username, Name: req.Name, Scopes: req.Scopes, Paths: paths, Source: source, Expires: expires}
+	secret, err := s.tokens.create(t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auditOf(r).Detail = map[string]interface{}{"id": t.ID, "name": t.Name, "scopes": t.Scopes, "paths": t.Paths}
+	c := *t
+	c.Hash = ""
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		apiToken
+		Token string `json:"token"`
+	}{c, secret})
+}
+
+// hTokenList lists the tokens of the user, admins and auditors see those
+// of ?user= or of everybody with ?all=true
+func (s *HTTPStaticServer) hTokenList(w http.ResponseWriter, r *http.Request) {
+	id := identityOf(r)
+	username := id.Username
+	if canAudit(r) {
+		if r.FormValue("all") == "true" {
+			username = ""
+		} else if u := r.FormValue("user"); u != "" {
+			username = u
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(s.tokens.list(username))
+}
+
+func (s *HTTPStaticServer) hTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	id := identityOf(r)
+	req := struct {
+		IDs []string `json:"ids"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	auditOf(r).Detail = map[string]interface{}{"ids": req.IDs}
+	username := id.Username
+	if isAdmin(r) {
+		username = ""
+	}
+	for _, tid := range req.IDs {
+		if err := s.tokens.revoke(tid, username); err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, fmt.Sprintf("token %s not found", tid), http.StatusNotFound)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+	w.Write([]byte("Success\n"))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"grapehttp/config"
+)
+
+func TestTokenStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.json")
+	ts := newTokenStore(file)
+	secret, err := ts.create(&apiToken{Username: "bob", Name: "ci", Scopes: []string{scopeRead}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := ts.create(&apiToken{Username: "bob", Scopes: []string{scopeRead}, Expires: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the secrets are not stored, a new store finds them by hash
+	ts = newTokenStore(file)
+	if err := ts.load(); err != nil {
+		t.Fatal(err)
+	}
+	tok := ts.lookup(secret)
+	if tok == nil || tok.Username != "bob" || tok.Name != "ci" {
+		t.Fatalf("lookup: got %+v", tok)
+	}
+	if ts.lookup(expired) != nil || ts.lookup(secret+"x") != nil {
+		t.Fatal("expired or unknown token accepted")
+	}
+	// the ID is no part of the secret
+	if len(tok.ID) != 16 || strings.Contains(secret, tok.ID) {
+		t.Fatalf("id %s of secret %s", tok.ID, secret)
+	}
+	if list := ts.list("bob"); len(list) != 2 || list[0].Hash != "" {
+		t.Fatalf("list: got %+v", list)
+	}
+	if err := ts.revoke(tok.ID, "alice"); err == nil {
+		t.Fatal("revoked the token of another user")
+	}
+	if err := ts.revoke(tok.ID, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if ts.lookup(secret) != nil {
+		t.Fatal("revoked token accepted")
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	ts := newTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	secret, _ := ts.create(&apiToken{Username: "bob", Scopes: []string{scopeRead}})
+	a := &tokenAuth{store: ts, userActive: func(name string) bool { return name == "bob" }}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if id, err := a.Authenticate(r); id != nil || err != nil {
+		t.Fatalf("no token: got %v %v", id, err)
+	}
+	r.Header.Set("Authorization", "Bearer "+secret)
+	if id, err := a.Authenticate(r); err != nil || id.Username != "bob" || id.Provider != "token" {
+		t.Fatalf("token: got %v %v", id, err)
+	}
+	r.Header.Set("Authorization", "Bearer ghs_0000")
+	if _, err := a.Authenticate(r); err == nil {
+		t.Fatal("bad token accepted")
+	}
+	a.userActive = func(string) bool { return false }
+	r.Header.Set("Authorization", "Bearer "+secret)
+	if _, err := a.Authenticate(r); err == nil {
+		t.Fatal("token of a disabled user accepted")
+	}
+}
+
+func TestIdentityAllows(t *testing.T) {
+	tests := []struct {
+		id    *Identity
+		scope string
+		name  string
+		want  bool
+	}{
+		{nil, scopeDelete, "a", true},
+		{&Identity{Provider: "db"}, scopeAdmin, "", true},
+		{&Identity{Provider: "token", Scopes: []string{scopeRead}}, scopeRead, "a/b", true},
+		{&Identity{Provider: "token", Scopes: []string{scopeRead}}, scopeWrite, "a/b", false},
+		{&Identity{Provider: "token", Scopes: []string{scopeAdmin}}, scopeDelete, "a/b", true},
+		{&Identity{Provider: "token", Scopes: []string{scopeWrite}, Paths: []string{"/ci"}}, scopeWrite, "ci/x", true},
+		{&Identity{Provider: "token", Scopes: []string{scopeWrite}, Paths: []string{"/ci"}}, scopeWrite, "/ci", true},
+		{&Identity{Provider: "token", Scopes: []string{scopeWrite}, Paths: []string{"/ci"}}, scopeWrite, "cid/x", false},
+		{&Identity{Provider: "token", Scopes: []string{scopeWrite}, Paths: []string{"/ci"}}, scopeWrite, "ci/../x", false},
+		{&Identity{Provider: "token", Scopes: []string{scopeAdmin}, Paths: []string{"/ci"}}, scopeAdmin, "ci/x", true},
+		{&Identity{Provider: "token", Scopes: []string{scopeAdmin}, Paths: []string{"/ci"}}, scopeAdmin, "", false},
+		{&Identity{Provider: "token", Scopes: []string{scopeAdmin}, Paths: []string{"/ci"}}, scopeDelete, "x", false},
+	}
+	for _, v := range tests {
+		if got := v.id.allows(v.scope, v.name); got != v.want {
+			t.Errorf("%+v allows(%s, %s): got %v, want %v", v.id, v.scope, v.name, got, v.want)
+		}
+	}
+}
+
+func TestTokenCreateAdminPaths(t *testing.T) {
+	saved := userRoles
+	defer func() { userRoles = saved }()
+	userRoles = newRoleCache(newRoleLookup(config.Configure{AdminUsername: "root"}, nil))
+
+	s := permServer(t, nil)
+	body := []byte(`{"name":"ci","scopes":["admin"],"paths":["/ci"]}`)
+	if code := permRequest(s, "root", "POST", "/-/token/create", body, ""); code != 400 {
+		t.Errorf("admin token limited to paths: got %d, want 400", code)
+	}
+	// tokens saved before are no admins of the server either
+	id := &Identity{Username: "root", Provider: "token", Scopes: []string{scopeAdmin}, Paths: []string{"/ci"}}
+	r := withIdentity(httptest.NewRequest("GET", "/", nil), id)
+	if isAdmin(r) {
+		t.Error("admin with a token limited to /ci")
+	}
+	if p := id.tokenPerms("other/a.txt"); p != 0 {
+		t.Errorf("perms outside of /ci: got %v", p.names())
+	}
+}
+
+func TestTokenCreateSource(t *testing.T) {
+	s := permServer(t, nil)
+	create := func(id *Identity) apiToken {
+		r := httptest.NewRequest("POST", "/-/token/create", strings.NewReader(`{"name":"ci"}`))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, withIdentity(r, id))
+		if w.Code != 200 {
+			t.Fatalf("create by %+v: got %d %s", id, w.Code, w.Body)
+		}
+		tokens := s.tokens.list(id.Username)
+		return tokens[len(tokens)-1]
+	}
+	// a token of an oidc user does not act for the local user of that name
+	if tk := create(&Identity{Username: "bob", Provider: "oidc"}); tk.Source != "oidc" {
+		t.Errorf("token of an oidc user: got source %q", tk.Source)
+	}
+	if tk := create(&Identity{Username: "carol", Provider: "db"}); tk.Source != "" {
+		t.Errorf("token of a local user: got source %q", tk.Source)
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		s    string
+		want time.Time
+	}{
+		{"", time.Time{}},
+		{"never", time.Time{}},
+		{"12h", now.Add(12 * time.Hour)},
+		{"30d", now.AddDate(0, 0, 30)},
+		{"2w", now.AddDate(0, 0, 14)},
+		{"1y", now.AddDate(1, 0, 0)},
+		{"2024-03-01T00:00:00Z", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, v := range tests {
+		got, err := parseExpiry(v.s, now)
+		if err != nil || !got.Equal(v.want) {
+			t.Errorf("%q: got %v %v, want %v", v.s, got, err, v.want)
+		}
+	}
+	for _, s := range []string{"30", "-1d", "3m", "soon"} {
+		if _, err := parseExpiry(s, now); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
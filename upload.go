@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"grapehttp/models"
+
+	"github.com/gorilla/mux"
+)
+
+// Resumable upload protocol:
+//
+//   POST   /-/upload       create an upload, body: {"path","name","size","mtime","key","resume"}
+//   HEAD   /-/upload/{id}  current offset in the Upload-Offset header
+//   GET    /-/upload/{id}  upload state as json
+//   PATCH  /-/upload/{id}  append the body at Upload-Offset
+//   POST   /-/upload/{id}  finish, the staged file is renamed to its destination
+//   DELETE /-/upload/{id}  abort and remove the staged file
+//
+// Partial files are staged in uploadStageDir under Root, which is hidden from
+// listings, search and downloads. With other storages than LocalStorage they
+// are staged in a temporary directory and copied into the storage at the end.
+const (
+	uploadStageDir     = ".ghs-uploads"
+	uploadOffsetHeader = "Upload-Offset"
+	uploadStaleAfter   = 7 * 24 * time.Hour
+)
+
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{16,64}$`)
+
+type stagedUpload struct {
+	ID       string `json:"id"`
+	Path     string `json:"path"` // destination directory, relative to Root
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+	ModTime  int64  `json:"mtime"` // of the source file in ms, kept on the destination
+	Username string `json:"username"`
+	Created  int64  `json:"created"`
+}
+
+// uploadLocks serializes requests on the same staged upload. A lock is
+// dropped once nobody holds or waits for it.
+type uploadLocks struct {
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+}
+
+type uploadLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (l *uploadLocks) lock(id string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*uploadLock)
+	}
+	m, ok := l.locks[id]
+	if !ok {
+		m = &uploadLock{}
+		l.locks[id] = m
+	}
+	m.refs++
+	l.mu.Unlock()
+	m.Lock()
+	return func() {
+		m.Unlock()
+		l.mu.Lock()
+		m.refs--
+		if m.refs == 0 {
+			delete(l.locks, id)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// isInternalPath reports whether a request path points into server private
+// data under Root, like the upload staging area or the search index.
+func isInternalPath(requestPath string) bool {
+	p := strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+requestPath)), "/")
+	for _, dir := range []string{uploadStageDir, indexDir, tokenDir, ownerDir, auditDir, models.SqliteDir} {
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func newUploadID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *HTTPStaticServer) stagePath(id string) string {
+	return filepath.Join(s.stageDir, id)
+}
+
+func (s *HTTPStaticServer) readStagedUpload(id string) (*stagedUpload, error) {
+	if !uploadIDPattern.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(s.stagePath(id) + ".json")
+	if err != nil {
+		return nil, err
+	}
+	u := &stagedUpload{}
+	if err := json.Unmarshal(data, u); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(s.stagePath(id))
+	if err != nil {
+		return nil, err
+	}
+	u.Offset = info.Size()
+	return u, nil
+}
+
+func (s *HTTPStaticServer) writeStagedUpload(u *stagedUpload) error {
+	data, _ := json.Marshal(u)
+	tmp := s.stagePath(u.ID) + ".json.tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.stagePath(u.ID)+".json")
+}
+
+func (s *HTTPStaticServer) removeStagedUpload(id string) {
+	os.Remove(s.stagePath(id))
+	os.Remove(s.stagePath(id) + ".json")
+}
+
+// cleanStaleUploads removes staged uploads which were not finished in time.
+func (s *HTTPStaticServer) cleanStaleUploads() {
+	infos, err := ioutil.ReadDir(s.stageDir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if time.Since(info.ModTime()) > uploadStaleAfter {
+			os.Remove(filepath.Join(s.stageDir, info.Name()))
+		}
+	}
+}
+
+// checkUploadDest verifies that the current user may write name into dir and
+// returns the storage name of the destination.
+func (s *HTTPStaticServer) checkUploadDest(r *http.Request, dir, name string) (string, int, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", http.StatusBadRequest, fmt.Errorf("invalid file name: %q", name)
+	}
+	if isInternalPath(dir) {
+		return "", http.StatusForbidden, errors.New("Upload forbidden")
+	}
+	auth := s.readAccessConf(dir, r)
+	info, err := s.storage.Stat(dir)
+	if err == errOutsideRoot {
+		return "", http.StatusForbidden, err
+	}
+	if err != nil || !info.IsDir() || s.hidden(r, cleanName(dir)) {
+		return "", http.StatusNotFound, fmt.Errorf("directory %s not exist", dir)
+	}
+	dst := path.Join(cleanName(dir), name)
+	if !s.canWrite(r, &auth, dst) {
+		if _, err := s.storage.Stat(dst); err == nil {
+			return "", http.StatusForbidden, fmt.Errorf("%s exists, overwrite forbidden", name)
+		}
+		return "", http.StatusForbidden, errors.New("Upload forbidden")
+	}
+	return dst, http.StatusOK, nil
+}
+
+// commitUpload moves a fully written staged file into the storage. Within
+// the local filesystem this is an atomic rename.
+func (s *HTTPStaticServer) commitUpload(staged, name string) error {
+	if l, ok := s.storage.(*LocalStorage); ok {
+		dst, err := l.LocalPath(name)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(staged, dst); err == nil {
+			return nil
+		}
+		// destination on another filesystem
+	}
+	in, err := os.Open(staged)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := s.storage.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(staged)
+}
+
+func (s *HTTPStaticServer) hUploadCreate(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Path   string `json:"path"`
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		Mtime  int64  `json:"mtime"`
+		Key    string `json:"key"`
+		Resume bool   `json:"resume"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Size < 0 {
+		http.Error(w, "invalid size", http.StatusBadRequest)
+		return
+	}
+	dstName, code, err := s.checkUploadDest(r, req.Path, req.Name)
+	if err != nil {
+		http.Error(w, s.relError(err), code)
+		return
+	}
+	if code, err := s.checkQuota(getUser(r), dstName, "", req.Size, 1); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	// ids from client keys are scoped per user, so nobody can reach into
+	// another user's upload by choosing the same key
+	id := newUploadID()
+	if req.Key != "" {
+		sum := sha256.Sum256([]byte(getUser(r) + ":" + req.Key))
+		id = hex.EncodeToString(sum[:16])
+	}
+
+	unlock := s.uploads.lock(id)
+	defer unlock()
+
+	u := &stagedUpload{
+		ID:       id,
+		Path:     filepath.ToSlash(filepath.Clean("/" + req.Path)),
+		Name:     req.Name,
+		Size:     req.Size,
+		ModTime:  req.Mtime,
+		Username: getUser(r),
+		Created:  time.Now().Unix(),
+	}
+	if old, err := s.readStagedUpload(id); err == nil && req.Resume &&
+		old.Path == u.Path && old.Name == u.Name && old.Size == u.Size && old.Username == u.Username {
+		u = old
+	} else {
+		if err := os.MkdirAll(s.stageDir, 0755); err != nil {
+			http.Error(w, s.relError(err), http.StatusInternalServerError)
+			return
+		}
+		if err := ioutil.WriteFile(s.stagePath(id), nil, 0644); err != nil {
+			http.Error(w, s.relError(err), http.StatusInternalServerError)
+			return
+		}
+		if err := s.writeStagedUpload(u); err != nil {
+			http.Error(w, s.relError(err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(u.Offset, 10))
+	json.NewEncoder(w).Encode(u)
+}
+
+// stagedUploadFor loads the upload referenced in the url and makes sure it
+// belongs to the current user.
+func (s *HTTPStaticServer) stagedUploadFor(w http.ResponseWriter, r *http.Request) *stagedUpload {
+	u, err := s.readStagedUpload(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return nil
+	}
+	if u.Username != getUser(r) {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return nil
+	}
+	return u
+}
+
+func (s *HTTPStaticServer) hUploadStatus(w http.ResponseWriter, r *http.Request) {
+	u := s.stagedUploadFor(w, r)
+	if u == nil {
+		return
+	}
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == "HEAD" {
+		return
+	}
+	json.NewEncoder(w).Encode(u)
+}
+
+func (s *HTTPStaticServer) hUploadPatch(w http.ResponseWriter, r *http.Request) {
+	unlock := s.uploads.lock(mux.Vars(r)["id"])
+	defer unlock()
+
+	u := s.stagedUploadFor(w, r)
+	if u == nil {
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid "+uploadOffsetHeader, http.StatusBadRequest)
+		return
+	}
+	if offset != u.Offset {
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(u.Offset, 10))
+		http.Error(w, fmt.Sprintf("offset mismatch, expect %d", u.Offset), http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(s.stagePath(u.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		http.Error(w, s.relError(err), http.StatusInternalServerError)
+		return
+	}
+	// never accept more than the declared size
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, u.Size-u.Offset+1))
+	closeErr := f.Close()
+	u.Offset += n
+	if u.Offset > u.Size {
+		os.Truncate(s.stagePath(u.ID), u.Size)
+		u.Offset = u.Size
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(u.Offset, 10))
+		http.Error(w, "upload exceeds declared size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(u.Offset, 10))
+	if copyErr != nil || closeErr != nil {
+		// whatever was written is kept, the client resumes from the new offset
+		log.Printf("upload %s interrupted at %d: %v %v", u.ID, u.Offset, copyErr, closeErr)
+		http.Error(w, "upload interrupted", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *HTTPStaticServer) hUploadFinish(w http.ResponseWriter, r *http.Request) {
+	unlock := s.uploads.lock(mux.Vars(r)["id"])
+	defer unlock()
+
+	u := s.stagedUploadFor(w, r)
+	if u == nil {
+		return
+	}
+	if u.Offset != u.Size {
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(u.Offset, 10))
+		http.Error(w, fmt.Sprintf("upload incomplete: %d of %d bytes", u.Offset, u.Size), http.StatusConflict)
+		return
+	}
+	dstName, code, err := s.checkUploadDest(r, u.Path, u.Name)
+	if err != nil {
+		http.Error(w, s.relError(err), code)
+		return
+	}
+	// checked again, other writes may have used the quota meanwhile
+	release, code, err := s.reserveQuota(getUser(r), dstName, "", u.Size, 1)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	defer release()
+	if err := s.commitUpload(s.stagePath(u.ID), dstName); err != nil {
+		http.Error(w, "File create "+s.relError(err), http.StatusInternalServerError)
+		return
+	}
+	os.Remove(s.stagePath(u.ID) + ".json")
+	s.owners.set(getUser(r), dstName)
+	auditOf(r).Paths = []string{"/" + dstName}
+	auditOf(r).Bytes = u.Size
+	if l, ok := s.storage.(*LocalStorage); ok && u.ModTime > 0 {
+		// object stores set the modification time themselves
+		l.Chtimes(dstName, time.Now(), time.Unix(0, u.ModTime*1e6))
+	}
+	s.indexWritten(dstName)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"destination": filepath.ToSlash(filepath.Join(u.Path, u.Name)),
+	})
+}
+
+func (s *HTTPStaticServer) hUploadAbort(w http.ResponseWriter, r *http.Request) {
+	unlock := s.uploads.lock(mux.Vars(r)["id"])
+	defer unlock()
+
+	u := s.stagedUploadFor(w, r)
+	if u == nil {
+		return
+	}
+	s.removeStagedUpload(u.ID)
+	w.Write([]byte("Success"))
+}
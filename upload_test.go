@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// brokenReader is a request body whose connection breaks after data
+type brokenReader struct {
+	data io.Reader
+}
+
+func (r brokenReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestResumableUpload(t *testing.T) {
+	s := permServer(t, map[string]string{
+		"up/.ghs.yml": "perms: [read, list, write]\n",
+	})
+	request := func(user, method, target, offset string, body io.Reader) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, body)
+		if offset != "" {
+			r.Header.Set(uploadOffsetHeader, offset)
+		}
+		r = withIdentity(r, &Identity{Username: user, Provider: "static"})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	create := func(body string) stagedUpload {
+		w := request("bob", "POST", "/-/upload", "", strings.NewReader(body))
+		if w.Code != 200 {
+			t.Fatalf("create %s: got %d %s", body, w.Code, w.Body)
+		}
+		u := stagedUpload{}
+		if err := json.NewDecoder(w.Body).Decode(&u); err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	u := create(`{"path":"/up","name":"f.txt","size":10,"key":"k1"}`)
+	target := "/-/upload/" + u.ID
+	if u.Offset != 0 {
+		t.Fatalf("new upload at offset %d", u.Offset)
+	}
+	if w := request("bob", "PATCH", target, "", strings.NewReader("hello")); w.Code != 400 {
+		t.Errorf("patch without offset: got %d, want 400", w.Code)
+	}
+	if w := request("bob", "PATCH", target, "5", strings.NewReader("hello")); w.Code != 409 || w.Header().Get(uploadOffsetHeader) != "0" {
+		t.Errorf("patch at a wrong offset: got %d at %s, want 409 at 0", w.Code, w.Header().Get(uploadOffsetHeader))
+	}
+	if w := request("bob", "PATCH", target, "0", strings.NewReader("hello")); w.Code != 204 || w.Header().Get(uploadOffsetHeader) != "5" {
+		t.Fatalf("patch: got %d at %s", w.Code, w.Header().Get(uploadOffsetHeader))
+	}
+	if w := request("eve", "HEAD", target, "", nil); w.Code != 404 {
+		t.Errorf("upload of another user: got %d, want 404", w.Code)
+	}
+
+	// what arrived before the connection broke is kept
+	w := request("bob", "PATCH", target, "5", brokenReader{strings.NewReader("wor")})
+	if w.Code != 500 || w.Header().Get(uploadOffsetHeader) != "8" {
+		t.Fatalf("interrupted patch: got %d at %s", w.Code, w.Header().Get(uploadOffsetHeader))
+	}
+	resumed := create(`{"path":"/up","name":"f.txt","size":10,"key":"k1","resume":true}`)
+	if resumed.ID != u.ID || resumed.Offset != 8 {
+		t.Fatalf("resume: got %s at %d, want %s at 8", resumed.ID, resumed.Offset, u.ID)
+	}
+	if w := request("bob", "POST", target, "", nil); w.Code != 409 {
+		t.Errorf("finish a short upload: got %d, want 409", w.Code)
+	}
+
+	// the bytes past the declared size are dropped
+	if w := request("bob", "PATCH", target, "8", strings.NewReader("ld!!")); w.Code != 413 || w.Header().Get(uploadOffsetHeader) != "10" {
+		t.Errorf("patch past the size: got %d at %s, want 413 at 10", w.Code, w.Header().Get(uploadOffsetHeader))
+	}
+	if w := request("bob", "POST", target, "", nil); w.Code != 200 {
+		t.Fatalf("finish: got %d %s", w.Code, w.Body)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.Root, "up", "f.txt"))
+	if err != nil || string(data) != "helloworld" {
+		t.Errorf("uploaded file: got %q, %v", data, err)
+	}
+	if _, err := os.Stat(s.stagePath(u.ID) + ".json"); !os.IsNotExist(err) {
+		t.Errorf("staged upload kept after finish: %v", err)
+	}
+
+	// abort removes the staged file
+	u = create(`{"path":"/up","name":"g.txt","size":10}`)
+	request("bob", "PATCH", "/-/upload/"+u.ID, "0", strings.NewReader("abc"))
+	if w := request("bob", "DELETE", "/-/upload/"+u.ID, "", nil); w.Code != 200 {
+		t.Fatalf("abort: got %d", w.Code)
+	}
+	for _, name := range []string{s.stagePath(u.ID), s.stagePath(u.ID) + ".json"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s kept after abort: %v", name, err)
+		}
+	}
+	if w := request("bob", "GET", "/-/upload/"+u.ID, "", nil); w.Code != 404 {
+		t.Errorf("aborted upload: got %d, want 404", w.Code)
+	}
+
+	if w := request("bob", "POST", "/-/upload", "", strings.NewReader(`{"path":"/","name":"h.txt","size":1}`)); w.Code != 403 {
+		t.Errorf("create where bob may not write: got %d, want 403", w.Code)
+	}
+	s.uploads.mu.Lock()
+	if n := len(s.uploads.locks); n != 0 {
+		t.Errorf("%d upload locks left", n)
+	}
+	s.uploads.mu.Unlock()
+}
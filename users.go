@@ -0,0 +1,122 @@
+package main
+
+import (
+	"grapehttp/models/admin"
+)
+
+// UserStore keeps the users and groups of the server. With simpleauth there
+// is none, the users and groups are those of the configuration.
+type UserStore interface {
+	// User returns the user username, enabled or not
+	User(username string) (admin.User, error)
+	// ActiveUser returns the user username if it is enabled
+	ActiveUser(username string) (admin.User, error)
+	SearchUsers(substr string) ([]*admin.User, error)
+	ListUsers(offset, limit int) ([]*admin.User, error)
+	AddUser(u *admin.User) error
+	UpdateUser(u *admin.User) error
+	// DeleteUser removes the user, its group memberships and logins
+	DeleteUser(username string) error
+	// AddLogin records a successful login
+	AddLogin(l *admin.Login) error
+	// Logins returns the last limit logins of username, newest first
+	Logins(username string, limit int) ([]*admin.Login, error)
+
+	// Group returns the group name with its members
+	Group(name string) (admin.Group, error)
+	Groups() ([]*admin.Group, error)
+	// AddGroup creates the group with its members
+	AddGroup(g *admin.Group) error
+	DeleteGroup(name string) error
+	AddMembers(group string, usernames ...string) error
+	RemoveMembers(group string, usernames ...string) error
+	// GroupsOf returns the names of the groups of username
+	GroupsOf(username string) ([]string, error)
+}
+
+// dbUserStore keeps the users in the database of rbac, sqlite, mysql or
+// postgres
+type dbUserStore struct{}
+
+func (dbUserStore) User(username string) (admin.User, error) {
+	return admin.GetUserByUsername(username)
+}
+
+func (dbUserStore) ActiveUser(username string) (admin.User, error) {
+	return admin.GetUsableUserByUsername(username)
+}
+
+func (dbUserStore) SearchUsers(substr string) ([]*admin.User, error) {
+	return admin.SearchUserByUsername(substr)
+}
+
+func (dbUserStore) ListUsers(offset, limit int) ([]*admin.User, error) {
+	return admin.ListUserByUsername(offset, limit)
+}
+
+func (dbUserStore) AddUser(u *admin.User) error {
+	return u.Insert()
+}
+
+func (dbUserStore) UpdateUser(u *admin.User) error {
+	return u.Update()
+}
+
+func (dbUserStore) DeleteUser(username string) error {
+	u, err := admin.GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+	if err := u.Delete(); err != nil {
+		return err
+	}
+	if err := admin.DeleteLogins(username); err != nil {
+		return err
+	}
+	return admin.RemoveUserFromGroups(username)
+}
+
+func (dbUserStore) AddLogin(l *admin.Login) error {
+	return l.Insert()
+}
+
+func (dbUserStore) Logins(username string, limit int) ([]*admin.Login, error) {
+	return admin.ListLogins(username, limit)
+}
+
+func (dbUserStore) Group(name string) (admin.Group, error) {
+	return admin.GetGroupByName(name)
+}
+
+func (dbUserStore) Groups() ([]*admin.Group, error) {
+	return admin.ListGroups()
+}
+
+func (dbUserStore) AddGroup(g *admin.Group) error {
+	if err := g.Insert(); err != nil {
+		return err
+	}
+	return g.AddMembers(g.Members...)
+}
+
+func (dbUserStore) DeleteGroup(name string) error {
+	g, err := admin.GetGroupByName(name)
+	if err != nil {
+		return err
+	}
+	return g.Delete()
+}
+
+func (dbUserStore) AddMembers(group string, usernames ...string) error {
+	g := admin.Group{Name: group}
+	return g.AddMembers(usernames...)
+}
+
+func (dbUserStore) RemoveMembers(group string, usernames ...string) error {
+	g := admin.Group{Name: group}
+	return g.RemoveMembers(usernames...)
+}
+
+func (dbUserStore) GroupsOf(username string) ([]string, error) {
+	return admin.GroupsOfUser(username)
+}
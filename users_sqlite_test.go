@@ -0,0 +1,81 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"grapehttp/config"
+	"grapehttp/models"
+	"grapehttp/models/admin"
+)
+
+// TestSQLiteUserStore runs the user store against a real sqlite database,
+// with go test -tags sqlite
+func TestSQLiteUserStore(t *testing.T) {
+	saved := config.Gcfg
+	defer func() { config.Gcfg = saved }()
+	config.Gcfg.Rbac = config.Rbac{Type: "sqlite", Path: filepath.Join(t.TempDir(), "users.db")}
+	models.Connect()
+	if err := models.Migrate(models.LatestVersion()); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.CheckSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	users := dbUserStore{}
+	bob := &admin.User{Username: "bob", Nickname: "Bob", Status: 1, Createtime: time.Now()}
+	if err := bob.SetPassword("bob-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.AddUser(bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.AddUser(&admin.User{Username: "bob", Status: 1}); err == nil {
+		t.Error("duplicate user added")
+	}
+	auth := dbUsers{users}
+	if id, err := auth.CheckPassword("bob", "bob-secret"); err != nil || id.Username != "bob" || id.Provider != "db" {
+		t.Fatalf("login: got %+v %v", id, err)
+	}
+	auth.recordLogin("bob", "10.0.0.1")
+	if u, err := users.User("bob"); err != nil || u.Logincount != 1 || u.Lastip != "10.0.0.1" {
+		t.Errorf("recorded login: got %+v %v", u, err)
+	}
+	if logins, err := users.Logins("bob", 10); err != nil || len(logins) != 1 || logins[0].Ip != "10.0.0.1" {
+		t.Errorf("logins: got %v %v", logins, err)
+	}
+
+	// a legacy md5 hash is upgraded in the database
+	users.AddUser(&admin.User{Username: "dave", Password: "21232f297a57a5a743894a0e4a801fc3", Status: 1, Createtime: time.Now()})
+	if _, err := auth.CheckPassword("dave", "admin"); err != nil {
+		t.Fatalf("login with a legacy hash: %v", err)
+	}
+	if u, _ := users.User("dave"); !strings.HasPrefix(u.Password, "$argon2id$") {
+		t.Errorf("legacy hash not upgraded: %s", u.Password)
+	}
+
+	if err := users.AddGroup(&admin.Group{Name: "dev", Members: []string{"bob", "dave"}, Createtime: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if groups, err := users.GroupsOf("bob"); err != nil || len(groups) != 1 || groups[0] != "dev" {
+		t.Errorf("groups of bob: got %v %v", groups, err)
+	}
+	if err := users.DeleteUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.User("bob"); err == nil {
+		t.Error("deleted user found")
+	}
+	if g, err := users.Group("dev"); err != nil || len(g.Members) != 1 || g.Members[0] != "dave" {
+		t.Errorf("members after delete: got %+v %v", g, err)
+	}
+	if logins, _ := users.Logins("bob", 10); len(logins) != 0 {
+		t.Errorf("logins of a deleted user: %v", logins)
+	}
+}
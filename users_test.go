@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"grapehttp/config"
+	"grapehttp/models/admin"
+)
+
+var errNoUser = errors.New("no row found")
+
+// memUserStore keeps the users in memory, for the tests
+type memUserStore struct {
+	users  map[string]admin.User
+	groups map[string]admin.Group
+	logins []*admin.Login
+}
+
+func newMemUserStore() *memUserStore {
+	return &memUserStore{users: map[string]admin.User{}, groups: map[string]admin.Group{}}
+}
+
+// checkPassword reports whether pass is the password of u
+func checkPassword(u admin.User, pass string) bool {
+	ok, _ := u.CheckPassword(pass)
+	return ok
+}
+
+func (m *memUserStore) User(username string) (admin.User, error) {
+	u, ok := m.users[username]
+	if !ok {
+		return u, errNoUser
+	}
+	return u, nil
+}
+
+func (m *memUserStore) ActiveUser(username string) (admin.User, error) {
+	u, err := m.User(username)
+	if err == nil && u.Status != 1 {
+		return u, errNoUser
+	}
+	return u, err
+}
+
+func (m *memUserStore) SearchUsers(substr string) ([]*admin.User, error) {
+	users := []*admin.User{}
+	for name, u := range m.users {
+		if strings.Contains(strings.ToLower(name), strings.ToLower(substr)) {
+			u := u
+			users = append(users, &u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (m *memUserStore) ListUsers(offset, limit int) ([]*admin.User, error) {
+	users, _ := m.SearchUsers("")
+	if offset > len(users) {
+		offset = len(users)
+	}
+	users = users[offset:]
+	if limit > 0 && limit < len(users) {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (m *memUserStore) AddUser(u *admin.User) error {
+	if _, ok := m.users[u.Username]; ok {
+		return errors.New("duplicate username")
+	}
+	u.Id = int64(len(m.users) + 1)
+	m.users[u.Username] = *u
+	return nil
+}
+
+func (m *memUserStore) UpdateUser(u *admin.User) error {
+	if _, ok := m.users[u.Username]; !ok {
+		return errNoUser
+	}
+	m.users[u.Username] = *u
+	return nil
+}
+
+func (m *memUserStore) DeleteUser(username string) error {
+	if _, ok := m.users[username]; !ok {
+		return errNoUser
+	}
+	delete(m.users, username)
+	for name := range m.groups {
+		m.RemoveMembers(name, username)
+	}
+	return nil
+}
+
+func (m *memUserStore) AddLogin(l *admin.Login) error {
+	m.logins = append(m.logins, l)
+	return nil
+}
+
+func (m *memUserStore) Logins(username string, limit int) ([]*admin.Login, error) {
+	logins := []*admin.Login{}
+	for i := len(m.logins) - 1; i >= 0 && len(logins) < limit; i-- {
+		if m.logins[i].Username == username {
+			logins = append(logins, m.logins[i])
+		}
+	}
+	return logins, nil
+}
+
+func (m *memUserStore) Group(name string) (admin.Group, error) {
+	g, ok := m.groups[name]
+	if !ok {
+		return g, errNoUser
+	}
+	return g, nil
+}
+
+func (m *memUserStore) Groups() ([]*admin.Group, error) {
+	groups := []*admin.Group{}
+	for _, g := range m.groups {
+		g := g
+		groups = append(groups, &g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, nil
+}
+
+func (m *memUserStore) AddGroup(g *admin.Group) error {
+	m.groups[g.Name] = admin.Group{Name: g.Name}
+	return m.AddMembers(g.Name, g.Members...)
+}
+
+func (m *memUserStore) DeleteGroup(name string) error {
+	delete(m.groups, name)
+	return nil
+}
+
+func (m *memUserStore) AddMembers(group string, usernames ...string) error {
+	g := m.groups[group]
+	for _, username := range usernames {
+		known := false
+		for _, member := range g.Members {
+			known = known || member == username
+		}
+		if !known {
+			g.Members = append(g.Members, username)
+		}
+	}
+	sort.Strings(g.Members)
+	m.groups[group] = g
+	return nil
+}
+
+func (m *memUserStore) RemoveMembers(group string, usernames ...string) error {
+	g := m.groups[group]
+	members := []string{}
+	for _, member := range g.Members {
+		keep := true
+		for _, username := range usernames {
+			keep = keep && member != username
+		}
+		if keep {
+			members = append(members, member)
+		}
+	}
+	g.Members = members
+	m.groups[group] = g
+	return nil
+}
+
+func (m *memUserStore) GroupsOf(username string) ([]string, error) {
+	groups := []string{}
+	for name, g := range m.groups {
+		for _, member := range g.Members {
+			if member == username {
+				groups = append(groups, name)
+			}
+		}
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+func TestUserStore(t *testing.T) {
+	saved := userGroups
+	defer func() { userGroups = saved }()
+
+	s := permServer(t, nil)
+	users := newMemUserStore()
+	s.users = users
+	userGroups = newGroupCache(newGroupLookup(config.Configure{}, users))
+	auth := dbUsers{users}
+	call := func(target, body string) (int, string) {
+		r := httptest.NewRequest("POST", target, strings.NewReader(body))
+		r = withIdentity(r, &Identity{Username: "admin", Provider: "static"})
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	if code, body := call("/-/user/add", `{"username":"bob","password":"bob-secret","nickname":"Bob","status":1}`); code != 200 {
+		t.Fatalf("add: got %d %s", code, body)
+	}
+	if id, err := auth.CheckPassword("bob", "bob-secret"); err != nil || id.Username != "bob" || id.Provider != "db" {
+		t.Errorf("login: got %+v %v", id, err)
+	}
+	if _, err := auth.CheckPassword("bob", "wrong"); err != errBadCredentials {
+		t.Errorf("wrong password: got %v", err)
+	}
+	// basic auth caches the credentials until they change
+	basic := newBasicAuth(auth)
+	login := func(pass string) error {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth("bob", pass)
+		_, err := basic.Authenticate(r)
+		return err
+	}
+	if err := login("bob-secret"); err != nil {
+		t.Errorf("basic auth: %v", err)
+	}
+	if code, _ := call("/-/user/add", `{"username":"bob","password":"bob-secret"}`); code != 500 {
+		t.Errorf("duplicate add: got %d", code)
+	}
+
+	call("/-/user/modify", `{"username":"bob","password":"new-secret","email":"bob@example.org"}`)
+	if u, _ := users.User("bob"); u.Email != "bob@example.org" || !checkPassword(u, "new-secret") {
+		t.Errorf("modify: got %+v", u)
+	}
+	if err := login("bob-secret"); err != errBadCredentials {
+		t.Errorf("basic auth with the old password: got %v", err)
+	}
+	login("new-secret")
+	if code, _ := call("/-/user/modify", `{"username":"carol","email":"c@example.org"}`); code != 404 {
+		t.Errorf("modify of a missing user: got %d, want 404", code)
+	}
+	call("/-/user/disable", `{"usernames":["bob"]}`)
+	if _, err := auth.CheckPassword("bob", "new-secret"); err == nil {
+		t.Error("login of a disabled user")
+	}
+	if err := login("new-secret"); err == nil {
+		t.Error("basic auth of a disabled user")
+	}
+	call("/-/user/enable", `{"usernames":["bob"]}`)
+
+	// a legacy md5 hash is replaced on login
+	users.AddUser(&admin.User{Username: "dave", Password: "21232f297a57a5a743894a0e4a801fc3", Status: 1})
+	if _, err := auth.CheckPassword("dave", "admin"); err != nil {
+		t.Fatalf("login with a legacy hash: %v", err)
+	}
+	if u, _ := users.User("dave"); !strings.HasPrefix(u.Password, "$argon2id$") || !checkPassword(u, "admin") {
+		t.Errorf("legacy hash not upgraded: %s", u.Password)
+	}
+
+	call("/-/group/add", `{"name":"devs","members":["bob"]}`)
+	if groups := userGroups.groups("", "bob"); !reflect.DeepEqual(groups, []string{"devs"}) {
+		t.Errorf("groups: got %v", groups)
+	}
+	if code, _ := call("/-/group/adduser", `{"name":"devs","usernames":["carol"]}`); code != 404 {
+		t.Errorf("adduser of a missing user: got %d, want 404", code)
+	}
+	if code, body := call("/-/user/del", `{"usernames":["bob"]}`); code != 200 {
+		t.Fatalf("del: got %d %s", code, body)
+	}
+	if g, _ := users.Group("devs"); len(g.Members) != 0 {
+		t.Errorf("members after del: %v", g.Members)
+	}
+
+	s.users = nil
+	if code, _ := call("/-/user/list", `{"limit":10}`); code != 400 {
+		t.Errorf("list with simpleauth: got %d, want 400", code)
+	}
+}
+
+func TestMe(t *testing.T) {
+	s := permServer(t, nil)
+	users := newMemUserStore()
+	s.users = users
+	bob := admin.User{Username: "bob", Nickname: "Bob", Status: 1}
+	bob.SetPassword("bob-secret")
+	users.AddUser(&bob)
+
+	// a password check is a login, the cached ones are not
+	auth := newBasicAuth(dbUsers{users})
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.7:4321"
+		r.SetBasicAuth("bob", "bob-secret")
+		if _, err := auth.Authenticate(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u, _ := users.User("bob"); u.Logincount != 1 || u.Lastip != "192.0.2.7" || u.Lastlogintime.IsZero() {
+		t.Errorf("login not recorded: %+v", u)
+	}
+
+	call := func(method, target, body string, id *Identity) (int, string) {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if id != nil {
+			r = withIdentity(r, id)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+	db := &Identity{Username: "bob", Provider: "db"}
+	if code, body := call("GET", "/-/me", "", db); code != 200 || !strings.Contains(body, `"nickname":"Bob"`) || strings.Contains(body, "argon2") {
+		t.Errorf("me: got %d %s", code, body)
+	}
+	if code, body := call("GET", "/-/me/logins", "", db); code != 200 || !strings.Contains(body, `"ip":"192.0.2.7"`) {
+		t.Errorf("logins: got %d %s", code, body)
+	}
+	if code, _ := call("GET", "/-/me", "", nil); code != 401 {
+		t.Errorf("me anonymous: got %d, want 401", code)
+	}
+
+	passwd := func(old, pass string, id *Identity) int {
+		code, _ := call("POST", "/-/me/passwd", `{"oldPassword":"`+old+`","password":"`+pass+`"}`, id)
+		return code
+	}
+	if code := passwd("wrong", "new-secret", db); code != 403 {
+		t.Errorf("wrong old password: got %d, want 403", code)
+	}
+	if code := passwd("bob-secret", "bob", db); code != 400 {
+		t.Errorf("weak password: got %d, want 400", code)
+	}
+	if code := passwd("bob-secret", "new-secret", &Identity{Username: "bob", Provider: "token", Scopes: []string{"read", "write"}}); code != 403 {
+		t.Errorf("token without admin: got %d, want 403", code)
+	}
+	if code := passwd("bob-secret", "new-secret", &Identity{Username: "bob", Provider: "ldap"}); code != 400 {
+		t.Errorf("ldap user: got %d, want 400", code)
+	}
+	if code := passwd("bob-secret", "new-secret", db); code != 200 {
+		t.Fatalf("passwd: got %d", code)
+	}
+	if u, _ := users.User("bob"); !checkPassword(u, "new-secret") {
+		t.Error("password not changed")
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("bob", "bob-secret")
+	if _, err := auth.Authenticate(r); err != errBadCredentials {
+		t.Errorf("cached old password after passwd: got %v", err)
+	}
+}
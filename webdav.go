@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+const webdavPrefix = "/-/webdav"
+
+type webdavRequestKey struct{}
+
+// hWebdav serves the storage over WebDAV. Requests are checked against the
+// .ghs.yml rules first, so clients get a proper 401/403 instead of the
+// generic errors of the webdav package. webdavFS checks them again for every
+// file touched by recursive COPY and PROPFIND.
+func (s *HTTPStaticServer) hWebdav(w http.ResponseWriter, r *http.Request) {
+	s.auditWebdav(r)
+	if code := s.webdavCheck(r); code != 0 {
+		if code == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+		}
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	name := cleanName(strings.TrimPrefix(r.URL.Path, webdavPrefix))
+	switch r.Method {
+	case "PUT":
+		if code, err := s.webdavQuota(r, name, r.ContentLength); err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+	case "COPY", "MOVE":
+		// before the webdav handler removes a destination to overwrite
+		if dst, ok := webdavDestination(r); ok {
+			bytes, files := s.Index.usage(name)
+			from := ""
+			if r.Method == "MOVE" {
+				from = name
+			}
+			if code, err := s.checkQuota(getUser(r), dst, from, bytes, files); err != nil {
+				http.Error(w, err.Error(), code)
+				return
+			}
+		}
+	}
+	ctx := context.WithValue(r.Context(), webdavRequestKey{}, r)
+	s.webdav.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// webdavQuota is checkQuota for a file of size bytes written over WebDAV.
+// A size of -1 is unknown, it is refused if a byte quota applies.
+func (s *HTTPStaticServer) webdavQuota(r *http.Request, name string, size int64) (int, error) {
+	if size < 0 {
+		if s.quotaLeft(getUser(r), name) >= 0 {
+			return http.StatusLengthRequired, errors.New("a quota applies, the length of the upload is required")
+		}
+		size = 0
+	}
+	return s.checkQuota(getUser(r), name, "", size, 1)
+}
+
+// webdavDestination returns the storage name of the Destination header of
+// a COPY or MOVE, false if it is not below webdavPrefix
+func webdavDestination(r *http.Request) (string, bool) {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || !strings.HasPrefix(u.Path, webdavPrefix+"/") {
+		return "", false
+	}
+	return cleanName(strings.TrimPrefix(u.Path, webdavPrefix)), true
+}
+
+// webdavSource returns the source of the storage name written by a COPY,
+// false if name is not below its destination
+func webdavSource(r *http.Request, name string) (string, bool) {
+	dst, ok := webdavDestination(r)
+	if !ok {
+		return "", false
+	}
+	src := cleanName(strings.TrimPrefix(r.URL.Path, webdavPrefix))
+	if name == dst {
+		return src, true
+	}
+	if dst != "" && strings.HasPrefix(name, dst+"/") {
+		return path.Join(src, strings.TrimPrefix(name, dst+"/")), true
+	}
+	return "", false
+}
+
+// webdavActions are the audited WebDAV methods, the others only read
+// properties or take locks
+var webdavActions = map[string]string{
+	"GET":    "download",
+	"PUT":    "upload",
+	"DELETE": "delete",
+	"MKCOL":  "mkdir",
+	"COPY":   "copy",
+	"MOVE":   "move",
+}
+
+// auditWebdav names the action and the paths of a WebDAV request in its
+// audit record
+func (s *HTTPStaticServer) auditWebdav(r *http.Request) {
+	rec := auditOf(r)
+	rec.Action = webdavActions[r.Method]
+	if rec.Action == "" {
+		return
+	}
+	rec.Paths = []string{"/" + cleanName(strings.TrimPrefix(r.URL.Path, webdavPrefix))}
+	if u, err := url.Parse(r.Header.Get("Destination")); err == nil && u.Path != "" {
+		rec.Paths = append(rec.Paths, "/"+cleanName(strings.TrimPrefix(u.Path, webdavPrefix)))
+	}
+}
+
+// webdavCheck returns the status code for a request which is not allowed, or
+// 0. Anonymous users get 401, so clients retry with their credentials.
+func (s *HTTPStaticServer) webdavCheck(r *http.Request) int {
+	if r.Method == "OPTIONS" {
+		return 0
+	}
+	name := cleanName(strings.TrimPrefix(r.URL.Path, webdavPrefix))
+	if isInternalPath(name) {
+		return http.StatusNotFound
+	}
+	forbidden := http.StatusForbidden
+	if getUser(r) == "" {
+		forbidden = http.StatusUnauthorized
+	}
+
+	if !s.visible(r, name) {
+		return http.StatusNotFound
+	}
+	auth := s.readAccessConf(name, r)
+	switch r.Method {
+	case "GET", "HEAD":
+		need := permRead
+		if info, err := s.storage.Stat(name); err == nil && info.IsDir() {
+			need = permList
+		}
+		if !auth.can(r, need) {
+			return forbidden
+		}
+	case "PROPFIND":
+		if !auth.can(r, permList) {
+			return forbidden
+		}
+	case "PUT":
+		if !s.canWrite(r, &auth, name) {
+			return forbidden
+		}
+	case "MKCOL", "PROPPATCH", "LOCK", "UNLOCK":
+		if !auth.can(r, permWrite) {
+			return forbidden
+		}
+	case "DELETE":
+		if name == "" || !s.canRemove(r, &auth, name) {
+			return forbidden
+		}
+	case "COPY", "MOVE":
+		if r.Method == "MOVE" && (name == "" || !s.canRename(r, &auth, name)) {
+			return forbidden
+		}
+		if r.Method == "COPY" && !auth.can(r, permRead) {
+			return forbidden
+		}
+		dst, ok := webdavDestination(r)
+		if !ok {
+			// rejected by the webdav handler
+			return 0
+		}
+		if dst == "" || s.hidden(r, dst) {
+			return forbidden
+		}
+		dstAuth := s.readAccessConf(dst, r)
+		if !s.canWrite(r, &dstAuth, dst) {
+			return forbidden
+		}
+	default:
+		if auth.noAccess(r) {
+			return forbidden
+		}
+	}
+	return 0
+}
+
+// webdavFS exposes the storage to the webdav package. It hides internal and
+// inaccessible files and refuses writes the .ghs.yml rules do not allow for
+// the request stored in ctx.
+type webdavFS struct {
+	s *HTTPStaticServer
+}
+
+func (fs webdavFS) request(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(webdavRequestKey{}).(*http.Request)
+	if r == nil {
+		// no credentials, only what anonymous users may do
+		r, _ = http.NewRequest("GET", "/", nil)
+	}
+	return r
+}
+
+// check returns os.ErrNotExist for hidden files, and os.ErrPermission if
+// the user lacks any permission of p on name.
+func (fs webdavFS) check(ctx context.Context, name string, p permSet) error {
+	r := fs.request(ctx)
+	name = cleanName(name)
+	if fs.s.hidden(r, name) {
+		return os.ErrNotExist
+	}
+	auth := fs.s.readAccessConf(name, r)
+	if !auth.can(r, p) {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func (fs webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if err := fs.check(ctx, name, permWrite); err != nil {
+		return err
+	}
+	if err := fs.s.storage.Mkdir(cleanName(name)); err != nil {
+		return err
+	}
+	return fs.s.owners.set(getUser(fs.request(ctx)), name)
+}
+
+func (fs webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = cleanName(name)
+	write := flag&(os.O_CREATE|os.O_TRUNC) != 0
+	if err := fs.check(ctx, name, 0); err != nil {
+		return nil, err
+	}
+	if write {
+		r := fs.request(ctx)
+		if auth := fs.s.readAccessConf(name, r); !fs.s.canWrite(r, &auth, name) {
+			return nil, os.ErrPermission
+		}
+		if info, err := fs.s.storage.Stat(path.Dir(name)); err != nil || !info.IsDir() {
+			return nil, os.ErrNotExist
+		}
+		// a COPY counts the size of the file it copies, before writing
+		size := int64(0)
+		switch r.Method {
+		case "PUT":
+			size = r.ContentLength
+		case "COPY":
+			if src, ok := webdavSource(r, name); ok {
+				if info, err := fs.s.storage.Stat(src); err == nil {
+					size = info.Size()
+				}
+			}
+		}
+		if _, err := fs.s.webdavQuota(r, name, size); err != nil {
+			return nil, os.ErrPermission
+		}
+		left := fs.s.quotaLeft(getUser(r), name)
+		if size < 0 {
+			size = 0
+		}
+		release, _, err := fs.s.reserveQuota(getUser(r), name, "", size, 1)
+		if err != nil {
+			return nil, os.ErrPermission
+		}
+		w, err := fs.s.storage.Create(name)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		fs.s.owners.set(getUser(r), name)
+		return &webdavWriter{WriteCloser: w, s: fs.s, path: name, name: path.Base(name), left: left, release: release}, nil
+	}
+
+	info, err := fs.s.storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		if err := fs.check(ctx, name, permList); err != nil {
+			return nil, err
+		}
+		return &webdavDir{fs: fs, ctx: ctx, name: name, info: info}, nil
+	}
+	if err := fs.check(ctx, name, permRead); err != nil {
+		return nil, err
+	}
+	f, err := fs.s.storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return webdavReader{f}, nil
+}
+
+func (fs webdavFS) RemoveAll(ctx context.Context, name string) error {
+	name = cleanName(name)
+	if name == "" {
+		return errRemoveRoot
+	}
+	if err := fs.check(ctx, name, 0); err != nil {
+		return err
+	}
+	r := fs.request(ctx)
+	if auth := fs.s.readAccessConf(name, r); !fs.s.canRemove(r, &auth, name) {
+		return os.ErrPermission
+	}
+	if err := fs.s.storage.RemoveAll(name); err != nil {
+		return err
+	}
+	fs.s.Index.remove(name)
+	return fs.s.owners.remove(name)
+}
+
+func (fs webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = cleanName(oldName), cleanName(newName)
+	if err := fs.check(ctx, oldName, 0); err != nil {
+		return err
+	}
+	if err := fs.check(ctx, newName, 0); err != nil {
+		return err
+	}
+	r := fs.request(ctx)
+	oldAuth := fs.s.readAccessConf(oldName, r)
+	newAuth := fs.s.readAccessConf(newName, r)
+	if !fs.s.canRename(r, &oldAuth, oldName) || !fs.s.canWrite(r, &newAuth, newName) {
+		return os.ErrPermission
+	}
+	bytes, files := fs.s.Index.usage(oldName)
+	release, _, err := fs.s.reserveQuota(getUser(r), newName, oldName, bytes, files)
+	if err != nil {
+		return os.ErrPermission
+	}
+	defer release()
+	if err := fs.s.storage.Rename(oldName, newName); err != nil {
+		return err
+	}
+	fs.s.Index.remove(oldName)
+	fs.s.indexWritten(newName)
+	return fs.s.owners.rename(oldName, newName)
+}
+
+func (fs webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if err := fs.check(ctx, name, 0); err == os.ErrNotExist {
+		return nil, err
+	}
+	return fs.s.storage.Stat(cleanName(name))
+}
+
+var errWebdavIsDir = errors.New("is a directory")
+
+// webdavDir lists a directory without the entries hidden by accessTables
+type webdavDir struct {
+	fs      webdavFS
+	ctx     context.Context
+	name    string
+	info    os.FileInfo
+	entries []os.FileInfo
+	read    bool
+}
+
+func (d *webdavDir) Close() error                                 { return nil }
+func (d *webdavDir) Read(p []byte) (int, error)                   { return 0, errWebdavIsDir }
+func (d *webdavDir) Write(p []byte) (int, error)                  { return 0, errWebdavIsDir }
+func (d *webdavDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (d *webdavDir) Stat() (os.FileInfo, error)                   { return d.info, nil }
+
+func (d *webdavDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.read {
+		infos, err := d.fs.s.storage.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		r := d.fs.request(d.ctx)
+		auth := d.fs.s.readAccessConf(d.name, r)
+		for _, info := range infos {
+			if isInternalPath(path.Join(d.name, info.Name())) || !auth.canAccess(info.Name()) {
+				continue
+			}
+			d.entries = append(d.entries, info)
+		}
+		d.read = true
+	}
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+// webdavReader is a file opened for reading
+type webdavReader struct {
+	File
+}
+
+func (f webdavReader) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f webdavReader) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+var errWebdavQuota = errors.New("quota exceeded")
+
+// webdavWriter is a file created by PUT, its content is stored on Close. It
+// refuses to write more than the left bytes of the quotas, -1 for none, and
+// removes the file then. Its reservation of the quotas is released once the
+// file is in the index.
+type webdavWriter struct {
+	io.WriteCloser
+	s       *HTTPStaticServer
+	path    string
+	name    string
+	size    int64
+	left    int64
+	over    bool
+	release func()
+}
+
+func (f *webdavWriter) Write(p []byte) (int, error) {
+	if f.left >= 0 && f.size+int64(len(p)) > f.left {
+		f.over = true
+		return 0, errWebdavQuota
+	}
+	n, err := f.WriteCloser.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *webdavWriter) Close() error {
+	defer f.release()
+	err := f.WriteCloser.Close()
+	if !f.over {
+		f.s.indexWritten(f.path)
+		return err
+	}
+	f.s.storage.Remove(f.path)
+	f.s.owners.remove(f.path)
+	f.s.Index.remove(f.path)
+	return errWebdavQuota
+}
+
+func (f *webdavWriter) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *webdavWriter) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *webdavWriter) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+// Stat describes the file written so far, the writer is its own FileInfo
+func (f *webdavWriter) Stat() (os.FileInfo, error) { return f, nil }
+
+func (f *webdavWriter) Name() string       { return f.name }
+func (f *webdavWriter) Size() int64        { return f.size }
+func (f *webdavWriter) Mode() os.FileMode  { return 0644 }
+func (f *webdavWriter) ModTime() time.Time { return time.Now() }
+func (f *webdavWriter) IsDir() bool        { return false }
+func (f *webdavWriter) Sys() interface{}   { return nil }
+
+func newWebdavHandler(s *HTTPStaticServer) *webdav.Handler {
+	return &webdav.Handler{
+		Prefix:     webdavPrefix,
+		FileSystem: webdavFS{s},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("webdav %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strconv"
@@ -31,37 +32,8 @@ func sanitizedName(filename string) string {
 	return filename
 }
 
-func statFile(filename string) (info os.FileInfo, reader io.ReadCloser, err error) {
-	info, err = os.Lstat(filename)
-	if err != nil {
-		return
-	}
-	// content
-	if info.Mode()&os.ModeSymlink != 0 {
-		var target string
-		target, err = os.Readlink(filename)
-		if err != nil {
-			return
-		}
-		reader = ioutil.NopCloser(bytes.NewBuffer([]byte(target)))
-	} else if !info.IsDir() {
-		reader, err = os.Open(filename)
-		if err != nil {
-			return
-		}
-	} else {
-		reader = ioutil.NopCloser(bytes.NewBuffer(nil))
-	}
-	return
-}
-
-func (z *Zip) Add(relpath, abspath string) error {
-	info, rdc, err := statFile(abspath)
-	if err != nil {
-		return err
-	}
-	defer rdc.Close()
-
+// Add writes a file or directory entry, reader is only read for files
+func (z *Zip) Add(relpath string, info os.FileInfo, reader io.Reader) error {
 	hdr, err := zip.FileInfoHeader(info)
 	if err != nil {
 		return err
@@ -75,13 +47,18 @@ func (z *Zip) Add(relpath, abspath string) error {
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(writer, rdc)
+	if info.IsDir() {
+		return nil
+	}
+	_, err = io.Copy(writer, reader)
 	return err
 }
 
-func CompressToZip(w http.ResponseWriter, rootDir string) {
-	rootDir = filepath.Clean(rootDir)
-	zipFileName := filepath.Base(rootDir) + ".zip"
+// CompressToZip writes rootDir as a zip archive, without the files and
+// directories allow refuses
+func CompressToZip(w http.ResponseWriter, st Storage, rootDir string, allow func(name string, info os.FileInfo) bool) {
+	rootDir = cleanName(rootDir)
+	zipFileName := path.Base("/root/"+rootDir) + ".zip"
 
 	w.Header().Set("Content-Type", "application/zip")
 	w.Header().Set("Content-Disposition", `attachment; filename="`+zipFileName+`"`)
@@ -89,9 +66,29 @@ func CompressToZip(w http.ResponseWriter, rootDir string) {
 	zw := &Zip{Writer: zip.NewWriter(w)}
 	defer zw.Close()
 
-	filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
-		zipPath := path[len(rootDir):]
-		return zw.Add(zipPath, path)
+	walkStorage(st, rootDir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || name == rootDir {
+			return err
+		}
+		if isInternalPath(name) || !allow(name, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		zipPath := strings.TrimPrefix(name, rootDir)
+		if info.IsDir() {
+			return zw.Add(zipPath, info, nil)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := st.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return zw.Add(zipPath, info, f)
 	})
 }
 